@@ -0,0 +1,235 @@
+package milter
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Accounting counts verdicts, modifications, rule hits and outcomes per sender
+// domain of the milters it wraps, a single Accounting is meant to be shared by
+// all sessions
+//
+// Responses other than continue are counted as verdicts wherever they are
+// returned, continue only as the verdict of a message. Rule hits are reported
+// by handlers with Hit.
+type Accounting struct {
+	// MaxDomains limits the number of sender domains tracked separately, others
+	// are counted under an empty domain; default 10000
+	MaxDomains int
+
+	mutex         sync.Mutex
+	verdicts      map[Code]uint64
+	modifications map[Code]uint64
+	rules         map[string]uint64
+	domains       map[string]map[Code]uint64
+}
+
+// AccountingStats is a snapshot of Accounting counters
+type AccountingStats struct {
+	Verdicts      map[Code]uint64
+	Modifications map[Code]uint64
+	Rules         map[string]uint64
+	// Domains holds message verdicts per sender domain
+	Domains map[string]map[Code]uint64
+}
+
+// Hit counts a hit of rule name
+func (a *Accounting) Hit(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.rules == nil {
+		a.rules = make(map[string]uint64)
+	}
+	a.rules[name]++
+}
+
+// Stats returns a copy of current counters
+func (a *Accounting) Stats() AccountingStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	stats := AccountingStats{
+		Verdicts:      make(map[Code]uint64, len(a.verdicts)),
+		Modifications: make(map[Code]uint64, len(a.modifications)),
+		Rules:         make(map[string]uint64, len(a.rules)),
+		Domains:       make(map[string]map[Code]uint64, len(a.domains)),
+	}
+	for code, n := range a.verdicts {
+		stats.Verdicts[code] = n
+	}
+	for code, n := range a.modifications {
+		stats.Modifications[code] = n
+	}
+	for name, n := range a.rules {
+		stats.Rules[name] = n
+	}
+	for domain, verdicts := range a.domains {
+		counts := make(map[Code]uint64, len(verdicts))
+		for code, n := range verdicts {
+			counts[code] = n
+		}
+		stats.Domains[domain] = counts
+	}
+	return stats
+}
+
+// verdict counts resp, message verdicts are also counted for domain
+func (a *Accounting) verdict(resp Response, message bool, domain string) {
+	if resp == nil || !message && resp.Continue() {
+		return
+	}
+	code := resp.Response().Code
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.verdicts == nil {
+		a.verdicts = make(map[Code]uint64)
+		a.domains = make(map[string]map[Code]uint64)
+	}
+	a.verdicts[code]++
+	if !message {
+		return
+	}
+	counts, ok := a.domains[domain]
+	if !ok {
+		if len(a.domains) >= a.maxDomains() {
+			domain = ""
+			counts = a.domains[domain]
+		}
+		if counts == nil {
+			counts = make(map[Code]uint64)
+			a.domains[domain] = counts
+		}
+	}
+	counts[code]++
+}
+
+// modified counts modification packets
+func (a *Accounting) modified(msgs []*Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.modifications == nil {
+		a.modifications = make(map[Code]uint64)
+	}
+	for _, msg := range msgs {
+		a.modifications[msg.Code]++
+	}
+}
+
+func (a *Accounting) maxDomains() int {
+	if a.MaxDomains <= 0 {
+		return 10000
+	}
+	return a.MaxDomains
+}
+
+// Wrap returns milter which accounts the callbacks of next
+func (a *Accounting) Wrap(next Milter) Milter {
+	return &accountingMilter{next: next, accounting: a}
+}
+
+// accountingMilter accounts a single session
+type accountingMilter struct {
+	next       Milter
+	accounting *Accounting
+	domain     string
+	message    bool
+}
+
+// count accounts a callback result and passes it on
+func (a *accountingMilter) count(resp Response, err error) (Response, error) {
+	if err == nil {
+		// a refused message has reached its verdict
+		final := a.message && resp != nil && !resp.Continue()
+		a.accounting.verdict(resp, final, a.domain)
+		if final {
+			a.message = false
+		}
+	}
+	return resp, err
+}
+
+func (a *accountingMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	return a.count(a.next.Connect(host, family, port, addr, m))
+}
+
+func (a *accountingMilter) Helo(name string, m *Modifier) (Response, error) {
+	return a.count(a.next.Helo(name, m))
+}
+
+func (a *accountingMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	a.domain, a.message = "", true
+	if at := strings.LastIndexByte(from, '@'); at != -1 {
+		a.domain = strings.ToLower(from[at+1:])
+	}
+	return a.count(a.next.MailFrom(from, m))
+}
+
+func (a *accountingMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	// refused recipients do not end the message
+	resp, err := a.next.RcptTo(rcptTo, m)
+	if err == nil {
+		a.accounting.verdict(resp, false, a.domain)
+	}
+	return resp, err
+}
+
+func (a *accountingMilter) Data(m *Modifier) (Response, error) {
+	return a.count(a.next.Data(m))
+}
+
+func (a *accountingMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	return a.count(a.next.Header(name, value, m))
+}
+
+func (a *accountingMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return a.count(a.next.Headers(h, m))
+}
+
+func (a *accountingMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	return a.count(a.next.BodyChunk(chunk, m))
+}
+
+// Body accounts the message verdict and the modifications made with it,
+// they are recorded in a transaction while the wrapped milter runs
+func (a *accountingMilter) Body(m *Modifier) (Response, error) {
+	tx := m.Begin()
+	resp, err := a.next.Body(m)
+	a.message = false
+	if err != nil {
+		// modifications of a failed handler are neither sent nor accounted
+		tx.Rollback()
+		return resp, err
+	}
+	a.accounting.modified(tx.Messages())
+	if err := tx.Commit(); err != nil {
+		m.Logf("Error committing accounted modifications: %v", err)
+	}
+	a.accounting.verdict(resp, true, a.domain)
+	return resp, nil
+}
+
+func (a *accountingMilter) Abort(m *Modifier) error {
+	return a.next.Abort(m)
+}
+
+func (a *accountingMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	// refused commands do not end the message
+	resp, err := a.next.Unknown(cmd, m)
+	if err == nil {
+		a.accounting.verdict(resp, false, a.domain)
+	}
+	return resp, err
+}
+
+func (a *accountingMilter) MessageReset() {
+	a.domain, a.message = "", false
+	ResetMessage(a.next)
+}
+
+func (a *accountingMilter) ConnectionReset() {
+	ResetConnection(a.next)
+}
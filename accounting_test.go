@@ -0,0 +1,59 @@
+package milter_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+// taggingMilter adds a header at the end of the message and fails if err is set
+type taggingMilter struct {
+	milter.NoOpMilter
+	err error
+}
+
+func (t taggingMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	if err := m.AddHeader("X-Tag", "yes"); err != nil {
+		return nil, err
+	}
+	return milter.RespAccept, t.err
+}
+
+func TestAccountingBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		modifications uint64
+		verdicts      uint64
+	}{
+		{"accepted", nil, 1, 1},
+		{"failed", errors.New("scanner down"), 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			accounting := &milter.Accounting{}
+			exchanges, _ := miltertest.NewScenario().MailFrom("a@example.com").RcptTo("b@example.org").Body("x").
+				Check(func() (milter.Milter, uint32, uint32) {
+					return accounting.Wrap(taggingMilter{err: test.err}), milter.OptAddHeader, 0
+				})
+			stats := accounting.Stats()
+			if n := stats.Modifications[milter.ActAddHeader]; n != test.modifications {
+				t.Errorf("%d modifications accounted, want %d", n, test.modifications)
+			}
+			if n := stats.Verdicts[milter.ActAccept]; n != test.verdicts {
+				t.Errorf("%d verdicts accounted, want %d", n, test.verdicts)
+			}
+			sent := false
+			for _, exchange := range exchanges {
+				for _, resp := range exchange.Responses {
+					sent = sent || resp.Code == milter.ActAddHeader
+				}
+			}
+			if sent != (test.err == nil) {
+				t.Errorf("header sent %v, want %v", sent, test.err == nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package milter
+
+import (
+	"fmt"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Anomaly reports a verdict rate deviating from its baseline
+type Anomaly struct {
+	// Verdict is one of "reject", "tempfail", "discard" or "quarantine"
+	Verdict string
+	// Rate is the share of messages with the verdict in the last window,
+	// Baseline its long term average
+	Rate     float64
+	Baseline float64
+	Count    int
+	Messages int
+	// Start is the start of the window
+	Start time.Time
+}
+
+// String describes the anomaly
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%s rate %.1f%% (%d of %d messages) against baseline %.1f%%",
+		a.Verdict, 100*a.Rate, a.Count, a.Messages, 100*a.Baseline)
+}
+
+// AnomalyDetector watches the verdict rates of the milters it wraps and calls
+// Alert when a rate rises sharply above its baseline, so that a misfiring rule
+// or an attack is noticed early. A single AnomalyDetector is meant to be shared
+// by all sessions.
+//
+// Verdicts are counted in windows of Window. At the end of each window with at
+// least MinMessages messages, the rate of every verdict is compared with its
+// baseline, an exponentially weighted average over about Baseline windows, and
+// rates over Factor times the baseline are reported. Windows are closed by the
+// first message after they end.
+type AnomalyDetector struct {
+	// Alert is called for anomalies, it must not block
+	Alert func(Anomaly)
+	// Window is the length of a counting window, default one minute
+	Window time.Duration
+	// Baseline is the number of windows averaged into baselines, default 60
+	Baseline int
+	// Factor is the rise over the baseline which is reported, default 3
+	Factor float64
+	// MinRate ignores rates below it, default 0.05
+	MinRate float64
+	// MinMessages ignores windows with less messages, default 20
+	MinMessages int
+	// Clock times windows, nil means SystemClock
+	Clock Clock
+
+	mutex     sync.Mutex
+	start     time.Time
+	messages  int
+	counts    map[string]int
+	baselines map[string]float64
+	warm      int
+}
+
+// anomalyVerdicts are the verdicts watched by AnomalyDetector
+var anomalyVerdicts = []string{"reject", "tempfail", "discard", "quarantine"}
+
+// Record counts a message with verdict, an empty verdict counts a message
+// without watched verdict
+func (d *AnomalyDetector) Record(verdict string) {
+	d.mutex.Lock()
+	now := ClockOrSystem(d.Clock).Now()
+	var anomalies []Anomaly
+	if d.start.IsZero() {
+		d.start = now
+	} else if now.Sub(d.start) >= d.window() {
+		anomalies = d.roll()
+		d.start = now
+	}
+	if d.counts == nil {
+		d.counts = make(map[string]int)
+	}
+	d.messages++
+	if verdict != "" {
+		d.counts[verdict]++
+	}
+	d.mutex.Unlock()
+
+	if d.Alert != nil {
+		for _, anomaly := range anomalies {
+			d.Alert(anomaly)
+		}
+	}
+}
+
+// roll closes the current window, the caller holds the mutex
+func (d *AnomalyDetector) roll() []Anomaly {
+	defer func() {
+		d.messages = 0
+		clear(d.counts)
+	}()
+	if d.messages < d.minMessages() {
+		return nil
+	}
+	if d.baselines == nil {
+		d.baselines = make(map[string]float64)
+	}
+	var anomalies []Anomaly
+	alpha := 2 / (float64(d.baseline()) + 1)
+	for _, verdict := range anomalyVerdicts {
+		rate := float64(d.counts[verdict]) / float64(d.messages)
+		baseline, known := d.baselines[verdict]
+		// the first windows only establish the baselines
+		if d.warm >= d.baseline()/4 && known && rate >= d.minRate() && rate > d.factor()*baseline {
+			anomalies = append(anomalies, Anomaly{verdict, rate, baseline, d.counts[verdict], d.messages, d.start})
+		}
+		if !known {
+			baseline = rate
+		}
+		d.baselines[verdict] = baseline + alpha*(rate-baseline)
+	}
+	d.warm++
+	return anomalies
+}
+
+// defaults for unset fields
+func (d *AnomalyDetector) window() time.Duration {
+	if d.Window <= 0 {
+		return time.Minute
+	}
+	return d.Window
+}
+
+func (d *AnomalyDetector) baseline() int {
+	if d.Baseline <= 0 {
+		return 60
+	}
+	return d.Baseline
+}
+
+func (d *AnomalyDetector) factor() float64 {
+	if d.Factor <= 0 {
+		return 3
+	}
+	return d.Factor
+}
+
+func (d *AnomalyDetector) minRate() float64 {
+	if d.MinRate <= 0 {
+		return 0.05
+	}
+	return d.MinRate
+}
+
+func (d *AnomalyDetector) minMessages() int {
+	if d.MinMessages <= 0 {
+		return 20
+	}
+	return d.MinMessages
+}
+
+// anomalyVerdict returns the watched verdict of resp, empty for others
+func anomalyVerdict(resp Response) string {
+	msg := resp.Response()
+	switch msg.Code {
+	case ActReject:
+		return "reject"
+	case ActTempFail:
+		return "tempfail"
+	case ActDiscard:
+		return "discard"
+	case ActReplyCode:
+		if len(msg.Data) != 0 && msg.Data[0] == '4' {
+			return "tempfail"
+		}
+		return "reject"
+	}
+	return ""
+}
+
+// Wrap returns milter which records the message verdicts of next
+func (d *AnomalyDetector) Wrap(next Milter) Milter {
+	return &anomalyMilter{Milter: next, detector: d}
+}
+
+// anomalyMilter records verdicts of a single session
+type anomalyMilter struct {
+	Milter
+	detector *AnomalyDetector
+	message  bool
+}
+
+// record records a message refused before end of body
+func (a *anomalyMilter) record(resp Response, err error) (Response, error) {
+	if err == nil && a.message && resp != nil && !resp.Continue() {
+		a.detector.Record(anomalyVerdict(resp))
+		a.message = false
+	}
+	return resp, err
+}
+
+func (a *anomalyMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	a.message = true
+	return a.record(a.Milter.MailFrom(from, m))
+}
+
+func (a *anomalyMilter) Data(m *Modifier) (Response, error) {
+	return a.record(a.Milter.Data(m))
+}
+
+func (a *anomalyMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	return a.record(a.Milter.Header(name, value, m))
+}
+
+func (a *anomalyMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return a.record(a.Milter.Headers(h, m))
+}
+
+func (a *anomalyMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	return a.record(a.Milter.BodyChunk(chunk, m))
+}
+
+// Body records the message verdict, quarantined messages are recognized in a
+// transaction while the wrapped milter runs
+func (a *anomalyMilter) Body(m *Modifier) (Response, error) {
+	tx := m.Begin()
+	resp, err := a.Milter.Body(m)
+	if err != nil {
+		// modifications of a failed handler are not sent
+		tx.Rollback()
+		a.message = false
+		return resp, err
+	}
+	msgs := tx.Messages()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if a.message && resp != nil {
+		verdict := anomalyVerdict(resp)
+		for _, msg := range msgs {
+			if msg.Code == ActQuarantine && verdict == "" {
+				verdict = "quarantine"
+			}
+		}
+		a.detector.Record(verdict)
+	}
+	a.message = false
+	return resp, nil
+}
+
+func (a *anomalyMilter) MessageReset() {
+	a.message = false
+	ResetMessage(a.Milter)
+}
+
+func (a *anomalyMilter) ConnectionReset() {
+	ResetConnection(a.Milter)
+}
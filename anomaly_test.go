@@ -0,0 +1,49 @@
+package milter_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+// txRecorder counts the modifications wrapped milters leave in an outer
+// transaction at the end of the message
+type txRecorder struct {
+	milter.Milter
+	msgs *int
+}
+
+func (r txRecorder) Body(m *milter.Modifier) (milter.Response, error) {
+	tx := m.Begin()
+	resp, err := r.Milter.Body(m)
+	*r.msgs = len(tx.Messages())
+	tx.Rollback()
+	return resp, err
+}
+
+func TestAnomalyBody(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		msgs int
+	}{
+		{"accepted", nil, 1},
+		{"failed", errors.New("scanner down"), 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector := &milter.AnomalyDetector{}
+			msgs := 0
+			miltertest.NewScenario().MailFrom("a@example.com").RcptTo("b@example.org").Body("x").
+				Check(func() (milter.Milter, uint32, uint32) {
+					return txRecorder{detector.Wrap(taggingMilter{err: test.err}), &msgs}, milter.OptAddHeader, 0
+				})
+			// modifications of a failed handler are rolled back
+			if msgs != test.msgs {
+				t.Errorf("%d modifications committed, want %d", msgs, test.msgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package milter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditFormat selects the line format of AuditMessages
+type AuditFormat int
+
+const (
+	// AuditLogfmt writes space separated key=value pairs
+	AuditLogfmt AuditFormat = iota
+	// AuditJSON writes a JSON object per line
+	AuditJSON
+)
+
+// AuditRecord describes a single message as written by AuditMessages
+type AuditRecord struct {
+	Time       time.Time     `json:"time"`
+	Client     string        `json:"client"`
+	Helo       string        `json:"helo"`
+	Sender     string        `json:"sender"`
+	Recipients []string      `json:"recipients"`
+	Size       int64         `json:"size"`
+	QueueID    string        `json:"queue_id"`
+	Verdict    string        `json:"verdict"`
+	Duration   time.Duration `json:"-"`
+}
+
+// MarshalJSON reports duration in milliseconds
+func (r AuditRecord) MarshalJSON() ([]byte, error) {
+	type record AuditRecord
+	return json.Marshal(struct {
+		record
+		Duration float64 `json:"duration_ms"`
+	}{record(r), float64(r.Duration) / float64(time.Millisecond)})
+}
+
+// logfmt formats record as key=value pairs, values are quoted when needed
+func (r *AuditRecord) logfmt() string {
+	var b strings.Builder
+	pair := func(key, value string) {
+		if b.Len() != 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, isControl) != -1 {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+	pair("time", r.Time.Format(time.RFC3339Nano))
+	pair("client", r.Client)
+	pair("helo", r.Helo)
+	pair("sender", r.Sender)
+	pair("recipients", strings.Join(r.Recipients, ","))
+	pair("size", strconv.FormatInt(r.Size, 10))
+	pair("queue_id", r.QueueID)
+	pair("verdict", r.Verdict)
+	pair("duration_ms", strconv.FormatFloat(float64(r.Duration)/float64(time.Millisecond), 'f', 3, 64))
+	return b.String()
+}
+
+// isControl reports characters which need quoting
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+// AuditMessages returns middleware which writes a line per message to w with
+// client, sender, recipients, size, queue id, verdict and duration from MAIL
+// FROM to the verdict; aborted messages have verdict abort
+func AuditMessages(w io.Writer, format AuditFormat) Middleware {
+	var mutex sync.Mutex
+	write := func(record *AuditRecord, logger Logger) {
+		var line []byte
+		switch format {
+		case AuditJSON:
+			var err error
+			if line, err = json.Marshal(record); err != nil {
+				LoggerOrDefault(logger).Printf("Error encoding audit record: %v", err)
+				return
+			}
+		default:
+			line = []byte(record.logfmt())
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			LoggerOrDefault(logger).Printf("Error writing audit record: %v", err)
+		}
+	}
+	return func(next Milter) Milter {
+		return &auditMilter{next: next, write: write}
+	}
+}
+
+// auditMilter audits messages of a single session
+type auditMilter struct {
+	next  Milter
+	write func(*AuditRecord, Logger)
+	// logger and clock are those of the session, messages may finish outside
+	// of callbacks
+	logger  Logger
+	clock   Clock
+	client  string
+	helo    string
+	record  *AuditRecord
+	started time.Time
+}
+
+// finish writes the record of the current message
+func (a *auditMilter) finish(verdict string, m *Modifier) {
+	if a.record == nil {
+		return
+	}
+	if m != nil && m.Macros["i"] != "" {
+		a.record.QueueID = m.Macros["i"]
+	}
+	a.record.Verdict = verdict
+	a.record.Duration = ClockOrSystem(a.clock).Now().Sub(a.started)
+	a.write(a.record, a.logger)
+	a.record = nil
+}
+
+// auditVerdict returns the name of a final response
+func auditVerdict(resp Response) string {
+	msg := resp.Response()
+	switch msg.Code {
+	case ActAccept:
+		return "accept"
+	case ActContinue:
+		return "continue"
+	case ActDiscard:
+		return "discard"
+	case ActReject:
+		return "reject"
+	case ActTempFail:
+		return "tempfail"
+	case ActReplyCode:
+		reply, _, _ := strings.Cut(strings.TrimRight(string(msg.Data), "\x00"), " ")
+		return "reply:" + reply
+	}
+	return msg.Code.String()
+}
+
+// stage finishes the message if the callback result ends it
+func (a *auditMilter) stage(m *Modifier) func(Response, error) (Response, error) {
+	return func(resp Response, err error) (Response, error) {
+		switch {
+		case err != nil:
+			a.finish("error", m)
+		case resp != nil && !resp.Continue():
+			a.finish(auditVerdict(resp), m)
+		}
+		return resp, err
+	}
+}
+
+func (a *auditMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	a.client = fmt.Sprintf("%s [%v]", host, addr)
+	return a.next.Connect(host, family, port, addr, m)
+}
+
+func (a *auditMilter) Helo(name string, m *Modifier) (Response, error) {
+	a.helo = name
+	return a.next.Helo(name, m)
+}
+
+func (a *auditMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	a.logger, a.clock = m.logger, m.clock
+	a.started = ClockOrSystem(a.clock).Now()
+	a.record = &AuditRecord{Time: a.started, Client: a.client, Helo: a.helo, Sender: from, Recipients: []string{}}
+	if id := m.Macros["i"]; id != "" {
+		a.record.QueueID = id
+	}
+	return a.stage(m)(a.next.MailFrom(from, m))
+}
+
+func (a *auditMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	// refused recipients do not end the message and are not listed
+	resp, err := a.next.RcptTo(rcptTo, m)
+	if err == nil && a.record != nil && (resp == nil || resp.Continue()) {
+		a.record.Recipients = append(a.record.Recipients, rcptTo)
+	}
+	return resp, err
+}
+
+func (a *auditMilter) Data(m *Modifier) (Response, error) {
+	return a.stage(m)(a.next.Data(m))
+}
+
+func (a *auditMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	return a.stage(m)(a.next.Header(name, value, m))
+}
+
+func (a *auditMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return a.stage(m)(a.next.Headers(h, m))
+}
+
+func (a *auditMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	if a.record != nil {
+		a.record.Size += int64(len(chunk))
+	}
+	return a.stage(m)(a.next.BodyChunk(chunk, m))
+}
+
+func (a *auditMilter) Body(m *Modifier) (Response, error) {
+	resp, err := a.next.Body(m)
+	switch {
+	case err != nil:
+		a.finish("error", m)
+	case resp != nil:
+		a.finish(auditVerdict(resp), m)
+	}
+	return resp, err
+}
+
+func (a *auditMilter) Abort(m *Modifier) error {
+	return a.next.Abort(m)
+}
+
+func (a *auditMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	// refused commands do not end the message
+	return a.next.Unknown(cmd, m)
+}
+
+func (a *auditMilter) MessageReset() {
+	a.finish("abort", nil)
+	ResetMessage(a.next)
+}
+
+func (a *auditMilter) ConnectionReset() {
+	a.client, a.helo = "", ""
+	ResetConnection(a.next)
+}
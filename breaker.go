@@ -0,0 +1,319 @@
+package milter
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a Breaker
+type BreakerState int
+
+const (
+	// BreakerClosed passes messages to the wrapped milter
+	BreakerClosed BreakerState = iota
+	// BreakerOpen answers messages with the fallback response
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial message through
+	BreakerHalfOpen
+)
+
+// String returns the name of state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Breaker stops calling a milter whose dependency keeps failing
+//
+// Callback errors count as failures and completed messages reset the count. Once
+// Threshold consecutive failures are reached the breaker opens and new messages
+// get Fallback without reaching the wrapped milter. After Cooldown a single
+// trial message is let through, closing the breaker if it succeeds. A single
+// Breaker is shared by all sessions using the dependency.
+type Breaker struct {
+	// Name identifies the dependency in stats and logs
+	Name string
+	// Threshold is the number of consecutive failures opening the breaker,
+	// default 5
+	Threshold int
+	// Cooldown is the time the breaker stays open, default 30 seconds
+	Cooldown time.Duration
+	// Fallback answers short circuited messages and failed callbacks, RespAccept
+	// or RespContinue fail open and the default RespTempFail fails closed
+	Fallback Response
+	// Clock times cooldown, nil means SystemClock
+	Clock Clock
+	// Logger receives state changes, nil means the standard logger
+	Logger Logger
+
+	mutex    sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+	trials   uint64
+	opened   uint64
+	bypassed uint64
+}
+
+// BreakerStats reports the state of a Breaker
+type BreakerStats struct {
+	Name  string
+	State BreakerState
+	// Failures counts consecutive failures
+	Failures int
+	// Opened counts how often the breaker opened, Bypassed messages which got
+	// the fallback response without reaching the wrapped milter
+	Opened   uint64
+	Bypassed uint64
+}
+
+// Stats returns current breaker state
+func (b *Breaker) Stats() BreakerStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.advance()
+	return BreakerStats{b.Name, b.state, b.failures, b.opened, b.bypassed}
+}
+
+// advance half-opens the breaker once cooldown has passed, the caller holds the mutex
+func (b *Breaker) advance() {
+	if b.state == BreakerOpen && !ClockOrSystem(b.Clock).Now().Before(b.openedAt.Add(b.cooldown())) {
+		b.state, b.trial = BreakerHalfOpen, false
+	}
+}
+
+// Allow returns true if a new message may use the dependency, a half open
+// breaker allows a single trial message
+func (b *Breaker) Allow() bool {
+	ok, _ := b.allow()
+	return ok
+}
+
+// allow is Allow which also returns the number of the trial granted, or zero
+func (b *Breaker) allow() (ok bool, trial uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.advance()
+	switch {
+	case b.state == BreakerClosed:
+		return true, 0
+	case b.state == BreakerHalfOpen && !b.trial:
+		b.trial = true
+		b.trials++
+		return true, b.trials
+	}
+	b.bypassed++
+	return false, 0
+}
+
+// release frees trial if it is still pending, so a trial message which ended
+// without success or failure lets the next message try
+func (b *Breaker) release(trial uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerHalfOpen && b.trial && b.trials == trial {
+		b.trial = false
+	}
+}
+
+// Success records a successful use of the dependency
+func (b *Breaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerHalfOpen {
+		LoggerOrDefault(b.Logger).Printf("Breaker %s closed", b.Name)
+	}
+	b.state, b.failures, b.trial = BreakerClosed, 0, false
+}
+
+// Failure records a failed use of the dependency
+func (b *Breaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.state == BreakerClosed && b.failures >= b.threshold() {
+		LoggerOrDefault(b.Logger).Printf("Error in dependency %s: breaker opened after %d failures", b.Name, b.failures)
+		b.state, b.openedAt, b.trial = BreakerOpen, ClockOrSystem(b.Clock).Now(), false
+		b.opened++
+	}
+}
+
+// defaults for unset fields
+func (b *Breaker) threshold() int {
+	if b.Threshold <= 0 {
+		return 5
+	}
+	return b.Threshold
+}
+
+func (b *Breaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return 30 * time.Second
+	}
+	return b.Cooldown
+}
+
+func (b *Breaker) fallback() Response {
+	if b.Fallback == nil {
+		return RespTempFail
+	}
+	return b.Fallback
+}
+
+// Wrap returns milter which guards next with the breaker, connection stage
+// callbacks always reach next and messages are decided at MAIL FROM
+func (b *Breaker) Wrap(next Milter) Milter {
+	return &breakerMilter{next: next, breaker: b}
+}
+
+// breakerMilter guards a single session
+type breakerMilter struct {
+	next     Milter
+	breaker  *Breaker
+	bypassed bool
+	// trial is the pending breaker trial of the message, stop cancels its
+	// release at the end of the session
+	trial uint64
+	stop  func() bool
+}
+
+// releaseTrial frees the trial of the message, if any
+func (b *breakerMilter) releaseTrial() {
+	if b.trial == 0 {
+		return
+	}
+	b.stop()
+	b.breaker.release(b.trial)
+	b.trial, b.stop = 0, nil
+}
+
+// guard records failed callbacks, they are answered with fallback
+func (b *breakerMilter) guard(name string, m *Modifier, resp Response, err error) (Response, error) {
+	if err != nil {
+		m.Logf("Error in %s callback guarded by breaker %s: %v", name, b.breaker.Name, err)
+		b.breaker.Failure()
+		b.bypassed = true
+		return b.breaker.fallback(), nil
+	}
+	return resp, nil
+}
+
+// bypass returns the response of a bypassed message for a callback
+func (b *breakerMilter) bypass() Response {
+	if resp := b.breaker.fallback(); !resp.Continue() {
+		return resp
+	}
+	return RespContinue
+}
+
+func (b *breakerMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	resp, err := b.next.Connect(host, family, port, addr, m)
+	return b.guard("Connect", m, resp, err)
+}
+
+func (b *breakerMilter) Helo(name string, m *Modifier) (Response, error) {
+	resp, err := b.next.Helo(name, m)
+	return b.guard("Helo", m, resp, err)
+}
+
+func (b *breakerMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	b.releaseTrial()
+	ok, trial := b.breaker.allow()
+	b.bypassed = !ok
+	if trial != 0 {
+		// sessions may end without finishing the trial message
+		b.trial = trial
+		b.stop = context.AfterFunc(m.Context(), func() { b.breaker.release(trial) })
+	}
+	if b.bypassed {
+		return b.breaker.fallback(), nil
+	}
+	resp, err := b.next.MailFrom(from, m)
+	return b.guard("MailFrom", m, resp, err)
+}
+
+func (b *breakerMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	if b.bypassed {
+		return b.bypass(), nil
+	}
+	resp, err := b.next.RcptTo(rcptTo, m)
+	return b.guard("RcptTo", m, resp, err)
+}
+
+func (b *breakerMilter) Data(m *Modifier) (Response, error) {
+	if b.bypassed {
+		return b.bypass(), nil
+	}
+	resp, err := b.next.Data(m)
+	return b.guard("Data", m, resp, err)
+}
+
+func (b *breakerMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	if b.bypassed {
+		return b.bypass(), nil
+	}
+	resp, err := b.next.Header(name, value, m)
+	return b.guard("Header", m, resp, err)
+}
+
+func (b *breakerMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	if b.bypassed {
+		return b.bypass(), nil
+	}
+	resp, err := b.next.Headers(h, m)
+	return b.guard("Headers", m, resp, err)
+}
+
+func (b *breakerMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	if b.bypassed {
+		return b.bypass(), nil
+	}
+	resp, err := b.next.BodyChunk(chunk, m)
+	return b.guard("BodyChunk", m, resp, err)
+}
+
+func (b *breakerMilter) Body(m *Modifier) (Response, error) {
+	if b.bypassed {
+		return b.breaker.fallback(), nil
+	}
+	resp, err := b.next.Body(m)
+	if err == nil {
+		b.breaker.Success()
+	}
+	return b.guard("Body", m, resp, err)
+}
+
+func (b *breakerMilter) Abort(m *Modifier) error {
+	// bypassed milters still release their message state
+	return b.next.Abort(m)
+}
+
+func (b *breakerMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	if b.bypassed {
+		return b.bypass(), nil
+	}
+	resp, err := b.next.Unknown(cmd, m)
+	return b.guard("Unknown", m, resp, err)
+}
+
+func (b *breakerMilter) MessageReset() {
+	// aborted or refused trial messages neither close nor open the breaker
+	b.releaseTrial()
+	b.bypassed = false
+	ResetMessage(b.next)
+}
+
+func (b *breakerMilter) ConnectionReset() {
+	ResetConnection(b.next)
+}
@@ -0,0 +1,98 @@
+package milter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+// trialMilter refuses recipients or data when configured to
+type trialMilter struct {
+	milter.NoOpMilter
+	rcpt, data milter.Response
+}
+
+func (t trialMilter) RcptTo(string, *milter.Modifier) (milter.Response, error) {
+	if t.rcpt != nil {
+		return t.rcpt, nil
+	}
+	return milter.RespContinue, nil
+}
+
+func (t trialMilter) Data(*milter.Modifier) (milter.Response, error) {
+	if t.data != nil {
+		return t.data, nil
+	}
+	return milter.RespContinue, nil
+}
+
+func TestBreakerTrialEnd(t *testing.T) {
+	tests := []struct {
+		name     string
+		inner    trialMilter
+		scenario *miltertest.Scenario
+		state    milter.BreakerState
+	}{
+		{"aborted", trialMilter{},
+			miltertest.NewScenario().MailFrom("a@example.com").Abort(), milter.BreakerHalfOpen},
+		{"recipient refused", trialMilter{rcpt: milter.RespReject},
+			miltertest.NewScenario().MailFrom("a@example.com").RcptTo("b@example.org").Abort(), milter.BreakerHalfOpen},
+		{"data refused", trialMilter{data: milter.RespReject},
+			miltertest.NewScenario().MailFrom("a@example.com").RcptTo("b@example.org").Data(), milter.BreakerHalfOpen},
+		{"disconnected", trialMilter{},
+			miltertest.NewScenario().MailFrom("a@example.com").RcptTo("b@example.org").Header("Subject", "x"), milter.BreakerHalfOpen},
+		{"completed", trialMilter{},
+			miltertest.NewScenario().MailFrom("a@example.com").RcptTo("b@example.org").Body("x"), milter.BreakerClosed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := miltertest.NewFakeClock(time.Unix(1000, 0))
+			breaker := &milter.Breaker{Name: "test", Threshold: 1, Cooldown: time.Minute, Clock: clock}
+			breaker.Failure()
+			clock.Advance(time.Minute)
+			test.scenario.Check(func() (milter.Milter, uint32, uint32) {
+				return breaker.Wrap(test.inner), 0, 0
+			})
+			if state := breaker.Stats().State; state != test.state {
+				t.Fatalf("state %v, want %v", state, test.state)
+			}
+			// the trial slot is released, possibly once the session context ends
+			deadline := time.Now().Add(time.Second)
+			for !breaker.Allow() {
+				if time.Now().After(deadline) {
+					t.Fatal("trial slot not released")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestBreakerOpens(t *testing.T) {
+	clock := miltertest.NewFakeClock(time.Unix(1000, 0))
+	breaker := &milter.Breaker{Threshold: 2, Cooldown: time.Minute, Clock: clock}
+	steps := []struct {
+		action func()
+		allow  bool
+		state  milter.BreakerState
+	}{
+		{func() {}, true, milter.BreakerClosed},
+		{breaker.Failure, true, milter.BreakerClosed},
+		{breaker.Failure, false, milter.BreakerOpen},
+		{func() { clock.Advance(time.Minute) }, true, milter.BreakerHalfOpen},
+		{breaker.Failure, false, milter.BreakerOpen},
+		{func() { clock.Advance(time.Minute) }, true, milter.BreakerHalfOpen},
+		{breaker.Success, true, milter.BreakerClosed},
+	}
+	for i, step := range steps {
+		step.action()
+		if state := breaker.Stats().State; state != step.state {
+			t.Fatalf("step %d: state %v, want %v", i, state, step.state)
+		}
+		if allow := breaker.Allow(); allow != step.allow {
+			t.Fatalf("step %d: allow %v, want %v", i, allow, step.allow)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package milter
+
+import (
+	"time"
+)
+
+// Clock is the source of time for delays and time windows, tests substitute a
+// fake clock to exercise timeouts and rate limits without sleeping
+//
+// Socket deadlines and latency measurements always use real time.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer firing after d
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single shot timer created by a Clock
+type Timer interface {
+	// C returns the channel receiving the time when the timer fires
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false if it already fired
+	Stop() bool
+}
+
+// SystemClock is the Clock of the time package
+var SystemClock Clock = systemClock{}
+
+// systemClock implements Clock with the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+// systemTimer adapts time.Timer to Timer
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// ClockOrSystem returns clock, or SystemClock if it is nil, for Clock fields of
+// middleware
+func ClockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
@@ -0,0 +1,144 @@
+package milter
+
+import (
+	"sync"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// Codec decodes command payloads for one protocol version,
+// the codec used by a session is selected during option negotiation
+type Codec interface {
+	// Version returns the protocol version implemented by codec
+	Version() uint32
+	// Allowed returns true if command may be sent by the MTA in this version
+	Allowed(code Code) bool
+	// Supports returns true if response may be sent to the MTA in this version
+	Supports(code Code) bool
+	// Actions and Protocol return the action and protocol flags defined in this
+	// version, flags outside of them are not negotiated
+	Actions() uint32
+	Protocol() uint32
+	// Connect decodes SMFIC_CONNECT payload
+	Connect(data []byte) (*milterwire.Connect, error)
+	// Macros decodes SMFIC_MACRO payload
+	Macros(data []byte) (stage byte, macros []milterwire.Macro, err error)
+	// Helo decodes SMFIC_HELO payload
+	Helo(data []byte) (string, error)
+	// Envelope decodes SMFIC_MAIL and SMFIC_RCPT payloads
+	Envelope(data []byte) (addr string, args []string, err error)
+	// Header decodes SMFIC_HEADER payload
+	Header(data []byte) (name, value string, err error)
+}
+
+// codecV2 implements protocol version 2
+type codecV2 struct{}
+
+func (codecV2) Version() uint32 {
+	return 2
+}
+
+func (codecV2) Allowed(code Code) bool {
+	switch code {
+	case CmdAbort, CmdBody, CmdConnect, CmdMacro, CmdEOB, CmdHelo,
+		CmdHeader, CmdMail, CmdEOH, CmdOptNeg, CmdQuit, CmdRcpt:
+		return true
+	case CmdData, CmdQuitNC:
+		// sent by some MTAs regardless of negotiated version
+		return true
+	}
+	return false
+}
+
+func (codecV2) Supports(code Code) bool {
+	switch code {
+	case ActInsHeader, ActChgFrom, ActAddRcptPar, ActSetSymList, ActSkip, ActProgress:
+		// introduced by later versions
+		return false
+	}
+	return true
+}
+
+func (codecV2) Actions() uint32 {
+	return OptAddHeader | OptChangeBody | OptAddRcpt | OptRemoveRcpt | OptChangeHeader | OptQuarantine
+}
+
+func (codecV2) Protocol() uint32 {
+	return OptNoConnect | OptNoHelo | OptNoMailFrom | OptNoRcptTo | OptNoBody | OptNoHeaders | OptNoEOH
+}
+
+func (codecV2) Connect(data []byte) (*milterwire.Connect, error) {
+	return milterwire.DecodeConnect(data)
+}
+
+func (codecV2) Macros(data []byte) (byte, []milterwire.Macro, error) {
+	return decodeMacros(data)
+}
+
+func (codecV2) Helo(data []byte) (string, error) {
+	name, _, _ := milterwire.ReadString(data)
+	return name, nil
+}
+
+func (codecV2) Envelope(data []byte) (string, []string, error) {
+	return milterwire.DecodeAddress(data)
+}
+
+func (codecV2) Header(data []byte) (string, string, error) {
+	return milterwire.DecodeHeader(data)
+}
+
+// codecV6 implements protocol version 6, payloads are encoded as in version 2
+type codecV6 struct {
+	codecV2
+}
+
+func (codecV6) Version() uint32 {
+	return 6
+}
+
+func (c codecV6) Allowed(code Code) bool {
+	return code == CmdUnknown || c.codecV2.Allowed(code)
+}
+
+func (codecV6) Supports(code Code) bool {
+	return true
+}
+
+func (c codecV6) Actions() uint32 {
+	return c.codecV2.Actions() | OptChangeFrom | OptAddRcptPar | OptSetSymList
+}
+
+func (c codecV6) Protocol() uint32 {
+	return c.codecV2.Protocol() | OptNoReplyHeader | OptNoUnknown | OptNoData | OptSkip |
+		OptRcptRejected | OptNoReplyConnect | OptNoReplyHelo | OptNoReplyMailFrom |
+		OptNoReplyRcptTo | OptNoReplyData | OptNoReplyUnknown | OptNoReplyEOH |
+		OptNoReplyBody | OptHeaderLeadingSpace | OptMaxDataSize256K | OptMaxDataSize1M
+}
+
+// registered codecs by protocol version
+var (
+	codecMutex sync.RWMutex
+	codecs     = map[uint32]Codec{2: codecV2{}, 6: codecV6{}}
+)
+
+// RegisterCodec makes a codec available for negotiation, replacing any codec
+// previously registered for the same version
+func RegisterCodec(codec Codec) {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+	codecs[codec.Version()] = codec
+}
+
+// selectCodec returns the codec with the highest version not above offered version
+func selectCodec(offered uint32) Codec {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	var selected Codec
+	for version, codec := range codecs {
+		if version <= offered && (selected == nil || version > selected.Version()) {
+			selected = codec
+		}
+	}
+	return selected
+}
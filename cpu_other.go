@@ -0,0 +1,8 @@
+//go:build !unix
+
+package milter
+
+// processCPU is not available without getrusage
+func processCPU() (float64, bool) {
+	return 0, false
+}
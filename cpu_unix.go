@@ -0,0 +1,19 @@
+//go:build unix
+
+package milter
+
+import (
+	"syscall"
+)
+
+// processCPU returns the user and system CPU time spent by the process
+func processCPU() (float64, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	seconds := func(t syscall.Timeval) float64 {
+		return float64(t.Sec) + float64(t.Usec)/1e6
+	}
+	return seconds(usage.Utime) + seconds(usage.Stime), true
+}
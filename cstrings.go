@@ -1,8 +1,7 @@
 package milter
 
 import (
-	"bytes"
-	"strings"
+	"github.com/phalaaxx/milter/milterwire"
 )
 
 // NULL terminator
@@ -10,17 +9,22 @@ const NULL = "\x00"
 
 // DecodeCStrings splits a C style strings into a Go slice
 func DecodeCStrings(data []byte) []string {
-	if len(data) == 0 {
-		return nil
-	}
-	return strings.Split(strings.Trim(string(data), NULL), NULL)
+	return milterwire.DecodeStrings(data)
 }
 
 // ReadCString reads and returns a C style string from []byte
 func ReadCString(data []byte) string {
-	pos := bytes.IndexByte(data, 0)
-	if pos == -1 {
-		return string(data)
-	}
-	return string(data[0:pos])
+	s, _, _ := milterwire.ReadString(data)
+	return s
+}
+
+// DecodeCBytes splits C style strings into sub-slices of data without copying
+func DecodeCBytes(data []byte) [][]byte {
+	return milterwire.SplitBytes(data)
+}
+
+// ReadCBytes returns the C style string at the beginning of data as a sub-slice
+func ReadCBytes(data []byte) []byte {
+	field, _, _ := milterwire.ReadBytes(data)
+	return field
 }
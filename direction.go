@@ -0,0 +1,138 @@
+package milter
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Direction is the direction of a message relative to the local mail system
+type Direction int
+
+const (
+	// DirectionUnknown is reported before a message has been classified
+	DirectionUnknown Direction = iota
+	// DirectionInbound messages come from outside
+	DirectionInbound
+	// DirectionOutbound messages are sent by local users to other domains
+	DirectionOutbound
+	// DirectionInternal messages are sent by local users to local domains
+	DirectionInternal
+)
+
+// String returns the name of direction
+func (d Direction) String() string {
+	switch d {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	case DirectionInternal:
+		return "internal"
+	}
+	return "unknown"
+}
+
+// DirectionClassifier classifies messages as inbound, outbound or internal so
+// that chained policies can branch on Modifier.Direction
+//
+// Messages come from local users if the client authenticated, was accepted on
+// one of Daemons or Interfaces, connected from Networks or submitted mail
+// without SMTP. Messages of local users whose recipients are all in
+// LocalDomains are internal, other messages of local users are outbound and
+// all remaining ones inbound. The direction is known from MAIL FROM on and
+// refined with every recipient.
+type DirectionClassifier struct {
+	// LocalDomains lists the domains of local recipients, a leading dot matches
+	// subdomains
+	LocalDomains []string
+	// Daemons lists daemon_name macro values of submission listeners
+	Daemons []string
+	// Interfaces lists if_addr macro values of submission listeners
+	Interfaces []string
+	// Networks lists client networks of local users
+	Networks []netip.Prefix
+}
+
+// Local returns true if rcpt is an address of a local domain
+func (c *DirectionClassifier) Local(rcpt string) bool {
+	domain := strings.ToLower(strings.Trim(rcpt, "<> "))
+	if at := strings.LastIndexByte(domain, '@'); at != -1 {
+		domain = domain[at+1:]
+	}
+	for _, local := range c.LocalDomains {
+		local = strings.ToLower(local)
+		if domain == local || strings.HasPrefix(local, ".") && strings.HasSuffix(domain, local) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns milter classifying messages in front of next
+func (c *DirectionClassifier) Wrap(next Milter) Milter {
+	return &directionMilter{Milter: next, classifier: c}
+}
+
+// directionMilter classifies messages of a single session
+type directionMilter struct {
+	Milter
+	classifier *DirectionClassifier
+	// local is set for clients of local users, daemon and iface hold
+	// connection macros which are not kept across messages
+	client netip.Addr
+	daemon string
+	iface  string
+	local  bool
+	// external is set once a recipient outside local domains is seen
+	external bool
+}
+
+func (d *directionMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	d.client, _ = netip.AddrFromSlice(addr)
+	d.client = d.client.Unmap()
+	d.daemon, d.iface = m.Macro("daemon_name"), m.Macro("if_addr")
+	return d.Milter.Connect(host, family, port, addr, m)
+}
+
+func (d *directionMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	c := d.classifier
+	d.local = m.Macro("auth_authen") != "" || m.NonSMTP ||
+		d.daemon != "" && slices.Contains(c.Daemons, d.daemon) ||
+		d.iface != "" && slices.Contains(c.Interfaces, d.iface) ||
+		slices.ContainsFunc(c.Networks, func(p netip.Prefix) bool { return d.client.IsValid() && p.Contains(d.client) })
+	d.external = false
+	// local users are assumed to send outbound until recipients are known
+	direction := DirectionInbound
+	if d.local {
+		direction = DirectionOutbound
+	}
+	m.setDirection(direction)
+	return d.Milter.MailFrom(from, m)
+}
+
+func (d *directionMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	resp, err := d.Milter.RcptTo(rcptTo, m)
+	// refused recipients do not change the direction
+	if d.local && err == nil && (resp == nil || resp.Continue()) {
+		local := d.classifier.Local(rcptTo)
+		d.external = d.external || !local
+		if d.external {
+			m.setDirection(DirectionOutbound)
+		} else {
+			m.setDirection(DirectionInternal)
+		}
+	}
+	return resp, err
+}
+
+func (d *directionMilter) MessageReset() {
+	d.local, d.external = false, false
+	ResetMessage(d.Milter)
+}
+
+func (d *directionMilter) ConnectionReset() {
+	d.client, d.daemon, d.iface = netip.Addr{}, "", ""
+	ResetConnection(d.Milter)
+}
@@ -0,0 +1,54 @@
+package milter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// readDeadliner is implemented by sockets supporting read deadlines, like net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// watch cancels ctx with EPeerClosed once the MTA closes the connection while
+// a handler runs; the returned function stops watching. Data the MTA sends in
+// the meantime is kept for the next read. Sockets without read deadlines are
+// not watched.
+func (m *MilterSession) watch(cancel context.CancelCauseFunc) (stop func()) {
+	conn, ok := m.Sock.(readDeadliner)
+	if !ok {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var data [512]byte
+	var n int
+	go func() {
+		defer close(done)
+		var err error
+		n, err = m.Sock.Read(data[:])
+		if err != nil && n == 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel(EPeerClosed)
+		}
+	}()
+	return func() {
+		// interrupt the pending read
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		conn.SetReadDeadline(time.Time{})
+		if n != 0 {
+			m.early.Write(data[:n])
+		}
+	}
+}
+
+// reader returns the reader of incoming packets, data read while watching
+// for disconnects comes first
+func (m *MilterSession) reader() io.Reader {
+	if m.early.Len() != 0 {
+		return io.MultiReader(&m.early, m.Sock)
+	}
+	return m.Sock
+}
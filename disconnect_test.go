@@ -0,0 +1,86 @@
+package milter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// slowMilter ends messages after wait unless its context ends first, causes
+// receives the context cause or nil and queueIDs the queue id at MAIL FROM
+type slowMilter struct {
+	milter.NoOpMilter
+	wait     time.Duration
+	causes   chan error
+	queueIDs chan string
+}
+
+func (s slowMilter) MailFrom(_ string, m *milter.Modifier) (milter.Response, error) {
+	s.queueIDs <- m.Macro("i")
+	return milter.RespContinue, nil
+}
+
+func (s slowMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	select {
+	case <-m.Context().Done():
+		s.causes <- context.Cause(m.Context())
+	case <-time.After(s.wait):
+		s.causes <- nil
+	}
+	// continue keeps the session for further messages
+	return milter.RespContinue, nil
+}
+
+func TestDisconnectWatcher(t *testing.T) {
+	tests := []struct {
+		name string
+		// closed closes the connection during end of message, otherwise the
+		// next message is pipelined
+		closed bool
+		cause  error
+	}{
+		{"peer closed", true, milter.EPeerClosed},
+		{"pipelined data kept", false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := slowMilter{wait: 200 * time.Millisecond, causes: make(chan error, 1), queueIDs: make(chan string, 2)}
+			c := pipeSession(t, milter.WithMilter(inner, 0, 0))
+			send(t, c, milter.CmdMail, mailFrom("a@example.com"))
+			<-inner.queueIDs
+			send(t, c, milter.CmdRcpt, rcptTo("b@example.org"))
+			send(t, c, milter.CmdEOH, nil)
+			if err := c.Write(milter.CmdEOB, nil); err != nil {
+				t.Fatal(err)
+			}
+			if test.closed {
+				c.Close()
+			} else if err := c.Write(milter.CmdMacro, append([]byte{byte(milter.CmdMail)}, milterwire.EncodeStrings("i", "Q2")...)); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case cause := <-inner.causes:
+				if cause != test.cause {
+					t.Fatalf("cause %v, want %v", cause, test.cause)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("end of message handler did not return")
+			}
+			if test.closed {
+				return
+			}
+			// the macro read while watching reaches the next message
+			if code, _, err := c.Read(); err != nil || code != milter.ActContinue {
+				t.Fatalf("end of message got %v, %v", code, err)
+			}
+			send(t, c, milter.CmdMail, mailFrom("a@example.com"))
+			if id := <-inner.queueIDs; id != "Q2" {
+				t.Fatalf("queue id %q, want Q2", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package milter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// bodyPreview limits the number of body bytes shown by FormatPayload
+const bodyPreview = 64
+
+// String returns a single line description of message with decoded payload
+func (m *Message) String() string {
+	payload := FormatPayload(m.Code, m.Data)
+	if payload == "" {
+		return m.Code.String()
+	}
+	return m.Code.String() + " " + payload
+}
+
+// Dump writes message description followed by a hex dump of its payload to w
+func (m *Message) Dump(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s\n", m); err != nil {
+		return err
+	}
+	if len(m.Data) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w, hex.Dump(m.Data))
+	return err
+}
+
+// FormatPayload decodes command or response specific fields of payload into
+// readable key=value pairs; payloads which fail to decode are shown quoted
+func FormatPayload(code Code, data []byte) string {
+	fields, err := payloadFields(code, data)
+	if err != nil {
+		return fmt.Sprintf("malformed=%q", data)
+	}
+	return strings.Join(fields, " ")
+}
+
+// payloadFields decodes payload into a list of formatted fields
+func payloadFields(code Code, data []byte) ([]string, error) {
+	switch code {
+	case CmdOptNeg:
+		optneg, err := milterwire.DecodeOptNeg(data)
+		if err != nil {
+			return nil, err
+		}
+		fields := []string{
+			fmt.Sprintf("version=%d", optneg.Version),
+			fmt.Sprintf("actions=0x%x", optneg.Actions),
+			fmt.Sprintf("protocol=0x%x", optneg.Protocol),
+		}
+		stages := make([]int, 0, len(optneg.Macros))
+		for stage := range optneg.Macros {
+			stages = append(stages, int(stage))
+		}
+		sort.Ints(stages)
+		for _, stage := range stages {
+			fields = append(fields, fmt.Sprintf("macros[%d]=%q", stage, optneg.Macros[uint32(stage)]))
+		}
+		return fields, nil
+
+	case CmdConnect:
+		connect, err := milterwire.DecodeConnect(data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{
+			fmt.Sprintf("hostname=%q", connect.Hostname),
+			fmt.Sprintf("family=%c", connect.Family),
+			fmt.Sprintf("port=%d", connect.Port),
+			fmt.Sprintf("address=%q", connect.Address),
+		}, nil
+
+	case CmdMacro:
+		stage, macros, err := milterwire.DecodeMacros(data)
+		if err != nil {
+			return nil, err
+		}
+		fields := []string{fmt.Sprintf("stage=%c", stage)}
+		for _, macro := range macros {
+			fields = append(fields, fmt.Sprintf("%s=%q", macro.Name, macro.Value))
+		}
+		return fields, nil
+
+	case CmdMail, CmdRcpt, ActAddRcpt, ActDelRcpt, ActAddRcptPar, ActChgFrom:
+		addr, args, err := milterwire.DecodeAddress(data)
+		if err != nil {
+			return nil, err
+		}
+		fields := []string{fmt.Sprintf("addr=%q", addr)}
+		if len(args) != 0 {
+			fields = append(fields, fmt.Sprintf("args=%q", args))
+		}
+		return fields, nil
+
+	case CmdHeader, ActAddHeader:
+		name, value, err := milterwire.DecodeHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{fmt.Sprintf("name=%q", name), fmt.Sprintf("value=%q", value)}, nil
+
+	case ActChgHeader, ActInsHeader:
+		index, name, value, err := milterwire.DecodeIndexedHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{
+			fmt.Sprintf("index=%d", index),
+			fmt.Sprintf("name=%q", name),
+			fmt.Sprintf("value=%q", value),
+		}, nil
+
+	case CmdBody, ActReplBody:
+		fields := []string{fmt.Sprintf("length=%d", len(data))}
+		if len(data) > bodyPreview {
+			return append(fields, fmt.Sprintf("data=%q...", data[:bodyPreview])), nil
+		}
+		return append(fields, fmt.Sprintf("data=%q", data)), nil
+
+	case CmdHelo, CmdUnknown, ActQuarantine, ActReplyCode:
+		names := map[Code]string{
+			CmdHelo:       "name",
+			CmdUnknown:    "command",
+			ActQuarantine: "reason",
+			ActReplyCode:  "reply",
+		}
+		value, _, ok := milterwire.ReadString(data)
+		if !ok {
+			return nil, milterwire.EMalformed
+		}
+		return []string{fmt.Sprintf("%s=%q", names[code], value)}, nil
+	}
+
+	// commands and responses without payload
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("data=%q", data)}, nil
+}
@@ -2,10 +2,114 @@ package milter
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/phalaaxx/milter/milterwire"
 )
 
 // pre-defined errors
 var (
-	ECloseSession = errors.New("Stop current milter processing")
-	EMacroNoData  = errors.New("Macro definition with no data")
+	EActionUnavailable = errors.New("Action not negotiated with MTA")
+	ECloseSession      = errors.New("Stop current milter processing")
+	EGoroutineBudget   = errors.New("Session goroutine budget exhausted")
+	EHeaderIndex       = errors.New("Header index out of range")
+	EMacroNoData       = errors.New("Macro definition with no data")
+	EMalformed         = milterwire.EMalformed
+	EModifierClosed    = errors.New("Modifier used after handler returned")
+	EPeerClosed        = errors.New("MTA closed connection")
+	EQuarantineReason  = errors.New("Quarantine without reason")
+	EQueueClosed       = errors.New("Task queue is shut down")
+	EQueueFull         = errors.New("Task queue is full")
+	EReply             = errors.New("Invalid SMTP reply")
+	EServerClosed      = errors.New("Server closed")
+	ESocketSpec        = errors.New("Invalid socket specification")
+	ETLSConfig         = errors.New("Invalid TLS configuration")
+	ETooLarge          = milterwire.ETooLarge
+	ETransaction       = errors.New("Transaction is not the innermost open one")
+	EUnknownCommand    = errors.New("Unrecognized command code")
+	EVersion           = errors.New("Unsupported protocol version")
 )
+
+// ProtocolError reports a malformed or unexpected packet received from the MTA
+type ProtocolError struct {
+	Code Code
+	Err  error
+}
+
+// Error implements the error interface
+func (e *ProtocolError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("Protocol error: %v", e.Err)
+	}
+	return fmt.Sprintf("Protocol error in command %v: %v", e.Code, e.Err)
+}
+
+// Unwrap returns the underlying cause
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// NegotiationError reports failed option negotiation with the MTA
+type NegotiationError struct {
+	Version  uint32
+	Actions  uint32
+	Protocol uint32
+	Err      error
+}
+
+// Error implements the error interface
+func (e *NegotiationError) Error() string {
+	return fmt.Sprintf("Negotiation failed (version %d, actions 0x%x, protocol 0x%x): %v",
+		e.Version, e.Actions, e.Protocol, e.Err)
+}
+
+// Unwrap returns the underlying cause
+func (e *NegotiationError) Unwrap() error {
+	return e.Err
+}
+
+// HandlerError wraps an error returned by a Milter callback handler
+type HandlerError struct {
+	Callback string
+	Err      error
+}
+
+// Error implements the error interface
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("%s handler failed: %v", e.Callback, e.Err)
+}
+
+// Unwrap returns the underlying cause
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError reports a panic recovered from the handler of a command, the
+// message is temporarily failed and the session ends
+type PanicError struct {
+	Code  Code
+	Value any
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+// Error implements the error interface
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Panic in %v handler: %v", e.Code, e.Value)
+}
+
+// SessionClosedError reports that the session ended because the connection was
+// closed or broken, or milter processing was stopped with ECloseSession
+type SessionClosedError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (e *SessionClosedError) Error() string {
+	return fmt.Sprintf("Session closed: %v", e.Err)
+}
+
+// Unwrap returns the underlying cause
+func (e *SessionClosedError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,95 @@
+package milter
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Flags is a registry of named feature flags which switch middlewares on and
+// off at runtime, for example from an admin interface or configuration reload
+//
+// Flags are evaluated when a middleware chain is built for a new session, so a
+// running session keeps the features it started with. Every evaluation is
+// counted, showing how often each path actually runs. Unknown flags are
+// enabled; the zero value is ready to use.
+type Flags struct {
+	mutex sync.RWMutex
+	flags map[string]*flagState
+}
+
+// flagState holds value and counters of a single flag
+type flagState struct {
+	enabled atomic.Bool
+	on, off atomic.Uint64
+}
+
+// FlagStats reports the state of a single flag
+type FlagStats struct {
+	Name    string
+	Enabled bool
+	// On and Off count sessions built with the flag enabled and disabled
+	On  uint64
+	Off uint64
+}
+
+// get returns state of flag name, creating an enabled flag if needed
+func (f *Flags) get(name string) *flagState {
+	f.mutex.RLock()
+	state, ok := f.flags[name]
+	f.mutex.RUnlock()
+	if ok {
+		return state
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if state, ok = f.flags[name]; !ok {
+		if f.flags == nil {
+			f.flags = make(map[string]*flagState)
+		}
+		state = &flagState{}
+		state.enabled.Store(true)
+		f.flags[name] = state
+	}
+	return state
+}
+
+// Set enables or disables flag name
+func (f *Flags) Set(name string, enabled bool) {
+	f.get(name).enabled.Store(enabled)
+}
+
+// Enabled returns true if flag name is enabled and counts the evaluation
+func (f *Flags) Enabled(name string) bool {
+	state := f.get(name)
+	if state.enabled.Load() {
+		state.on.Add(1)
+		return true
+	}
+	state.off.Add(1)
+	return false
+}
+
+// Stats returns the state of all flags sorted by name
+func (f *Flags) Stats() []FlagStats {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	stats := make([]FlagStats, 0, len(f.flags))
+	for name, state := range f.flags {
+		stats = append(stats, FlagStats{name, state.enabled.Load(), state.on.Load(), state.off.Load()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// Gate returns middleware which applies middleware only while flag name is enabled
+func (f *Flags) Gate(name string, middleware Middleware) Middleware {
+	// register flag so that it is reported before first use
+	f.get(name)
+	return func(next Milter) Milter {
+		if f.Enabled(name) {
+			return middleware(next)
+		}
+		return next
+	}
+}
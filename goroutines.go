@@ -0,0 +1,80 @@
+package milter
+
+import (
+	"context"
+	"time"
+)
+
+// LeakGrace is the time goroutines started with Modifier.Go may keep running
+// after their session ended before they are reported as leaked
+const LeakGrace = 5 * time.Second
+
+// Go runs f in a new goroutine accounted to the session, so that sessions stay
+// within their MaxGoroutines budget and goroutines which outlive the session
+// are detected. The context passed to f is cancelled when the session ends.
+// Unlike modifications, goroutines may be started by workers of the handler
+// until the session ends.
+func (m *Modifier) Go(f func(ctx context.Context)) error {
+	if m.spawn == nil {
+		go f(context.Background())
+		return nil
+	}
+	return m.spawn(f)
+}
+
+// spawn starts a goroutine accounted to the session
+func (m *MilterSession) spawn(f func(ctx context.Context)) error {
+	if n := m.stats.goroutines.Add(1); m.MaxGoroutines > 0 && n > int64(m.MaxGoroutines) {
+		m.stats.goroutines.Add(-1)
+		return EGoroutineBudget
+	}
+	ctx := m.context()
+	go func() {
+		defer m.stats.goroutines.Add(-1)
+		f(ctx)
+	}()
+	return nil
+}
+
+// context returns the context of the session, it is cancelled when the
+// session ends
+func (m *MilterSession) context() context.Context {
+	m.ctxOnce.Do(func() {
+		m.ctx, m.cancel = context.WithCancel(context.Background())
+	})
+	return m.ctx
+}
+
+// commandContext returns the context of the handler of code, commands of a
+// message get a context which is also cancelled when the message is complete
+func (m *MilterSession) commandContext(code Code) context.Context {
+	switch code {
+	case CmdMail, CmdRcpt, CmdData, CmdHeader, CmdEOH, CmdBody, CmdEOB, CmdAbort:
+	default:
+		return m.context()
+	}
+	if m.msgCtx == nil {
+		m.msgCtx, m.msgCancel = context.WithCancel(m.context())
+	}
+	return m.msgCtx
+}
+
+// end cancels the session context, releases the read buffer and reports
+// goroutines still running after LeakGrace
+func (m *MilterSession) end() {
+	m.context()
+	m.cancel()
+	readBuffers.put(m.readBuf)
+	m.readBuf = nil
+	if m.stats.goroutines.Load() == 0 {
+		return
+	}
+	time.AfterFunc(LeakGrace, func() {
+		if n := m.stats.goroutines.Load(); n > 0 {
+			m.logf("Error in milter session: %d goroutines still running %v after session end", n, LeakGrace)
+			if m.leaked != nil {
+				m.leaked(n)
+			}
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package milter
+
+import (
+	"strings"
+)
+
+// HeaderField is a header as sent by the MTA with its original name capitalization
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// HeaderFields lists message headers in the order they were received
+type HeaderFields []HeaderField
+
+// Get returns the first header named name, names are compared case insensitively
+func (h HeaderFields) Get(name string) (HeaderField, bool) {
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			return field, true
+		}
+	}
+	return HeaderField{}, false
+}
+
+// All returns all headers named name in received order
+func (h HeaderFields) All(name string) HeaderFields {
+	var fields HeaderFields
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,240 @@
+package milter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// HeaderEditor is a mutable copy of message headers, ApplyHeaders turns the
+// differences to the received headers into header modifications
+//
+// Fields are addressed by their position among the current headers. Edits keep
+// the relative order of received headers, moving a header is expressed as a
+// deletion and an insertion.
+type HeaderEditor struct {
+	fields []editField
+}
+
+// editField is a header together with its position in received headers,
+// deleted received headers are kept to preserve positions
+type editField struct {
+	HeaderField
+	origin   int
+	received string
+	deleted  bool
+}
+
+// EditHeaders returns an editor for the headers received so far
+func (m *Modifier) EditHeaders() *HeaderEditor {
+	e := &HeaderEditor{fields: make([]editField, len(m.HeaderFields))}
+	for i, field := range m.HeaderFields {
+		e.fields[i] = editField{HeaderField: field, origin: i, received: field.Value}
+	}
+	return e
+}
+
+// Fields returns current headers
+func (e *HeaderEditor) Fields() HeaderFields {
+	var fields HeaderFields
+	for _, field := range e.fields {
+		if !field.deleted {
+			fields = append(fields, field.HeaderField)
+		}
+	}
+	return fields
+}
+
+// Len returns the number of current headers
+func (e *HeaderEditor) Len() int {
+	n := 0
+	for _, field := range e.fields {
+		if !field.deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// position returns the slice index of current header i, Len() maps to the end
+func (e *HeaderEditor) position(i int) (int, error) {
+	if i < 0 {
+		return 0, EHeaderIndex
+	}
+	for pos, field := range e.fields {
+		if field.deleted {
+			continue
+		}
+		if i == 0 {
+			return pos, nil
+		}
+		i--
+	}
+	if i == 0 {
+		return len(e.fields), nil
+	}
+	return 0, EHeaderIndex
+}
+
+// existing returns the slice index of current header i, which must exist
+func (e *HeaderEditor) existing(i int) (int, error) {
+	pos, err := e.position(i)
+	if err == nil && pos == len(e.fields) {
+		return 0, EHeaderIndex
+	}
+	return pos, err
+}
+
+// Set changes value of current header i, it fails with EHeaderIndex if there
+// is no such header
+func (e *HeaderEditor) Set(i int, value string) error {
+	pos, err := e.existing(i)
+	if err != nil {
+		return err
+	}
+	e.fields[pos].Value = value
+	return nil
+}
+
+// Delete removes current header i, it fails with EHeaderIndex if there is no
+// such header
+func (e *HeaderEditor) Delete(i int) error {
+	pos, err := e.existing(i)
+	if err != nil {
+		return err
+	}
+	if e.fields[pos].origin == -1 {
+		e.fields = append(e.fields[:pos], e.fields[pos+1:]...)
+		return nil
+	}
+	e.fields[pos].deleted = true
+	return nil
+}
+
+// Insert inserts a new header before current header i, i equal to Len()
+// appends; it fails with EHeaderIndex if i is beyond Len()
+func (e *HeaderEditor) Insert(i int, name, value string) error {
+	pos, err := e.position(i)
+	if err != nil {
+		return err
+	}
+	e.fields = append(e.fields, editField{})
+	copy(e.fields[pos+1:], e.fields[pos:])
+	e.fields[pos] = editField{HeaderField: HeaderField{name, value}, origin: -1}
+	return nil
+}
+
+// Add appends a new header
+func (e *HeaderEditor) Add(name, value string) {
+	e.fields = append(e.fields, editField{HeaderField: HeaderField{name, value}, origin: -1})
+}
+
+// Replace sets the first header named name to value and removes the others,
+// the header is appended if it does not exist
+func (e *HeaderEditor) Replace(name, value string) {
+	found := false
+	for i := 0; i < len(e.fields); i++ {
+		field := &e.fields[i]
+		if field.deleted || !strings.EqualFold(field.Name, name) {
+			continue
+		}
+		if !found {
+			field.Value, found = value, true
+			continue
+		}
+		if field.origin == -1 {
+			e.fields = append(e.fields[:i], e.fields[i+1:]...)
+			i--
+			continue
+		}
+		field.deleted = true
+	}
+	if !found {
+		e.Add(name, value)
+	}
+}
+
+// Remove removes all headers named name
+func (e *HeaderEditor) Remove(name string) {
+	fields := e.fields[:0]
+	for _, field := range e.fields {
+		if strings.EqualFold(field.Name, name) {
+			if field.origin == -1 {
+				continue
+			}
+			field.deleted = true
+		}
+		fields = append(fields, field)
+	}
+	e.fields = fields
+}
+
+// Modifications returns the header modification packets which turn received
+// headers into current headers
+//
+// New headers are inserted first, bottom up so that positions computed against
+// received headers stay valid, and headers following all received ones are
+// appended. Changed and deleted headers are then addressed by their occurrence
+// among headers of the same name, including inserted ones, highest occurrence
+// first so that deletions do not shift the headers still to be changed.
+func (e *HeaderEditor) Modifications() []*Message {
+	// headers after the last received one are appended
+	last := -1
+	for pos, field := range e.fields {
+		if field.origin != -1 {
+			last = pos
+		}
+	}
+	var inserts, msgs []*Message
+	received := 0
+	for pos, field := range e.fields {
+		switch {
+		case field.origin != -1:
+			received++
+		case pos > last:
+			msgs = append(msgs, &Message{ActAddHeader, milterwire.EncodeHeader(field.Name, field.Value)})
+		default:
+			data := milterwire.EncodeIndexedHeader(uint32(received), field.Name, field.Value)
+			inserts = append([]*Message{{ActInsHeader, data}}, inserts...)
+		}
+	}
+	msgs = append(inserts, msgs...)
+
+	// number received headers among same named headers present after inserts
+	type change struct {
+		name       string
+		occurrence int
+		value      string
+	}
+	var changes []change
+	counts := make(map[string]int)
+	for _, field := range e.fields[:last+1] {
+		name := strings.ToLower(field.Name)
+		counts[name]++
+		switch {
+		case field.origin == -1:
+		case field.deleted:
+			changes = append(changes, change{field.Name, counts[name], ""})
+		case field.Value != field.received:
+			changes = append(changes, change{field.Name, counts[name], field.Value})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].occurrence > changes[j].occurrence })
+	for _, c := range changes {
+		data := milterwire.EncodeIndexedHeader(uint32(c.occurrence), c.name, c.value)
+		msgs = append(msgs, &Message{ActChgHeader, data})
+	}
+	return msgs
+}
+
+// ApplyHeaders sends the modifications which turn received headers into the
+// headers of editor
+func (m *Modifier) ApplyHeaders(e *HeaderEditor) error {
+	for _, msg := range e.Modifications() {
+		if err := m.write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package milter_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+)
+
+func TestHeaderEditorIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(e *milter.HeaderEditor) error
+		err  error
+		len  int
+	}{
+		{"set", func(e *milter.HeaderEditor) error { return e.Set(1, "x") }, nil, 2},
+		{"set at end", func(e *milter.HeaderEditor) error { return e.Set(2, "x") }, milter.EHeaderIndex, 2},
+		{"set negative", func(e *milter.HeaderEditor) error { return e.Set(-1, "x") }, milter.EHeaderIndex, 2},
+		{"delete", func(e *milter.HeaderEditor) error { return e.Delete(0) }, nil, 1},
+		{"delete past end", func(e *milter.HeaderEditor) error { return e.Delete(5) }, milter.EHeaderIndex, 2},
+		{"delete deleted", func(e *milter.HeaderEditor) error {
+			if err := e.Delete(1); err != nil {
+				return err
+			}
+			return e.Delete(1)
+		}, milter.EHeaderIndex, 1},
+		{"insert", func(e *milter.HeaderEditor) error { return e.Insert(1, "X-New", "x") }, nil, 3},
+		{"insert at end", func(e *milter.HeaderEditor) error { return e.Insert(2, "X-New", "x") }, nil, 3},
+		{"insert past end", func(e *milter.HeaderEditor) error { return e.Insert(3, "X-New", "x") }, milter.EHeaderIndex, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &milter.Modifier{HeaderFields: milter.HeaderFields{{Name: "Subject", Value: "hi"}, {Name: "From", Value: "a@example.com"}}}
+			e := m.EditHeaders()
+			if err := test.edit(e); !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if n := e.Len(); n != test.len {
+				t.Fatalf("%d headers, want %d", n, test.len)
+			}
+		})
+	}
+}
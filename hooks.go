@@ -0,0 +1,44 @@
+package milter
+
+import (
+	"time"
+)
+
+// Hooks receives instrumentation events of sessions, for example to export
+// session counts, handler latency and verdict rates as metrics. Hooks are
+// called from session goroutines and must be safe for concurrent use, embed
+// NoHooks to implement only some of them.
+type Hooks interface {
+	// OnSessionStart is called when a session starts serving the MTA
+	OnSessionStart(sessionID string)
+	// OnSessionEnd is called when a session ends with the error of Run
+	OnSessionEnd(sessionID string, err error)
+	// OnCommand is called after command code was processed, d includes the
+	// time spent by handlers
+	OnCommand(code Code, d time.Duration)
+	// OnResponse is called with every response sent to command
+	OnResponse(command, response Code)
+}
+
+// NoHooks ignores all events
+type NoHooks struct{}
+
+func (NoHooks) OnSessionStart(string) {
+}
+
+func (NoHooks) OnSessionEnd(string, error) {
+}
+
+func (NoHooks) OnCommand(Code, time.Duration) {
+}
+
+func (NoHooks) OnResponse(Code, Code) {
+}
+
+// hooks returns the hooks of the session, NoHooks if none are set
+func (m *MilterSession) hooks() Hooks {
+	if m.Hooks == nil {
+		return NoHooks{}
+	}
+	return m.Hooks
+}
@@ -0,0 +1,46 @@
+package milter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// newSessionID returns a random session id
+func newSessionID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// beginMessage assigns the message id when code starts a message, ids are the
+// session id followed by the number of the message within the session
+func (m *MilterSession) beginMessage(code Code) {
+	if code != CmdMail || m.messageID != "" {
+		return
+	}
+	m.messages++
+	m.messageID = fmt.Sprintf("%s.%d", m.SessionID, m.messages)
+	m.stats.setMessageID(m.messageID)
+}
+
+// logID returns the id log messages of the session are tagged with, the
+// message id while a message is in progress
+func (m *MilterSession) logID() string {
+	if m.messageID != "" {
+		return m.messageID
+	}
+	return m.SessionID
+}
+
+// SessionID returns the id of the session, it is unique per connection
+func (m *Modifier) SessionID() string {
+	return m.sessionID
+}
+
+// MessageID returns the id of the current message, it is assigned at MAIL FROM
+// and unique per message; outside of messages it is empty. Unlike the queue id
+// of the MTA it is known from the first command of the message.
+func (m *Modifier) MessageID() string {
+	return m.messageID
+}
@@ -0,0 +1,157 @@
+package milter
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes a running session
+type SessionInfo struct {
+	// ID identifies the session within its server
+	ID uint64
+	// Peer is the address of the MTA connection and Client the SMTP client
+	// reported by the MTA, if any
+	Peer   string
+	Client string
+	// SessionID and MessageID are the ids of the session and its current
+	// message, see Modifier
+	SessionID string
+	MessageID string
+	// QueueID is the MTA queue id of the current message, macro i
+	QueueID string
+	// Stage is the last command received
+	Stage   Code
+	Started time.Time
+	// BytesRead and BytesWritten count packet bytes exchanged with the MTA
+	BytesRead    int64
+	BytesWritten int64
+	// Goroutines counts running goroutines started with Modifier.Go
+	Goroutines int64
+}
+
+// sessionStats holds inspected session state, updated by the session and read
+// concurrently by inspection
+type sessionStats struct {
+	mutex      sync.Mutex
+	client     string
+	queueID    string
+	messageID  string
+	stage      Code
+	read       atomic.Int64
+	written    atomic.Int64
+	goroutines atomic.Int64
+}
+
+// setStage records the command being processed
+func (s *sessionStats) setStage(code Code) {
+	s.mutex.Lock()
+	s.stage = code
+	s.mutex.Unlock()
+}
+
+// setClient records the SMTP client reported by the MTA
+func (s *sessionStats) setClient(client string) {
+	s.mutex.Lock()
+	s.client = client
+	s.mutex.Unlock()
+}
+
+// setQueueID records the queue id of the current message
+func (s *sessionStats) setQueueID(id string) {
+	s.mutex.Lock()
+	s.queueID = id
+	s.mutex.Unlock()
+}
+
+// setMessageID records the id of the current message
+func (s *sessionStats) setMessageID(id string) {
+	s.mutex.Lock()
+	s.messageID = id
+	s.mutex.Unlock()
+}
+
+// trackedSession is a session registered with its server
+type trackedSession struct {
+	session *MilterSession
+	peer    string
+	started time.Time
+}
+
+// track registers session and returns its id
+func (s *Server) track(session *MilterSession) uint64 {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*trackedSession)
+	}
+	s.lastID++
+	peer := ""
+	if conn, ok := session.Sock.(net.Conn); ok {
+		peer = conn.RemoteAddr().String()
+	}
+	s.sessions[s.lastID] = &trackedSession{session, peer, time.Now()}
+	// sessions starting during shutdown are closed like idle ones
+	if s.closing.Load() {
+		session.stopAfterMessage()
+	}
+	return s.lastID
+}
+
+// untrack removes a finished session
+func (s *Server) untrack(id uint64) {
+	s.sessionMutex.Lock()
+	delete(s.sessions, id)
+	s.sessionMutex.Unlock()
+}
+
+// Sessions returns running sessions ordered by id
+func (s *Server) Sessions() []SessionInfo {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for id, tracked := range s.sessions {
+		stats := &tracked.session.stats
+		stats.mutex.Lock()
+		infos = append(infos, SessionInfo{
+			ID:           id,
+			Peer:         tracked.peer,
+			Client:       stats.client,
+			SessionID:    tracked.session.SessionID,
+			MessageID:    stats.messageID,
+			QueueID:      stats.queueID,
+			Stage:        stats.stage,
+			Started:      tracked.started,
+			BytesRead:    stats.read.Load(),
+			BytesWritten: stats.written.Load(),
+			Goroutines:   stats.goroutines.Load(),
+		})
+		stats.mutex.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Leaks returns the number of sessions whose goroutines outlived them by more
+// than LeakGrace
+func (s *Server) Leaks() uint64 {
+	return s.leaks.Load()
+}
+
+// Kill terminates session id by closing its connection, it returns false if
+// there is no such session; the MTA applies its milter failure policy to the
+// message in progress
+func (s *Server) Kill(id uint64) bool {
+	s.sessionMutex.Lock()
+	tracked, ok := s.sessions[id]
+	s.sessionMutex.Unlock()
+	if !ok {
+		return false
+	}
+	if err := tracked.session.Sock.Close(); err != nil {
+		return false
+	}
+	return true
+}
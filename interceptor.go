@@ -0,0 +1,67 @@
+package milter
+
+// Interceptor inspects or transforms raw packets passing through a session
+//
+// Incoming is called with every command read from the MTA before it is processed
+// and Outgoing with every packet before it is written, including modifications.
+// Returning a nil message drops the packet; returning an error ends the session
+// for incoming and fails the write for outgoing packets. Interceptors see incoming
+// packets in registration order and outgoing packets in reverse order, so the
+// first registered interceptor is always the one closest to the wire. Incoming
+// message data is reused for the next packet, interceptors which retain it must
+// copy it.
+type Interceptor interface {
+	Incoming(msg *Message) (*Message, error)
+	Outgoing(msg *Message) (*Message, error)
+}
+
+// InterceptorFuncs adapts a pair of functions to the Interceptor interface,
+// a nil function passes packets unchanged
+type InterceptorFuncs struct {
+	In  func(*Message) (*Message, error)
+	Out func(*Message) (*Message, error)
+}
+
+// Incoming calls In function
+func (f InterceptorFuncs) Incoming(msg *Message) (*Message, error) {
+	if f.In == nil {
+		return msg, nil
+	}
+	return f.In(msg)
+}
+
+// Outgoing calls Out function
+func (f InterceptorFuncs) Outgoing(msg *Message) (*Message, error) {
+	if f.Out == nil {
+		return msg, nil
+	}
+	return f.Out(msg)
+}
+
+// Use registers packet interceptors on session, it must be called before the
+// session starts processing commands
+func (m *MilterSession) Use(interceptors ...Interceptor) {
+	m.Interceptors = append(m.Interceptors, interceptors...)
+}
+
+// intercept passes an incoming command through all interceptors
+func (m *MilterSession) intercept(msg *Message) (*Message, error) {
+	for _, i := range m.Interceptors {
+		var err error
+		if msg, err = i.Incoming(msg); err != nil || msg == nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// interceptOutgoing passes an outgoing packet through all interceptors
+func (m *MilterSession) interceptOutgoing(msg *Message) (*Message, error) {
+	for i := len(m.Interceptors) - 1; i >= 0; i-- {
+		var err error
+		if msg, err = m.Interceptors[i].Outgoing(msg); err != nil || msg == nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
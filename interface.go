@@ -23,6 +23,11 @@ type Milter interface {
 	//   supress with NoRcptTo
 	RcptTo(rcptTo string, m *Modifier) (Response, error)
 
+	// Data is called when the SMTP client starts sending the message, after
+	// the last recipient and before the first header
+	//   supress with NoData
+	Data(m *Modifier) (Response, error)
+
 	// Header is called once for each header in incoming message
 	//   supress with NoHeaders
 	Header(name string, value string, m *Modifier) (Response, error)
@@ -32,10 +37,65 @@ type Milter interface {
 	Headers(h textproto.MIMEHeader, m *Modifier) (Response, error)
 
 	// BodyChunk is called to process next message body chunk data (up to 64KB in size)
+	//   chunk is reused after BodyChunk returns, copy it to retain data
 	//   supress with NoBody
 	BodyChunk(chunk []byte, m *Modifier) (Response, error)
 
 	// Body is called at the end of each message
 	//   all changes to message's content & attributes must be done here
 	Body(m *Modifier) (Response, error)
+
+	// Abort is called when the MTA aborts the current message, for example on
+	// RSET, before MessageReset; modifications are no longer possible
+	Abort(m *Modifier) error
+
+	// Unknown is called with SMTP commands the MTA does not recognize, a
+	// refusal replies to the command only
+	//   supress with NoUnknown
+	Unknown(cmd string, m *Modifier) (Response, error)
+}
+
+// RawHeaderHandler is implemented by milters which receive headers as raw byte
+// slices when session RawHeaders is set; name and value are only valid until
+// RawHeader returns. Headers keep received order, case and duplicates.
+type RawHeaderHandler interface {
+	RawHeader(name, value []byte, m *Modifier) (Response, error)
+}
+
+// Negotiator is implemented by milters which choose actions and protocol flags
+// per connection instead of using the masks returned by MilterInit; Negotiate
+// receives the flags offered by the MTA which the negotiated protocol version
+// defines and returns the flags to request, flags not offered are dropped.
+// Chain keeps the Negotiator of the milter it wraps.
+type Negotiator interface {
+	Negotiate(mtaActions, mtaProtocol uint32) (actions, protocol uint32)
+}
+
+// MessageResetter is implemented by milters which keep per-message state,
+// MessageReset is called whenever the session finishes or aborts a message
+type MessageResetter interface {
+	MessageReset()
+}
+
+// ResetMessage calls MessageReset of m if it implements MessageResetter, it is
+// used by middlewares to pass the call on to the milter they wrap
+func ResetMessage(m Milter) {
+	if resetter, ok := m.(MessageResetter); ok {
+		resetter.MessageReset()
+	}
+}
+
+// ConnectionResetter is implemented by milters which keep per-connection state,
+// ConnectionReset is called when the MTA ends the connection context with
+// SMFIC_QUIT_NC and reuses the session for another connection
+type ConnectionResetter interface {
+	ConnectionReset()
+}
+
+// ResetConnection calls ConnectionReset of m if it implements ConnectionResetter,
+// it is used by middlewares to pass the call on to the milter they wrap
+func ResetConnection(m Milter) {
+	if resetter, ok := m.(ConnectionResetter); ok {
+		resetter.ConnectionReset()
+	}
 }
@@ -0,0 +1,106 @@
+package milter
+
+import (
+	"sync"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// interning limits, longer strings are unlikely to repeat
+const (
+	internMaxLength = 64
+	internMaxSize   = 4096
+)
+
+// interner deduplicates short, frequently repeating strings; lookups of known
+// strings do not allocate
+type interner struct {
+	mutex   sync.RWMutex
+	strings map[string]string
+}
+
+// intern returns the canonical string for b
+func (i *interner) intern(b []byte) string {
+	if len(b) > internMaxLength {
+		return string(b)
+	}
+	i.mutex.RLock()
+	s, ok := i.strings[string(b)]
+	i.mutex.RUnlock()
+	if ok {
+		return s
+	}
+	s = string(b)
+	// the table stops growing once full so that random input can not exhaust memory
+	i.mutex.Lock()
+	if len(i.strings) < internMaxSize {
+		i.strings[s] = s
+	}
+	i.mutex.Unlock()
+	return s
+}
+
+// macroStrings holds interned macro names and values
+var macroStrings = &interner{strings: make(map[string]string)}
+
+// macros whose values commonly repeat across connections
+var (
+	internedMutex  sync.RWMutex
+	internedValues = map[string]bool{
+		"j":                true,
+		"v":                true,
+		"{daemon_name}":    true,
+		"{daemon_addr}":    true,
+		"{daemon_port}":    true,
+		"{if_name}":        true,
+		"{if_addr}":        true,
+		"{mail_mailer}":    true,
+		"{rcpt_mailer}":    true,
+		"{auth_type}":      true,
+		"{tls_version}":    true,
+		"{cipher}":         true,
+		"{cipher_bits}":    true,
+		"{verify}":         true,
+		"{cert_issuer}":    true,
+		"{client_resolve}": true,
+	}
+)
+
+// InternMacroValues marks macros whose values repeat often enough to be interned,
+// for example site specific daemon or interface names; macro names are always interned
+func InternMacroValues(names ...string) {
+	internedMutex.Lock()
+	defer internedMutex.Unlock()
+	for _, name := range names {
+		internedValues[name] = true
+	}
+}
+
+// decodeMacros decodes macro definition payload interning names and common values
+func decodeMacros(data []byte) (byte, []milterwire.Macro, error) {
+	if len(data) == 0 {
+		return 0, nil, milterwire.EMalformed
+	}
+	stage, data := data[0], data[1:]
+	var macros []milterwire.Macro
+	internedMutex.RLock()
+	defer internedMutex.RUnlock()
+	for len(data) != 0 {
+		name, rest, ok := milterwire.ReadBytes(data)
+		if !ok {
+			return 0, nil, milterwire.EMalformed
+		}
+		value, rest, ok := milterwire.ReadBytes(rest)
+		if !ok && len(value) == 0 {
+			return 0, nil, milterwire.EMalformed
+		}
+		macro := milterwire.Macro{Name: macroStrings.intern(name)}
+		if internedValues[macro.Name] {
+			macro.Value = macroStrings.intern(value)
+		} else {
+			macro.Value = string(value)
+		}
+		macros, data = append(macros, macro), rest
+	}
+	return stage, macros, nil
+}
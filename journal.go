@@ -0,0 +1,257 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalEntry records a single verdict or modification
+type JournalEntry struct {
+	Time       time.Time `json:"time"`
+	QueueID    string    `json:"queue_id,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Sender     string    `json:"sender,omitempty"`
+	Recipients []string  `json:"recipients,omitempty"`
+	// Stage is the callback which produced the entry
+	Stage string `json:"stage"`
+	// Verdict is true for responses and false for modifications
+	Verdict bool `json:"verdict"`
+	// Code and Data hold the packet sent to the MTA
+	Code Code   `json:"code"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// JournalBackend stores journal entries, Append must only return once the
+// entries are durable. Entries of a message are appended together when the
+// message ends.
+type JournalBackend interface {
+	Append(entries []JournalEntry) error
+}
+
+// FileJournal is a JournalBackend appending a JSON object per entry to a file
+type FileJournal struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// NewFileJournal opens or creates the journal file at path
+func NewFileJournal(path string) (*FileJournal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{file: file}, nil
+}
+
+// Append implements JournalBackend, entries are synced to disk before it returns
+func (j *FileJournal) Append(entries []JournalEntry) error {
+	var data []byte
+	for i := range entries {
+		line, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if _, err := j.file.Write(data); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close closes the journal file
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
+
+// ReadJournal returns the entries of queueID read from a journal written by
+// FileJournal, an empty queueID returns all entries
+func ReadJournal(r io.Reader, queueID string) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, fmt.Errorf("journal line %d: %w", line, err)
+		}
+		if queueID == "" || entry.QueueID == queueID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Journal returns middleware which records every response and modification of
+// next in backend. It should be the outermost middleware so that entries match
+// what was sent to the MTA. Entries of a message are buffered until the message
+// ends and then stamped with its queue id, which many MTAs only provide late.
+func Journal(backend JournalBackend) Middleware {
+	return func(next Milter) Milter {
+		return &journalMilter{next: next, backend: backend}
+	}
+}
+
+// journalMilter records a single session
+type journalMilter struct {
+	next       Milter
+	backend    JournalBackend
+	client     string
+	sender     string
+	recipients []string
+	queueID    string
+	entries    []JournalEntry
+	inMessage  bool
+	// logger is the Logger of the session, entries may be flushed outside of
+	// callbacks
+	logger Logger
+}
+
+// record runs callback in a transaction and journals its modifications and response
+func (j *journalMilter) record(stage string, m *Modifier, callback func() (Response, error)) (Response, error) {
+	j.logger = m.logger
+	tx := m.Begin()
+	resp, err := callback()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	msgs := tx.Messages()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if id := m.Macros["i"]; id != "" {
+		j.queueID = id
+	}
+	now := ClockOrSystem(m.clock).Now()
+	entry := func(verdict bool, msg *Message) {
+		j.entries = append(j.entries, JournalEntry{
+			Time:       now,
+			Client:     j.client,
+			Sender:     j.sender,
+			Recipients: append([]string(nil), j.recipients...),
+			Stage:      stage,
+			Verdict:    verdict,
+			Code:       msg.Code,
+			Data:       append([]byte(nil), msg.Data...),
+		})
+	}
+	for _, msg := range msgs {
+		entry(false, msg)
+	}
+	final := resp != nil && (!resp.Continue() || stage == "Body")
+	if resp != nil && (final || len(msgs) != 0) {
+		entry(true, resp.Response())
+	}
+	// connection stage entries and finished messages are written right away
+	if !j.inMessage || final && stage != "RcptTo" {
+		j.flush()
+	}
+	return resp, err
+}
+
+// flush appends buffered entries to backend
+func (j *journalMilter) flush() {
+	if len(j.entries) == 0 {
+		return
+	}
+	for i := range j.entries {
+		j.entries[i].QueueID = j.queueID
+	}
+	if err := j.backend.Append(j.entries); err != nil {
+		LoggerOrDefault(j.logger).Printf("Error writing journal: %v", err)
+	}
+	j.entries = nil
+}
+
+func (j *journalMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	j.client = fmt.Sprintf("%s [%v]", host, addr)
+	return j.record("Connect", m, func() (Response, error) {
+		return j.next.Connect(host, family, port, addr, m)
+	})
+}
+
+func (j *journalMilter) Helo(name string, m *Modifier) (Response, error) {
+	return j.record("Helo", m, func() (Response, error) {
+		return j.next.Helo(name, m)
+	})
+}
+
+func (j *journalMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	j.sender, j.inMessage = from, true
+	return j.record("MailFrom", m, func() (Response, error) {
+		return j.next.MailFrom(from, m)
+	})
+}
+
+func (j *journalMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	resp, err := j.record("RcptTo", m, func() (Response, error) {
+		return j.next.RcptTo(rcptTo, m)
+	})
+	if err == nil && (resp == nil || resp.Continue()) {
+		j.recipients = append(j.recipients, rcptTo)
+	}
+	return resp, err
+}
+
+func (j *journalMilter) Data(m *Modifier) (Response, error) {
+	return j.record("Data", m, func() (Response, error) {
+		return j.next.Data(m)
+	})
+}
+
+func (j *journalMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	return j.record("Header", m, func() (Response, error) {
+		return j.next.Header(name, value, m)
+	})
+}
+
+func (j *journalMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return j.record("Headers", m, func() (Response, error) {
+		return j.next.Headers(h, m)
+	})
+}
+
+func (j *journalMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	return j.record("BodyChunk", m, func() (Response, error) {
+		return j.next.BodyChunk(chunk, m)
+	})
+}
+
+func (j *journalMilter) Body(m *Modifier) (Response, error) {
+	return j.record("Body", m, func() (Response, error) {
+		return j.next.Body(m)
+	})
+}
+
+func (j *journalMilter) Abort(m *Modifier) error {
+	return j.next.Abort(m)
+}
+
+func (j *journalMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	return j.record("Unknown", m, func() (Response, error) {
+		return j.next.Unknown(cmd, m)
+	})
+}
+
+func (j *journalMilter) MessageReset() {
+	j.flush()
+	j.sender, j.recipients, j.queueID, j.inMessage = "", nil, "", false
+	ResetMessage(j.next)
+}
+
+func (j *journalMilter) ConnectionReset() {
+	j.flush()
+	j.client = ""
+	ResetConnection(j.next)
+}
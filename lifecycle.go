@@ -0,0 +1,75 @@
+package milter
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// SessionOption configures a session created by NewSession
+type SessionOption func(*MilterSession)
+
+// WithInit makes the session use the milter and options returned by init
+func WithInit(init MilterInit) SessionOption {
+	return func(s *MilterSession) {
+		s.Milter, s.Actions, s.Protocol = init()
+	}
+}
+
+// WithMilter makes the session use milter m with negotiation actions and
+// protocol flags
+func WithMilter(m Milter, actions, protocol uint32) SessionOption {
+	return func(s *MilterSession) {
+		s.Milter, s.Actions, s.Protocol = m, actions, protocol
+	}
+}
+
+// WithConfig applies configure to the session, for example to set limits
+func WithConfig(configure func(*MilterSession)) SessionOption {
+	return func(s *MilterSession) {
+		configure(s)
+	}
+}
+
+// NewSession returns a session serving the milter protocol over rw, which may
+// be any stream such as an in-memory pipe, a forwarded SSH channel or a custom
+// tunnel. Sessions served by Server are created the same way.
+func NewSession(rw io.ReadWriteCloser, opts ...SessionOption) *MilterSession {
+	s := &MilterSession{Sock: rw, SessionID: newSessionID()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.Milter == nil {
+		s.Milter = NoOpMilter{}
+	}
+	return s
+}
+
+// Run serves the session until the MTA ends it or ctx is done, the stream is
+// closed when Run returns. The session context seen by goroutines started with
+// Modifier.Go is derived from ctx. A regular end of the session returns nil,
+// ctx ending it returns the context error.
+func (m *MilterSession) Run(ctx context.Context) (err error) {
+	m.ctxOnce.Do(func() {
+		m.ctx, m.cancel = context.WithCancel(ctx)
+	})
+	// closing the stream interrupts a pending read
+	stop := context.AfterFunc(ctx, func() {
+		m.Sock.Close()
+	})
+	defer stop()
+	m.hooks().OnSessionStart(m.SessionID)
+	defer func() {
+		m.hooks().OnSessionEnd(m.SessionID, err)
+	}()
+
+	err = m.Serve()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var closedErr *SessionClosedError
+	if errors.As(err, &closedErr) && (errors.Is(err, io.EOF) || errors.Is(err, ECloseSession)) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package milter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ParseSocketSpec converts a socket specification in milter syntax to network
+// and address suitable for net.Listen and net.Dial
+//
+// Accepted forms are inet:port@host, inet6:port@host, unix:path and local:path;
+// a spec without a prefix is a unix socket path. The host of inet specs may be
+// omitted to use all addresses and IPv6 hosts may be enclosed in brackets.
+func ParseSocketSpec(spec string) (network, address string, err error) {
+	proto, rest, found := strings.Cut(spec, ":")
+	if !found {
+		proto, rest = "unix", spec
+	}
+	switch strings.ToLower(proto) {
+	case "unix", "local":
+		if rest == "" {
+			return "", "", fmt.Errorf("%w: %q has no path", ESocketSpec, spec)
+		}
+		return "unix", rest, nil
+	case "inet", "inet6":
+		port, host, _ := strings.Cut(rest, "@")
+		if port == "" {
+			return "", "", fmt.Errorf("%w: %q has no port", ESocketSpec, spec)
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		network = "tcp4"
+		if strings.ToLower(proto) == "inet6" {
+			network = "tcp6"
+		}
+		return network, net.JoinHostPort(host, port), nil
+	}
+	return "", "", fmt.Errorf("%w: unknown protocol %q", ESocketSpec, proto)
+}
+
+// Listen announces on the socket described by spec in milter syntax, see
+// ParseSocketSpec
+func Listen(spec string) (net.Listener, error) {
+	network, address, err := ParseSocketSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(network, address)
+}
+
+// ListenTLS announces on the socket described by spec like Listen and serves
+// TLS with config on accepted connections, for MTAs connecting over untrusted
+// networks
+func ListenTLS(spec string, config *tls.Config) (net.Listener, error) {
+	listener, err := Listen(spec)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, config), nil
+}
+
+// MutualTLSConfig returns a TLS configuration serving the certificate and key
+// of certFile and keyFile which only accepts MTAs presenting a client
+// certificate signed by a CA in caFile, all files are PEM encoded
+func MutualTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: no certificates in %s", ETLSConfig, caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,74 @@
+package milter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Logger receives the log messages of sessions and servers, *log.Logger
+// implements it. Messages about failures start with "Error".
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// DiscardLogger drops all messages, for example to silence tests
+var DiscardLogger Logger = log.New(io.Discard, "", 0)
+
+// SlogLogger adapts l to Logger, messages about failures are logged at error
+// level and all others at info level
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+// slogLogger implements Logger with a structured logger
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (s slogLogger) Printf(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	level := slog.LevelInfo
+	if strings.HasPrefix(msg, "Error") {
+		level = slog.LevelError
+	}
+	s.logger.Log(context.Background(), level, msg)
+}
+
+// LoggerOrDefault returns logger, or the standard logger if it is nil, for
+// Logger fields of middleware
+func LoggerOrDefault(logger Logger) Logger {
+	if logger == nil {
+		return log.Default()
+	}
+	return logger
+}
+
+// logf logs through the Logger of the session, tagged with the session or
+// message id
+func (m *MilterSession) logf(format string, v ...any) {
+	logTagged(m.Logger, m.logID(), format, v)
+}
+
+// Logf logs through the Logger of the session, so that middleware and handlers
+// log where the application routes library messages; messages are tagged with
+// the message id, or the session id outside of messages
+func (m *Modifier) Logf(format string, v ...any) {
+	id := m.messageID
+	if id == "" {
+		id = m.sessionID
+	}
+	logTagged(m.logger, id, format, v)
+}
+
+// logTagged logs a message with id appended, if any
+func logTagged(logger Logger, id, format string, v []any) {
+	if id != "" {
+		format += " [%s]"
+		v = append(v[:len(v):len(v)], id)
+	}
+	LoggerOrDefault(logger).Printf(format, v...)
+}
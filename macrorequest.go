@@ -0,0 +1,35 @@
+package milter
+
+import (
+	"strings"
+)
+
+// MacroRequests lists the macros a milter wants the MTA to send at each stage,
+// nil lists keep the macros configured in the MTA. Requests require protocol
+// version 6 and are dropped if the MTA does not offer OptSetSymList.
+type MacroRequests struct {
+	Connect  []string
+	Helo     []string
+	MailFrom []string
+	RcptTo   []string
+	Data     []string
+	EOH      []string
+	EOM      []string
+}
+
+// stages returns macro lists by SMFIM_* stage number
+func (r *MacroRequests) stages() map[uint32]string {
+	lists := map[uint32]string{}
+	// stages are numbered in this order, end of headers was added last
+	for stage, names := range [][]string{r.Connect, r.Helo, r.MailFrom, r.RcptTo, r.Data, r.EOM, r.EOH} {
+		if names != nil {
+			lists[uint32(stage)] = strings.Join(names, " ")
+		}
+	}
+	return lists
+}
+
+// empty returns true if no stage has a list
+func (r *MacroRequests) empty() bool {
+	return r == nil || len(r.stages()) == 0
+}
@@ -1,16 +1,116 @@
 package milter
 
+import (
+	"fmt"
+)
+
+// Code identifies a milter command or response
+type Code byte
+
 // Message represents a command sent from milter client
 type Message struct {
-	Code byte
+	Code Code
 	Data []byte
 }
 
+// Define milter command codes (SMFIC_*)
+const (
+	CmdAbort   Code = 'A'
+	CmdBody    Code = 'B'
+	CmdConnect Code = 'C'
+	CmdMacro   Code = 'D'
+	CmdEOB     Code = 'E'
+	CmdHelo    Code = 'H'
+	CmdQuitNC  Code = 'K'
+	CmdHeader  Code = 'L'
+	CmdMail    Code = 'M'
+	CmdEOH     Code = 'N'
+	CmdOptNeg  Code = 'O'
+	CmdQuit    Code = 'Q'
+	CmdRcpt    Code = 'R'
+	CmdData    Code = 'T'
+	CmdUnknown Code = 'U'
+)
+
+// Define milter response codes (SMFIR_*)
+const (
+	ActAddRcpt    Code = '+'
+	ActDelRcpt    Code = '-'
+	ActAddRcptPar Code = '2'
+	ActShutdown   Code = '4'
+	ActAccept     Code = 'a'
+	ActReplBody   Code = 'b'
+	ActContinue   Code = 'c'
+	ActDiscard    Code = 'd'
+	ActChgFrom    Code = 'e'
+	ActConnFail   Code = 'f'
+	ActAddHeader  Code = 'h'
+	ActInsHeader  Code = 'i'
+	ActSetSymList Code = 'l'
+	ActChgHeader  Code = 'm'
+	ActOptNeg     Code = 'O'
+	ActProgress   Code = 'p'
+	ActQuarantine Code = 'q'
+	ActReject     Code = 'r'
+	ActSkip       Code = 's'
+	ActTempFail   Code = 't'
+	ActReplyCode  Code = 'y'
+)
+
 // Define milter response codes
 const (
-	Accept   = 'a'
-	Continue = 'c'
-	Discard  = 'd'
-	Reject   = 'r'
-	TempFail = 't'
+	Accept   = ActAccept
+	Continue = ActContinue
+	Discard  = ActDiscard
+	Reject   = ActReject
+	Skip     = ActSkip
+	TempFail = ActTempFail
 )
+
+// codeNames maps codes to protocol names, option negotiation is the only code
+// shared by commands and responses
+var codeNames = map[Code]string{
+	CmdAbort:      "SMFIC_ABORT",
+	CmdBody:       "SMFIC_BODY",
+	CmdConnect:    "SMFIC_CONNECT",
+	CmdMacro:      "SMFIC_MACRO",
+	CmdEOB:        "SMFIC_BODYEOB",
+	CmdHelo:       "SMFIC_HELO",
+	CmdQuitNC:     "SMFIC_QUIT_NC",
+	CmdHeader:     "SMFIC_HEADER",
+	CmdMail:       "SMFIC_MAIL",
+	CmdEOH:        "SMFIC_EOH",
+	CmdOptNeg:     "SMFIC_OPTNEG",
+	CmdQuit:       "SMFIC_QUIT",
+	CmdRcpt:       "SMFIC_RCPT",
+	CmdData:       "SMFIC_DATA",
+	CmdUnknown:    "SMFIC_UNKNOWN",
+	ActAddRcpt:    "SMFIR_ADDRCPT",
+	ActDelRcpt:    "SMFIR_DELRCPT",
+	ActAddRcptPar: "SMFIR_ADDRCPT_PAR",
+	ActShutdown:   "SMFIR_SHUTDOWN",
+	ActAccept:     "SMFIR_ACCEPT",
+	ActReplBody:   "SMFIR_REPLBODY",
+	ActContinue:   "SMFIR_CONTINUE",
+	ActDiscard:    "SMFIR_DISCARD",
+	ActChgFrom:    "SMFIR_CHGFROM",
+	ActConnFail:   "SMFIR_CONN_FAIL",
+	ActAddHeader:  "SMFIR_ADDHEADER",
+	ActInsHeader:  "SMFIR_INSHEADER",
+	ActSetSymList: "SMFIR_SETSYMLIST",
+	ActChgHeader:  "SMFIR_CHGHEADER",
+	ActProgress:   "SMFIR_PROGRESS",
+	ActQuarantine: "SMFIR_QUARANTINE",
+	ActReject:     "SMFIR_REJECT",
+	ActSkip:       "SMFIR_SKIP",
+	ActTempFail:   "SMFIR_TEMPFAIL",
+	ActReplyCode:  "SMFIR_REPLYCODE",
+}
+
+// String returns protocol name of code
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%q)", byte(c))
+}
@@ -0,0 +1,249 @@
+package milter
+
+import (
+	"net"
+	"net/textproto"
+)
+
+// Middleware wraps a milter in another milter adding behaviour around callbacks
+type Middleware func(next Milter) Milter
+
+// Chain wraps next in middlewares, the first middleware is called first
+func Chain(next Milter, middlewares ...Middleware) Milter {
+	inner := next
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		next = middlewares[i](next)
+	}
+	// middlewares hide the negotiation of the milter they wrap
+	if negotiator, ok := inner.(Negotiator); ok {
+		if _, ok := next.(Negotiator); !ok {
+			next = &negotiatingMilter{next, negotiator}
+		}
+	}
+	return next
+}
+
+// negotiatingMilter adds the Negotiator of a wrapped milter to a chain
+type negotiatingMilter struct {
+	Milter
+	negotiator Negotiator
+}
+
+func (n *negotiatingMilter) Negotiate(mtaActions, mtaProtocol uint32) (uint32, uint32) {
+	return n.negotiator.Negotiate(mtaActions, mtaProtocol)
+}
+
+// RawHeader passes raw headers on as the session would
+func (n *negotiatingMilter) RawHeader(name, value []byte, m *Modifier) (Response, error) {
+	if handler, ok := n.Milter.(RawHeaderHandler); ok {
+		return handler.RawHeader(name, value, m)
+	}
+	return n.Milter.Header(string(name), string(value), m)
+}
+
+func (n *negotiatingMilter) MessageReset() {
+	ResetMessage(n.Milter)
+}
+
+func (n *negotiatingMilter) ConnectionReset() {
+	ResetConnection(n.Milter)
+}
+
+// NoOpMilter continues at every stage and accepts every message, it is the end
+// of middleware chains and may be embedded to implement only some callbacks
+type NoOpMilter struct{}
+
+func (NoOpMilter) Connect(string, string, uint16, net.IP, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) Helo(string, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) MailFrom(string, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) RcptTo(string, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) Data(*Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) Header(string, string, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) Headers(textproto.MIMEHeader, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) BodyChunk([]byte, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) Body(*Modifier) (Response, error) {
+	return RespAccept, nil
+}
+
+func (NoOpMilter) Abort(*Modifier) error {
+	return nil
+}
+
+func (NoOpMilter) Unknown(string, *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+// ConnectCheck decides on a new connection before the wrapped milter sees it
+type ConnectCheck func(host string, family string, port uint16, addr net.IP) Response
+
+// ConnectFilter returns middleware which ends connections refused by check; a
+// delayed continue response passes the connection on and delays the response
+// of the wrapped milter instead
+func ConnectFilter(check ConnectCheck) Middleware {
+	return func(next Milter) Milter {
+		return &connectFilter{Milter: next, check: check}
+	}
+}
+
+// connectFilter applies ConnectCheck to a single session
+type connectFilter struct {
+	Milter
+	check ConnectCheck
+}
+
+// Connect runs check before the wrapped milter
+func (c *connectFilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	resp := c.check(host, family, port, addr)
+	if !resp.Continue() {
+		return resp, nil
+	}
+	next, err := c.Milter.Connect(host, family, port, addr, m)
+	if delayed, ok := resp.(*DelayedResponse); ok && err == nil {
+		return &DelayedResponse{Reply: next, Delay: delayed.Delay, Context: delayed.Context}, nil
+	}
+	return next, err
+}
+
+// MessageReset passes the call on to the wrapped milter
+func (c *connectFilter) MessageReset() {
+	ResetMessage(c.Milter)
+}
+
+// ConnectionReset passes the call on to the wrapped milter
+func (c *connectFilter) ConnectionReset() {
+	ResetConnection(c.Milter)
+}
+
+// LogCallbacks returns middleware which logs every callback and its response to
+// logger, or the Logger of the session if logger is nil
+func LogCallbacks(logger Logger) Middleware {
+	return func(next Milter) Milter {
+		return &callbackLogger{next, logger}
+	}
+}
+
+// callbackLogger logs callbacks of a single session
+type callbackLogger struct {
+	next   Milter
+	logger Logger
+}
+
+// printf logs to the configured logger or through the session of m
+func (c *callbackLogger) printf(m *Modifier, format string, v ...any) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
+		return
+	}
+	m.Logf(format, v...)
+}
+
+// log logs callback result and passes it on
+func (c *callbackLogger) log(m *Modifier, callback string, arg any, resp Response, err error) (Response, error) {
+	switch {
+	case err != nil:
+		c.printf(m, "Error in milter %s %v: %v", callback, arg, err)
+	case resp != nil:
+		c.printf(m, "milter %s %v: %v", callback, arg, resp.Response())
+	}
+	return resp, err
+}
+
+func (c *callbackLogger) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	resp, err := c.next.Connect(host, family, port, addr, m)
+	return c.log(m, "Connect", host+" ["+addr.String()+"]", resp, err)
+}
+
+func (c *callbackLogger) Helo(name string, m *Modifier) (Response, error) {
+	resp, err := c.next.Helo(name, m)
+	return c.log(m, "Helo", name, resp, err)
+}
+
+func (c *callbackLogger) MailFrom(from string, m *Modifier) (Response, error) {
+	resp, err := c.next.MailFrom(from, m)
+	return c.log(m, "MailFrom", from, resp, err)
+}
+
+func (c *callbackLogger) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	resp, err := c.next.RcptTo(rcptTo, m)
+	return c.log(m, "RcptTo", rcptTo, resp, err)
+}
+
+func (c *callbackLogger) Data(m *Modifier) (Response, error) {
+	resp, err := c.next.Data(m)
+	return c.log(m, "Data", m.Macros["i"], resp, err)
+}
+
+func (c *callbackLogger) Header(name string, value string, m *Modifier) (Response, error) {
+	// headers are not logged individually, refusals still are
+	resp, err := c.next.Header(name, value, m)
+	if err == nil && resp.Continue() {
+		return resp, nil
+	}
+	return c.log(m, "Header", name, resp, err)
+}
+
+func (c *callbackLogger) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	resp, err := c.next.Headers(h, m)
+	return c.log(m, "Headers", len(h), resp, err)
+}
+
+func (c *callbackLogger) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	// chunks are not logged individually, refusals still are
+	resp, err := c.next.BodyChunk(chunk, m)
+	if err == nil && resp.Continue() {
+		return resp, nil
+	}
+	return c.log(m, "BodyChunk", len(chunk), resp, err)
+}
+
+func (c *callbackLogger) Body(m *Modifier) (Response, error) {
+	resp, err := c.next.Body(m)
+	return c.log(m, "Body", m.Macros["i"], resp, err)
+}
+
+func (c *callbackLogger) Abort(m *Modifier) error {
+	err := c.next.Abort(m)
+	if err != nil {
+		c.printf(m, "Error in milter Abort %v: %v", m.Macros["i"], err)
+	} else {
+		c.printf(m, "milter Abort %v", m.Macros["i"])
+	}
+	return err
+}
+
+func (c *callbackLogger) Unknown(cmd string, m *Modifier) (Response, error) {
+	resp, err := c.next.Unknown(cmd, m)
+	return c.log(m, "Unknown", cmd, resp, err)
+}
+
+func (c *callbackLogger) MessageReset() {
+	ResetMessage(c.next)
+}
+
+func (c *callbackLogger) ConnectionReset() {
+	ResetConnection(c.next)
+}
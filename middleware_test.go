@@ -0,0 +1,64 @@
+package milter_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+)
+
+// recordingLogger keeps logged messages
+type recordingLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) Printf(format string, v ...any) {
+	r.mutex.Lock()
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+	r.mutex.Unlock()
+}
+
+func (r *recordingLogger) logged(s string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, line := range r.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogCallbacks(t *testing.T) {
+	tests := []struct {
+		name string
+		// explicit passes a logger to LogCallbacks, otherwise the session logs
+		explicit bool
+	}{
+		{"session logger", false},
+		{"explicit logger", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, explicit := &recordingLogger{}, &recordingLogger{}
+			var logger milter.Logger
+			if test.explicit {
+				logger = explicit
+			}
+			inner := milter.LogCallbacks(logger)(milter.NoOpMilter{})
+			c := pipeSession(t, milter.WithMilter(inner, 0, 0), milter.WithConfig(func(s *milter.MilterSession) {
+				s.Logger = session
+			}))
+			send(t, c, milter.CmdMail, mailFrom("a@example.com"))
+			if got := explicit.logged("milter MailFrom a@example.com"); got != test.explicit {
+				t.Fatalf("explicit logger used %v, want %v", got, test.explicit)
+			}
+			if got := session.logged("milter MailFrom a@example.com"); got == test.explicit {
+				t.Fatalf("session logger used %v, want %v", got, !test.explicit)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package milteradmin serves an HTTP admin interface for a milter server
+//
+// Endpoints exchange JSON:
+//
+//	GET  /stats                             active and leaking session counts
+//	GET  /sessions                          running sessions
+//	POST /sessions/kill?id=N                terminate session N
+//	GET  /accounting                        verdict and modification counters
+//	GET  /breakers                          circuit breaker states
+//	GET  /flags                             feature flags and their counters
+//	POST /flags?name=NAME&enabled=BOOL      switch feature flag NAME
+//	GET  /lists                             allow and deny list entries
+//	POST /lists                             add list entry given as JSON body
+//	DELETE /lists?kind=KIND&pattern=PATTERN remove list entry
+//	GET  /quarantine                        quarantined messages
+//	POST /quarantine/release?id=ID          re-inject quarantined message ID
+//	DELETE /quarantine?id=ID                drop quarantined message ID
+//	GET  /trim                              reclaimed resource counters
+//	POST /trim                              trim idle resources now
+//
+// The handler performs no authentication and must only be reachable by
+// administrators, for example on a loopback address.
+package milteradmin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterlist"
+	"github.com/phalaaxx/milter/milterquarantine"
+)
+
+// Handler serves the admin interface of Server and optionally Accounting,
+// Breakers, Flags, Lists, Quarantine and Janitor
+type Handler struct {
+	Server     *milter.Server
+	Accounting *milter.Accounting
+	Breakers   []*milter.Breaker
+	Flags      *milter.Flags
+	Lists      *milterlist.List
+	Quarantine *milterquarantine.Quarantine
+	Janitor    *milter.Janitor
+	// Logger receives the changes made through the interface, nil means the
+	// standard logger
+	Logger milter.Logger
+}
+
+// session is the JSON view of milter.SessionInfo
+type session struct {
+	ID           uint64 `json:"id"`
+	Peer         string `json:"peer"`
+	Client       string `json:"client,omitempty"`
+	SessionID    string `json:"session_id,omitempty"`
+	MessageID    string `json:"message_id,omitempty"`
+	QueueID      string `json:"queue_id,omitempty"`
+	Stage        string `json:"stage,omitempty"`
+	Started      string `json:"started"`
+	Age          string `json:"age"`
+	BytesRead    int64  `json:"bytes_read"`
+	BytesWritten int64  `json:"bytes_written"`
+	Goroutines   int64  `json:"goroutines"`
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/stats" && r.Method == http.MethodGet:
+		h.reply(w, map[string]uint64{"active": uint64(h.Server.Active()), "leaked": h.Server.Leaks()})
+	case r.URL.Path == "/sessions" && r.Method == http.MethodGet:
+		h.sessions(w)
+	case r.URL.Path == "/sessions/kill" && r.Method == http.MethodPost:
+		h.kill(w, r)
+	case r.URL.Path == "/accounting" && h.Accounting == nil:
+		http.NotFound(w, r)
+	case r.URL.Path == "/accounting" && r.Method == http.MethodGet:
+		h.accounting(w)
+	case r.URL.Path == "/breakers" && r.Method == http.MethodGet:
+		h.breakers(w)
+	case r.URL.Path == "/flags" && h.Flags == nil:
+		http.NotFound(w, r)
+	case r.URL.Path == "/flags" && r.Method == http.MethodGet:
+		h.reply(w, h.Flags.Stats())
+	case r.URL.Path == "/flags" && r.Method == http.MethodPost:
+		h.setFlag(w, r)
+	case r.URL.Path == "/lists" && h.Lists == nil:
+		http.NotFound(w, r)
+	case r.URL.Path == "/lists" && r.Method == http.MethodGet:
+		h.reply(w, h.Lists.Entries())
+	case r.URL.Path == "/lists" && r.Method == http.MethodPost:
+		h.addEntry(w, r)
+	case r.URL.Path == "/lists" && r.Method == http.MethodDelete:
+		h.removeEntry(w, r)
+	case strings.HasPrefix(r.URL.Path, "/quarantine") && h.Quarantine == nil:
+		http.NotFound(w, r)
+	case r.URL.Path == "/quarantine" && r.Method == http.MethodGet:
+		h.quarantined(w, r)
+	case r.URL.Path == "/quarantine" && r.Method == http.MethodDelete:
+		h.release(w, r, false)
+	case r.URL.Path == "/quarantine/release" && r.Method == http.MethodPost:
+		h.release(w, r, true)
+	case r.URL.Path == "/trim" && h.Janitor == nil:
+		http.NotFound(w, r)
+	case r.URL.Path == "/trim" && r.Method == http.MethodGet:
+		h.reply(w, h.Janitor.Stats())
+	case r.URL.Path == "/trim" && r.Method == http.MethodPost:
+		milter.LoggerOrDefault(h.Logger).Printf("Trimmed %d bytes of idle resources from admin interface", h.Janitor.Trim())
+		h.reply(w, h.Janitor.Stats())
+	case r.URL.Path == "/stats", r.URL.Path == "/sessions", r.URL.Path == "/sessions/kill",
+		r.URL.Path == "/accounting", r.URL.Path == "/breakers", r.URL.Path == "/flags",
+		r.URL.Path == "/lists", r.URL.Path == "/quarantine", r.URL.Path == "/quarantine/release",
+		r.URL.Path == "/trim":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sessions lists running sessions
+func (h *Handler) sessions(w http.ResponseWriter) {
+	now := time.Now()
+	infos := h.Server.Sessions()
+	sessions := make([]session, len(infos))
+	for i, info := range infos {
+		sessions[i] = session{
+			ID:           info.ID,
+			Peer:         info.Peer,
+			Client:       info.Client,
+			SessionID:    info.SessionID,
+			MessageID:    info.MessageID,
+			QueueID:      info.QueueID,
+			Started:      info.Started.Format(time.RFC3339),
+			Age:          now.Sub(info.Started).Round(time.Second).String(),
+			BytesRead:    info.BytesRead,
+			BytesWritten: info.BytesWritten,
+			Goroutines:   info.Goroutines,
+		}
+		if info.Stage != 0 {
+			sessions[i].Stage = info.Stage.String()
+		}
+	}
+	h.reply(w, sessions)
+}
+
+// accounting reports accounting counters with codes by name
+func (h *Handler) accounting(w http.ResponseWriter) {
+	stats := h.Accounting.Stats()
+	named := func(counts map[milter.Code]uint64) map[string]uint64 {
+		result := make(map[string]uint64, len(counts))
+		for code, n := range counts {
+			result[code.String()] = n
+		}
+		return result
+	}
+	domains := make(map[string]map[string]uint64, len(stats.Domains))
+	for domain, counts := range stats.Domains {
+		domains[domain] = named(counts)
+	}
+	h.reply(w, map[string]any{
+		"verdicts":      named(stats.Verdicts),
+		"modifications": named(stats.Modifications),
+		"rules":         stats.Rules,
+		"domains":       domains,
+	})
+}
+
+// breakers reports circuit breaker states
+func (h *Handler) breakers(w http.ResponseWriter) {
+	type breaker struct {
+		Name     string `json:"name"`
+		State    string `json:"state"`
+		Failures int    `json:"failures"`
+		Opened   uint64 `json:"opened"`
+		Bypassed uint64 `json:"bypassed"`
+	}
+	breakers := make([]breaker, len(h.Breakers))
+	for i, b := range h.Breakers {
+		stats := b.Stats()
+		breakers[i] = breaker{stats.Name, stats.State.String(), stats.Failures, stats.Opened, stats.Bypassed}
+	}
+	h.reply(w, breakers)
+}
+
+// kill terminates a single session
+func (h *Handler) kill(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	if !h.Server.Kill(id) {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	milter.LoggerOrDefault(h.Logger).Printf("Killed milter session %d from admin interface", id)
+	h.reply(w, map[string]uint64{"killed": id})
+}
+
+// setFlag switches a feature flag
+func (h *Handler) setFlag(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	enabled, err := strconv.ParseBool(query.Get("enabled"))
+	if name == "" || err != nil {
+		http.Error(w, "invalid flag name or value", http.StatusBadRequest)
+		return
+	}
+	h.Flags.Set(name, enabled)
+	h.reply(w, h.Flags.Stats())
+}
+
+// addEntry adds an allow or deny list entry
+func (h *Handler) addEntry(w http.ResponseWriter, r *http.Request) {
+	var entry milterlist.Entry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, "invalid list entry", http.StatusBadRequest)
+		return
+	}
+	if err := h.Lists.Add(r.Context(), entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	milter.LoggerOrDefault(h.Logger).Printf("Added %s %s entry %q from admin interface", entry.Action, entry.Kind, entry.Pattern)
+	h.reply(w, h.Lists.Entries())
+}
+
+// removeEntry removes an allow or deny list entry
+func (h *Handler) removeEntry(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	kind, pattern := milterlist.Kind(query.Get("kind")), query.Get("pattern")
+	removed, err := h.Lists.Remove(r.Context(), kind, pattern)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case !removed:
+		http.Error(w, "no such list entry", http.StatusNotFound)
+		return
+	}
+	milter.LoggerOrDefault(h.Logger).Printf("Removed %s entry %q from admin interface", kind, pattern)
+	h.reply(w, h.Lists.Entries())
+}
+
+// quarantined lists quarantined messages
+func (h *Handler) quarantined(w http.ResponseWriter, r *http.Request) {
+	msgs, err := h.Quarantine.List(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.reply(w, msgs)
+}
+
+// release re-injects or drops a quarantined message
+func (h *Handler) release(w http.ResponseWriter, r *http.Request, reinject bool) {
+	id := r.URL.Query().Get("id")
+	var err error
+	if reinject {
+		err = h.Quarantine.Release(r.Context(), id)
+	} else {
+		err = h.Quarantine.Delete(r.Context(), id)
+	}
+	switch {
+	case errors.Is(err, milterquarantine.ENotFound):
+		http.Error(w, "no such quarantined message", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if reinject {
+		h.reply(w, map[string]string{"released": id})
+	} else {
+		milter.LoggerOrDefault(h.Logger).Printf("Dropped quarantined message %s from admin interface", id)
+		h.reply(w, map[string]string{"deleted": id})
+	}
+}
+
+// reply writes value as JSON
+func (h *Handler) reply(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		milter.LoggerOrDefault(h.Logger).Printf("Error writing admin reply: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+// Package milterbench generates load against a milter and measures its performance
+//
+// Run acts as an MTA, opening concurrent connections to the target milter and
+// sending complete messages of configurable size. Latency is measured from
+// writing a command until its reply is read and reported per command, so both
+// library and filter regressions show up at the stage they are introduced.
+package milterbench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterclient"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// chunkSize is the largest body chunk sent in a single packet
+const chunkSize = 65535
+
+// pre-defined errors
+var (
+	EUnexpected = milterclient.EUnexpected
+)
+
+// Config describes generated load
+type Config struct {
+	// Network and Address of the target milter, Network defaults to tcp
+	Network string
+	Address string
+
+	// Concurrency is the number of simultaneous connections, default 1
+	Concurrency int
+	// Messages limits the number of messages sent and Duration the time spent
+	// sending; at least one must be set, whichever is reached first ends the run
+	Messages int
+	Duration time.Duration
+	// Timeout limits waiting for a single reply, zero means no limit
+	Timeout time.Duration
+
+	// BodySize is the size of every message body in bytes
+	BodySize int
+	// Headers and Recipients is the number of headers and recipients per message
+	Headers    int
+	Recipients int
+	// Macros are sent before the command with the same code
+	Macros map[milter.Code][]milterwire.Macro
+}
+
+// Latency summarizes reply latencies of a single command
+type Latency struct {
+	Count int
+	Min   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Report holds the results of a benchmark run
+type Report struct {
+	// Messages counts messages which reached a verdict, Errors failed messages
+	Messages int
+	Errors   int
+	// FirstError is the first error which failed a message
+	FirstError error
+	Elapsed    time.Duration
+	// Verdicts counts final replies by response code
+	Verdicts map[milter.Code]int
+	// Stages holds reply latency per command code
+	Stages map[milter.Code]Latency
+}
+
+// Throughput returns the number of completed messages per second
+func (r *Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Messages) / r.Elapsed.Seconds()
+}
+
+// Print writes a human readable summary of report to w
+func (r *Report) Print(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "messages %d, errors %d, elapsed %v, %.1f msg/s\n",
+		r.Messages, r.Errors, r.Elapsed.Round(time.Millisecond), r.Throughput())
+	if r.FirstError != nil {
+		fmt.Fprintf(&b, "first error: %v\n", r.FirstError)
+	}
+	codes := make([]milter.Code, 0, len(r.Verdicts))
+	for code := range r.Verdicts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, code := range codes {
+		fmt.Fprintf(&b, "verdict %-16v %d\n", code, r.Verdicts[code])
+	}
+	// stages are listed in protocol order
+	for _, code := range order {
+		l, ok := r.Stages[code]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "stage %-16v n=%d min=%v mean=%v p50=%v p90=%v p99=%v max=%v\n",
+			code, l.Count, l.Min, l.Mean, l.P50, l.P90, l.P99, l.Max)
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// order lists commands in the order they are sent
+var order = []milter.Code{
+	milter.CmdOptNeg, milter.CmdConnect, milter.CmdHelo, milter.CmdMail, milter.CmdRcpt,
+	milter.CmdHeader, milter.CmdEOH, milter.CmdBody, milter.CmdEOB,
+}
+
+// recorder collects results from all workers
+type recorder struct {
+	mutex     sync.Mutex
+	report    Report
+	latencies map[milter.Code][]time.Duration
+}
+
+// message describes a single pre-encoded message
+type message struct {
+	code milter.Code
+	data []byte
+}
+
+// Run generates configured load until message or time limit is reached or ctx is
+// cancelled; failed messages are counted in report, an error is returned only
+// for invalid configuration
+func Run(ctx context.Context, config Config) (*Report, error) {
+	if config.Address == "" {
+		return nil, errors.New("Missing milter address")
+	}
+	if config.Messages <= 0 && config.Duration <= 0 {
+		return nil, errors.New("Missing message or duration limit")
+	}
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Duration)
+		defer cancel()
+	}
+
+	// every message sends the same commands
+	commands := build(&config)
+	rec := &recorder{
+		report:    Report{Verdicts: make(map[milter.Code]int), Stages: make(map[milter.Code]Latency)},
+		latencies: make(map[milter.Code][]time.Duration),
+	}
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if config.Messages > 0 && sent.Add(1) > int64(config.Messages) {
+					return
+				}
+				rec.run(ctx, &config, commands)
+			}
+		}()
+	}
+	wg.Wait()
+	rec.report.Elapsed = time.Since(start)
+
+	// summarize latencies
+	for code, values := range rec.latencies {
+		rec.report.Stages[code] = summarize(values)
+	}
+	return &rec.report, nil
+}
+
+// build encodes commands of a message according to config
+func build(config *Config) []message {
+	commands := []message{
+		{milter.CmdConnect, (&milterwire.Connect{Hostname: "bench.example", Family: '4', Port: 25, Address: "192.0.2.1"}).Encode()},
+		{milter.CmdHelo, milterwire.EncodeStrings("bench.example")},
+		{milter.CmdMail, milterwire.EncodeAddress("<sender@bench.example>")},
+	}
+	for i := 0; i < max(config.Recipients, 1); i++ {
+		addr := fmt.Sprintf("<rcpt%d@bench.example>", i)
+		commands = append(commands, message{milter.CmdRcpt, milterwire.EncodeAddress(addr)})
+	}
+	commands = append(commands,
+		message{milter.CmdHeader, milterwire.EncodeHeader("From", "sender@bench.example")},
+		message{milter.CmdHeader, milterwire.EncodeHeader("Subject", "benchmark")},
+	)
+	for i := 0; i < config.Headers-2; i++ {
+		name := fmt.Sprintf("X-Bench-%d", i)
+		commands = append(commands, message{milter.CmdHeader, milterwire.EncodeHeader(name, "value")})
+	}
+	commands = append(commands, message{milter.CmdEOH, nil})
+	// body consists of fixed length lines
+	line := []byte("The quick brown fox jumps over the lazy dog 0123456789\r\n")
+	body := bytes.Repeat(line, config.BodySize/len(line)+1)[:config.BodySize]
+	for len(body) != 0 {
+		n := min(len(body), chunkSize)
+		commands = append(commands, message{milter.CmdBody, body[:n]})
+		body = body[n:]
+	}
+	return append(commands, message{milter.CmdEOB, nil})
+}
+
+// run sends a single message over a new connection and records the results
+func (r *recorder) run(ctx context.Context, config *Config, commands []message) {
+	latencies := make(map[milter.Code][]time.Duration)
+	verdict, err := send(ctx, config, commands, latencies)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		// messages interrupted by the end of a run are not failures
+		if ctx.Err() != nil {
+			return
+		}
+		r.report.Errors++
+		if r.report.FirstError == nil {
+			r.report.FirstError = err
+		}
+		return
+	}
+	r.report.Messages++
+	r.report.Verdicts[verdict]++
+	for code, values := range latencies {
+		r.latencies[code] = append(r.latencies[code], values...)
+	}
+}
+
+// send runs one milter session and returns the final reply
+func send(ctx context.Context, config *Config, commands []message, latencies map[milter.Code][]time.Duration) (milter.Code, error) {
+	c, err := milterclient.Dial(ctx, config.Network, config.Address)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.Timeout = config.Timeout
+	// unblock pending reads when run ends
+	stop := context.AfterFunc(ctx, func() { c.Conn().SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	start := time.Now()
+	// offer all actions and protocol steps
+	if _, err := c.Negotiate(milterwire.OptNeg{Version: 2, Actions: 0x3f, Protocol: 0x7f}); err != nil {
+		return 0, err
+	}
+	latencies[milter.CmdOptNeg] = append(latencies[milter.CmdOptNeg], time.Since(start))
+
+	verdict := milter.ActContinue
+	for _, cmd := range commands {
+		if c.Skips(cmd.code) {
+			continue
+		}
+		if macros, ok := config.Macros[cmd.code]; ok {
+			if err := c.Write(milter.CmdMacro, milterwire.EncodeMacros(byte(cmd.code), macros)); err != nil {
+				return 0, err
+			}
+		}
+		start := time.Now()
+		reply, err := c.Send(cmd.code, cmd.data)
+		if err != nil {
+			return 0, err
+		}
+		verdict = reply.Code
+		latencies[cmd.code] = append(latencies[cmd.code], time.Since(start))
+		// refused recipients and skipped bodies do not end the message
+		if verdict != milter.ActContinue && verdict != milter.ActSkip && cmd.code != milter.CmdRcpt {
+			break
+		}
+	}
+	// session ends after a verdict, a failed quit does not affect results
+	c.Write(milter.CmdQuit, nil)
+	return verdict, nil
+}
+
+// summarize computes latency statistics
+func summarize(values []time.Duration) Latency {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	var total time.Duration
+	for _, value := range values {
+		total += value
+	}
+	percentile := func(p int) time.Duration {
+		return values[(len(values)-1)*p/100]
+	}
+	return Latency{
+		Count: len(values),
+		Min:   values[0],
+		Mean:  total / time.Duration(len(values)),
+		P50:   percentile(50),
+		P90:   percentile(90),
+		P99:   percentile(99),
+		Max:   values[len(values)-1],
+	}
+}
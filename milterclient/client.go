@@ -0,0 +1,178 @@
+// Package milterclient implements the MTA side of the milter protocol
+//
+// Client sends commands to a milter and reads its replies, it is used by tools
+// exercising milters such as load generators and conformance checks. It leaves
+// deciding which commands to send to the caller.
+package milterclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// pre-defined errors
+var (
+	EUnexpected = errors.New("Unexpected milter response")
+)
+
+// Reply is the response of a milter to a single command
+type Reply struct {
+	Code milter.Code
+	Data []byte
+	// Modifications holds modification and progress packets preceding the
+	// response to end of body
+	Modifications []*milter.Message
+}
+
+// Client drives a single milter connection acting as the MTA
+type Client struct {
+	// Timeout limits every read and write, zero means no limit
+	Timeout time.Duration
+
+	conn       net.Conn
+	negotiated milterwire.OptNeg
+	readBuf    []byte
+}
+
+// New returns client using conn
+func New(conn net.Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Dial connects to the milter at address
+func Dial(ctx context.Context, network, address string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// Conn returns the underlying connection
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Write writes a command without waiting for reply
+func (c *Client) Write(code milter.Code, data []byte) error {
+	if c.Timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	}
+	return milterwire.WriteFrame(c.conn, byte(code), data)
+}
+
+// Read reads a single packet, data is valid until the next read
+func (c *Client) Read() (milter.Code, []byte, error) {
+	if c.Timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	}
+	code, data, buf, err := milterwire.ReadFrameBuffer(c.conn, c.readBuf, 0)
+	c.readBuf = buf
+	return milter.Code(code), data, err
+}
+
+// modification returns true if code is a packet a milter may send before its
+// response to end of body
+func modification(code milter.Code) bool {
+	switch code {
+	case milter.ActAddRcpt, milter.ActDelRcpt, milter.ActAddRcptPar, milter.ActReplBody,
+		milter.ActChgFrom, milter.ActAddHeader, milter.ActInsHeader, milter.ActChgHeader,
+		milter.ActQuarantine, milter.ActProgress:
+		return true
+	}
+	return false
+}
+
+// Send writes a command and waits for the milter reply, modifications sent to
+// any command other than end of body fail with EUnexpected. Commands the milter
+// does not reply to get a continue reply without waiting.
+func (c *Client) Send(code milter.Code, data []byte) (*Reply, error) {
+	if err := c.Write(code, data); err != nil {
+		return nil, err
+	}
+	if c.NoReply(code) {
+		return &Reply{Code: milter.ActContinue}, nil
+	}
+	reply := &Reply{}
+	for {
+		resp, data, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if modification(resp) {
+			if code != milter.CmdEOB && resp != milter.ActProgress {
+				return nil, fmt.Errorf("%w %v to %v", EUnexpected, resp, code)
+			}
+			reply.Modifications = append(reply.Modifications, &milter.Message{Code: resp, Data: append([]byte(nil), data...)})
+			continue
+		}
+		reply.Code, reply.Data = resp, append([]byte(nil), data...)
+		return reply, nil
+	}
+}
+
+// Negotiate sends option negotiation offer and returns the options requested
+// by the milter, later calls to Skips use them
+func (c *Client) Negotiate(offer milterwire.OptNeg) (*milterwire.OptNeg, error) {
+	if err := c.Write(milter.CmdOptNeg, offer.Encode()); err != nil {
+		return nil, err
+	}
+	code, data, err := c.Read()
+	if err != nil {
+		return nil, err
+	}
+	if code != milter.ActOptNeg {
+		return nil, fmt.Errorf("%w %v to %v", EUnexpected, code, milter.CmdOptNeg)
+	}
+	reply, err := milterwire.DecodeOptNeg(data)
+	if err != nil {
+		return nil, err
+	}
+	c.negotiated = *reply
+	return reply, nil
+}
+
+// Skips returns true if the milter asked not to receive command
+func (c *Client) Skips(code milter.Code) bool {
+	flags := map[milter.Code]uint32{
+		milter.CmdConnect: milter.OptNoConnect,
+		milter.CmdHelo:    milter.OptNoHelo,
+		milter.CmdMail:    milter.OptNoMailFrom,
+		milter.CmdRcpt:    milter.OptNoRcptTo,
+		milter.CmdBody:    milter.OptNoBody,
+		milter.CmdHeader:  milter.OptNoHeaders,
+		milter.CmdEOH:     milter.OptNoEOH,
+		milter.CmdUnknown: milter.OptNoUnknown,
+		milter.CmdData:    milter.OptNoData,
+	}
+	return c.negotiated.Protocol&flags[code] != 0
+}
+
+// NoReply returns true if the milter asked not to wait for its response to
+// command
+func (c *Client) NoReply(code milter.Code) bool {
+	flags := map[milter.Code]uint32{
+		milter.CmdConnect: milter.OptNoReplyConnect,
+		milter.CmdHelo:    milter.OptNoReplyHelo,
+		milter.CmdMail:    milter.OptNoReplyMailFrom,
+		milter.CmdRcpt:    milter.OptNoReplyRcptTo,
+		milter.CmdData:    milter.OptNoReplyData,
+		milter.CmdUnknown: milter.OptNoReplyUnknown,
+		milter.CmdHeader:  milter.OptNoReplyHeader,
+		milter.CmdEOH:     milter.OptNoReplyEOH,
+		milter.CmdBody:    milter.OptNoReplyBody,
+	}
+	return c.negotiated.Protocol&flags[code] != 0
+}
@@ -0,0 +1,312 @@
+// Package milterconfig builds middleware chains from a configuration file
+//
+// The JSON configuration enables and tunes the built-in middlewares, so that a
+// deployment using only those needs no Go code beyond main:
+//
+//	init, err := milterconfig.Init("/etc/milter.json", nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(milter.RunServer(listener, init))
+//
+// Middlewares are chained in a fixed order: logging, penalty box, connect risk
+// scoring, recipient limits and sender reputation, followed by the application
+// milter. Unknown settings are rejected so that typos do not go unnoticed. A
+// Reloader picks up configuration changes on SIGHUP or file modification.
+package milterconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterreputation"
+	"github.com/phalaaxx/milter/milterrisk"
+	"github.com/phalaaxx/milter/milterstore"
+)
+
+// Duration is a time.Duration read from strings such as "1h30m"
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config is the configuration file schema
+type Config struct {
+	// Logging logs every callback and its response
+	Logging bool `json:"logging"`
+	// Flags switches middlewares on and off by name, names are the keys of
+	// middleware settings such as penalty or recipient_limit
+	Flags map[string]bool `json:"flags"`
+
+	Penalty        *Penalty        `json:"penalty"`
+	Risk           *Risk           `json:"risk"`
+	RecipientLimit *RecipientLimit `json:"recipient_limit"`
+	Reputation     *Reputation     `json:"reputation"`
+}
+
+// Penalty configures milter.PenaltyBox
+type Penalty struct {
+	HalfLife    Duration `json:"half_life"`
+	TarpitStep  Duration `json:"tarpit_step"`
+	RejectScore float64  `json:"reject_score"`
+	BanScore    float64  `json:"ban_score"`
+	BanDuration Duration `json:"ban_duration"`
+}
+
+// Risk configures milterrisk.Pipeline
+type Risk struct {
+	Timeout    Duration    `json:"timeout"`
+	DNSBL      []DNSBL     `json:"dnsbl"`
+	FCrDNS     *Weight     `json:"fcrdns"`
+	Rate       *Rate       `json:"rate"`
+	Thresholds []Threshold `json:"thresholds"`
+}
+
+// DNSBL configures a blocklist zone
+type DNSBL struct {
+	Zone   string  `json:"zone"`
+	Weight float64 `json:"weight"`
+}
+
+// Weight configures a signal which only has a weight
+type Weight struct {
+	Weight float64 `json:"weight"`
+}
+
+// Rate configures connection rate signal
+type Rate struct {
+	Limit  int      `json:"limit"`
+	Window Duration `json:"window"`
+	Weight float64  `json:"weight"`
+}
+
+// Threshold maps risk scores to an action
+type Threshold struct {
+	Score float64 `json:"score"`
+	// Action is one of tarpit, tempfail or reject
+	Action string `json:"action"`
+	// Delay is the tarpit delay
+	Delay Duration `json:"delay"`
+	// Reply replaces the default reply text of tempfail and reject actions
+	Reply milter.ReplyTemplate `json:"reply"`
+}
+
+// RecipientLimit configures milter.RecipientLimit
+type RecipientLimit struct {
+	PerMessage int      `json:"per_message"`
+	PerSender  int      `json:"per_sender"`
+	Window     Duration `json:"window"`
+}
+
+// Reputation configures milterreputation.Engine stored in a directory
+type Reputation struct {
+	Dir      string   `json:"dir"`
+	HalfLife Duration `json:"half_life"`
+	// RejectBelow rejects senders with a combined score below the value
+	RejectBelow *float64 `json:"reject_below"`
+}
+
+// Load reads configuration file
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Parse reads configuration from r
+func Parse(r io.Reader) (*Config, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var config Config
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Build creates configured middlewares and returns them as a single middleware,
+// state such as penalties and rate windows is shared by all milters it wraps
+func (c *Config) Build() (milter.Middleware, error) {
+	return c.BuildFlags(nil)
+}
+
+// BuildFlags is like Build and additionally gates every middleware by a flag of
+// the same name in flags, configured flag values are applied to flags
+func (c *Config) BuildFlags(flags *milter.Flags) (milter.Middleware, error) {
+	var middlewares []milter.Middleware
+	add := func(name string, middleware milter.Middleware) {
+		if flags != nil {
+			middleware = flags.Gate(name, middleware)
+		}
+		middlewares = append(middlewares, middleware)
+	}
+	if c.Logging {
+		add("logging", milter.LogCallbacks(nil))
+	}
+	if p := c.Penalty; p != nil {
+		box := &milter.PenaltyBox{
+			HalfLife:    time.Duration(p.HalfLife),
+			TarpitStep:  time.Duration(p.TarpitStep),
+			RejectScore: p.RejectScore,
+			BanScore:    p.BanScore,
+			BanDuration: time.Duration(p.BanDuration),
+		}
+		add("penalty", box.Wrap)
+	}
+	if c.Risk != nil {
+		pipeline, err := c.Risk.build()
+		if err != nil {
+			return nil, err
+		}
+		add("risk", pipeline.Wrap)
+	}
+	if l := c.RecipientLimit; l != nil {
+		if l.PerSender > 0 && l.Window <= 0 {
+			return nil, fmt.Errorf("recipient_limit: per_sender requires window")
+		}
+		limit := &milter.RecipientLimit{
+			PerMessage: l.PerMessage,
+			PerSender:  l.PerSender,
+			Window:     time.Duration(l.Window),
+		}
+		add("recipient_limit", limit.Wrap)
+	}
+	if r := c.Reputation; r != nil {
+		middleware, err := r.build()
+		if err != nil {
+			return nil, err
+		}
+		add("reputation", middleware)
+	}
+	// flags change only once the configuration proved valid
+	if flags != nil {
+		for name, enabled := range c.Flags {
+			flags.Set(name, enabled)
+		}
+	}
+	return func(next milter.Milter) milter.Milter {
+		return milter.Chain(next, middlewares...)
+	}, nil
+}
+
+// build creates risk scoring pipeline
+func (r *Risk) build() (*milterrisk.Pipeline, error) {
+	pipeline := &milterrisk.Pipeline{Timeout: time.Duration(r.Timeout)}
+	for _, d := range r.DNSBL {
+		if d.Zone == "" {
+			return nil, fmt.Errorf("risk: dnsbl without zone")
+		}
+		pipeline.Signals = append(pipeline.Signals, &milterrisk.DNSBL{Zone: d.Zone, Weight: d.Weight})
+	}
+	if r.FCrDNS != nil {
+		pipeline.Signals = append(pipeline.Signals, &milterrisk.FCrDNS{Weight: r.FCrDNS.Weight})
+	}
+	if r.Rate != nil {
+		pipeline.Signals = append(pipeline.Signals, &milterrisk.Rate{
+			Limit:  r.Rate.Limit,
+			Window: time.Duration(r.Rate.Window),
+			Weight: r.Rate.Weight,
+		})
+	}
+	for _, t := range r.Thresholds {
+		resp, err := t.response()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Thresholds = append(pipeline.Thresholds, milterrisk.Threshold{Score: t.Score, Response: resp})
+	}
+	return pipeline, nil
+}
+
+// response returns the response of threshold action
+func (t *Threshold) response() (milter.Response, error) {
+	var resp milter.Response
+	switch t.Action {
+	case "tarpit":
+		return milter.Tarpit(milter.RespContinue, time.Duration(t.Delay)), nil
+	case "tempfail":
+		resp = milter.RespTempFail
+	case "reject":
+		resp = milter.RespReject
+	default:
+		return nil, fmt.Errorf("risk: unknown threshold action %q", t.Action)
+	}
+	if t.Reply != "" {
+		// connect stage has no macros to expand
+		resp = milter.NewResponseStr(milter.ActReplyCode, t.Reply.Expand(nil, nil))
+	}
+	return resp, nil
+}
+
+// build creates reputation middleware
+func (r *Reputation) build() (milter.Middleware, error) {
+	if r.Dir == "" {
+		return nil, fmt.Errorf("reputation: missing dir")
+	}
+	if err := os.MkdirAll(r.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	engine := &milterreputation.Engine{Store: milterstore.Dir(r.Dir), HalfLife: time.Duration(r.HalfLife)}
+	var policy milterreputation.Policy
+	if r.RejectBelow != nil {
+		threshold := *r.RejectBelow
+		policy = func(from string, rep milterreputation.Reputation, m *milter.Modifier) (milter.Response, error) {
+			if rep.Score() < threshold {
+				return milter.RespReject, nil
+			}
+			return milter.RespContinue, nil
+		}
+	}
+	return func(next milter.Milter) milter.Milter {
+		return engine.Wrap(next, policy)
+	}, nil
+}
+
+// Init loads configuration file and returns MilterInit wrapping milters created
+// by base in configured middlewares; nil base uses milter.NoOpMilter
+func Init(path string, base milter.MilterInit) (milter.MilterInit, error) {
+	config, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	middleware, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		base = func() (milter.Milter, uint32, uint32) {
+			return milter.NoOpMilter{}, 0, 0
+		}
+	}
+	return func() (milter.Milter, uint32, uint32) {
+		m, actions, protocol := base()
+		return middleware(m), actions, protocol
+	}, nil
+}
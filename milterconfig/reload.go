@@ -0,0 +1,115 @@
+package milterconfig
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/phalaaxx/milter"
+)
+
+// Reloader keeps the middleware built from a configuration file up to date
+//
+// Connections accepted after a successful reload use the new configuration
+// while running sessions finish with the one they started with. A file which
+// fails to load or validate is reported and the current configuration stays
+// in place. Middleware state such as penalty scores starts over on reload.
+type Reloader struct {
+	// Flags gates configured middlewares, values set at runtime are kept across
+	// reloads unless the configuration sets them
+	Flags *milter.Flags
+	// Logger receives the results of reloads by the watchers, nil means the
+	// standard logger
+	Logger milter.Logger
+
+	path       string
+	base       milter.MilterInit
+	middleware atomic.Pointer[milter.Middleware]
+}
+
+// NewReloader loads configuration file, a broken initial file is an error;
+// nil base uses milter.NoOpMilter
+func NewReloader(path string, base milter.MilterInit) (*Reloader, error) {
+	if base == nil {
+		base = func() (milter.Milter, uint32, uint32) {
+			return milter.NoOpMilter{}, 0, 0
+		}
+	}
+	r := &Reloader{Flags: &milter.Flags{}, path: path, base: base}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads and builds configuration file and swaps it in if it is valid
+func (r *Reloader) Reload() error {
+	config, err := Load(r.path)
+	if err != nil {
+		return err
+	}
+	middleware, err := config.BuildFlags(r.Flags)
+	if err != nil {
+		return err
+	}
+	r.middleware.Store(&middleware)
+	return nil
+}
+
+// Init creates milters wrapped in the current configuration, it is passed to
+// milter.RunServer or milter.Server
+func (r *Reloader) Init() (milter.Milter, uint32, uint32) {
+	m, actions, protocol := r.base()
+	return (*r.middleware.Load())(m), actions, protocol
+}
+
+// WatchSignals reloads configuration on SIGHUP until ctx is done, failed reloads
+// are logged
+func (r *Reloader) WatchSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			r.reload()
+		}
+	}
+}
+
+// WatchFile reloads configuration once for every change of file modification
+// time, it checks every interval until ctx is done; failed reloads are logged
+func (r *Reloader) WatchFile(ctx context.Context, interval time.Duration) {
+	var modified time.Time
+	if info, err := os.Stat(r.path); err == nil {
+		modified = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if info, err := os.Stat(r.path); err == nil && !info.ModTime().Equal(modified) {
+				modified = info.ModTime()
+				r.reload()
+			}
+		}
+	}
+}
+
+// reload reloads configuration and logs the result
+func (r *Reloader) reload() {
+	logger := milter.LoggerOrDefault(r.Logger)
+	if err := r.Reload(); err != nil {
+		logger.Printf("Error reloading milter configuration, keeping current one: %v", err)
+		return
+	}
+	logger.Printf("Reloaded milter configuration from %s", r.path)
+}
@@ -0,0 +1,375 @@
+// Package milterconform probes a milter implementation for protocol conformance
+//
+// Check connects to a milter as an MTA would and runs a battery of scenarios,
+// each over a new connection: option negotiation variants, complete and
+// aborted messages, oversized frames, macro edge cases and unknown commands.
+// The milter may be written in any language, only its wire behavior is
+// inspected. Findings are reported per scenario; failures violate the
+// protocol, warnings point out behavior some MTAs do not cope with.
+package milterconform
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterclient"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// Severity classifies a finding
+type Severity int
+
+const (
+	Pass Severity = iota
+	Warn
+	Fail
+)
+
+// String returns the name of severity
+func (s Severity) String() string {
+	switch s {
+	case Pass:
+		return "PASS"
+	case Warn:
+		return "WARN"
+	case Fail:
+		return "FAIL"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Finding is the outcome of a single scenario
+type Finding struct {
+	Scenario string
+	Severity Severity
+	Detail   string
+}
+
+// Config describes the milter under test
+type Config struct {
+	// Network and Address of the milter, Network defaults to tcp
+	Network string
+	Address string
+	// Timeout limits waiting for a single reply, default 10 seconds
+	Timeout time.Duration
+}
+
+// Report holds the findings of all scenarios in the order they ran
+type Report struct {
+	Findings []Finding
+}
+
+// Failed returns true if any scenario failed
+func (r *Report) Failed() bool {
+	for _, finding := range r.Findings {
+		if finding.Severity == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes findings to w, one per line
+func (r *Report) Print(w io.Writer) error {
+	var b bytes.Buffer
+	for _, finding := range r.Findings {
+		fmt.Fprintf(&b, "%-4v %-24s %s\n", finding.Severity, finding.Scenario, finding.Detail)
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// scenario runs against a fresh connection and returns its finding
+type scenario struct {
+	name string
+	run  func(c *milterclient.Client) (Severity, string)
+}
+
+// scenarios lists all checks in the order they run
+var scenarios = []scenario{
+	{"negotiate-v2", negotiateV2},
+	{"negotiate-v6", negotiateV6},
+	{"negotiate-no-actions", negotiateNoActions},
+	{"message", message},
+	{"abort-mid-message", abortMidMessage},
+	{"macro-edge-cases", macroEdgeCases},
+	{"oversized-frame", oversizedFrame},
+	{"unknown-command", unknownCommand},
+	{"quit-mid-message", quitMidMessage},
+}
+
+// Check runs all scenarios against the milter described by config, an error is
+// returned only for invalid configuration or cancelled ctx
+func Check(ctx context.Context, config Config) (*Report, error) {
+	if config.Address == "" {
+		return nil, errors.New("Missing milter address")
+	}
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	report := &Report{}
+	for _, s := range scenarios {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		c, err := milterclient.Dial(ctx, config.Network, config.Address)
+		if err != nil {
+			report.Findings = append(report.Findings, Finding{s.name, Fail, fmt.Sprintf("connect: %v", err)})
+			continue
+		}
+		c.Timeout = config.Timeout
+		severity, detail := s.run(c)
+		c.Close()
+		report.Findings = append(report.Findings, Finding{s.name, severity, detail})
+	}
+	return report, nil
+}
+
+// offers used by scenarios
+var (
+	offerV2 = milterwire.OptNeg{Version: 2, Actions: 0x3f, Protocol: 0x7f}
+	offerV6 = milterwire.OptNeg{Version: 6, Actions: 0x1ff, Protocol: 0x1fffff}
+)
+
+// negotiate sends offer and checks that the reply stays within it
+func negotiate(c *milterclient.Client, offer milterwire.OptNeg) (*milterwire.OptNeg, Severity, string) {
+	reply, err := c.Negotiate(offer)
+	if err != nil {
+		return nil, Fail, fmt.Sprintf("negotiation: %v", err)
+	}
+	switch {
+	case reply.Version > offer.Version:
+		return nil, Fail, fmt.Sprintf("version %d above offered %d", reply.Version, offer.Version)
+	case reply.Actions&^offer.Actions != 0:
+		return nil, Fail, fmt.Sprintf("actions %#x not offered", reply.Actions&^offer.Actions)
+	case reply.Protocol&^offer.Protocol != 0:
+		return nil, Fail, fmt.Sprintf("protocol flags %#x not offered", reply.Protocol&^offer.Protocol)
+	}
+	return reply, Pass, fmt.Sprintf("version %d actions %#x protocol %#x", reply.Version, reply.Actions, reply.Protocol)
+}
+
+func negotiateV2(c *milterclient.Client) (Severity, string) {
+	_, severity, detail := negotiate(c, offerV2)
+	return severity, detail
+}
+
+func negotiateV6(c *milterclient.Client) (Severity, string) {
+	_, severity, detail := negotiate(c, offerV6)
+	return severity, detail
+}
+
+func negotiateNoActions(c *milterclient.Client) (Severity, string) {
+	reply, err := c.Negotiate(milterwire.OptNeg{Version: 2, Actions: 0, Protocol: 0x7f})
+	if err != nil {
+		// refusing to work without actions is legitimate
+		return Pass, fmt.Sprintf("refused: %v", err)
+	}
+	if reply.Actions != 0 {
+		return Fail, fmt.Sprintf("requested actions %#x although none were offered", reply.Actions)
+	}
+	return Pass, "no actions requested"
+}
+
+// command is a single command of a generated message
+type command struct {
+	code milter.Code
+	data []byte
+}
+
+// envelope returns the commands of a short message
+func envelope() []command {
+	return []command{
+		{milter.CmdConnect, (&milterwire.Connect{Hostname: "client.example.org", Family: '4', Port: 25, Address: "192.0.2.1"}).Encode()},
+		{milter.CmdHelo, milterwire.EncodeStrings("client.example.org")},
+		{milter.CmdMail, milterwire.EncodeAddress("<sender@example.org>")},
+		{milter.CmdRcpt, milterwire.EncodeAddress("<rcpt@example.com>")},
+		{milter.CmdHeader, milterwire.EncodeHeader("From", "sender@example.org")},
+		{milter.CmdHeader, milterwire.EncodeHeader("Subject", "conformance")},
+		{milter.CmdEOH, nil},
+		{milter.CmdBody, []byte("Hello\r\n")},
+		{milter.CmdEOB, nil},
+	}
+}
+
+// continuing returns true if code lets the MTA go on with the message
+func continuing(code milter.Code) bool {
+	return code == milter.ActContinue || code == milter.ActSkip
+}
+
+// final returns true if code is a valid final reply
+func final(code milter.Code) bool {
+	switch code {
+	case milter.ActAccept, milter.ActContinue, milter.ActDiscard, milter.ActReject,
+		milter.ActTempFail, milter.ActReplyCode, milter.ActSkip:
+		return true
+	}
+	return false
+}
+
+// errNoVerdict reports commands which did not reach a verdict
+var errNoVerdict = errors.New("no verdict")
+
+// run sends commands until a verdict, it returns the verdict and the command
+// which produced it
+func run(c *milterclient.Client, commands []command, negotiated *milterwire.OptNeg) (*milterclient.Reply, milter.Code, error) {
+	for _, cmd := range commands {
+		if c.Skips(cmd.code) {
+			continue
+		}
+		reply, err := c.Send(cmd.code, cmd.data)
+		if err != nil {
+			return nil, cmd.code, err
+		}
+		if !final(reply.Code) {
+			return reply, cmd.code, fmt.Errorf("%w %v to %v", milterclient.EUnexpected, reply.Code, cmd.code)
+		}
+		for _, msg := range reply.Modifications {
+			if flag, ok := actionFlags[msg.Code]; ok && negotiated.Actions&flag == 0 {
+				return reply, cmd.code, fmt.Errorf("modification %v without negotiated action", msg.Code)
+			}
+		}
+		if !continuing(reply.Code) && cmd.code != milter.CmdRcpt || cmd.code == milter.CmdEOB {
+			return reply, cmd.code, nil
+		}
+	}
+	return nil, 0, errNoVerdict
+}
+
+// actionFlags maps modifications to the action flag they require
+var actionFlags = map[milter.Code]uint32{
+	milter.ActAddHeader:  milter.OptAddHeader,
+	milter.ActInsHeader:  milter.OptAddHeader,
+	milter.ActChgHeader:  milter.OptChangeHeader,
+	milter.ActReplBody:   milter.OptChangeBody,
+	milter.ActAddRcpt:    milter.OptAddRcpt,
+	milter.ActAddRcptPar: milter.OptAddRcptPar,
+	milter.ActDelRcpt:    milter.OptRemoveRcpt,
+	milter.ActQuarantine: milter.OptQuarantine,
+	milter.ActChgFrom:    milter.OptChangeFrom,
+}
+
+func message(c *milterclient.Client) (Severity, string) {
+	negotiated, severity, detail := negotiate(c, offerV2)
+	if severity != Pass {
+		return severity, detail
+	}
+	reply, stage, err := run(c, envelope(), negotiated)
+	if err != nil {
+		return Fail, fmt.Sprintf("at %v: %v", stage, err)
+	}
+	return Pass, fmt.Sprintf("verdict %v at %v with %d modifications", reply.Code, stage, len(reply.Modifications))
+}
+
+func abortMidMessage(c *milterclient.Client) (Severity, string) {
+	negotiated, severity, detail := negotiate(c, offerV2)
+	if severity != Pass {
+		return severity, detail
+	}
+	commands := envelope()
+	// abort after the first header, abort has no reply
+	if _, stage, err := run(c, commands[:5], negotiated); err != nil && err != errNoVerdict {
+		return Fail, fmt.Sprintf("at %v: %v", stage, err)
+	}
+	if err := c.Write(milter.CmdAbort, nil); err != nil {
+		return Fail, fmt.Sprintf("abort: %v", err)
+	}
+	// the next message starts at MAIL FROM
+	reply, stage, err := run(c, commands[2:], negotiated)
+	if err != nil {
+		return Fail, fmt.Sprintf("message after abort at %v: %v", stage, err)
+	}
+	return Pass, fmt.Sprintf("message after abort got %v at %v", reply.Code, stage)
+}
+
+func macroEdgeCases(c *milterclient.Client) (Severity, string) {
+	negotiated, severity, detail := negotiate(c, offerV2)
+	if severity != Pass {
+		return severity, detail
+	}
+	// macros have no reply, a reply to them shows up as answer to the next command
+	macros := [][]byte{
+		{byte(milter.CmdConnect)},
+		append([]byte{byte(milter.CmdConnect)}, milterwire.EncodeStrings("j", "mx.example.com", "{daemon_name}", "smtpd")...),
+		append([]byte{byte(milter.CmdConnect)}, milterwire.EncodeStrings("{unpaired}")...),
+		append([]byte{byte(milter.CmdConnect)}, milterwire.EncodeStrings("{empty}", "")...),
+		append([]byte{'Z'}, milterwire.EncodeStrings("{unknown_stage}", "value")...),
+	}
+	for _, data := range macros {
+		if err := c.Write(milter.CmdMacro, data); err != nil {
+			return Fail, fmt.Sprintf("macro: %v", err)
+		}
+	}
+	reply, stage, err := run(c, envelope(), negotiated)
+	switch {
+	case errors.Is(err, milterclient.EUnexpected):
+		return Fail, fmt.Sprintf("at %v: %v", stage, err)
+	case err != nil:
+		// refusing malformed macros is legitimate but MTAs fail the whole connection
+		return Warn, fmt.Sprintf("connection failed at %v after unusual macros: %v", stage, err)
+	}
+	return Pass, fmt.Sprintf("verdict %v at %v", reply.Code, stage)
+}
+
+func oversizedFrame(c *milterclient.Client) (Severity, string) {
+	negotiated, severity, detail := negotiate(c, offerV2)
+	if severity != Pass {
+		return severity, detail
+	}
+	commands := envelope()
+	if _, stage, err := run(c, commands[:7], negotiated); err != nil && err != errNoVerdict {
+		return Fail, fmt.Sprintf("at %v: %v", stage, err)
+	}
+	// MTAs never send body chunks above 64KiB in protocol version 2
+	reply, err := c.Send(milter.CmdBody, bytes.Repeat([]byte("x"), 16<<20))
+	switch {
+	case err != nil:
+		return Pass, fmt.Sprintf("refused 16MiB frame: %v", err)
+	case final(reply.Code) && !continuing(reply.Code):
+		return Pass, fmt.Sprintf("refused 16MiB frame with %v", reply.Code)
+	}
+	return Warn, "accepted 16MiB frame, memory use is not bounded"
+}
+
+func unknownCommand(c *milterclient.Client) (Severity, string) {
+	if _, severity, detail := negotiate(c, offerV2); severity != Pass {
+		return severity, detail
+	}
+	reply, err := c.Send('X', []byte("unknown"))
+	switch {
+	case errors.Is(err, io.EOF):
+		return Pass, "closed connection"
+	case err != nil:
+		return Warn, fmt.Sprintf("unknown command: %v", err)
+	}
+	return Pass, fmt.Sprintf("replied %v", reply.Code)
+}
+
+func quitMidMessage(c *milterclient.Client) (Severity, string) {
+	negotiated, severity, detail := negotiate(c, offerV2)
+	if severity != Pass {
+		return severity, detail
+	}
+	if _, stage, err := run(c, envelope()[:5], negotiated); err != nil && err != errNoVerdict {
+		return Fail, fmt.Sprintf("at %v: %v", stage, err)
+	}
+	if err := c.Write(milter.CmdQuit, nil); err != nil {
+		return Fail, fmt.Sprintf("quit: %v", err)
+	}
+	// the milter closes the connection without reply
+	code, _, err := c.Read()
+	switch {
+	case errors.Is(err, io.EOF):
+		return Pass, "closed connection"
+	case err != nil:
+		return Warn, fmt.Sprintf("after quit: %v", err)
+	}
+	return Fail, fmt.Sprintf("replied %v to quit", code)
+}
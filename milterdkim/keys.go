@@ -0,0 +1,224 @@
+// Package milterdkim manages DKIM signing keys
+//
+// A Manager holds keys for any number of domains and selectors loaded from one
+// or more sources such as key files or a KMS. Every key has a validity period,
+// so rotation is scheduled by publishing a new selector ahead of time; Select
+// always returns the newest active key of a domain and periodic reloads pick up
+// new keys without restarting the filter.
+package milterdkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phalaaxx/milter"
+)
+
+// pre-defined errors
+var (
+	ENoKey     = errors.New("No active DKIM key for domain")
+	EKeyFormat = errors.New("Unsupported DKIM key format")
+)
+
+// Key is a signing key published under a selector of a domain
+type Key struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+	// NotBefore and NotAfter limit the time key is used, zero means no limit
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Algorithm returns DKIM signing algorithm of key
+func (k *Key) Algorithm() string {
+	if _, ok := k.Signer.Public().(ed25519.PublicKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// active returns true if key may be used at now
+func (k *Key) active(now time.Time) bool {
+	return !now.Before(k.NotBefore) && (k.NotAfter.IsZero() || now.Before(k.NotAfter))
+}
+
+// Source provides keys, for example from files or a key management service
+// which returns crypto.Signer implementations backed by remote keys
+type Source interface {
+	Keys(ctx context.Context) ([]*Key, error)
+}
+
+// FileSource loads PEM encoded private keys stored as Dir/<domain>/<selector>.pem
+type FileSource struct {
+	Dir string
+	// Activation delays the use of new key files, giving DNS time to publish
+	// the selector; keys become active Activation after file modification time
+	Activation time.Duration
+}
+
+// Keys implements Source
+func (s *FileSource) Keys(ctx context.Context) ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*", "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*Key
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ReadKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &Key{
+			Domain:    filepath.Base(filepath.Dir(path)),
+			Selector:  strings.TrimSuffix(filepath.Base(path), ".pem"),
+			Signer:    signer,
+			NotBefore: info.ModTime().Add(s.Activation),
+		})
+	}
+	return keys, nil
+}
+
+// ReadKeyFile reads a PEM encoded RSA or Ed25519 private key
+func ReadKeyFile(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// ParseKey parses a PEM encoded PKCS #1 or PKCS #8 private key
+func ParseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, EKeyFormat
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+	}
+	return nil, EKeyFormat
+}
+
+// Manager selects signing keys from all configured sources
+type Manager struct {
+	Sources []Source
+	// Clock selects active keys and times reloads of Run, nil means
+	// milter.SystemClock
+	Clock milter.Clock
+	// Logger receives failed reloads of Run, nil means the standard logger
+	Logger milter.Logger
+
+	mutex sync.RWMutex
+	keys  map[string][]*Key
+}
+
+// Reload loads keys from all sources, current keys are kept if any source fails
+func (m *Manager) Reload(ctx context.Context) error {
+	keys := make(map[string][]*Key)
+	for _, source := range m.Sources {
+		loaded, err := source.Keys(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range loaded {
+			domain := strings.ToLower(key.Domain)
+			keys[domain] = append(keys[domain], key)
+		}
+	}
+	m.mutex.Lock()
+	m.keys = keys
+	m.mutex.Unlock()
+	return nil
+}
+
+// Run reloads keys every interval until ctx is done, failed reloads are logged
+// and retried at the next interval
+func (m *Manager) Run(ctx context.Context, interval time.Duration) error {
+	clock := milter.ClockOrSystem(m.Clock)
+	for {
+		timer := clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C():
+			if err := m.Reload(ctx); err != nil && ctx.Err() == nil {
+				milter.LoggerOrDefault(m.Logger).Printf("Error reloading DKIM keys: %v", err)
+			}
+		}
+	}
+}
+
+// Select returns the key used to sign messages of domain, the active key which
+// became valid last wins so a new selector takes over once its NotBefore passes
+func (m *Manager) Select(domain string) (*Key, error) {
+	now := m.now()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var selected *Key
+	for _, key := range m.keys[strings.ToLower(domain)] {
+		if !key.active(now) {
+			continue
+		}
+		if selected == nil || key.NotBefore.After(selected.NotBefore) ||
+			key.NotBefore.Equal(selected.NotBefore) && key.Selector > selected.Selector {
+			selected = key
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("%w %s", ENoKey, domain)
+	}
+	return selected, nil
+}
+
+// Lookup returns the key of domain published under selector regardless of validity
+func (m *Manager) Lookup(domain, selector string) (*Key, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, key := range m.keys[strings.ToLower(domain)] {
+		if key.Selector == selector {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s selector %s", ENoKey, domain, selector)
+}
+
+// now returns current time
+func (m *Manager) now() time.Time {
+	return milter.ClockOrSystem(m.Clock).Now()
+}
@@ -0,0 +1,325 @@
+// Package milterdns provides a DNS cache shared by all sessions of a process
+//
+// Milters look up the same names over and over: every session from a client
+// checks the same blocklist entries and reverse names. Cache answers repeated
+// lookups from memory and merges concurrent identical lookups into one query.
+// The standard resolver does not report record TTLs, so answers are kept for
+// configured times: TTL for answers, NegativeTTL for names which do not exist.
+// Temporary failures are never cached.
+package milterdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phalaaxx/milter"
+)
+
+// Resolver performs DNS lookups, *net.Resolver and *Cache implement it
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// lookupTimeout limits lookups shared by several callers
+const lookupTimeout = 30 * time.Second
+
+// errLookupPanic is returned to callers which joined a lookup that panicked
+var errLookupPanic = errors.New("DNS lookup panicked")
+
+// Default is the process wide cache used by library helpers when no resolver
+// is configured, it is available to handlers as well
+var Default = &Cache{}
+
+// Cache is a caching Resolver, the zero value uses net.DefaultResolver
+type Cache struct {
+	// Resolver performs lookups missing in the cache, default net.DefaultResolver
+	Resolver Resolver
+	// TTL is the time answers are kept, default 5 minutes
+	TTL time.Duration
+	// NegativeTTL is the time missing names are remembered, default 1 minute
+	NegativeTTL time.Duration
+	// MaxEntries limits cache size, default 100000
+	MaxEntries int
+	// Clock times entries, nil means milter.SystemClock
+	Clock milter.Clock
+
+	mutex    sync.Mutex
+	entries  map[cacheKey]*entry
+	sweepAt  int
+	hits     uint64
+	misses   uint64
+	inflight map[cacheKey]*call
+}
+
+// cacheKey identifies a lookup
+type cacheKey struct {
+	kind byte
+	name string
+}
+
+// entry is a cached answer
+type entry struct {
+	value   any
+	err     error
+	expires time.Time
+	used    time.Time
+}
+
+// call is a lookup in progress shared by concurrent callers
+type call struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// CacheStats reports cache counters
+type CacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// Stats returns cache counters
+func (c *Cache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CacheStats{len(c.entries), c.hits, c.misses}
+}
+
+// Flush removes all cached answers
+func (c *Cache) Flush() {
+	c.mutex.Lock()
+	c.entries = nil
+	c.mutex.Unlock()
+}
+
+// notFound returns true if err reports a missing DNS name
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookup returns the cached answer for key or runs fetch, every caller gets its
+// own copy of the answer
+func (c *Cache) lookup(ctx context.Context, key cacheKey, fetch func(context.Context, Resolver) (any, error)) (any, error) {
+	clock := c.Clock
+	if clock == nil {
+		clock = milter.SystemClock
+	}
+	c.mutex.Lock()
+	now := clock.Now()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		e.used = now
+		c.hits++
+		c.mutex.Unlock()
+		return clone(e.value), e.err
+	}
+	c.misses++
+	// join a lookup already in progress
+	if pending, ok := c.inflight[key]; ok {
+		c.mutex.Unlock()
+		select {
+		case <-pending.done:
+			return clone(pending.value), pending.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.inflight == nil {
+		c.inflight = make(map[cacheKey]*call)
+	}
+	pending := &call{done: make(chan struct{}), err: errLookupPanic}
+	c.inflight[key] = pending
+	c.mutex.Unlock()
+	// waiting callers are released even if fetch panics
+	defer func() {
+		c.mutex.Lock()
+		delete(c.inflight, key)
+		c.mutex.Unlock()
+		close(pending.done)
+	}()
+
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	// the shared lookup must not fail because the first caller gives up
+	shared, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+	value, err := fetch(shared, resolver)
+	cancel()
+	pending.value, pending.err = value, err
+
+	c.mutex.Lock()
+	switch {
+	case err == nil:
+		c.store(key, &entry{value: value, expires: clock.Now().Add(c.ttl())}, now)
+	case notFound(err):
+		c.store(key, &entry{value: value, err: err, expires: clock.Now().Add(c.negativeTTL())}, now)
+	}
+	c.mutex.Unlock()
+	return clone(value), err
+}
+
+// clone copies an answer so that callers cannot change the cached one
+func clone(value any) any {
+	switch value := value.(type) {
+	case []string:
+		return append([]string(nil), value...)
+	case []net.IPAddr:
+		addrs := make([]net.IPAddr, len(value))
+		for i, addr := range value {
+			addrs[i] = net.IPAddr{IP: append(net.IP(nil), addr.IP...), Zone: addr.Zone}
+		}
+		return addrs
+	case []*net.MX:
+		records := make([]*net.MX, len(value))
+		for i, mx := range value {
+			copied := *mx
+			records[i] = &copied
+		}
+		return records
+	}
+	return value
+}
+
+// store adds an entry, the caller holds the mutex
+func (c *Cache) store(key cacheKey, e *entry, now time.Time) {
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*entry)
+	}
+	// drop expired entries whenever the map doubles in size
+	if len(c.entries) >= c.sweepAt {
+		for k, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.sweepAt = max(2*len(c.entries), 1024)
+	}
+	if len(c.entries) >= c.maxEntries() {
+		return
+	}
+	e.used = now
+	c.entries[key] = e
+}
+
+// Trim drops expired answers and answers not used for idle, it implements
+// milter.Trimmer and returns the estimated number of bytes reclaimed
+func (c *Cache) Trim(idle time.Duration) int64 {
+	clock := c.Clock
+	if clock == nil {
+		clock = milter.SystemClock
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := clock.Now()
+	var reclaimed int64
+	kept := make(map[cacheKey]*entry)
+	for key, e := range c.entries {
+		if now.Before(e.expires) && now.Sub(e.used) < idle {
+			kept[key] = e
+		} else {
+			reclaimed += entrySize(key, e)
+		}
+	}
+	// a new map releases the buckets of dropped entries
+	if reclaimed != 0 {
+		c.entries = kept
+		c.sweepAt = 0
+	}
+	return reclaimed
+}
+
+// entrySize estimates memory held by a cached answer
+func entrySize(key cacheKey, e *entry) int64 {
+	size := int64(96 + len(key.name))
+	switch value := e.value.(type) {
+	case []string:
+		for _, s := range value {
+			size += int64(16 + len(s))
+		}
+	case []net.IPAddr:
+		for _, addr := range value {
+			size += int64(40 + len(addr.IP) + len(addr.Zone))
+		}
+	case []*net.MX:
+		for _, mx := range value {
+			size += int64(32 + len(mx.Host))
+		}
+	}
+	return size
+}
+
+// defaults for unset fields
+func (c *Cache) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return 5 * time.Minute
+	}
+	return c.TTL
+}
+
+func (c *Cache) negativeTTL() time.Duration {
+	if c.NegativeTTL <= 0 {
+		return time.Minute
+	}
+	return c.NegativeTTL
+}
+
+func (c *Cache) maxEntries() int {
+	if c.MaxEntries <= 0 {
+		return 100000
+	}
+	return c.MaxEntries
+}
+
+// LookupHost implements Resolver
+func (c *Cache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	value, err := c.lookup(ctx, cacheKey{'h', host}, func(ctx context.Context, r Resolver) (any, error) {
+		return r.LookupHost(ctx, host)
+	})
+	addrs, _ := value.([]string)
+	return addrs, err
+}
+
+// LookupAddr implements Resolver
+func (c *Cache) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	value, err := c.lookup(ctx, cacheKey{'a', addr}, func(ctx context.Context, r Resolver) (any, error) {
+		return r.LookupAddr(ctx, addr)
+	})
+	names, _ := value.([]string)
+	return names, err
+}
+
+// LookupIPAddr implements Resolver
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	value, err := c.lookup(ctx, cacheKey{'i', host}, func(ctx context.Context, r Resolver) (any, error) {
+		return r.LookupIPAddr(ctx, host)
+	})
+	addrs, _ := value.([]net.IPAddr)
+	return addrs, err
+}
+
+// LookupTXT implements Resolver
+func (c *Cache) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	value, err := c.lookup(ctx, cacheKey{'t', name}, func(ctx context.Context, r Resolver) (any, error) {
+		return r.LookupTXT(ctx, name)
+	})
+	records, _ := value.([]string)
+	return records, err
+}
+
+// LookupMX implements Resolver
+func (c *Cache) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	value, err := c.lookup(ctx, cacheKey{'m', name}, func(ctx context.Context, r Resolver) (any, error) {
+		return r.LookupMX(ctx, name)
+	})
+	records, _ := value.([]*net.MX)
+	return records, err
+}
@@ -0,0 +1,154 @@
+package milterdns_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter/milterdns"
+)
+
+// fakeResolver answers every lookup with fixed records, it waits for release
+// if set and panics if panics is set
+type fakeResolver struct {
+	lookups atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	panics  bool
+}
+
+func (f *fakeResolver) answer() {
+	f.lookups.Add(1)
+	if f.started != nil {
+		close(f.started)
+	}
+	if f.release != nil {
+		<-f.release
+	}
+	if f.panics {
+		panic("resolver failure")
+	}
+}
+
+func (f *fakeResolver) LookupHost(context.Context, string) ([]string, error) {
+	f.answer()
+	return []string{"192.0.2.1", "192.0.2.2"}, nil
+}
+
+func (f *fakeResolver) LookupAddr(context.Context, string) ([]string, error) {
+	f.answer()
+	return []string{"mx.example.com."}, nil
+}
+
+func (f *fakeResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	f.answer()
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+}
+
+func (f *fakeResolver) LookupTXT(context.Context, string) ([]string, error) {
+	f.answer()
+	return []string{"v=spf1 -all"}, nil
+}
+
+func (f *fakeResolver) LookupMX(context.Context, string) ([]*net.MX, error) {
+	f.answer()
+	return []*net.MX{{Host: "mx.example.com.", Pref: 10}}, nil
+}
+
+func TestCacheCopies(t *testing.T) {
+	tests := []struct {
+		name string
+		// lookup looks up a name, corrupts the answer and returns the first
+		// record as a string
+		lookup func(c *milterdns.Cache) string
+	}{
+		{"host", func(c *milterdns.Cache) string {
+			addrs, _ := c.LookupHost(context.Background(), "example.com")
+			first := addrs[0]
+			addrs[0] = "changed"
+			return first
+		}},
+		{"addr", func(c *milterdns.Cache) string {
+			names, _ := c.LookupAddr(context.Background(), "192.0.2.1")
+			first := names[0]
+			names[0] = "changed"
+			return first
+		}},
+		{"ip addr", func(c *milterdns.Cache) string {
+			addrs, _ := c.LookupIPAddr(context.Background(), "example.com")
+			first := addrs[0].IP.String()
+			addrs[0].IP[len(addrs[0].IP)-1] = 99
+			return first
+		}},
+		{"txt", func(c *milterdns.Cache) string {
+			records, _ := c.LookupTXT(context.Background(), "example.com")
+			first := records[0]
+			records[0] = "changed"
+			return first
+		}},
+		{"mx", func(c *milterdns.Cache) string {
+			records, _ := c.LookupMX(context.Background(), "example.com")
+			first := records[0].Host
+			records[0].Host = "changed"
+			return first
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &fakeResolver{}
+			cache := &milterdns.Cache{Resolver: resolver}
+			first := test.lookup(cache)
+			if cached := test.lookup(cache); cached != first {
+				t.Fatalf("cached answer %q, want %q", cached, first)
+			}
+			if n := resolver.lookups.Load(); n != 1 {
+				t.Fatalf("%d lookups, want 1", n)
+			}
+		})
+	}
+}
+
+func TestCachePanic(t *testing.T) {
+	resolver := &fakeResolver{started: make(chan struct{}), release: make(chan struct{}), panics: true}
+	cache := &milterdns.Cache{Resolver: resolver}
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() {
+			panicked <- recover()
+		}()
+		cache.LookupHost(context.Background(), "example.com")
+	}()
+	<-resolver.started
+	// join the lookup in progress, then let it panic
+	joined := make(chan error, 1)
+	go func() {
+		_, err := cache.LookupHost(context.Background(), "example.com")
+		joined <- err
+	}()
+	for cache.Stats().Misses != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(resolver.release)
+	if recovered := <-panicked; recovered == nil {
+		t.Fatal("lookup did not panic")
+	}
+	select {
+	case err := <-joined:
+		if err == nil {
+			t.Fatal("joined lookup succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("joined lookup still waiting")
+	}
+
+	// the failed lookup is neither cached nor in progress
+	resolver.started, resolver.panics = nil, false
+	if addrs, err := cache.LookupHost(context.Background(), "example.com"); err != nil || len(addrs) != 2 {
+		t.Fatalf("lookup after panic got %v, %v", addrs, err)
+	}
+	if n := resolver.lookups.Load(); n != 2 {
+		t.Fatalf("%d lookups, want 2", n)
+	}
+}
@@ -0,0 +1,318 @@
+// Package milterintegration runs milters against a real MTA for end to end tests
+//
+// A harness starts the filter under test on a loopback port and a Postfix or
+// Sendmail container configured to use it, injects messages over SMTP and reads
+// back what was delivered. Containers are run with the docker command using the
+// host network, so the harness works where containers share the loopback
+// interface with the test, as on Linux hosts.
+//
+//	func TestFilter(t *testing.T) {
+//		h := milterintegration.Run(t, milterintegration.Config{Init: newFilter})
+//		if err := h.Send(ctx, "a@example.org", []string{"b@example.test"}, message); err != nil {
+//			t.Fatal(err)
+//		}
+//		delivered, err := h.Wait(ctx, 1)
+//		...
+//	}
+package milterintegration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+)
+
+// DefaultImage is the container image used when Config.Image is not set, the
+// MTA is installed from Debian packages when the container starts
+const DefaultImage = "debian:bookworm-slim"
+
+// pre-defined errors
+var (
+	ENoDocker = errors.New("Docker command is not available")
+)
+
+// Config describes an integration environment
+type Config struct {
+	// Init creates the filter under test for every connection
+	Init milter.MilterInit
+	// Configure is called with every new session, see milter.Server
+	Configure func(*milter.MilterSession)
+	// MTA selects the mail server, default Postfix
+	MTA MTA
+	// Image is a Debian based container image, default DefaultImage; images
+	// with the MTA preinstalled start much faster
+	Image string
+	// StartTimeout limits waiting for the MTA to accept SMTP, default 5 minutes
+	StartTimeout time.Duration
+}
+
+// Harness is a running integration environment
+type Harness struct {
+	// SMTPAddr is the address of the MTA SMTP service
+	SMTPAddr string
+	// MilterAddr is the address the filter listens on
+	MilterAddr string
+
+	config    Config
+	container string
+	listener  net.Listener
+	served    chan error
+}
+
+// Available returns true if containers can be started
+func Available() bool {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return false
+	}
+	return exec.Command("docker", "info").Run() == nil
+}
+
+// Run starts a harness for test t and stops it when the test ends, the test is
+// skipped if docker is not available
+func Run(t testing.TB, config Config) *Harness {
+	t.Helper()
+	if !Available() {
+		t.Skip("milterintegration: docker is not available")
+	}
+	h, err := Start(context.Background(), config)
+	if err != nil {
+		t.Fatalf("start integration harness: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Errorf("stop integration harness: %v", err)
+		}
+	})
+	return h
+}
+
+// Start launches filter and MTA container and waits until the MTA accepts SMTP
+func Start(ctx context.Context, config Config) (*Harness, error) {
+	if config.Init == nil {
+		return nil, errors.New("Missing milter init")
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil, ENoDocker
+	}
+	if config.Image == "" {
+		config.Image = DefaultImage
+	}
+	if config.StartTimeout <= 0 {
+		config.StartTimeout = 5 * time.Minute
+	}
+
+	// filter listens on the loopback interface shared with the container
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	smtpPort, err := freePort()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	h := &Harness{
+		SMTPAddr:   fmt.Sprintf("127.0.0.1:%d", smtpPort),
+		MilterAddr: listener.Addr().String(),
+		config:     config,
+		listener:   listener,
+		served:     make(chan error, 1),
+	}
+	server := &milter.Server{Init: config.Init, Configure: config.Configure}
+	go func() { h.served <- server.Serve(listener) }()
+
+	script, err := config.MTA.setup(smtpPort, listener.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	out, err := exec.CommandContext(ctx, "docker", "run", "--detach", "--rm", "--network", "host",
+		config.Image, "sh", "-c", script+"exec sleep infinity").Output()
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("start container: %w", commandError(err))
+	}
+	h.container = strings.TrimSpace(string(out))
+
+	if err := h.waitSMTP(ctx); err != nil {
+		logs, _ := exec.Command("docker", "logs", h.container).CombinedOutput()
+		h.Close()
+		return nil, fmt.Errorf("%w, container output:\n%s", err, logs)
+	}
+	return h, nil
+}
+
+// freePort returns a currently unused loopback port
+func freePort() (int, error) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitSMTP waits until the MTA greets SMTP clients
+func (h *Harness) waitSMTP(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.config.StartTimeout)
+	defer cancel()
+	for {
+		conn, err := net.DialTimeout("tcp4", h.SMTPAddr, time.Second)
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+			if err == nil && strings.HasPrefix(line, "220") {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v did not start: %w", h.config.MTA, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// Send injects message over SMTP, an error reports refusal by MTA or filter
+func (h *Harness) Send(ctx context.Context, from string, to []string, message []byte) error {
+	// net/smtp has no context support, durations are bounded by the connection deadline
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp4", h.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if err := client.Hello("client.example.org"); err != nil {
+		return err
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Messages returns all messages delivered so far in delivery order
+func (h *Harness) Messages(ctx context.Context) ([]*mail.Message, error) {
+	out, err := exec.CommandContext(ctx, "docker", "exec", h.container, "sh", "-c", "cat "+Mailbox+" 2>/dev/null || true").Output()
+	if err != nil {
+		return nil, fmt.Errorf("read mailbox: %w", commandError(err))
+	}
+	return splitMbox(out)
+}
+
+// Wait waits until at least n messages have been delivered and returns them
+func (h *Harness) Wait(ctx context.Context, n int) ([]*mail.Message, error) {
+	for {
+		messages, err := h.Messages(ctx)
+		if err != nil || len(messages) >= n {
+			return messages, err
+		}
+		select {
+		case <-ctx.Done():
+			return messages, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// Logs returns the output of the container, including the MTA log
+func (h *Harness) Logs() ([]byte, error) {
+	return exec.Command("docker", "logs", h.container).CombinedOutput()
+}
+
+// Close stops container and filter
+func (h *Harness) Close() error {
+	var err error
+	if h.container != "" {
+		if out, stopErr := exec.Command("docker", "rm", "--force", h.container).CombinedOutput(); stopErr != nil {
+			err = fmt.Errorf("stop container: %v: %s", stopErr, out)
+		}
+		h.container = ""
+	}
+	if h.listener != nil {
+		h.listener.Close()
+		<-h.served
+		h.listener = nil
+	}
+	return err
+}
+
+// splitMbox parses an mbox file
+func splitMbox(data []byte) ([]*mail.Message, error) {
+	var messages []*mail.Message
+	var current [][]byte
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		message, err := mail.ReadMessage(bytes.NewReader(bytes.Join(current, []byte("\n"))))
+		if err != nil {
+			return fmt.Errorf("parse delivered message: %w", err)
+		}
+		messages = append(messages, message)
+		return nil
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("From ")):
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			current = [][]byte{}
+		case current == nil:
+		case bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")):
+			// quoted From lines
+			current = append(current, line[1:])
+		default:
+			current = append(current, line)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// commandError adds the error output of a failed command
+func commandError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) != 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return err
+}
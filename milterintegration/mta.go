@@ -0,0 +1,67 @@
+package milterintegration
+
+import (
+	"fmt"
+)
+
+// MTA selects the mail server started in the container
+type MTA int
+
+const (
+	// Postfix with smtpd_milters and non_smtpd_milters pointing to the filter
+	Postfix MTA = iota
+	// Sendmail with an INPUT_MAIL_FILTER pointing to the filter
+	Sendmail
+)
+
+// String returns the name of the MTA
+func (m MTA) String() string {
+	switch m {
+	case Postfix:
+		return "postfix"
+	case Sendmail:
+		return "sendmail"
+	}
+	return fmt.Sprintf("MTA(%d)", int(m))
+}
+
+// Mailbox is the mbox file receiving all mail addressed to local domains,
+// every local recipient is delivered to user tester
+const Mailbox = "/var/mail/tester"
+
+// setup returns the shell script which installs and starts mta in a Debian
+// based container, SMTP listens on smtpPort and the filter is reached on
+// milterPort of the loopback address
+func (m MTA) setup(smtpPort, milterPort int) (string, error) {
+	// packages are installed only if the image does not provide them
+	common := `set -e
+export DEBIAN_FRONTEND=noninteractive
+install() { command -v "$1" >/dev/null || { apt-get update -qq && apt-get install -y -qq "$2" >/dev/null; }; }
+id tester >/dev/null 2>&1 || useradd -m tester
+`
+	switch m {
+	case Postfix:
+		return common + fmt.Sprintf(`install postfix postfix
+postconf -e "myhostname=mta.example.test" "mydestination=example.test, localhost" \
+	"inet_interfaces=127.0.0.1" "inet_protocols=ipv4" "smtpd_tls_security_level=none" \
+	"local_recipient_maps=" "luser_relay=tester" "alias_maps=" "alias_database=" \
+	"smtpd_milters=inet:127.0.0.1:%[2]d" "non_smtpd_milters=inet:127.0.0.1:%[2]d" \
+	"milter_default_action=tempfail" "maillog_file=/dev/stdout"
+postconf -MX smtp/inet
+postconf -M "%[1]d/inet=%[1]d inet n - n - - smtpd"
+postfix start
+`, smtpPort, milterPort), nil
+	case Sendmail:
+		return common + fmt.Sprintf(`install sendmail sendmail
+sed -i '/^DAEMON_OPTIONS/d' /etc/mail/sendmail.mc
+sed -i "/^MAILER_DEFINITIONS/i\\
+DAEMON_OPTIONS(%[3]sPort=%[1]d, Addr=127.0.0.1, Name=MTA')dnl\\
+define(%[3]sLUSER_RELAY', %[3]slocal:tester')dnl\\
+INPUT_MAIL_FILTER(%[3]stest', %[3]sS=inet:%[2]d@127.0.0.1, F=T, T=S:30s;R:30s;E:5m')dnl" /etc/mail/sendmail.mc
+echo example.test >> /etc/mail/local-host-names
+m4 /etc/mail/sendmail.mc > /etc/mail/sendmail.cf
+sendmail -bd -q30m
+`, smtpPort, milterPort, "`"), nil
+	}
+	return "", fmt.Errorf("unsupported MTA %v", m)
+}
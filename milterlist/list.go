@@ -0,0 +1,352 @@
+// Package milterlist implements allow and deny lists for milters
+//
+// A List holds entries matching client addresses and networks, HELO names,
+// envelope senders and recipients and header values. Wrap checks every stage
+// against the list before passing it to the wrapped milter: denied stages get
+// the deny response and allowed ones accept the message without further
+// filtering. Entries are kept in a milterstore.Store so that runtime changes,
+// for example from the admin interface, survive restarts.
+package milterlist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterstore"
+)
+
+// pre-defined errors
+var (
+	EAction  = errors.New("Unknown list action")
+	EKind    = errors.New("Unknown list entry kind")
+	EPattern = errors.New("Invalid list pattern")
+)
+
+// storeKey is the store key holding all list entries
+const storeKey = "list/entries"
+
+// Kind is the attribute an entry matches
+type Kind string
+
+// Define entry kinds
+const (
+	// Client matches client addresses by IP address or CIDR network
+	Client Kind = "client"
+	// Helo matches HELO names
+	Helo Kind = "helo"
+	// Sender and Recipient match envelope addresses
+	Sender    Kind = "sender"
+	Recipient Kind = "recipient"
+	// Header matches header values, patterns have the form "Name: value"
+	Header Kind = "header"
+)
+
+// Action is the effect of a matching entry
+type Action string
+
+// Define list actions
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Entry is a single list entry
+//
+// Patterns other than client ones match case insensitively and may use the
+// wildcards of path.Match, so "*@example.com" matches all senders of a domain.
+type Entry struct {
+	Kind    Kind   `json:"kind"`
+	Pattern string `json:"pattern"`
+	Action  Action `json:"action"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// parsed is an entry prepared for matching
+type parsed struct {
+	Entry
+	prefix netip.Prefix
+	header string
+	glob   string
+}
+
+// parse validates entry and prepares it for matching
+func parse(entry Entry) (parsed, error) {
+	p := parsed{Entry: entry}
+	if entry.Action != Allow && entry.Action != Deny {
+		return p, fmt.Errorf("%w: %q", EAction, entry.Action)
+	}
+	switch entry.Kind {
+	case Client:
+		var err error
+		if strings.Contains(entry.Pattern, "/") {
+			p.prefix, err = netip.ParsePrefix(entry.Pattern)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(entry.Pattern)
+			p.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		if err != nil {
+			return p, fmt.Errorf("%w: %v", EPattern, err)
+		}
+		p.prefix = p.prefix.Masked()
+		return p, nil
+	case Header:
+		name, value, ok := strings.Cut(entry.Pattern, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return p, fmt.Errorf("%w: %q has no header name", EPattern, entry.Pattern)
+		}
+		p.header = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		p.glob = strings.ToLower(strings.TrimSpace(value))
+	case Helo, Sender, Recipient:
+		p.glob = strings.ToLower(strings.Trim(entry.Pattern, "<> "))
+	default:
+		return p, fmt.Errorf("%w: %q", EKind, entry.Kind)
+	}
+	if _, err := path.Match(p.glob, ""); err != nil {
+		return p, fmt.Errorf("%w: %v", EPattern, err)
+	}
+	return p, nil
+}
+
+// match returns true if entry matches a value of its kind
+func (p *parsed) match(value string) bool {
+	if p.Kind == Client {
+		addr, err := netip.ParseAddr(value)
+		return err == nil && p.prefix.Contains(addr.Unmap())
+	}
+	ok, _ := path.Match(p.glob, value)
+	return ok
+}
+
+// List is a set of allow and deny entries, a single List is meant to be
+// shared by all sessions
+type List struct {
+	// Store persists entries, nil keeps them in memory only
+	Store milterstore.Store
+	// Response answers denied stages, default RespReject
+	Response milter.Response
+
+	mutex   sync.RWMutex
+	entries []parsed
+}
+
+// Load replaces entries with the ones persisted in Store
+func (l *List) Load(ctx context.Context) error {
+	if l.Store == nil {
+		return nil
+	}
+	data, err := l.Store.Get(ctx, storeKey)
+	if errors.Is(err, milterstore.ENotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	list, err := compile(entries)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.entries = list
+	l.mutex.Unlock()
+	return nil
+}
+
+// Set replaces all entries
+func (l *List) Set(ctx context.Context, entries []Entry) error {
+	list, err := compile(entries)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = list
+	return l.save(ctx)
+}
+
+// compile parses entries
+func compile(entries []Entry) ([]parsed, error) {
+	list := make([]parsed, 0, len(entries))
+	for _, entry := range entries {
+		p, err := parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// Add adds entry, an existing entry of the same kind and pattern is replaced
+func (l *List) Add(ctx context.Context, entry Entry) error {
+	p, err := parse(entry)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.remove(entry.Kind, entry.Pattern)
+	l.entries = append(l.entries, p)
+	return l.save(ctx)
+}
+
+// Remove deletes the entry of kind with pattern, it returns false if there is none
+func (l *List) Remove(ctx context.Context, kind Kind, pattern string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.remove(kind, pattern) {
+		return false, nil
+	}
+	return true, l.save(ctx)
+}
+
+// remove deletes an entry, the caller holds the mutex
+func (l *List) remove(kind Kind, pattern string) bool {
+	for i, p := range l.entries {
+		if p.Kind == kind && p.Pattern == pattern {
+			l.entries = append(l.entries[:i:i], l.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// save persists entries, the caller holds the mutex
+func (l *List) save(ctx context.Context) error {
+	if l.Store == nil {
+		return nil
+	}
+	data, err := json.Marshal(l.list())
+	if err != nil {
+		return err
+	}
+	return l.Store.Put(ctx, storeKey, data)
+}
+
+// list returns a copy of entries, the caller holds the mutex
+func (l *List) list() []Entry {
+	entries := make([]Entry, len(l.entries))
+	for i, p := range l.entries {
+		entries[i] = p.Entry
+	}
+	return entries
+}
+
+// Entries returns a copy of all entries
+func (l *List) Entries() []Entry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.list()
+}
+
+// Check returns the action of the entries of kind matching value, allow entries
+// take precedence over deny entries; ok is false if no entry matches. For
+// Header value has the form "Name: value".
+func (l *List) Check(kind Kind, value string) (action Action, ok bool) {
+	var name string
+	if kind == Header {
+		name, value, _ = strings.Cut(value, ":")
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+	}
+	if kind != Client {
+		value = strings.ToLower(strings.Trim(value, "<> "))
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, p := range l.entries {
+		if p.Kind != kind || kind == Header && p.header != name || !p.match(value) {
+			continue
+		}
+		if p.Action == Allow {
+			return Allow, true
+		}
+		action, ok = Deny, true
+	}
+	return action, ok
+}
+
+// response returns the response of a check, nil means no entry matched
+func (l *List) response(kind Kind, value string) milter.Response {
+	action, ok := l.Check(kind, value)
+	switch {
+	case !ok:
+		return nil
+	case action == Allow:
+		return milter.RespAccept
+	case l.Response != nil:
+		return l.Response
+	}
+	return milter.RespReject
+}
+
+// Wrap returns milter which checks every stage against the list before passing
+// it to next
+func (l *List) Wrap(next milter.Milter) milter.Milter {
+	return &listMilter{Milter: next, list: l}
+}
+
+// listMilter applies the list to a single session
+type listMilter struct {
+	milter.Milter
+	list *List
+}
+
+func (l *listMilter) Connect(host string, family string, port uint16, addr net.IP, m *milter.Modifier) (milter.Response, error) {
+	if addr != nil {
+		if resp := l.list.response(Client, addr.String()); resp != nil {
+			return resp, nil
+		}
+	}
+	return l.Milter.Connect(host, family, port, addr, m)
+}
+
+func (l *listMilter) Helo(name string, m *milter.Modifier) (milter.Response, error) {
+	if resp := l.list.response(Helo, name); resp != nil {
+		return resp, nil
+	}
+	return l.Milter.Helo(name, m)
+}
+
+func (l *listMilter) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
+	if resp := l.list.response(Sender, from); resp != nil {
+		return resp, nil
+	}
+	return l.Milter.MailFrom(from, m)
+}
+
+func (l *listMilter) RcptTo(rcptTo string, m *milter.Modifier) (milter.Response, error) {
+	// denied recipients are refused alone, allowed ones accept the message
+	if resp := l.list.response(Recipient, rcptTo); resp != nil {
+		return resp, nil
+	}
+	return l.Milter.RcptTo(rcptTo, m)
+}
+
+func (l *listMilter) Header(name string, value string, m *milter.Modifier) (milter.Response, error) {
+	if resp := l.list.response(Header, name+":"+value); resp != nil {
+		return resp, nil
+	}
+	return l.Milter.Header(name, value, m)
+}
+
+func (l *listMilter) MessageReset() {
+	milter.ResetMessage(l.Milter)
+}
+
+func (l *listMilter) ConnectionReset() {
+	milter.ResetConnection(l.Milter)
+}
@@ -0,0 +1,246 @@
+package miltermime
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// pre-defined errors
+var (
+	EArchiveDepth = errors.New("Archive nesting too deep")
+	EArchiveFiles = errors.New("Archive contains too many files")
+	EArchiveRatio = errors.New("Archive compression ratio too high")
+	EArchiveSize  = errors.New("Archive content too large")
+)
+
+// ArchiveLimits bounds the resources spent unpacking archives, zero fields use
+// the defaults
+type ArchiveLimits struct {
+	// MaxDepth limits nesting of archives within archives, default 3
+	MaxDepth int
+	// MaxFiles limits the number of files listed, default 1000
+	MaxFiles int
+	// MaxSize limits the total decompressed size in bytes, default 100 MiB
+	MaxSize int64
+	// MaxRatio limits the ratio of decompressed to compressed size of archives
+	// larger than one MiB once unpacked, default 100
+	MaxRatio int64
+}
+
+// File is a file found within an archive
+type File struct {
+	// Name is the path of the file, names of nested archives are separated by
+	// slashes as in "outer.zip/inner.tar/file.exe"
+	Name string
+	// Type is the media type detected from content
+	Type string
+	Size int64
+	// SHA256 is the hex encoded digest of content
+	SHA256 string
+	// Depth is the archive nesting level, files of the attachment are at depth 1
+	Depth int
+	// Encrypted is set for files which could not be read because they are
+	// encrypted or use an unsupported compression method
+	Encrypted bool
+}
+
+// Archive returns the files of the attachment if it is an archive
+func (a *Attachment) Archive(limits *ArchiveLimits) ([]File, error) {
+	return InspectArchive(a.Filename, a.Content, limits)
+}
+
+// InspectArchive lists the files of a zip, tar or gzip archive named name,
+// nested archives are unpacked as well. Data which is no archive returns no
+// files. When a limit is exceeded the files found so far are returned together
+// with an error matching one of the EArchive errors, policies should treat
+// this as suspicious rather than as a failure.
+func InspectArchive(name string, data []byte, limits *ArchiveLimits) ([]File, error) {
+	if limits == nil {
+		limits = &ArchiveLimits{}
+	}
+	in := &inspector{limits: limits}
+	err := in.archive(name, data, 1)
+	return in.files, err
+}
+
+// inspector unpacks a single archive
+type inspector struct {
+	limits *ArchiveLimits
+	files  []File
+	total  int64
+}
+
+// defaults for unset limits
+func (l *ArchiveLimits) maxDepth() int {
+	if l.MaxDepth <= 0 {
+		return 3
+	}
+	return l.MaxDepth
+}
+
+func (l *ArchiveLimits) maxFiles() int {
+	if l.MaxFiles <= 0 {
+		return 1000
+	}
+	return l.MaxFiles
+}
+
+func (l *ArchiveLimits) maxSize() int64 {
+	if l.MaxSize <= 0 {
+		return 100 << 20
+	}
+	return l.MaxSize
+}
+
+func (l *ArchiveLimits) maxRatio() int64 {
+	if l.MaxRatio <= 0 {
+		return 100
+	}
+	return l.MaxRatio
+}
+
+// archive format of data
+const (
+	formatNone = iota
+	formatZip
+	formatGzip
+	formatTar
+)
+
+// format detects the archive format of data
+func format(data []byte) int {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return formatZip
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return formatGzip
+	case len(data) >= 262 && string(data[257:262]) == "ustar":
+		return formatTar
+	}
+	return formatNone
+}
+
+// archive lists the files of archive data named name, its files are at depth
+func (in *inspector) archive(name string, data []byte, depth int) error {
+	start := in.total
+	// members are checked against the compression ratio as they are unpacked
+	member := func(member string, r io.Reader) error {
+		if err := in.file(name+"/"+member, r, depth); err != nil {
+			return err
+		}
+		if out := in.total - start; out > 1<<20 && out > in.limits.maxRatio()*int64(len(data)) {
+			return fmt.Errorf("%w: %s unpacks %d bytes to %d", EArchiveRatio, name, len(data), out)
+		}
+		return nil
+	}
+
+	switch format(data) {
+	case formatZip:
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		for _, f := range reader.File {
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			// encrypted files and unknown methods cannot be unpacked
+			rc, err := f.Open()
+			if f.Flags&0x1 != 0 || errors.Is(err, zip.ErrAlgorithm) {
+				if err == nil {
+					rc.Close()
+				}
+				if err := in.add(File{Name: name + "/" + f.Name, Size: int64(f.UncompressedSize64), Depth: depth, Encrypted: true}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = member(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	case formatGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		reader.Multistream(false)
+		// name the content after the archive if gzip header has no name
+		inner := reader.Name
+		if inner == "" {
+			inner = path.Base(name)
+			if strings.HasSuffix(inner, ".tgz") {
+				inner = strings.TrimSuffix(inner, ".tgz") + ".tar"
+			} else {
+				inner = strings.TrimSuffix(inner, ".gz")
+			}
+		}
+		return member(inner, reader)
+	case formatTar:
+		reader := tar.NewReader(bytes.NewReader(data))
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := member(header.Name, reader); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// file reads a single archive member and unpacks it if it is an archive itself
+func (in *inspector) file(name string, r io.Reader, depth int) error {
+	// read one byte over the remaining budget to detect oversized content
+	remaining := in.limits.maxSize() - in.total
+	data, err := io.ReadAll(io.LimitReader(r, remaining+1))
+	in.total += int64(len(data))
+	if int64(len(data)) > remaining {
+		return fmt.Errorf("%w: more than %d bytes", EArchiveSize, in.limits.maxSize())
+	}
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if err := in.add(File{Name: name, Type: detect(data), Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), Depth: depth}); err != nil {
+		return err
+	}
+	if format(data) == formatNone {
+		return nil
+	}
+	if depth >= in.limits.maxDepth() {
+		return fmt.Errorf("%w: %s at depth %d", EArchiveDepth, name, depth)
+	}
+	return in.archive(name, data, depth+1)
+}
+
+// add lists a file
+func (in *inspector) add(file File) error {
+	if len(in.files) >= in.limits.maxFiles() {
+		return fmt.Errorf("%w: more than %d", EArchiveFiles, in.limits.maxFiles())
+	}
+	in.files = append(in.files, file)
+	return nil
+}
@@ -0,0 +1,260 @@
+// Package miltermime inspects the MIME structure of messages received by a milter
+//
+// Handlers collect the body from BodyChunk callbacks and pass it together with
+// the message headers to Attachments at end of message, for example to feed
+// attachments to a virus scanner or a threat intelligence lookup. Parsing is
+// bounded by Limits, so crafted messages cannot make a filter spend unbounded
+// time and memory; violations are reported as errors which Limits.Verdict
+// turns into a response.
+package miltermime
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/phalaaxx/milter"
+)
+
+// pre-defined errors
+var (
+	EMIMEBoundary = errors.New("Malformed MIME boundary")
+	EMIMEDepth    = errors.New("MIME nesting too deep")
+	EMIMEParts    = errors.New("Too many MIME parts")
+)
+
+// Limits bounds MIME parsing, zero fields use the defaults
+type Limits struct {
+	// MaxDepth limits nesting of multipart entities, default 20
+	MaxDepth int
+	// MaxParts limits the number of parts of a message, default 500
+	MaxParts int
+	// MaxBoundaryLength limits boundary length, default 70 as set by RFC 2046
+	MaxBoundaryLength int
+	// Response answers messages violating limits, default a 554 5.6.0 reply
+	Response milter.Response
+}
+
+// defaultLimits is used by Attachments
+var defaultLimits = &Limits{}
+
+// rejectStructure is the default response to messages violating limits
+var rejectStructure = milter.NewResponseStr(milter.ActReplyCode, "554 5.6.0 Message structure not accepted")
+
+// defaults for unset fields
+func (l *Limits) maxDepth() int {
+	if l.MaxDepth <= 0 {
+		return 20
+	}
+	return l.MaxDepth
+}
+
+func (l *Limits) maxParts() int {
+	if l.MaxParts <= 0 {
+		return 500
+	}
+	return l.MaxParts
+}
+
+func (l *Limits) maxBoundaryLength() int {
+	if l.MaxBoundaryLength <= 0 {
+		return 70
+	}
+	return l.MaxBoundaryLength
+}
+
+// Violation returns true if err reports a message violating MIME limits
+func Violation(err error) bool {
+	return errors.Is(err, EMIMEBoundary) || errors.Is(err, EMIMEDepth) || errors.Is(err, EMIMEParts)
+}
+
+// Verdict returns the response to a message whose parsing failed with err, it
+// is nil unless err is a limit violation
+func (l *Limits) Verdict(err error) milter.Response {
+	switch {
+	case !Violation(err):
+		return nil
+	case l.Response != nil:
+		return l.Response
+	}
+	return rejectStructure
+}
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	// Filename is the name given in Content-Disposition or Content-Type
+	Filename string
+	// DeclaredType is the media type of Content-Type, DetectedType the one
+	// detected from content
+	DeclaredType string
+	DetectedType string
+	// Size is the decoded size in bytes
+	Size int64
+	// SHA256 is the hex encoded digest of decoded content
+	SHA256 string
+	// Content holds the decoded data
+	Content []byte
+}
+
+// Attachments returns the attachments of a message with header and body within
+// default limits, see Limits.Attachments
+func Attachments(header textproto.MIMEHeader, body []byte) ([]Attachment, error) {
+	return defaultLimits.Attachments(header, body)
+}
+
+// Attachments returns the attachments of a message with header and body, parts
+// which fail to decode are returned with their raw content. When the message
+// violates limits the attachments found so far are returned with an error
+// matching one of the EMIME errors.
+func (l *Limits) Attachments(header textproto.MIMEHeader, body []byte) ([]Attachment, error) {
+	var attachments []Attachment
+	w := &walker{limits: l, leaf: func(part textproto.MIMEHeader, content []byte) {
+		if attachment, ok := attachment(part, content); ok {
+			attachments = append(attachments, attachment)
+		}
+	}}
+	err := w.walk(header, body, nil)
+	return attachments, err
+}
+
+// walker walks the parts of a message within limits
+type walker struct {
+	limits *Limits
+	leaf   func(textproto.MIMEHeader, []byte)
+	parts  int
+}
+
+// walk calls leaf for every non-multipart part of an entity, boundaries holds
+// the boundaries of enclosing entities
+func (w *walker) walk(header textproto.MIMEHeader, body []byte, boundaries []string) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		w.leaf(header, body)
+		return nil
+	}
+
+	boundary := params["boundary"]
+	switch {
+	case boundary == "":
+		return fmt.Errorf("%w: %s without boundary", EMIMEBoundary, mediaType)
+	case len(boundary) > w.limits.maxBoundaryLength():
+		return fmt.Errorf("%w: boundary of %d characters", EMIMEBoundary, len(boundary))
+	case len(boundaries) >= w.limits.maxDepth():
+		return fmt.Errorf("%w: more than %d levels", EMIMEDepth, w.limits.maxDepth())
+	}
+	// a boundary reused by a nested entity makes parsers disagree on the parts
+	for _, enclosing := range boundaries {
+		if strings.HasPrefix(boundary, enclosing) || strings.HasPrefix(enclosing, boundary) {
+			return fmt.Errorf("%w: %q nested in %q", EMIMEBoundary, boundary, enclosing)
+		}
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", EMIMEBoundary, err)
+		}
+		if w.parts++; w.parts > w.limits.maxParts() {
+			return fmt.Errorf("%w: more than %d", EMIMEParts, w.limits.maxParts())
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("%w: %v", EMIMEBoundary, err)
+		}
+		if err := w.walk(part.Header, content, append(boundaries, boundary)); err != nil {
+			return err
+		}
+	}
+}
+
+// attachment returns the attachment of a leaf part, parts without file name or
+// attachment disposition are attachments unless they hold text
+func attachment(header textproto.MIMEHeader, content []byte) (Attachment, bool) {
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	mediaType, typeParams, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = typeParams["name"]
+	}
+	// some clients encode file names as RFC 2047 words
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if name == "" && disposition != "attachment" && (strings.HasPrefix(mediaType, "text/") || mediaType == "message/rfc822") {
+		return Attachment{}, false
+	}
+
+	data := decode(header.Get("Content-Transfer-Encoding"), content)
+	sum := sha256.Sum256(data)
+	return Attachment{
+		Filename:     name,
+		DeclaredType: mediaType,
+		DetectedType: detect(data),
+		Size:         int64(len(data)),
+		SHA256:       hex.EncodeToString(sum[:]),
+		Content:      data,
+	}, true
+}
+
+// decode undoes the content transfer encoding, undecodable content is returned as is
+func decode(encoding string, content []byte) []byte {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, &lineStripper{r: bytes.NewReader(content)})
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(bytes.NewReader(content))
+	default:
+		return content
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return content
+	}
+	return data
+}
+
+// detect returns the media type of data detected from its content
+func detect(data []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return mediaType
+}
+
+// lineStripper removes line breaks and white space from base64 data
+type lineStripper struct {
+	r io.Reader
+}
+
+// Read implements io.Reader
+func (l *lineStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := l.r.Read(p)
+		kept := 0
+		for _, c := range p[:n] {
+			if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+				p[kept] = c
+				kept++
+			}
+		}
+		if kept != 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package milterpcap imports milter sessions from pcap and pcapng packet captures
+//
+// TCP streams found in a capture are reassembled and every stream which carries
+// the milter protocol is converted into a miltertest.Transcript, so a session
+// captured on the wire can be replayed against a Milter in a regression test.
+package milterpcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// pre-defined errors
+var (
+	EUnknownFormat = errors.New("Unknown packet capture format")
+	ETruncated     = errors.New("Truncated packet capture")
+)
+
+// link layer types
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+// frame is a single captured link layer frame
+type frame struct {
+	link uint16
+	data []byte
+}
+
+// captureReader returns captured frames one at a time
+type captureReader interface {
+	next() (*frame, error)
+}
+
+// newCaptureReader detects capture file format and returns a suitable reader
+func newCaptureReader(r io.Reader) (captureReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, EUnknownFormat
+	}
+	switch binary.BigEndian.Uint32(magic) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		return newPcapReader(br, binary.BigEndian)
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		return newPcapReader(br, binary.LittleEndian)
+	case 0x0a0d0d0a:
+		return &pcapngReader{r: br}, nil
+	}
+	return nil, EUnknownFormat
+}
+
+// pcapReader reads classic libpcap files
+type pcapReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	link  uint16
+}
+
+// newPcapReader parses pcap file header
+func newPcapReader(r io.Reader, order binary.ByteOrder) (*pcapReader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ETruncated
+	}
+	return &pcapReader{
+		r:     r,
+		order: order,
+		link:  uint16(order.Uint32(header[20:])),
+	}, nil
+}
+
+// next reads the following packet record
+func (p *pcapReader) next() (*frame, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ETruncated
+	}
+	data := make([]byte, p.order.Uint32(header[8:]))
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, ETruncated
+	}
+	return &frame{link: p.link, data: data}, nil
+}
+
+// pcapngReader reads pcapng files
+type pcapngReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	links []uint16
+}
+
+// next reads blocks until the following packet block
+func (p *pcapngReader) next() (*frame, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(p.r, header); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, ETruncated
+		}
+		// section header block defines byte order of the section
+		if binary.BigEndian.Uint32(header) == 0x0a0d0d0a {
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(p.r, magic); err != nil {
+				return nil, ETruncated
+			}
+			if binary.BigEndian.Uint32(magic) == 0x1a2b3c4d {
+				p.order = binary.BigEndian
+			} else {
+				p.order = binary.LittleEndian
+			}
+			p.links = nil
+			header = append(header, magic...)
+		} else if p.order == nil {
+			return nil, EUnknownFormat
+		}
+		// read remaining block body including trailing length
+		length := p.order.Uint32(header[4:])
+		if length < uint32(len(header))+4 || length%4 != 0 {
+			return nil, fmt.Errorf("bad pcapng block length %d", length)
+		}
+		body := make([]byte, int(length)-len(header))
+		if _, err := io.ReadFull(p.r, body); err != nil {
+			return nil, ETruncated
+		}
+		body = body[:len(body)-4]
+		switch p.order.Uint32(header) {
+		case 1:
+			// interface description block
+			if len(body) < 2 {
+				return nil, ETruncated
+			}
+			p.links = append(p.links, p.order.Uint16(body))
+		case 2, 6:
+			// obsolete packet block and enhanced packet block
+			if len(body) < 20 {
+				return nil, ETruncated
+			}
+			var iface uint32
+			if p.order.Uint32(header) == 2 {
+				iface = uint32(p.order.Uint16(body))
+			} else {
+				iface = p.order.Uint32(body)
+			}
+			size := p.order.Uint32(body[12:])
+			if uint32(len(body)-20) < size || int(iface) >= len(p.links) {
+				return nil, ETruncated
+			}
+			return &frame{link: p.links[iface], data: body[20 : 20+size]}, nil
+		case 3:
+			// simple packet block always refers to the first interface
+			if len(body) < 4 || len(p.links) == 0 {
+				return nil, ETruncated
+			}
+			size := p.order.Uint32(body)
+			if uint32(len(body)-4) < size {
+				size = uint32(len(body) - 4)
+			}
+			return &frame{link: p.links[0], data: body[4 : 4+size]}, nil
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package milterpcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// tcp flags
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagACK = 0x10
+)
+
+// segment is a decoded TCP segment
+type segment struct {
+	src, dst netip.AddrPort
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+// decodeFrame strips link layer framing and decodes TCP segment, returns nil
+// for anything other than TCP over IPv4 or IPv6
+func decodeFrame(f *frame) *segment {
+	data := f.data
+	var ethertype uint16
+	switch f.link {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		ethertype, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		// skip 802.1Q tags
+		for ethertype == 0x8100 || ethertype == 0x88a8 {
+			if len(data) < 4 {
+				return nil
+			}
+			ethertype, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case linkSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		ethertype, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		ethertype, data = binary.BigEndian.Uint16(data), data[20:]
+	case linkNull, linkLoop:
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+	default:
+		return nil
+	}
+	// protocols without ethertype are told apart by IP version
+	if ethertype == 0 && len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			ethertype = 0x0800
+		case 6:
+			ethertype = 0x86dd
+		}
+	}
+	switch ethertype {
+	case 0x0800:
+		return decodeIPv4(data)
+	case 0x86dd:
+		return decodeIPv6(data)
+	}
+	return nil
+}
+
+// decodeIPv4 decodes an IPv4 packet
+func decodeIPv4(data []byte) *segment {
+	if len(data) < 20 || data[0]>>4 != 4 || data[9] != 6 {
+		return nil
+	}
+	// fragments are not reassembled
+	if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 {
+		return nil
+	}
+	headerLength := int(data[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(data[2:]))
+	if headerLength < 20 || totalLength < headerLength || totalLength > len(data) {
+		return nil
+	}
+	src, _ := netip.AddrFromSlice(data[12:16])
+	dst, _ := netip.AddrFromSlice(data[16:20])
+	return decodeTCP(src, dst, data[headerLength:totalLength])
+}
+
+// decodeIPv6 decodes an IPv6 packet skipping extension headers
+func decodeIPv6(data []byte) *segment {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return nil
+	}
+	payloadLength := int(binary.BigEndian.Uint16(data[4:]))
+	if 40+payloadLength > len(data) {
+		return nil
+	}
+	src, _ := netip.AddrFromSlice(data[8:24])
+	dst, _ := netip.AddrFromSlice(data[24:40])
+	next, payload := data[6], data[40:40+payloadLength]
+	for {
+		switch next {
+		case 6:
+			return decodeTCP(src, dst, payload)
+		case 0, 43, 60:
+			// hop-by-hop, routing and destination options
+			if len(payload) < 8 || len(payload) < (int(payload[1])+1)*8 {
+				return nil
+			}
+			next, payload = payload[0], payload[(int(payload[1])+1)*8:]
+		default:
+			// fragments and other protocols are ignored
+			return nil
+		}
+	}
+}
+
+// decodeTCP decodes a TCP segment
+func decodeTCP(src, dst netip.Addr, data []byte) *segment {
+	if len(data) < 20 {
+		return nil
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil
+	}
+	return &segment{
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(data)),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(data[2:])),
+		seq:     binary.BigEndian.Uint32(data[4:]),
+		flags:   data[13],
+		payload: data[offset:],
+	}
+}
@@ -0,0 +1,210 @@
+package milterpcap
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// Options control which TCP streams are imported
+type Options struct {
+	// Ports lists milter server ports; when empty, streams are recognized by an
+	// option negotiation packet at the beginning of MTA data
+	Ports []uint16
+}
+
+// Stream is a milter session extracted from a capture
+type Stream struct {
+	MTA       netip.AddrPort
+	Milter    netip.AddrPort
+	Commands  miltertest.Transcript
+	Responses []*milter.Message
+	// Truncated is set if stream data has gaps or ends inside a packet
+	Truncated bool
+}
+
+// flow reassembles one direction of a TCP connection
+type flow struct {
+	started bool
+	next    uint32
+	pending map[uint32][]byte
+	data    []byte
+	// index of the first captured packet carrying data
+	first int
+}
+
+// add appends segment payload in sequence order
+func (f *flow) add(s *segment, index int) {
+	if s.flags&flagSYN != 0 {
+		f.started, f.next = true, s.seq+1
+		return
+	}
+	if len(s.payload) == 0 {
+		return
+	}
+	if !f.started {
+		f.started, f.next = true, s.seq
+	}
+	if f.first == 0 {
+		f.first = index
+	}
+	if f.pending == nil {
+		f.pending = make(map[uint32][]byte)
+	}
+	f.pending[s.seq] = s.payload
+	// consume every pending segment which is now in order
+	for progress := true; progress; {
+		progress = false
+		for seq, payload := range f.pending {
+			offset := int32(f.next - seq)
+			if offset < 0 {
+				continue
+			}
+			delete(f.pending, seq)
+			if int(offset) < len(payload) {
+				f.data = append(f.data, payload[offset:]...)
+				f.next += uint32(len(payload)) - uint32(offset)
+			}
+			progress = true
+		}
+	}
+}
+
+// connection tracks both directions of a TCP connection
+type connection struct {
+	client, server netip.AddrPort
+	known          bool
+	flows          map[netip.AddrPort]*flow
+}
+
+// key identifies a connection regardless of direction
+type key struct {
+	a, b netip.AddrPort
+}
+
+// connKey returns the same key for both directions of a segment
+func connKey(s *segment) key {
+	if s.src.Addr().Less(s.dst.Addr()) || (s.src.Addr() == s.dst.Addr() && s.src.Port() < s.dst.Port()) {
+		return key{s.src, s.dst}
+	}
+	return key{s.dst, s.src}
+}
+
+// Import reads a pcap or pcapng capture and returns all milter streams found in it
+func Import(r io.Reader, opts *Options) ([]*Stream, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	reader, err := newCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var order []*connection
+	active := make(map[key]*connection)
+	for index := 1; ; index++ {
+		f, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := decodeFrame(f)
+		if s == nil {
+			continue
+		}
+		k := connKey(s)
+		c := active[k]
+		// initial SYN starts a new connection, even if the tuple is reused
+		if s.flags&(flagSYN|flagACK) == flagSYN || c == nil {
+			c = &connection{client: s.src, server: s.dst, flows: make(map[netip.AddrPort]*flow)}
+			c.known = s.flags&(flagSYN|flagACK) == flagSYN
+			active[k] = c
+			order = append(order, c)
+		}
+		if c.flows[s.src] == nil {
+			c.flows[s.src] = &flow{}
+		}
+		c.flows[s.src].add(s, index)
+	}
+	var streams []*Stream
+	for _, c := range order {
+		if stream := c.stream(opts); stream != nil {
+			streams = append(streams, stream)
+		}
+	}
+	return streams, nil
+}
+
+// ImportFile reads capture file and returns all milter streams found in it
+func ImportFile(path string, opts *Options) ([]*Stream, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Import(file, opts)
+}
+
+// stream converts a connection to a milter stream, returns nil if connection
+// does not carry milter protocol
+func (c *connection) stream(opts *Options) *Stream {
+	client, server := c.client, c.server
+	// without a captured handshake, the MTA is the side which speaks first
+	if !c.known {
+		a, b := c.flows[client], c.flows[server]
+		if b != nil && len(b.data) != 0 && (a == nil || len(a.data) == 0 || b.first < a.first) {
+			client, server = server, client
+		}
+	}
+	in, out := c.flows[client], c.flows[server]
+	if in == nil || len(in.data) == 0 {
+		return nil
+	}
+	if len(opts.Ports) != 0 {
+		found := false
+		for _, port := range opts.Ports {
+			found = found || port == server.Port()
+		}
+		if !found {
+			return nil
+		}
+	} else if len(in.data) < 5 || binary.BigEndian.Uint32(in.data) != 13 || milter.Code(in.data[4]) != milter.CmdOptNeg {
+		return nil
+	}
+	commands, truncated := split(in.data)
+	stream := &Stream{
+		MTA:       client,
+		Milter:    server,
+		Commands:  miltertest.Transcript(commands),
+		Truncated: truncated || len(in.pending) != 0,
+	}
+	if out != nil {
+		responses, truncated := split(out.data)
+		stream.Responses = responses
+		stream.Truncated = stream.Truncated || truncated || len(out.pending) != 0
+	}
+	return stream
+}
+
+// split cuts reassembled stream data into milter packets
+func split(data []byte) ([]*milter.Message, bool) {
+	var messages []*milter.Message
+	for len(data) != 0 {
+		code, payload, n, err := milterwire.DecodeFrame(data)
+		if err != nil {
+			return messages, true
+		}
+		messages = append(messages, &milter.Message{
+			Code: milter.Code(code),
+			Data: payload,
+		})
+		data = data[n:]
+	}
+	return messages, false
+}
@@ -0,0 +1,380 @@
+// Package milterquarantine keeps quarantined messages for later review and release
+//
+// Wrap captures every message of a session and stores a copy when the wrapped
+// milter quarantines it with Modifier.Quarantine. The MTA is told to discard
+// the message instead of holding it in its own queue, so the stored copy is
+// the only one. Released messages are re-injected over SMTP to a relay with
+// their original envelope.
+package milterquarantine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// pre-defined errors
+var (
+	ENotFound = errors.New("Quarantined message not found")
+	ENoRelay  = errors.New("No relay configured for release")
+)
+
+// Message is a quarantined message
+type Message struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Reason     string    `json:"reason"`
+	QueueID    string    `json:"queue_id,omitempty"`
+	Sender     string    `json:"sender"`
+	Recipients []string  `json:"recipients"`
+	// Raw holds headers and body with CRLF line endings, it is not set in listings
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// Store keeps quarantined messages
+type Store interface {
+	Put(ctx context.Context, msg *Message) error
+	Get(ctx context.Context, id string) (*Message, error)
+	// List returns all messages without their Raw content
+	List(ctx context.Context) ([]*Message, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// Dir stores every message as a JSON file in a directory
+type Dir string
+
+// path returns file name of message id
+func (d Dir) path(id string) string {
+	return filepath.Join(string(d), id+".json")
+}
+
+// Put implements Store, messages are written atomically
+func (d Dir) Put(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(string(d), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.path(msg.ID))
+}
+
+// Trim removes temporary files of writes which did not finish within idle,
+// for example after a crash; it implements milter.Trimmer and returns the
+// number of bytes reclaimed
+func (d Dir) Trim(idle time.Duration) int64 {
+	names, err := filepath.Glob(filepath.Join(string(d), ".put-*"))
+	if err != nil {
+		return 0
+	}
+	var reclaimed int64
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil || time.Since(info.ModTime()) < idle {
+			continue
+		}
+		// files which cannot be removed are tried again at the next run
+		if err := os.Remove(name); err != nil {
+			continue
+		}
+		reclaimed += info.Size()
+	}
+	return reclaimed
+}
+
+// Get implements Store
+func (d Dir) Get(ctx context.Context, id string) (*Message, error) {
+	if strings.ContainsAny(id, `/\.`) {
+		return nil, ENotFound
+	}
+	data, err := os.ReadFile(d.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ENotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// List implements Store, messages are sorted by time
+func (d Dir) List(ctx context.Context) ([]*Message, error) {
+	names, err := filepath.Glob(filepath.Join(string(d), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(names))
+	for _, name := range names {
+		msg, err := d.Get(ctx, strings.TrimSuffix(filepath.Base(name), ".json"))
+		if errors.Is(err, ENotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg.Raw = nil
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Time.Before(msgs[j].Time) })
+	return msgs, nil
+}
+
+// Delete implements Store
+func (d Dir) Delete(ctx context.Context, id string) error {
+	if strings.ContainsAny(id, `/\.`) {
+		return ENotFound
+	}
+	err := os.Remove(d.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ENotFound
+	}
+	return err
+}
+
+// Quarantine stores quarantined messages and releases them
+type Quarantine struct {
+	Store Store
+	// Relay is the SMTP host:port released messages are sent to
+	Relay string
+	// Helo is the name used when connecting to Relay, default localhost
+	Helo string
+	// MaxSize limits the size of captured messages, larger messages are left to
+	// the quarantine of the MTA; default 50 MiB
+	MaxSize int
+	// Logger receives released messages, nil means the standard logger;
+	// sessions log through their own Logger
+	Logger milter.Logger
+}
+
+// List returns all quarantined messages without their content
+func (q *Quarantine) List(ctx context.Context) ([]*Message, error) {
+	return q.Store.List(ctx)
+}
+
+// Delete removes a quarantined message without releasing it
+func (q *Quarantine) Delete(ctx context.Context, id string) error {
+	return q.Store.Delete(ctx, id)
+}
+
+// Release re-injects the message id to Relay with its original envelope and
+// removes it from the quarantine
+func (q *Quarantine) Release(ctx context.Context, id string) error {
+	if q.Relay == "" {
+		return ENoRelay
+	}
+	msg, err := q.Store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := q.send(ctx, msg); err != nil {
+		return fmt.Errorf("release %s: %w", id, err)
+	}
+	milter.LoggerOrDefault(q.Logger).Printf("Released quarantined message %s from %s to %d recipients", id, msg.Sender, len(msg.Recipients))
+	return q.Store.Delete(ctx, id)
+}
+
+// send delivers msg to Relay
+func (q *Quarantine) send(ctx context.Context, msg *Message) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", q.Relay)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(q.Relay)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	helo := q.Helo
+	if helo == "" {
+		helo = "localhost"
+	}
+	if err := client.Hello(helo); err != nil {
+		return err
+	}
+	if err := client.Mail(strings.Trim(msg.Sender, "<>")); err != nil {
+		return err
+	}
+	for _, rcpt := range msg.Recipients {
+		if err := client.Rcpt(strings.Trim(rcpt, "<>")); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Raw); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// maxSize returns the capture limit
+func (q *Quarantine) maxSize() int {
+	if q.MaxSize <= 0 {
+		return 50 << 20
+	}
+	return q.MaxSize
+}
+
+// newID returns a random message id
+func newID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// Wrap returns milter which stores the messages next quarantines
+func (q *Quarantine) Wrap(next milter.Milter) milter.Milter {
+	return &quarantineMilter{Milter: next, quarantine: q}
+}
+
+// quarantineMilter captures messages of a single session
+type quarantineMilter struct {
+	milter.Milter
+	quarantine *Quarantine
+	sender     string
+	recipients []string
+	raw        bytes.Buffer
+	oversize   bool
+}
+
+// capture appends data to the raw message within the size limit
+func (q *quarantineMilter) capture(data ...string) {
+	for _, s := range data {
+		if q.oversize || q.raw.Len()+len(s) > q.quarantine.maxSize() {
+			q.oversize = true
+			q.raw.Reset()
+			return
+		}
+		q.raw.WriteString(s)
+	}
+}
+
+func (q *quarantineMilter) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
+	q.sender = from
+	return q.Milter.MailFrom(from, m)
+}
+
+func (q *quarantineMilter) RcptTo(rcptTo string, m *milter.Modifier) (milter.Response, error) {
+	resp, err := q.Milter.RcptTo(rcptTo, m)
+	if err == nil && (resp == nil || resp.Continue()) {
+		q.recipients = append(q.recipients, rcptTo)
+	}
+	return resp, err
+}
+
+func (q *quarantineMilter) Header(name string, value string, m *milter.Modifier) (milter.Response, error) {
+	// header values are sent without the separating space and with bare line feeds
+	raw := strings.ReplaceAll(strings.ReplaceAll(value, "\r\n", "\n"), "\n", "\r\n")
+	if !strings.HasPrefix(raw, " ") && !strings.HasPrefix(raw, "\t") {
+		raw = " " + raw
+	}
+	q.capture(name, ":", raw, "\r\n")
+	return q.Milter.Header(name, value, m)
+}
+
+func (q *quarantineMilter) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
+	q.capture("\r\n")
+	return q.Milter.Headers(h, m)
+}
+
+func (q *quarantineMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
+	q.capture(string(chunk))
+	return q.Milter.BodyChunk(chunk, m)
+}
+
+// Body stores the message if next quarantines it and discards it at the MTA
+func (q *quarantineMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	tx := m.Begin()
+	resp, err := q.Milter.Body(m)
+	if err != nil || q.oversize {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return resp, err
+	}
+	var reason string
+	quarantined := false
+	for _, msg := range tx.Messages() {
+		if msg.Code == milter.ActQuarantine {
+			quarantined = true
+			if reasons := milterwire.DecodeStrings(msg.Data); len(reasons) != 0 {
+				reason = reasons[0]
+			}
+		}
+	}
+	if !quarantined {
+		return resp, tx.Commit()
+	}
+
+	stored := &Message{
+		ID:         newID(),
+		Time:       time.Now(),
+		Reason:     reason,
+		QueueID:    m.Macros["i"],
+		Sender:     q.sender,
+		Recipients: q.recipients,
+		Raw:        bytes.Clone(q.raw.Bytes()),
+	}
+	if err := q.quarantine.Store.Put(m.Context(), stored); err != nil {
+		// the quarantine of the MTA keeps the message instead
+		m.Logf("Error storing quarantined message: %v", err)
+		return resp, tx.Commit()
+	}
+	// other modifications are pointless for a discarded message
+	if err := tx.Rollback(); err != nil {
+		return nil, err
+	}
+	m.Logf("Quarantined message %s from %s: %s", stored.ID, q.sender, reason)
+	return milter.RespDiscard, nil
+}
+
+func (q *quarantineMilter) MessageReset() {
+	q.sender, q.recipients, q.oversize = "", nil, false
+	q.raw.Reset()
+	milter.ResetMessage(q.Milter)
+}
+
+func (q *quarantineMilter) ConnectionReset() {
+	milter.ResetConnection(q.Milter)
+}
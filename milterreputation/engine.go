@@ -0,0 +1,153 @@
+// Package milterreputation scores senders by their past behaviour
+//
+// The engine accumulates signals such as authentication results, bounces and
+// verdicts into decaying scores for every sender address and domain, stored in
+// a milterstore.Store. Policy handlers look up the reputation at MAIL FROM time,
+// either directly through Lookup or by wrapping their milter with Wrap.
+package milterreputation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterstore"
+)
+
+// Signal is a reputation change, positive signals improve reputation
+type Signal float64
+
+// Define common signals
+const (
+	AuthPass  Signal = 1
+	AuthFail  Signal = -2
+	Bounce    Signal = -1
+	Complaint Signal = -3
+	Accepted  Signal = 0.5
+	Rejected  Signal = -1
+	TempFail  Signal = -0.25
+)
+
+// Reputation holds decayed scores of a sender
+type Reputation struct {
+	Address float64
+	Domain  float64
+}
+
+// Score returns combined address and domain score
+func (r Reputation) Score() float64 {
+	return r.Address + r.Domain
+}
+
+// record is the stored state of a single score
+type record struct {
+	Score   float64   `json:"score"`
+	Updated time.Time `json:"updated"`
+}
+
+// Engine accumulates signals into sender reputation
+type Engine struct {
+	Store milterstore.Store
+	// HalfLife is the time it takes a score to halve, default one week
+	HalfLife time.Duration
+	// Clock decays scores, nil means milter.SystemClock
+	Clock milter.Clock
+
+	// serializes read-modify-write cycles of a single process
+	mutex sync.Mutex
+}
+
+// Record adds signal to the reputation of sender address and its domain
+func (e *Engine) Record(ctx context.Context, sender string, signal Signal) error {
+	address, domain := keys(sender)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, key := range []string{address, domain} {
+		if key == "" {
+			continue
+		}
+		rec, err := e.load(ctx, key)
+		if err != nil {
+			return err
+		}
+		rec.Score += float64(signal)
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := e.Store.Put(ctx, key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the current reputation of sender, unknown senders have zero scores
+func (e *Engine) Lookup(ctx context.Context, sender string) (Reputation, error) {
+	address, domain := keys(sender)
+	var rep Reputation
+	for key, score := range map[string]*float64{address: &rep.Address, domain: &rep.Domain} {
+		if key == "" {
+			continue
+		}
+		rec, err := e.load(ctx, key)
+		if err != nil {
+			return Reputation{}, err
+		}
+		*score = rec.Score
+	}
+	return rep, nil
+}
+
+// load reads record of key decayed to current time
+func (e *Engine) load(ctx context.Context, key string) (record, error) {
+	now := e.now()
+	data, err := e.Store.Get(ctx, key)
+	if errors.Is(err, milterstore.ENotFound) {
+		return record{Updated: now}, nil
+	}
+	if err != nil {
+		return record{}, err
+	}
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return record{}, err
+	}
+	if elapsed := now.Sub(rec.Updated); elapsed > 0 {
+		rec.Score *= math.Exp2(-float64(elapsed) / float64(e.halfLife()))
+		rec.Updated = now
+	}
+	return rec, nil
+}
+
+// keys returns store keys of sender address and domain
+func keys(sender string) (address, domain string) {
+	sender = strings.ToLower(strings.Trim(sender, "<>"))
+	if sender == "" {
+		// null sender of bounces has no reputation
+		return "", ""
+	}
+	address = "reputation/address/" + sender
+	if pos := strings.LastIndexByte(sender, '@'); pos != -1 && pos < len(sender)-1 {
+		domain = "reputation/domain/" + sender[pos+1:]
+	}
+	return address, domain
+}
+
+// now returns current time
+func (e *Engine) now() time.Time {
+	return milter.ClockOrSystem(e.Clock).Now()
+}
+
+// halfLife returns score half life
+func (e *Engine) halfLife() time.Duration {
+	if e.HalfLife <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return e.HalfLife
+}
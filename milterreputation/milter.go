@@ -0,0 +1,73 @@
+package milterreputation
+
+import (
+	"context"
+
+	"github.com/phalaaxx/milter"
+)
+
+// Policy decides how to proceed with a sender of known reputation
+type Policy func(from string, rep Reputation, m *milter.Modifier) (milter.Response, error)
+
+// Wrap returns milter which applies policy at MAIL FROM time before passing the
+// command to next and records the final verdict of every message as a signal;
+// reputation store failures are logged and do not affect mail flow
+func (e *Engine) Wrap(next milter.Milter, policy Policy) milter.Milter {
+	return &reputationMilter{Milter: next, engine: e, policy: policy}
+}
+
+// reputationMilter applies reputation policy to a single session
+type reputationMilter struct {
+	milter.Milter
+	engine *Engine
+	policy Policy
+	from   string
+}
+
+// MailFrom looks up sender reputation and applies policy
+func (r *reputationMilter) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
+	r.from = from
+	if r.policy != nil {
+		rep, err := r.engine.Lookup(context.Background(), from)
+		if err != nil {
+			m.Logf("Error looking up sender reputation: %v", err)
+		} else if resp, err := r.policy(from, rep, m); err != nil || !resp.Continue() {
+			// verdicts of the policy itself are not recorded to avoid feedback
+			r.from = ""
+			return resp, err
+		}
+	}
+	return r.Milter.MailFrom(from, m)
+}
+
+// Body records the verdict of the wrapped milter
+func (r *reputationMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	resp, err := r.Milter.Body(m)
+	if err != nil || r.from == "" {
+		return resp, err
+	}
+	signals := map[milter.Code]Signal{
+		milter.ActAccept:   Accepted,
+		milter.ActContinue: Accepted,
+		milter.ActReject:   Rejected,
+		milter.ActDiscard:  Rejected,
+		milter.ActTempFail: TempFail,
+	}
+	if signal, ok := signals[resp.Response().Code]; ok {
+		if err := r.engine.Record(context.Background(), r.from, signal); err != nil {
+			m.Logf("Error recording sender reputation: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// MessageReset forgets the sender of the finished message
+func (r *reputationMilter) MessageReset() {
+	r.from = ""
+	milter.ResetMessage(r.Milter)
+}
+
+// ConnectionReset passes the call on to the wrapped milter
+func (r *reputationMilter) ConnectionReset() {
+	milter.ResetConnection(r.Milter)
+}
@@ -0,0 +1,131 @@
+// Package milterrisk combines connection signals into a single risk score
+//
+// A Pipeline evaluates signal providers such as DNS blocklists, forward
+// confirmed reverse DNS or connection rate history concurrently when a client
+// connects, adds up their weighted scores and maps the total to a response
+// through configurable thresholds, for example a tarpit, tempfail or reject.
+package milterrisk
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phalaaxx/milter"
+)
+
+// Client describes a connecting SMTP client as passed to Milter.Connect
+type Client struct {
+	Host   string
+	Family string
+	Port   uint16
+	Addr   net.IP
+}
+
+// Signal provides a risk score contribution for a client, zero means no risk
+type Signal interface {
+	Name() string
+	Score(ctx context.Context, client *Client) (float64, error)
+}
+
+// SignalFunc adapts a function to the Signal interface, for example to plug in
+// GeoIP or ASN lookups
+type SignalFunc struct {
+	Label string
+	Func  func(ctx context.Context, client *Client) (float64, error)
+}
+
+// Name implements Signal
+func (s SignalFunc) Name() string {
+	return s.Label
+}
+
+// Score implements Signal
+func (s SignalFunc) Score(ctx context.Context, client *Client) (float64, error) {
+	return s.Func(ctx, client)
+}
+
+// Threshold maps scores of at least Score to Response
+type Threshold struct {
+	Score    float64
+	Response milter.Response
+}
+
+// Result holds the outcome of an evaluation
+type Result struct {
+	Score float64
+	// Signals holds the score of every signal and Errors the signals which failed
+	Signals map[string]float64
+	Errors  map[string]error
+}
+
+// Pipeline evaluates signals and applies thresholds
+type Pipeline struct {
+	Signals    []Signal
+	Thresholds []Threshold
+	// Timeout limits a single evaluation, default two seconds; signals which do
+	// not finish in time are counted as failed
+	Timeout time.Duration
+	// Logger receives failed signals of Connect, nil means the standard logger
+	Logger milter.Logger
+}
+
+// Evaluate scores client using all signals concurrently
+func (p *Pipeline) Evaluate(ctx context.Context, client *Client) Result {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := Result{Signals: make(map[string]float64), Errors: make(map[string]error)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, signal := range p.Signals {
+		wg.Add(1)
+		go func(signal Signal) {
+			defer wg.Done()
+			score, err := signal.Score(ctx, client)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				result.Errors[signal.Name()] = err
+				return
+			}
+			result.Signals[signal.Name()] = score
+			result.Score += score
+		}(signal)
+	}
+	wg.Wait()
+	return result
+}
+
+// Response returns the response of the highest threshold reached by score
+func (p *Pipeline) Response(score float64) milter.Response {
+	thresholds := append([]Threshold(nil), p.Thresholds...)
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i].Score > thresholds[j].Score })
+	for _, t := range thresholds {
+		if score >= t.Score {
+			return t.Response
+		}
+	}
+	return milter.RespContinue
+}
+
+// Connect evaluates client and returns the resulting response, it is meant to be
+// returned from Milter.Connect; failed signals are logged
+func (p *Pipeline) Connect(host string, family string, port uint16, addr net.IP) milter.Response {
+	result := p.Evaluate(context.Background(), &Client{host, family, port, addr})
+	for name, err := range result.Errors {
+		milter.LoggerOrDefault(p.Logger).Printf("Error evaluating risk signal %s: %v", name, err)
+	}
+	return p.Response(result.Score)
+}
+
+// Wrap returns milter which applies Connect in front of next
+func (p *Pipeline) Wrap(next milter.Milter) milter.Milter {
+	return milter.ConnectFilter(p.Connect)(next)
+}
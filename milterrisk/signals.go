@@ -0,0 +1,156 @@
+package milterrisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterdns"
+)
+
+// resolver returns r or the shared cache
+func resolver(r milterdns.Resolver) milterdns.Resolver {
+	if r == nil {
+		return milterdns.Default
+	}
+	return r
+}
+
+// notFound returns true if err reports a missing DNS name
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// DNSBL scores clients listed in a DNS blocklist zone
+type DNSBL struct {
+	Zone   string
+	Weight float64
+	// Resolver is used for lookups, default milterdns.Default
+	Resolver milterdns.Resolver
+}
+
+// Name implements Signal
+func (d *DNSBL) Name() string {
+	return "dnsbl:" + d.Zone
+}
+
+// Score implements Signal, listed clients score Weight
+func (d *DNSBL) Score(ctx context.Context, client *Client) (float64, error) {
+	addr, ok := netip.AddrFromSlice(client.Addr)
+	if !ok {
+		return 0, nil
+	}
+	addrs, err := resolver(d.Resolver).LookupHost(ctx, reverseName(addr.Unmap())+d.Zone)
+	if notFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// only answers in 127.0.0.0/8 are listings, others report blocklist errors
+	for _, answer := range addrs {
+		if strings.HasPrefix(answer, "127.") {
+			return d.Weight, nil
+		}
+	}
+	return 0, nil
+}
+
+// reverseName returns reversed address labels followed by a dot
+func reverseName(addr netip.Addr) string {
+	var b strings.Builder
+	if addr.Is4() {
+		ip := addr.As4()
+		for i := len(ip) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip[i])
+		}
+		return b.String()
+	}
+	ip := addr.As16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+	}
+	return b.String()
+}
+
+// FCrDNS scores clients without forward confirmed reverse DNS
+type FCrDNS struct {
+	Weight float64
+	// Resolver is used for lookups, default milterdns.Default
+	Resolver milterdns.Resolver
+}
+
+// Name implements Signal
+func (f *FCrDNS) Name() string {
+	return "fcrdns"
+}
+
+// Score implements Signal, clients whose reverse names do not resolve back to
+// the client address score Weight
+func (f *FCrDNS) Score(ctx context.Context, client *Client) (float64, error) {
+	if client.Addr == nil {
+		return 0, nil
+	}
+	r := resolver(f.Resolver)
+	names, err := r.LookupAddr(ctx, client.Addr.String())
+	if notFound(err) {
+		return f.Weight, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		addrs, err := r.LookupIPAddr(ctx, name)
+		if err != nil && !notFound(err) {
+			return 0, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(client.Addr) {
+				return 0, nil
+			}
+		}
+	}
+	return f.Weight, nil
+}
+
+// Rate scores clients connecting more than Limit times within Window, the score
+// grows by Weight for every Limit connections above the limit
+type Rate struct {
+	Limit  int
+	Window time.Duration
+	Weight float64
+	// Clock measures windows, nil means milter.SystemClock
+	Clock milter.Clock
+
+	mutex   sync.Mutex
+	clients milter.Windows[netip.Addr]
+}
+
+// Name implements Signal
+func (r *Rate) Name() string {
+	return "rate"
+}
+
+// Score implements Signal, every call counts as a connection
+func (r *Rate) Score(ctx context.Context, client *Client) (float64, error) {
+	addr, ok := netip.AddrFromSlice(client.Addr)
+	if !ok || r.Limit <= 0 {
+		return 0, nil
+	}
+	now := milter.ClockOrSystem(r.Clock).Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	window := r.clients.Get(addr.Unmap(), now, r.Window)
+	window.Count++
+	if window.Count <= r.Limit {
+		return 0, nil
+	}
+	return r.Weight * float64(window.Count-r.Limit) / float64(r.Limit), nil
+}
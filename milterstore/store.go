@@ -0,0 +1,107 @@
+// Package milterstore defines the storage interface used by stateful filters
+//
+// Subsystems such as reputation tracking persist small records through Store so
+// that the backend can be chosen by the application. Memory and Dir are simple
+// implementations for single instance deployments, shared deployments plug in
+// a database or key value service.
+package milterstore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// pre-defined errors
+var (
+	ENotFound = errors.New("Key not found")
+)
+
+// Store persists values by key, Get returns ENotFound for missing keys
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Memory is an in-memory store
+type Memory struct {
+	mutex  sync.RWMutex
+	values map[string][]byte
+}
+
+// Get implements Store
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	value, ok := m.values[key]
+	if !ok {
+		return nil, ENotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// Put implements Store
+func (m *Memory) Put(ctx context.Context, key string, value []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values == nil {
+		m.values = make(map[string][]byte)
+	}
+	m.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// Delete implements Store
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+// Dir stores every value in a file of directory, file names are hex encoded keys
+type Dir string
+
+// path returns file name of key
+func (d Dir) path(key string) string {
+	return filepath.Join(string(d), hex.EncodeToString([]byte(key)))
+}
+
+// Get implements Store
+func (d Dir) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := os.ReadFile(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ENotFound
+	}
+	return value, err
+}
+
+// Put implements Store, values are replaced atomically
+func (d Dir) Put(ctx context.Context, key string, value []byte) error {
+	f, err := os.CreateTemp(string(d), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.path(key))
+}
+
+// Delete implements Store
+func (d Dir) Delete(ctx context.Context, key string) error {
+	err := os.Remove(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package miltertest
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// Generators below produce random protocol inputs for property based tests.
+// Regular generators stay within what real MTAs send, adversarial ones add
+// inputs which are valid on the wire but unusual: empty, very long, non-ASCII
+// and control characters. The Random* types implement quick.Generator, other
+// frameworks can call the functions with their own source of randomness.
+
+// pick returns a random element of values
+func pick(r *rand.Rand, values ...string) string {
+	return values[r.Intn(len(values))]
+}
+
+// word returns a random lowercase word of 1 to n letters
+func word(r *rand.Rand, n int) string {
+	b := make([]byte, 1+r.Intn(n))
+	for i := range b {
+		b[i] = byte('a' + r.Intn(26))
+	}
+	return string(b)
+}
+
+// noise returns a random string for adversarial inputs
+func noise(r *rand.Rand) string {
+	switch r.Intn(5) {
+	case 0:
+		return ""
+	case 1:
+		return strings.Repeat(word(r, 8), 1+r.Intn(2000))
+	case 2:
+		return "üñíçødé " + word(r, 8)
+	case 3:
+		return "ctl\x01\x7f\t" + word(r, 8)
+	}
+	return "sp ace\"quote<angle>@" + word(r, 8)
+}
+
+// Domain returns a random domain name
+func Domain(r *rand.Rand) string {
+	labels := make([]string, 1+r.Intn(3))
+	for i := range labels {
+		labels[i] = word(r, 10)
+	}
+	return strings.Join(labels, ".") + "." + pick(r, "com", "org", "net", "example", "test")
+}
+
+// Address returns a random mailbox address without angle brackets
+func Address(r *rand.Rand) string {
+	local := word(r, 12)
+	if r.Intn(4) == 0 {
+		local += pick(r, ".", "+", "-", "_") + word(r, 6)
+	}
+	return local + "@" + Domain(r)
+}
+
+// AdversarialAddress returns a random address which may be empty, quoted,
+// without domain or unusually long
+func AdversarialAddress(r *rand.Rand) string {
+	switch r.Intn(6) {
+	case 0:
+		// null sender
+		return ""
+	case 1:
+		return `"` + word(r, 8) + ` ` + word(r, 8) + `"@` + Domain(r)
+	case 2:
+		return word(r, 12)
+	case 3:
+		return strings.Repeat(word(r, 10), 100) + "@" + Domain(r)
+	case 4:
+		return word(r, 8) + "@[192.0.2." + fmt.Sprint(r.Intn(256)) + "]"
+	}
+	return noise(r) + "@" + Domain(r)
+}
+
+// Headers returns a random set of message headers in order, always including
+// From, To, Subject, Date and Message-Id
+func Headers(r *rand.Rand) []milter.HeaderField {
+	fields := []milter.HeaderField{
+		{Name: "From", Value: Address(r)},
+		{Name: "To", Value: Address(r)},
+		{Name: "Subject", Value: word(r, 10) + " " + word(r, 10)},
+		{Name: "Date", Value: "Mon, 2 Jan 2006 15:04:05 -0700"},
+		{Name: "Message-Id", Value: "<" + word(r, 16) + "@" + Domain(r) + ">"},
+	}
+	for i := r.Intn(8); i > 0; i-- {
+		name := pick(r, "Received", "X-Mailer", "Cc", "Reply-To", "X-"+word(r, 8))
+		fields = append(fields, milter.HeaderField{Name: name, Value: word(r, 20)})
+	}
+	r.Shuffle(len(fields), func(i, j int) { fields[i], fields[j] = fields[j], fields[i] })
+	return fields
+}
+
+// AdversarialHeaders returns headers with duplicates, unusual case, empty and
+// oversized values and folded lines
+func AdversarialHeaders(r *rand.Rand) []milter.HeaderField {
+	fields := Headers(r)
+	for i := 1 + r.Intn(6); i > 0; i-- {
+		switch r.Intn(5) {
+		case 0:
+			// duplicate with different case
+			field := fields[r.Intn(len(fields))]
+			fields = append(fields, milter.HeaderField{Name: strings.ToUpper(field.Name), Value: noise(r)})
+		case 1:
+			fields = append(fields, milter.HeaderField{Name: "X-Empty", Value: ""})
+		case 2:
+			fields = append(fields, milter.HeaderField{Name: "X-Folded", Value: word(r, 10) + "\r\n\t" + word(r, 10)})
+		case 3:
+			fields = append(fields, milter.HeaderField{Name: "Subject", Value: "=?utf-8?B?w7zDsQ==?= " + noise(r)})
+		default:
+			fields = append(fields, milter.HeaderField{Name: "X-" + word(r, 8), Value: noise(r)})
+		}
+	}
+	return fields
+}
+
+// Macros returns random macros of the connect stage as sent by Postfix and
+// Sendmail
+func Macros(r *rand.Rand) map[string]string {
+	macros := map[string]string{
+		"j":             "mx." + Domain(r),
+		"{daemon_name}": pick(r, "smtpd", "MTA", "submission"),
+		"_":             word(r, 8) + " [192.0.2." + fmt.Sprint(r.Intn(256)) + "]",
+	}
+	if r.Intn(2) == 0 {
+		macros["{client_addr}"] = "192.0.2." + fmt.Sprint(r.Intn(256))
+		macros["{client_name}"] = Domain(r)
+	}
+	if r.Intn(3) == 0 {
+		macros["{auth_authen}"] = word(r, 8)
+		macros["{auth_type}"] = pick(r, "PLAIN", "LOGIN")
+	}
+	return macros
+}
+
+// AdversarialMacros returns macros with empty names and values, unusual names
+// and oversized values
+func AdversarialMacros(r *rand.Rand) map[string]string {
+	macros := Macros(r)
+	macros[""] = noise(r)
+	macros["{"+word(r, 8)] = ""
+	macros["{"+word(r, 8)+"}"] = noise(r)
+	return macros
+}
+
+// macroCommand encodes macros for stage in sorted order
+func macroCommand(stage milter.Code, macros map[string]string) *milter.Message {
+	pairs := make([]milterwire.Macro, 0, len(macros))
+	for name, value := range macros {
+		pairs = append(pairs, milterwire.Macro{Name: name, Value: value})
+	}
+	return &milter.Message{Code: milter.CmdMacro, Data: milterwire.EncodeMacros(byte(stage), pairs)}
+}
+
+// Session returns a random valid transcript: option negotiation, connection
+// and one or more messages, some of them aborted, ending with quit
+func Session(r *rand.Rand) Transcript {
+	return session(r, false)
+}
+
+// AdversarialSession returns a random transcript using adversarial addresses,
+// headers and macros in an otherwise valid command order
+func AdversarialSession(r *rand.Rand) Transcript {
+	return session(r, true)
+}
+
+// session generates transcripts for Session and AdversarialSession
+func session(r *rand.Rand, adversarial bool) Transcript {
+	address, headers, macros := Address, Headers, Macros
+	if adversarial {
+		address, headers, macros = AdversarialAddress, AdversarialHeaders, AdversarialMacros
+	}
+	s := NewScenario()
+	s.commands = append(s.commands, macroCommand(milter.CmdConnect, macros(r)))
+	s.Connect(Domain(r), fmt.Sprintf("192.0.2.%d", r.Intn(256))).Helo(Domain(r))
+	for messages := 1 + r.Intn(3); messages > 0; messages-- {
+		s.MailFrom(address(r))
+		for rcpts := 1 + r.Intn(4); rcpts > 0; rcpts-- {
+			s.RcptTo(address(r))
+		}
+		// a quarter of messages is aborted after the recipients
+		if r.Intn(4) == 0 {
+			s.Abort()
+			continue
+		}
+		for _, field := range headers(r) {
+			s.Header(field.Name, field.Value)
+		}
+		body := strings.Repeat(word(r, 60)+"\r\n", r.Intn(200))
+		if adversarial && r.Intn(2) == 0 {
+			body = strings.Repeat("x", 70000+r.Intn(70000))
+		}
+		s.Body(body)
+	}
+	return append(s.Transcript(), &milter.Message{Code: milter.CmdQuit})
+}
+
+// RandomTranscript is a Session generated by testing/quick
+type RandomTranscript Transcript
+
+// Generate implements quick.Generator
+func (RandomTranscript) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(RandomTranscript(Session(r)))
+}
+
+// AdversarialTranscript is an AdversarialSession generated by testing/quick
+type AdversarialTranscript Transcript
+
+// Generate implements quick.Generator
+func (AdversarialTranscript) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(AdversarialTranscript(AdversarialSession(r)))
+}
+
+// RandomAddress is an Address generated by testing/quick
+type RandomAddress string
+
+// Generate implements quick.Generator
+func (RandomAddress) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(RandomAddress(Address(r)))
+}
+
+// RandomHeaders is a Headers set generated by testing/quick
+type RandomHeaders []milter.HeaderField
+
+// Generate implements quick.Generator
+func (RandomHeaders) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(RandomHeaders(Headers(r)))
+}
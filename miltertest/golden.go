@@ -0,0 +1,174 @@
+package miltertest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// UpdateGolden makes Golden rewrite golden files instead of comparing against them,
+// it is enabled by setting MILTERTEST_UPDATE environment variable
+var UpdateGolden = os.Getenv("MILTERTEST_UPDATE") != ""
+
+// Exchange holds a command together with all packets written in response to it
+type Exchange struct {
+	Command   *milter.Message
+	Responses []*milter.Message
+}
+
+// conn replays transcript commands and records written responses
+type conn struct {
+	pending   []byte
+	commands  Transcript
+	exchanges []Exchange
+	output    bytes.Buffer
+}
+
+// Read serves transcript commands one at a time
+func (c *conn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if len(c.commands) == 0 {
+			return 0, io.EOF
+		}
+		// advance to next command
+		msg := c.commands[0]
+		c.commands = c.commands[1:]
+		c.exchanges = append(c.exchanges, Exchange{Command: msg})
+		c.pending = milterwire.EncodeFrame(byte(msg.Code), msg.Data)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write splits output into packets and attributes them to the current command
+func (c *conn) Write(p []byte) (int, error) {
+	c.output.Write(p)
+	for {
+		code, data, n, err := milterwire.DecodeFrame(c.output.Bytes())
+		if err != nil {
+			break
+		}
+		msg := &milter.Message{
+			Code: milter.Code(code),
+			Data: append([]byte(nil), data...),
+		}
+		c.output.Next(n)
+		if len(c.exchanges) == 0 {
+			c.exchanges = append(c.exchanges, Exchange{})
+		}
+		last := &c.exchanges[len(c.exchanges)-1]
+		last.Responses = append(last.Responses, msg)
+	}
+	return len(p), nil
+}
+
+// Close is a no-op
+func (c *conn) Close() error {
+	return nil
+}
+
+// Run drives a milter session created by init through the transcript and
+// returns all commands together with the responses they produced
+func Run(init milter.MilterInit, transcript Transcript) []Exchange {
+	c := &conn{commands: transcript}
+	milter.NewSession(c, milter.WithInit(init)).HandleMilterCommands()
+	return c.exchanges
+}
+
+// Render formats exchanges as readable text; commands are prefixed with ">",
+// responses with "<" and all data is quoted so output is byte exact
+func Render(exchanges []Exchange) []byte {
+	buffer := new(bytes.Buffer)
+	for _, exchange := range exchanges {
+		if exchange.Command != nil {
+			fmt.Fprintf(buffer, "> %c %q\n", byte(exchange.Command.Code), exchange.Command.Data)
+		}
+		for _, resp := range exchange.Responses {
+			fmt.Fprintf(buffer, "< %c %q\n", byte(resp.Code), resp.Data)
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Golden runs init against transcript file and compares the rendered output against
+// golden file, reporting a line diff on mismatch
+func Golden(t testing.TB, init milter.MilterInit, transcriptPath, goldenPath string) {
+	t.Helper()
+	transcript, err := LoadTranscript(transcriptPath)
+	if err != nil {
+		t.Fatalf("load transcript: %v", err)
+	}
+	output := Render(Run(init, transcript))
+	// rewrite golden file if requested
+	if UpdateGolden {
+		if err := os.WriteFile(goldenPath, output, 0644); err != nil {
+			t.Fatalf("update golden file: %v", err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("read golden file: %v", err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Errorf("output differs from %s (-golden +actual):\n%s", goldenPath, Diff(string(expected), string(output)))
+	}
+}
+
+// Diff returns a line based diff between a and b
+func Diff(a, b string) string {
+	x := strings.SplitAfter(a, "\n")
+	y := strings.SplitAfter(b, "\n")
+	// longest common subsequence table
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	// walk the table and emit changed lines
+	buffer := new(strings.Builder)
+	line := func(prefix, text string) {
+		if text == "" {
+			return
+		}
+		buffer.WriteString(prefix + strings.TrimSuffix(text, "\n") + "\n")
+	}
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			line("  ", x[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			line("- ", x[i])
+			i++
+		default:
+			line("+ ", y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		line("- ", x[i])
+	}
+	for ; j < len(y); j++ {
+		line("+ ", y[j])
+	}
+	return buffer.String()
+}
@@ -0,0 +1,248 @@
+package miltertest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// Scenario builds a message exchange and expectations on the milter responses
+// for table driven tests:
+//
+//	miltertest.NewScenario().
+//		Connect("client.example.com", "192.0.2.1").
+//		MailFrom("sender@example.com").
+//		RcptTo("rcpt@example.org").
+//		Header("Subject", "hello").
+//		Body("Hello world\r\n").
+//		ExpectHeaderAdded("X-Spam", "no").
+//		ExpectVerdict(milter.ActAccept).
+//		Run(t, newMilter)
+//
+// Option negotiation offering protocol version 2 with all actions is sent first
+// unless Negotiate is called. Body ends the message, sending end of headers
+// first if needed. Expectations are checked against the responses of the whole
+// scenario and every failure reports the complete exchange.
+type Scenario struct {
+	negotiate   *milter.Message
+	commands    Transcript
+	headersDone bool
+	verdict     *milter.Code
+	expects     []expectation
+}
+
+// expectation checks exchanges and returns a failure description or ""
+type expectation func(exchanges []Exchange) string
+
+// NewScenario returns an empty scenario
+func NewScenario() *Scenario {
+	return &Scenario{}
+}
+
+// add appends a command
+func (s *Scenario) add(code milter.Code, data []byte) *Scenario {
+	s.commands = append(s.commands, &milter.Message{Code: code, Data: data})
+	return s
+}
+
+// Negotiate sends option negotiation with version, actions and protocol flags
+func (s *Scenario) Negotiate(version, actions, protocol uint32) *Scenario {
+	offer := milterwire.OptNeg{Version: version, Actions: actions, Protocol: protocol}
+	s.negotiate = &milter.Message{Code: milter.CmdOptNeg, Data: offer.Encode()}
+	return s
+}
+
+// Macros defines macros for the next command, given as name and value pairs
+func (s *Scenario) Macros(stage milter.Code, pairs ...string) *Scenario {
+	return s.add(milter.CmdMacro, append([]byte{byte(stage)}, milterwire.EncodeStrings(pairs...)...))
+}
+
+// Connect sends a TCP connection from host with IPv4 or IPv6 address addr
+func (s *Scenario) Connect(host, addr string) *Scenario {
+	connect := milterwire.Connect{Hostname: host, Family: '4', Port: 25, Address: addr}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		connect.Family = '6'
+	}
+	return s.add(milter.CmdConnect, connect.Encode())
+}
+
+// Helo sends the HELO name
+func (s *Scenario) Helo(name string) *Scenario {
+	return s.add(milter.CmdHelo, milterwire.EncodeStrings(name))
+}
+
+// MailFrom starts a message from sender with optional ESMTP arguments
+func (s *Scenario) MailFrom(sender string, args ...string) *Scenario {
+	s.headersDone = false
+	return s.add(milter.CmdMail, milterwire.EncodeAddress("<"+sender+">", args...))
+}
+
+// RcptTo adds a recipient with optional ESMTP arguments
+func (s *Scenario) RcptTo(rcpt string, args ...string) *Scenario {
+	return s.add(milter.CmdRcpt, milterwire.EncodeAddress("<"+rcpt+">", args...))
+}
+
+// Unknown sends an SMTP command the MTA did not recognize
+func (s *Scenario) Unknown(cmd string) *Scenario {
+	return s.add(milter.CmdUnknown, milterwire.EncodeStrings(cmd))
+}
+
+// Data sends the start of message data
+func (s *Scenario) Data() *Scenario {
+	return s.add(milter.CmdData, nil)
+}
+
+// Header sends a message header
+func (s *Scenario) Header(name, value string) *Scenario {
+	return s.add(milter.CmdHeader, milterwire.EncodeHeader(name, value))
+}
+
+// EndOfHeaders sends end of headers, Body sends it automatically
+func (s *Scenario) EndOfHeaders() *Scenario {
+	s.headersDone = true
+	return s.add(milter.CmdEOH, nil)
+}
+
+// Body sends body in chunks of at most 64KiB followed by end of message
+func (s *Scenario) Body(body string) *Scenario {
+	if !s.headersDone {
+		s.EndOfHeaders()
+	}
+	for len(body) != 0 {
+		n := min(len(body), 65535)
+		s.add(milter.CmdBody, []byte(body[:n]))
+		body = body[n:]
+	}
+	return s.add(milter.CmdEOB, nil)
+}
+
+// Abort aborts the current message
+func (s *Scenario) Abort() *Scenario {
+	return s.add(milter.CmdAbort, nil)
+}
+
+// ExpectVerdict expects code as the last response of the scenario
+func (s *Scenario) ExpectVerdict(code milter.Code) *Scenario {
+	s.verdict = &code
+	return s
+}
+
+// ExpectModification expects at least one response packet with code
+func (s *Scenario) ExpectModification(code milter.Code) *Scenario {
+	s.expects = append(s.expects, func(exchanges []Exchange) string {
+		for _, resp := range responses(exchanges) {
+			if resp.Code == code {
+				return ""
+			}
+		}
+		return fmt.Sprintf("expected modification %v, none sent", code)
+	})
+	return s
+}
+
+// ExpectNoModifications expects no modification packets at all
+func (s *Scenario) ExpectNoModifications() *Scenario {
+	s.expects = append(s.expects, func(exchanges []Exchange) string {
+		for _, resp := range responses(exchanges) {
+			if modification(resp.Code) {
+				return fmt.Sprintf("expected no modifications, got %v %q", resp.Code, resp.Data)
+			}
+		}
+		return ""
+	})
+	return s
+}
+
+// ExpectHeaderAdded expects a header added or inserted with name and value
+func (s *Scenario) ExpectHeaderAdded(name, value string) *Scenario {
+	s.expects = append(s.expects, func(exchanges []Exchange) string {
+		for _, resp := range responses(exchanges) {
+			var field, content string
+			var err error
+			switch resp.Code {
+			case milter.ActAddHeader:
+				field, content, err = milterwire.DecodeHeader(resp.Data)
+			case milter.ActInsHeader:
+				_, field, content, err = milterwire.DecodeIndexedHeader(resp.Data)
+			default:
+				continue
+			}
+			if err == nil && strings.EqualFold(field, name) && content == value {
+				return ""
+			}
+		}
+		return fmt.Sprintf("expected header %s: %s to be added", name, value)
+	})
+	return s
+}
+
+// Expect adds a custom expectation, check returns a failure description or ""
+func (s *Scenario) Expect(check func(exchanges []Exchange) string) *Scenario {
+	s.expects = append(s.expects, check)
+	return s
+}
+
+// Transcript returns the commands of the scenario including negotiation
+func (s *Scenario) Transcript() Transcript {
+	negotiate := s.negotiate
+	if negotiate == nil {
+		offer := milterwire.OptNeg{Version: 2, Actions: 0x3f, Protocol: 0}
+		negotiate = &milter.Message{Code: milter.CmdOptNeg, Data: offer.Encode()}
+	}
+	return append(Transcript{negotiate}, s.commands...)
+}
+
+// Check runs the scenario with a milter created by init and returns exchanges
+// and failed expectations
+func (s *Scenario) Check(init milter.MilterInit) ([]Exchange, []string) {
+	exchanges := Run(init, s.Transcript())
+	var failures []string
+	if s.verdict != nil {
+		all := responses(exchanges)
+		switch {
+		case len(all) == 0:
+			failures = append(failures, fmt.Sprintf("expected verdict %v, no response sent", *s.verdict))
+		case all[len(all)-1].Code != *s.verdict:
+			failures = append(failures, fmt.Sprintf("expected verdict %v, got %v", *s.verdict, all[len(all)-1].Code))
+		}
+	}
+	for _, expect := range s.expects {
+		if failure := expect(exchanges); failure != "" {
+			failures = append(failures, failure)
+		}
+	}
+	return exchanges, failures
+}
+
+// Run runs the scenario and reports failed expectations to t
+func (s *Scenario) Run(t testing.TB, init milter.MilterInit) {
+	t.Helper()
+	exchanges, failures := s.Check(init)
+	if len(failures) != 0 {
+		t.Errorf("%s\nexchange:\n%s", strings.Join(failures, "\n"), Render(exchanges))
+	}
+}
+
+// responses returns all responses in order
+func responses(exchanges []Exchange) []*milter.Message {
+	var all []*milter.Message
+	for _, exchange := range exchanges {
+		all = append(all, exchange.Responses...)
+	}
+	return all
+}
+
+// modification returns true if code is a message modification
+func modification(code milter.Code) bool {
+	switch code {
+	case milter.ActAddRcpt, milter.ActDelRcpt, milter.ActAddRcptPar, milter.ActReplBody,
+		milter.ActChgFrom, milter.ActAddHeader, milter.ActInsHeader, milter.ActChgHeader,
+		milter.ActQuarantine:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+// Package miltertest provides utilities for regression testing of milters
+//
+// A transcript is a plain text script of commands sent by the MTA, one per
+// line. Running a Milter against a transcript records every packet written
+// back in response, which can then be compared against a golden file.
+//
+// Transcript lines start with a command code followed by its fields. Fields are
+// bare words or Go quoted strings:
+//
+//	# comments and empty lines are ignored
+//	O 6 0x1ff 0
+//	D C j mx.example.org {daemon_name} smtpd
+//	C client.example.com 4 25 192.0.2.1
+//	H client.example.com
+//	M <sender@example.com> SIZE=1024
+//	R <rcpt@example.org>
+//	L Subject "Hello world"
+//	N
+//	B "Hello\r\nworld\r\n"
+//	E
+//	Q
+//
+// A command code prefixed with "=" takes a single quoted field holding the raw
+// payload, which allows replaying packets that do not fit the regular syntax:
+//
+//	=C "client.example.com\x00"
+package miltertest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// Transcript is a sequence of commands sent by the MTA
+type Transcript []*milter.Message
+
+// ParseTranscript reads a transcript script from r
+func ParseTranscript(r io.Reader) (Transcript, error) {
+	var transcript Transcript
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		// skip comments and empty lines
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields, err := splitFields(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		msg, err := encodeCommand(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		transcript = append(transcript, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return transcript, nil
+}
+
+// LoadTranscript reads a transcript script from file
+func LoadTranscript(path string) (Transcript, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseTranscript(file)
+}
+
+// splitFields splits a line into bare words and Go quoted strings
+func splitFields(text string) ([]string, error) {
+	var fields []string
+	for text = strings.TrimLeft(text, " \t"); text != ""; text = strings.TrimLeft(text, " \t") {
+		if text[0] != '"' {
+			end := strings.IndexAny(text, " \t")
+			if end == -1 {
+				end = len(text)
+			}
+			fields = append(fields, text[:end])
+			text = text[end:]
+			continue
+		}
+		// find closing quote of a quoted string
+		quoted, err := strconv.QuotedPrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad quoted string: %s", text)
+		}
+		value, _ := strconv.Unquote(quoted)
+		fields = append(fields, value)
+		text = text[len(quoted):]
+	}
+	return fields, nil
+}
+
+// encodeCommand converts transcript fields to a milter command
+func encodeCommand(fields []string) (*milter.Message, error) {
+	// raw payload
+	if len(fields[0]) == 2 && fields[0][0] == '=' {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("raw command %s takes a single field", fields[0])
+		}
+		return &milter.Message{Code: milter.Code(fields[0][1]), Data: []byte(fields[1])}, nil
+	}
+	if len(fields[0]) != 1 {
+		return nil, fmt.Errorf("bad command code: %s", fields[0])
+	}
+	code, args := milter.Code(fields[0][0]), fields[1:]
+	switch code {
+	case milter.CmdAbort, milter.CmdEOB, milter.CmdQuitNC, milter.CmdEOH, milter.CmdQuit, milter.CmdData:
+		// commands without data
+		if len(args) != 0 {
+			return nil, fmt.Errorf("command %c takes no arguments", byte(code))
+		}
+		return &milter.Message{Code: code}, nil
+
+	case milter.CmdBody:
+		// raw body chunk
+		return &milter.Message{Code: code, Data: []byte(strings.Join(args, " "))}, nil
+
+	case milter.CmdConnect:
+		// hostname, family, port and address
+		if len(args) < 2 || len(args) > 4 || len(args[1]) != 1 {
+			return nil, fmt.Errorf("usage: C hostname family [port [address]]")
+		}
+		connect := milterwire.Connect{Hostname: args[0], Family: args[1][0]}
+		if len(args) == 2 {
+			return &milter.Message{Code: code, Data: connect.Encode()}, nil
+		}
+		port, err := strconv.ParseUint(args[2], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad port: %v", err)
+		}
+		connect.Port = uint16(port)
+		if len(args) == 4 {
+			connect.Address = args[3]
+		}
+		data := connect.Encode()
+		if len(args) == 3 {
+			// port without address
+			data = data[:len(data)-1]
+		}
+		return &milter.Message{Code: code, Data: data}, nil
+
+	case milter.CmdMacro:
+		// macro stage followed by name and value pairs
+		if len(args) == 0 || len(args[0]) != 1 || len(args)%2 != 1 {
+			return nil, fmt.Errorf("usage: D stage [name value]...")
+		}
+		return &milter.Message{Code: code, Data: append([]byte(args[0]), milterwire.EncodeStrings(args[1:]...)...)}, nil
+
+	case milter.CmdOptNeg:
+		// version, actions and protocol
+		if len(args) != 3 {
+			return nil, fmt.Errorf("usage: O version actions protocol")
+		}
+		var values [3]uint32
+		for i, arg := range args {
+			value, err := strconv.ParseUint(arg, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad number: %v", err)
+			}
+			values[i] = uint32(value)
+		}
+		optneg := milterwire.OptNeg{Version: values[0], Actions: values[1], Protocol: values[2]}
+		return &milter.Message{Code: code, Data: optneg.Encode()}, nil
+
+	default:
+		// every other command is a sequence of C strings
+		return &milter.Message{Code: code, Data: milterwire.EncodeStrings(args...)}, nil
+	}
+}
+
+// WriteTranscript writes transcript t to w in script form, commands which can not
+// be expressed with regular syntax are written as raw payload
+func WriteTranscript(w io.Writer, t Transcript) error {
+	for _, msg := range t {
+		if _, err := fmt.Fprintln(w, formatCommand(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quote returns bare words as is and quotes everything else
+func quote(field string) string {
+	if field == "" || strings.ContainsAny(field, " \t\"#") || strconv.Quote(field) != `"`+field+`"` {
+		return strconv.Quote(field)
+	}
+	return field
+}
+
+// formatCommand converts a command to a single transcript line
+func formatCommand(msg *milter.Message) string {
+	raw := fmt.Sprintf("=%c %q", byte(msg.Code), msg.Data)
+	var fields []string
+	switch msg.Code {
+	case milter.CmdAbort, milter.CmdEOB, milter.CmdQuitNC, milter.CmdEOH, milter.CmdQuit, milter.CmdData:
+		// commands without data
+	case milter.CmdBody:
+		fields = []string{strconv.Quote(string(msg.Data))}
+	case milter.CmdConnect:
+		connect, err := milterwire.DecodeConnect(msg.Data)
+		if err != nil {
+			return raw
+		}
+		fields = []string{quote(connect.Hostname), quote(string(connect.Family))}
+		if connect.Family != 'U' || connect.Port != 0 || connect.Address != "" {
+			fields = append(fields, strconv.Itoa(int(connect.Port)), quote(connect.Address))
+		}
+	case milter.CmdMacro:
+		stage, macros, err := milterwire.DecodeMacros(msg.Data)
+		if err != nil {
+			return raw
+		}
+		fields = []string{quote(string(stage))}
+		for _, macro := range macros {
+			fields = append(fields, quote(macro.Name), quote(macro.Value))
+		}
+	case milter.CmdOptNeg:
+		optneg, err := milterwire.DecodeOptNeg(msg.Data)
+		if err != nil || len(optneg.Macros) != 0 {
+			return raw
+		}
+		for _, value := range []uint32{optneg.Version, optneg.Actions, optneg.Protocol} {
+			fields = append(fields, fmt.Sprintf("0x%x", value))
+		}
+	default:
+		for _, value := range milterwire.DecodeStrings(msg.Data) {
+			fields = append(fields, quote(value))
+		}
+	}
+	line := strings.Join(append([]string{string(rune(msg.Code))}, fields...), " ")
+	// fall back to raw payload unless line reproduces the exact packet
+	parsed, err := splitFields(line)
+	if err != nil {
+		return raw
+	}
+	if check, err := encodeCommand(parsed); err != nil || check.Code != msg.Code || !bytes.Equal(check.Data, msg.Data) {
+		return raw
+	}
+	return line
+}
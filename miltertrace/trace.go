@@ -0,0 +1,230 @@
+// Package miltertrace traces milter sessions with spans per message and callback
+//
+// Tracing is independent of a tracing library, Tracer and Span are small
+// enough to be implemented by an adapter to OpenTelemetry or any other system:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, miltertrace.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name)
+//		return ctx, otelSpan{span}
+//	}
+//
+// Every message transaction gets a span from its first callback, the connect
+// callback for the first message of a connection and MAIL FROM for later
+// ones, until the end of the message. Callbacks get child spans and their
+// Modifier context carries the callback span, so requests to scanners and
+// other backends made with it join the trace.
+package miltertrace
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"sync"
+
+	"github.com/phalaaxx/milter"
+)
+
+// Attribute keys set on spans
+const (
+	AttrSessionID = "milter.session_id"
+	AttrMessageID = "milter.message_id"
+	AttrQueueID   = "milter.queue_id"
+	AttrResponse  = "milter.response"
+)
+
+// Tracer starts spans
+type Tracer interface {
+	// Start starts span name as a child of the span carried by ctx, if any,
+	// and returns a context carrying the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation
+type Span interface {
+	SetAttribute(key, value string)
+	RecordError(err error)
+	End()
+}
+
+// Tracing traces the milters it wraps
+type Tracing struct {
+	Tracer Tracer
+	// Detailed adds spans for every header and body chunk, they are left out
+	// by default as messages carry many of them
+	Detailed bool
+}
+
+// Wrap returns milter tracing the callbacks of next
+func (t *Tracing) Wrap(next milter.Milter) milter.Milter {
+	return &traceMilter{Milter: next, tracing: t}
+}
+
+// traceMilter traces a single session
+type traceMilter struct {
+	milter.Milter
+	tracing *Tracing
+
+	// mutex guards the transaction span which also ends when the session does
+	mutex sync.Mutex
+	ctx   context.Context
+	span  Span
+	// messageID and queueID are set once known
+	messageID bool
+	queueID   bool
+	stop      func() bool
+	// spans counts transaction spans, so a late end of a previous one is ignored
+	spans uint64
+}
+
+// spanContext carries the values of a span context and the cancellation of the
+// Modifier context
+type spanContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c spanContext) Value(key any) any {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+// transaction returns the context of the transaction span, the span is started
+// if there is none
+func (t *traceMilter) transaction(m *milter.Modifier) context.Context {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.span == nil {
+		t.ctx, t.span = t.tracing.Tracer.Start(context.Background(), "milter.message")
+		t.span.SetAttribute(AttrSessionID, m.SessionID())
+		// sessions may end without finishing the message
+		t.spans++
+		n := t.spans
+		t.stop = context.AfterFunc(m.Context(), func() { t.end(n) })
+	}
+	if id := m.MessageID(); id != "" && !t.messageID {
+		t.span.SetAttribute(AttrMessageID, id)
+		t.messageID = true
+	}
+	if id := m.Macro("i"); id != "" && !t.queueID {
+		t.span.SetAttribute(AttrQueueID, id)
+		t.queueID = true
+	}
+	return t.ctx
+}
+
+// end ends transaction span n, zero ends the current one
+func (t *traceMilter) end(n uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.span == nil || n != 0 && n != t.spans {
+		return
+	}
+	t.stop()
+	t.span.End()
+	t.ctx, t.span, t.messageID, t.queueID, t.stop = nil, nil, false, false, nil
+}
+
+// trace runs callback name in a child span of the transaction
+func (t *traceMilter) trace(name string, m *milter.Modifier, callback func() (milter.Response, error)) (milter.Response, error) {
+	ctx, span := t.tracing.Tracer.Start(t.transaction(m), "milter."+name)
+	parent := m.Context()
+	m.SetContext(spanContext{parent, ctx})
+	resp, err := callback()
+	m.SetContext(parent)
+	switch {
+	case err != nil:
+		span.RecordError(err)
+	case resp != nil:
+		span.SetAttribute(AttrResponse, resp.Response().Code.String())
+	}
+	span.End()
+	return resp, err
+}
+
+func (t *traceMilter) Connect(host string, family string, port uint16, addr net.IP, m *milter.Modifier) (milter.Response, error) {
+	return t.trace("Connect", m, func() (milter.Response, error) {
+		return t.Milter.Connect(host, family, port, addr, m)
+	})
+}
+
+func (t *traceMilter) Helo(name string, m *milter.Modifier) (milter.Response, error) {
+	return t.trace("Helo", m, func() (milter.Response, error) {
+		return t.Milter.Helo(name, m)
+	})
+}
+
+func (t *traceMilter) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
+	return t.trace("MailFrom", m, func() (milter.Response, error) {
+		return t.Milter.MailFrom(from, m)
+	})
+}
+
+func (t *traceMilter) RcptTo(rcptTo string, m *milter.Modifier) (milter.Response, error) {
+	return t.trace("RcptTo", m, func() (milter.Response, error) {
+		return t.Milter.RcptTo(rcptTo, m)
+	})
+}
+
+func (t *traceMilter) Data(m *milter.Modifier) (milter.Response, error) {
+	return t.trace("Data", m, func() (milter.Response, error) {
+		return t.Milter.Data(m)
+	})
+}
+
+func (t *traceMilter) Header(name string, value string, m *milter.Modifier) (milter.Response, error) {
+	if !t.tracing.Detailed {
+		return t.Milter.Header(name, value, m)
+	}
+	return t.trace("Header", m, func() (milter.Response, error) {
+		return t.Milter.Header(name, value, m)
+	})
+}
+
+func (t *traceMilter) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
+	return t.trace("Headers", m, func() (milter.Response, error) {
+		return t.Milter.Headers(h, m)
+	})
+}
+
+func (t *traceMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
+	if !t.tracing.Detailed {
+		return t.Milter.BodyChunk(chunk, m)
+	}
+	return t.trace("BodyChunk", m, func() (milter.Response, error) {
+		return t.Milter.BodyChunk(chunk, m)
+	})
+}
+
+func (t *traceMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	return t.trace("Body", m, func() (milter.Response, error) {
+		return t.Milter.Body(m)
+	})
+}
+
+func (t *traceMilter) Abort(m *milter.Modifier) error {
+	_, err := t.trace("Abort", m, func() (milter.Response, error) {
+		return nil, t.Milter.Abort(m)
+	})
+	return err
+}
+
+func (t *traceMilter) Unknown(cmd string, m *milter.Modifier) (milter.Response, error) {
+	return t.trace("Unknown", m, func() (milter.Response, error) {
+		return t.Milter.Unknown(cmd, m)
+	})
+}
+
+// MessageReset ends the transaction span
+func (t *traceMilter) MessageReset() {
+	t.end(0)
+	milter.ResetMessage(t.Milter)
+}
+
+// ConnectionReset passes the call on to the wrapped milter
+func (t *traceMilter) ConnectionReset() {
+	milter.ResetConnection(t.Milter)
+}
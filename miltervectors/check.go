@@ -0,0 +1,214 @@
+package miltervectors
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// DecodeFunc reads a single framed packet from r
+type DecodeFunc func(r io.Reader) (code byte, data []byte, err error)
+
+// EncodeFunc writes a single framed packet to w
+type EncodeFunc func(w io.Writer, code byte, data []byte) error
+
+// ProcessFunc handles a single decoded command sent by the MTA
+type ProcessFunc func(code byte, data []byte) (milter.Response, error)
+
+// Failure describes a vector an implementation did not conform to
+type Failure struct {
+	Vector Vector
+	Reason string
+}
+
+// Error implements the error interface
+func (f Failure) Error() string {
+	return fmt.Sprintf("%s %s (v%d): %s", f.Vector.Direction, f.Vector.Name, f.Vector.Version, f.Reason)
+}
+
+// guard converts a panic in fn into a failure reason
+func guard(fn func() string) (reason string) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason = fmt.Sprintf("panic: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// CheckDecode feeds every vector to decode and reports unexpected results;
+// well formed vectors must decode to their code and data, vectors with broken
+// framing must yield an error
+func CheckDecode(decode DecodeFunc) []Failure {
+	var failures []Failure
+	for _, v := range All() {
+		reason := guard(func() string {
+			code, data, err := decode(bytes.NewReader(v.Wire))
+			if v.Fault == BadFrame {
+				if err == nil {
+					return "decoded broken frame without error"
+				}
+				return ""
+			}
+			if err != nil {
+				return fmt.Sprintf("decode error: %v", err)
+			}
+			if code != v.Code {
+				return fmt.Sprintf("code %q, expected %q", code, v.Code)
+			}
+			if !bytes.Equal(data, v.Data) {
+				return fmt.Sprintf("data %q, expected %q", data, v.Data)
+			}
+			return ""
+		})
+		if reason != "" {
+			failures = append(failures, Failure{v, reason})
+		}
+	}
+	return failures
+}
+
+// CheckEncode encodes every well formed vector and compares the output against its wire bytes
+func CheckEncode(encode EncodeFunc) []Failure {
+	var failures []Failure
+	for _, v := range All() {
+		if v.Fault == BadFrame {
+			continue
+		}
+		reason := guard(func() string {
+			buffer := new(bytes.Buffer)
+			if err := encode(buffer, v.Code, v.Data); err != nil {
+				return fmt.Sprintf("encode error: %v", err)
+			}
+			if !bytes.Equal(buffer.Bytes(), v.Wire) {
+				return fmt.Sprintf("wire %q, expected %q", buffer.Bytes(), v.Wire)
+			}
+			return ""
+		})
+		if reason != "" {
+			failures = append(failures, Failure{v, reason})
+		}
+	}
+	return failures
+}
+
+// CheckProcess passes every correctly framed command to process; commands with
+// invalid payload must be refused with an error or a non-continue response and
+// no command may cause a panic
+func CheckProcess(process ProcessFunc) []Failure {
+	var failures []Failure
+	for _, v := range All() {
+		if v.Direction != ToMilter || v.Fault == BadFrame {
+			continue
+		}
+		reason := guard(func() string {
+			resp, err := process(v.Code, append([]byte(nil), v.Data...))
+			if v.Fault == BadPayload && err == nil && resp != nil && resp.Continue() {
+				return "accepted invalid payload"
+			}
+			return ""
+		})
+		if reason != "" {
+			failures = append(failures, Failure{v, reason})
+		}
+	}
+	return failures
+}
+
+// stream adapts a reader or writer to the session socket interface
+type stream struct {
+	io.Reader
+	io.Writer
+}
+
+// Close is a no-op
+func (s stream) Close() error {
+	return nil
+}
+
+// Decode reads a packet with the milter library implementation
+func Decode(r io.Reader) (byte, []byte, error) {
+	session := milter.MilterSession{Sock: stream{Reader: r}}
+	msg, err := session.ReadPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	return byte(msg.Code), msg.Data, nil
+}
+
+// Encode writes a packet with the milter library implementation
+func Encode(w io.Writer, code byte, data []byte) error {
+	session := milter.MilterSession{Sock: stream{Writer: w}}
+	return session.WritePacket(&milter.Message{Code: milter.Code(code), Data: data})
+}
+
+// Process handles a command with a fresh milter library session
+func Process(code byte, data []byte) (milter.Response, error) {
+	session := milter.MilterSession{
+		Sock:   stream{Writer: io.Discard},
+		Milter: nopMilter{},
+	}
+	return session.Process(&milter.Message{Code: milter.Code(code), Data: data})
+}
+
+// Check runs all conformance assertions against the milter library itself,
+// both the session and the standalone milterwire codec
+func Check() []Failure {
+	failures := CheckDecode(Decode)
+	failures = append(failures, CheckEncode(Encode)...)
+	failures = append(failures, CheckDecode(milterwire.ReadFrame)...)
+	failures = append(failures, CheckEncode(milterwire.WriteFrame)...)
+	return append(failures, CheckProcess(Process)...)
+}
+
+// nopMilter continues at every stage
+type nopMilter struct{}
+
+func (nopMilter) Connect(string, string, uint16, net.IP, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) Helo(string, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) MailFrom(string, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) RcptTo(string, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) Data(*milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) Header(string, string, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) Headers(textproto.MIMEHeader, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) BodyChunk([]byte, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) Body(*milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func (nopMilter) Abort(*milter.Modifier) error {
+	return nil
+}
+
+func (nopMilter) Unknown(string, *milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
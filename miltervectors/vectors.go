@@ -0,0 +1,207 @@
+// Package miltervectors publishes canonical milter wire-format test vectors
+//
+// Every vector holds the exact bytes of one framed packet as seen on the socket
+// together with its decoded command code and payload. Vectors cover all
+// commands sent by the MTA and all responses sent by the milter for protocol
+// versions 2 and 6, as well as malformed packets which a conforming
+// implementation must refuse without crashing.
+package miltervectors
+
+import (
+	"encoding/binary"
+)
+
+// Direction tells which side of the connection sends a packet
+type Direction int
+
+const (
+	// ToMilter packets are commands sent by the MTA
+	ToMilter Direction = iota
+	// ToMTA packets are responses sent by the milter
+	ToMTA
+)
+
+// String returns a human readable direction name
+func (d Direction) String() string {
+	if d == ToMilter {
+		return "MTA->milter"
+	}
+	return "milter->MTA"
+}
+
+// Fault classifies what is wrong with a malformed vector
+type Fault int
+
+const (
+	// None marks a well formed packet
+	None Fault = iota
+	// BadFrame marks a packet whose framing can not be decoded
+	BadFrame
+	// BadPayload marks a correctly framed packet with invalid contents
+	BadPayload
+)
+
+// Vector is a single wire-format test case
+type Vector struct {
+	Name      string
+	Version   uint32
+	Direction Direction
+	Wire      []byte
+	Code      byte
+	Data      []byte
+	Fault     Fault
+}
+
+// Valid returns true if vector describes a well formed packet
+func (v Vector) Valid() bool {
+	return v.Fault == None
+}
+
+// frame builds the wire representation of a packet
+func frame(code byte, data []byte) []byte {
+	wire := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(wire, uint32(len(data)+1))
+	wire[4] = code
+	return append(wire, data...)
+}
+
+// cstr joins strings as a sequence of NUL terminated C strings
+func cstr(values ...string) []byte {
+	var data []byte
+	for _, value := range values {
+		data = append(data, value...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+// join concatenates byte slices
+func join(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+// u16 encodes a big endian uint16
+func u16(value uint16) []byte {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return data
+}
+
+// u32 encodes a sequence of big endian uint32 values
+func u32(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[4*i:], value)
+	}
+	return data
+}
+
+// valid creates a well formed vector
+func valid(name string, version uint32, dir Direction, code byte, data []byte) Vector {
+	return Vector{
+		Name:      name,
+		Version:   version,
+		Direction: dir,
+		Wire:      frame(code, data),
+		Code:      code,
+		Data:      data,
+	}
+}
+
+// payload creates a correctly framed vector with invalid contents
+func payload(name string, version uint32, code byte, data []byte) Vector {
+	v := valid(name, version, ToMilter, code, data)
+	v.Fault = BadPayload
+	return v
+}
+
+// broken creates a vector with framing that can not be decoded
+func broken(name string, version uint32, wire []byte) Vector {
+	return Vector{
+		Name:      name,
+		Version:   version,
+		Direction: ToMilter,
+		Wire:      wire,
+		Fault:     BadFrame,
+	}
+}
+
+// Commands lists vectors for packets sent by the MTA
+var Commands = []Vector{
+	valid("optneg-v2", 2, ToMilter, 'O', u32(2, 0x3f, 0x7f)),
+	valid("optneg-v6", 6, ToMilter, 'O', u32(6, 0x1ff, 0x1fffff)),
+	valid("macro-connect", 2, ToMilter, 'D', join([]byte{'C'}, cstr("j", "mx.example.org", "{daemon_name}", "smtpd"))),
+	valid("macro-empty-value", 2, ToMilter, 'D', join([]byte{'M'}, cstr("{auth_authen}", ""))),
+	valid("macro-no-values", 2, ToMilter, 'D', []byte{'R'}),
+	valid("connect-inet", 2, ToMilter, 'C', join(cstr("client.example.com"), []byte{'4'}, u16(25), cstr("192.0.2.1"))),
+	valid("connect-inet6", 2, ToMilter, 'C', join(cstr("client.example.com"), []byte{'6'}, u16(587), cstr("2001:db8::1"))),
+	valid("connect-unix", 2, ToMilter, 'C', join(cstr("localhost"), []byte{'L'}, u16(0), cstr("/var/run/mta.sock"))),
+	valid("connect-unknown", 2, ToMilter, 'C', join(cstr("localhost"), []byte{'U'})),
+	valid("helo", 2, ToMilter, 'H', cstr("client.example.com")),
+	valid("mail", 2, ToMilter, 'M', cstr("<sender@example.com>")),
+	valid("mail-esmtp-args", 6, ToMilter, 'M', cstr("<sender@example.com>", "SIZE=1024", "BODY=8BITMIME")),
+	valid("mail-null-sender", 2, ToMilter, 'M', cstr("<>")),
+	valid("rcpt", 2, ToMilter, 'R', cstr("<rcpt@example.org>")),
+	valid("rcpt-esmtp-args", 6, ToMilter, 'R', cstr("<rcpt@example.org>", "NOTIFY=NEVER")),
+	valid("data", 6, ToMilter, 'T', nil),
+	valid("header", 2, ToMilter, 'L', cstr("Subject", "Hello world")),
+	valid("header-empty-value", 2, ToMilter, 'L', cstr("X-Empty", "")),
+	valid("eoh", 2, ToMilter, 'N', nil),
+	valid("body", 2, ToMilter, 'B', []byte("Hello\r\nworld\r\n")),
+	valid("body-empty", 2, ToMilter, 'B', nil),
+	valid("eom", 2, ToMilter, 'E', nil),
+	valid("abort", 2, ToMilter, 'A', nil),
+	valid("unknown", 6, ToMilter, 'U', cstr("XCLIENT foo")),
+	valid("quit-nc", 6, ToMilter, 'K', nil),
+	valid("quit", 2, ToMilter, 'Q', nil),
+}
+
+// Responses lists vectors for packets sent by the milter
+var Responses = []Vector{
+	valid("optneg-v2", 2, ToMTA, 'O', u32(2, 0x3f, 0)),
+	valid("optneg-v6", 6, ToMTA, 'O', u32(6, 0x1ff, 0x400)),
+	valid("optneg-v6-symlist", 6, ToMTA, 'O', join(u32(6, 0x100, 0), u32(2), cstr("{auth_authen} {mail_addr}"))),
+	valid("accept", 2, ToMTA, 'a', nil),
+	valid("continue", 2, ToMTA, 'c', nil),
+	valid("discard", 2, ToMTA, 'd', nil),
+	valid("reject", 2, ToMTA, 'r', nil),
+	valid("tempfail", 2, ToMTA, 't', nil),
+	valid("skip", 6, ToMTA, 's', nil),
+	valid("replycode", 2, ToMTA, 'y', cstr("550 5.7.1 Rejected by policy")),
+	valid("add-recipient", 2, ToMTA, '+', cstr("<bcc@example.org>")),
+	valid("add-recipient-par", 6, ToMTA, '2', cstr("<bcc@example.org>", "NOTIFY=NEVER")),
+	valid("delete-recipient", 2, ToMTA, '-', cstr("<rcpt@example.org>")),
+	valid("replace-body", 2, ToMTA, 'b', []byte("New body\r\n")),
+	valid("add-header", 2, ToMTA, 'h', cstr("X-Filtered", "yes")),
+	valid("insert-header", 6, ToMTA, 'i', join(u32(0), cstr("Authentication-Results", "mx.example.org; none"))),
+	valid("change-header", 2, ToMTA, 'm', join(u32(1), cstr("Subject", "[SPAM] Hello"))),
+	valid("delete-header", 2, ToMTA, 'm', join(u32(2), cstr("Received", ""))),
+	valid("change-from", 6, ToMTA, 'e', cstr("<bounce@example.org>", "SIZE=1024")),
+	valid("quarantine", 2, ToMTA, 'q', cstr("Suspicious attachment")),
+	valid("progress", 2, ToMTA, 'p', nil),
+}
+
+// Malformed lists vectors which conforming implementations must refuse
+var Malformed = []Vector{
+	broken("zero-length", 2, []byte{0, 0, 0, 0}),
+	broken("short-length", 2, []byte{0, 0}),
+	broken("truncated-data", 2, []byte{0, 0, 0, 10, 'H', 'a', 'b'}),
+	broken("missing-code", 2, []byte{0, 0, 0, 1}),
+	payload("connect-no-family", 2, 'C', cstr("client.example.com")),
+	payload("connect-no-terminator", 2, 'C', []byte("client.example.com")),
+	payload("connect-short-port", 2, 'C', join(cstr("client.example.com"), []byte{'4', 0})),
+	payload("macro-no-stage", 2, 'D', nil),
+	payload("macro-odd-count", 2, 'D', join([]byte{'C'}, cstr("j"))),
+}
+
+// All returns every published vector
+func All() []Vector {
+	vectors := make([]Vector, 0, len(Commands)+len(Responses)+len(Malformed))
+	vectors = append(vectors, Commands...)
+	vectors = append(vectors, Responses...)
+	return append(vectors, Malformed...)
+}
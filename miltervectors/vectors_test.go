@@ -0,0 +1,45 @@
+package miltervectors_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltervectors"
+)
+
+func TestCheck(t *testing.T) {
+	for _, failure := range miltervectors.Check() {
+		t.Error(failure)
+	}
+}
+
+func TestCheckReportsFailures(t *testing.T) {
+	errBroken := errors.New("broken")
+	tests := []struct {
+		name  string
+		check func() []miltervectors.Failure
+	}{
+		{"decode", func() []miltervectors.Failure {
+			return miltervectors.CheckDecode(func(io.Reader) (byte, []byte, error) {
+				return 0, nil, errBroken
+			})
+		}},
+		{"encode", func() []miltervectors.Failure {
+			return miltervectors.CheckEncode(func(io.Writer, byte, []byte) error {
+				return errBroken
+			})
+		}},
+		{"process", func() []miltervectors.Failure {
+			return miltervectors.CheckProcess(func(byte, []byte) (milter.Response, error) {
+				panic(errBroken)
+			})
+		}},
+	}
+	for _, test := range tests {
+		if len(test.check()) == 0 {
+			t.Errorf("%s: broken implementation passed", test.name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package milterwire implements the milter wire format
+//
+// The package provides pure functions to frame packets and to encode and decode
+// command and response payloads. It has no session state, so it can be shared
+// by milters, MTA side clients, proxies, fuzzers and protocol analyzers.
+package milterwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// pre-defined errors
+var (
+	EShort     = errors.New("Short milter packet")
+	EMalformed = errors.New("Malformed milter packet")
+	ETooLarge  = errors.New("Milter packet exceeds maximum size")
+)
+
+// HeaderSize is the size of the length prefix preceding every packet
+const HeaderSize = 4
+
+// AppendFrame appends framed packet with code and data to dst
+func AppendFrame(dst []byte, code byte, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)+1))
+	dst = append(dst, code)
+	return append(dst, data...)
+}
+
+// EncodeFrame returns framed packet with code and data
+func EncodeFrame(code byte, data []byte) []byte {
+	return AppendFrame(make([]byte, 0, HeaderSize+1+len(data)), code, data)
+}
+
+// DecodeFrame decodes the first packet in buf and returns the number of bytes it
+// occupies; data refers to buf. EShort is returned if buf holds an incomplete packet.
+func DecodeFrame(buf []byte) (code byte, data []byte, n int, err error) {
+	if len(buf) < HeaderSize {
+		return 0, nil, 0, EShort
+	}
+	length := binary.BigEndian.Uint32(buf)
+	// every packet carries at least a command code
+	if length == 0 {
+		return 0, nil, 0, EMalformed
+	}
+	if uint64(len(buf)-HeaderSize) < uint64(length) {
+		return 0, nil, 0, EShort
+	}
+	n = HeaderSize + int(length)
+	return buf[HeaderSize], buf[HeaderSize+1 : n], n, nil
+}
+
+// ReadFrame reads a single packet from r
+func ReadFrame(r io.Reader) (code byte, data []byte, err error) {
+	// read packet length
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 {
+		return 0, nil, EMalformed
+	}
+	// read packet data
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// ReadFrameBuffer reads a single packet from r into buf, growing it up to max bytes
+// if needed, and returns the possibly reallocated buffer for reuse; data refers to
+// buf and is only valid until the buffer is reused. ETooLarge is returned without
+// consuming the packet if it is longer than max; zero max means no limit.
+func ReadFrameBuffer(r io.Reader, buf []byte, max uint32) (code byte, data, newBuf []byte, err error) {
+	// read packet length
+	if cap(buf) < HeaderSize {
+		buf = make([]byte, HeaderSize, 512)
+	}
+	if _, err := io.ReadFull(r, buf[:HeaderSize]); err != nil {
+		return 0, nil, buf, err
+	}
+	length := binary.BigEndian.Uint32(buf[:HeaderSize])
+	if length == 0 {
+		return 0, nil, buf, EMalformed
+	}
+	if max != 0 && length > max {
+		return 0, nil, buf, ETooLarge
+	}
+	// read packet data
+	if uint64(cap(buf)) < uint64(length) {
+		buf = make([]byte, length)
+	}
+	packet := buf[:length]
+	if _, err := io.ReadFull(r, packet); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, buf, err
+	}
+	return packet[0], packet[1:], buf, nil
+}
+
+// WriteFrame writes a single packet to w
+func WriteFrame(w io.Writer, code byte, data []byte) error {
+	_, err := w.Write(EncodeFrame(code, data))
+	return err
+}
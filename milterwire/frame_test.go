@@ -0,0 +1,126 @@
+package milterwire_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		code byte
+		data []byte
+	}{
+		{"empty", 'N', nil},
+		{"command", 'H', []byte("mx.example.com\x00")},
+		{"binary", 'B', []byte{0, 1, 2, 0xff}},
+		{"large", 'b', bytes.Repeat([]byte("x"), 70000)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := milterwire.EncodeFrame(test.code, test.data)
+			if want := milterwire.HeaderSize + 1 + len(test.data); len(frame) != want {
+				t.Fatalf("frame of %d bytes, want %d", len(frame), want)
+			}
+			// frames appended to other data decode after it
+			prefix := []byte("prefix")
+			if appended := milterwire.AppendFrame(prefix, test.code, test.data); !bytes.Equal(appended[len(prefix):], frame) {
+				t.Fatal("appended frame differs from encoded frame")
+			}
+
+			// all decoders return the packet and consume all of it
+			check := func(decoder string, code byte, data []byte, err error) {
+				t.Helper()
+				if err != nil {
+					t.Fatalf("%s: %v", decoder, err)
+				}
+				if code != test.code || !bytes.Equal(data, test.data) {
+					t.Fatalf("%s got %q %q", decoder, code, data)
+				}
+			}
+			code, data, n, err := milterwire.DecodeFrame(append(frame, 'x'))
+			check("DecodeFrame", code, data, err)
+			if n != len(frame) {
+				t.Fatalf("DecodeFrame consumed %d bytes, want %d", n, len(frame))
+			}
+			code, data, err = milterwire.ReadFrame(bytes.NewReader(frame))
+			check("ReadFrame", code, data, err)
+			code, data, _, err = milterwire.ReadFrameBuffer(bytes.NewReader(frame), nil, 0)
+			check("ReadFrameBuffer", code, data, err)
+
+			var written bytes.Buffer
+			if err := milterwire.WriteFrame(&written, test.code, test.data); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written.Bytes(), frame) {
+				t.Fatal("written frame differs from encoded frame")
+			}
+		})
+	}
+}
+
+func TestFrameMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  []byte
+		max    uint32
+		decode error
+		read   error
+		buffer error
+	}{
+		{"empty", nil, 0, milterwire.EShort, io.EOF, io.EOF},
+		{"short length", []byte{0, 0, 1}, 0, milterwire.EShort, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF},
+		{"zero length", []byte{0, 0, 0, 0}, 0, milterwire.EMalformed, milterwire.EMalformed, milterwire.EMalformed},
+		{"truncated data", []byte{0, 0, 0, 5, 'H', 'x'}, 0, milterwire.EShort, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF},
+		{"missing data", []byte{0, 0, 0, 1}, 0, milterwire.EShort, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF},
+		{"oversized length", []byte{0xff, 0xff, 0xff, 0xff, 'B'}, 1024, milterwire.EShort, io.ErrUnexpectedEOF, milterwire.ETooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, _, err := milterwire.DecodeFrame(test.frame); !errors.Is(err, test.decode) {
+				t.Fatalf("DecodeFrame error %v, want %v", err, test.decode)
+			}
+			if test.max == 0 {
+				// ReadFrame has no limit and would allocate the full length
+				if _, _, err := milterwire.ReadFrame(bytes.NewReader(test.frame)); !errors.Is(err, test.read) {
+					t.Fatalf("ReadFrame error %v, want %v", err, test.read)
+				}
+			}
+			if _, _, _, err := milterwire.ReadFrameBuffer(bytes.NewReader(test.frame), nil, test.max); !errors.Is(err, test.buffer) {
+				t.Fatalf("ReadFrameBuffer error %v, want %v", err, test.buffer)
+			}
+		})
+	}
+}
+
+func TestReadFrameBufferReuse(t *testing.T) {
+	tests := []struct {
+		name   string
+		buf    []byte
+		data   []byte
+		reused bool
+	}{
+		{"no buffer", nil, []byte("x"), false},
+		{"fits", make([]byte, 0, 64), []byte("mx.example.com\x00"), true},
+		{"grows", make([]byte, 0, 8), bytes.Repeat([]byte("x"), 64), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := milterwire.EncodeFrame('H', test.data)
+			_, data, buf, err := milterwire.ReadFrameBuffer(bytes.NewReader(frame), test.buf, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Fatalf("data %q, want %q", data, test.data)
+			}
+			if reused := cap(test.buf) != 0 && &buf[:1][0] == &test.buf[:1][0]; reused != test.reused {
+				t.Fatalf("buffer reused %v, want %v", reused, test.reused)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package milterwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+// AppendString appends s as a NUL terminated C string to dst
+func AppendString(dst []byte, s string) []byte {
+	dst = append(dst, s...)
+	return append(dst, 0)
+}
+
+// EncodeStrings encodes values as a sequence of NUL terminated C strings
+func EncodeStrings(values ...string) []byte {
+	var data []byte
+	for _, value := range values {
+		data = AppendString(data, value)
+	}
+	return data
+}
+
+// DecodeStrings decodes a sequence of NUL terminated C strings, a missing final
+// terminator is tolerated; all returned strings share a single allocation
+func DecodeStrings(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	s := strings.TrimSuffix(string(data), "\x00")
+	values := make([]string, 0, strings.Count(s, "\x00")+1)
+	for {
+		pos := strings.IndexByte(s, 0)
+		if pos == -1 {
+			return append(values, s)
+		}
+		values = append(values, s[:pos])
+		s = s[pos+1:]
+	}
+}
+
+// SplitBytes splits a sequence of NUL terminated C strings into sub-slices of
+// data without copying, a missing final terminator is tolerated
+func SplitBytes(data []byte) [][]byte {
+	if len(data) == 0 {
+		return nil
+	}
+	data = bytes.TrimSuffix(data, []byte{0})
+	return bytes.Split(data, []byte{0})
+}
+
+// ReadString returns the C string at the beginning of data and the remaining data,
+// ok is false if data contains no NUL terminator
+func ReadString(data []byte) (s string, rest []byte, ok bool) {
+	field, rest, ok := ReadBytes(data)
+	return string(field), rest, ok
+}
+
+// ReadBytes returns the C string at the beginning of data as a sub-slice of data
+// together with the remaining data, ok is false if data contains no NUL terminator;
+// calling it repeatedly iterates over a sequence of C strings without allocation
+func ReadBytes(data []byte) (field, rest []byte, ok bool) {
+	pos := bytes.IndexByte(data, 0)
+	if pos == -1 {
+		return data, nil, false
+	}
+	return data[:pos], data[pos+1:], true
+}
+
+// OptNeg is the option negotiation payload sent by both sides
+type OptNeg struct {
+	Version  uint32
+	Actions  uint32
+	Protocol uint32
+	// Macros lists space separated macro names requested per stage, it is only
+	// sent in protocol version 6 responses
+	Macros map[uint32]string
+}
+
+// DecodeOptNeg decodes option negotiation payload
+func DecodeOptNeg(data []byte) (*OptNeg, error) {
+	if len(data) < 12 {
+		return nil, EMalformed
+	}
+	o := &OptNeg{
+		Version:  binary.BigEndian.Uint32(data),
+		Actions:  binary.BigEndian.Uint32(data[4:]),
+		Protocol: binary.BigEndian.Uint32(data[8:]),
+	}
+	// requested macros follow as stage and macro list pairs
+	for data = data[12:]; len(data) != 0; {
+		if len(data) < 4 {
+			return nil, EMalformed
+		}
+		stage := binary.BigEndian.Uint32(data)
+		list, rest, ok := ReadString(data[4:])
+		if !ok {
+			return nil, EMalformed
+		}
+		if o.Macros == nil {
+			o.Macros = make(map[uint32]string)
+		}
+		o.Macros[stage], data = list, rest
+	}
+	return o, nil
+}
+
+// Encode encodes option negotiation payload
+func (o *OptNeg) Encode() []byte {
+	data := make([]byte, 0, 12)
+	for _, value := range []uint32{o.Version, o.Actions, o.Protocol} {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	// macro lists are sent in stage order
+	stages := make([]uint32, 0, len(o.Macros))
+	for stage := range o.Macros {
+		stages = append(stages, stage)
+	}
+	sort.Slice(stages, func(i, j int) bool { return stages[i] < stages[j] })
+	for _, stage := range stages {
+		data = binary.BigEndian.AppendUint32(data, stage)
+		data = AppendString(data, o.Macros[stage])
+	}
+	return data
+}
+
+// Connect is the connection information payload
+type Connect struct {
+	Hostname string
+	Family   byte
+	Port     uint16
+	Address  string
+}
+
+// DecodeConnect decodes connection information payload
+func DecodeConnect(data []byte) (*Connect, error) {
+	// get hostname and protocol family
+	hostname, data, ok := ReadString(data)
+	if !ok || len(data) == 0 {
+		return nil, EMalformed
+	}
+	c := &Connect{Hostname: hostname, Family: data[0]}
+	data = data[1:]
+	if c.Family == 'U' && len(data) == 0 {
+		// unknown family omits port and address
+		return c, nil
+	}
+	// get port and address
+	if len(data) < 2 {
+		return nil, EMalformed
+	}
+	c.Port = binary.BigEndian.Uint16(data)
+	c.Address, _, _ = ReadString(data[2:])
+	return c, nil
+}
+
+// Encode encodes connection information payload
+func (c *Connect) Encode() []byte {
+	data := AppendString(nil, c.Hostname)
+	data = append(data, c.Family)
+	if c.Family == 'U' && c.Port == 0 && c.Address == "" {
+		return data
+	}
+	data = binary.BigEndian.AppendUint16(data, c.Port)
+	return AppendString(data, c.Address)
+}
+
+// Macro is a single macro definition
+type Macro struct {
+	Name  string
+	Value string
+}
+
+// DecodeMacros decodes macro definition payload
+func DecodeMacros(data []byte) (stage byte, macros []Macro, err error) {
+	if len(data) == 0 {
+		return 0, nil, EMalformed
+	}
+	values := DecodeStrings(data[1:])
+	if len(values)%2 != 0 {
+		return 0, nil, EMalformed
+	}
+	for i := 0; i < len(values); i += 2 {
+		macros = append(macros, Macro{values[i], values[i+1]})
+	}
+	return data[0], macros, nil
+}
+
+// EncodeMacros encodes macro definition payload
+func EncodeMacros(stage byte, macros []Macro) []byte {
+	data := []byte{stage}
+	for _, macro := range macros {
+		data = AppendString(data, macro.Name)
+		data = AppendString(data, macro.Value)
+	}
+	return data
+}
+
+// DecodeHeader decodes header name and value payload, both strings share a
+// single allocation
+func DecodeHeader(data []byte) (name, value string, err error) {
+	rawName, rawValue, err := DecodeHeaderBytes(data)
+	if err != nil {
+		return "", "", err
+	}
+	s := string(data[:len(rawName)+1+len(rawValue)])
+	return s[:len(rawName)], s[len(rawName)+1:], nil
+}
+
+// DecodeHeaderBytes decodes header name and value payload into sub-slices of data
+func DecodeHeaderBytes(data []byte) (name, value []byte, err error) {
+	name, rest, ok := ReadBytes(data)
+	if !ok || len(rest) == 0 {
+		return nil, nil, EMalformed
+	}
+	value, rest, _ = ReadBytes(rest)
+	if len(rest) != 0 {
+		return nil, nil, EMalformed
+	}
+	return name, value, nil
+}
+
+// EncodeHeader encodes header name and value payload
+func EncodeHeader(name, value string) []byte {
+	return EncodeStrings(name, value)
+}
+
+// DecodeIndexedHeader decodes header change and insert payloads
+func DecodeIndexedHeader(data []byte) (index uint32, name, value string, err error) {
+	if len(data) < 4 {
+		return 0, "", "", EMalformed
+	}
+	name, value, err = DecodeHeader(data[4:])
+	return binary.BigEndian.Uint32(data), name, value, err
+}
+
+// EncodeIndexedHeader encodes header change and insert payloads
+func EncodeIndexedHeader(index uint32, name, value string) []byte {
+	data := binary.BigEndian.AppendUint32(nil, index)
+	return append(data, EncodeHeader(name, value)...)
+}
+
+// DecodeAddress decodes envelope address payload of MAIL and RCPT commands and
+// recipient and sender modifications; addr keeps the angle brackets
+func DecodeAddress(data []byte) (addr string, args []string, err error) {
+	values := DecodeStrings(data)
+	if len(values) == 0 {
+		return "", nil, EMalformed
+	}
+	return values[0], values[1:], nil
+}
+
+// EncodeAddress encodes envelope address payload
+func EncodeAddress(addr string, args ...string) []byte {
+	return EncodeStrings(append([]string{addr}, args...)...)
+}
@@ -0,0 +1,242 @@
+package milterwire_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		values []string
+	}{
+		{"empty", nil, nil},
+		{"single", []byte("a\x00"), []string{"a"}},
+		{"several", []byte("a\x00\x00bc\x00"), []string{"a", "", "bc"}},
+		{"missing terminator", []byte("a\x00b"), []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if values := milterwire.DecodeStrings(test.data); !reflect.DeepEqual(values, test.values) {
+				t.Fatalf("DecodeStrings %q, want %q", values, test.values)
+			}
+			var fields []string
+			for _, field := range milterwire.SplitBytes(test.data) {
+				fields = append(fields, string(field))
+			}
+			if !reflect.DeepEqual(fields, test.values) {
+				t.Fatalf("SplitBytes %q, want %q", fields, test.values)
+			}
+			// iterating with ReadString yields the same values
+			var read []string
+			for data := test.data; len(data) != 0; {
+				var value string
+				value, data, _ = milterwire.ReadString(data)
+				read = append(read, value)
+			}
+			if !reflect.DeepEqual(read, test.values) {
+				t.Fatalf("ReadString %q, want %q", read, test.values)
+			}
+			if bytes.HasSuffix(test.data, []byte{0}) || len(test.data) == 0 {
+				if data := milterwire.EncodeStrings(test.values...); !bytes.Equal(data, test.data) {
+					t.Fatalf("EncodeStrings %q, want %q", data, test.data)
+				}
+			}
+		})
+	}
+}
+
+func TestReadStringMissingTerminator(t *testing.T) {
+	s, rest, ok := milterwire.ReadString([]byte("abc"))
+	if ok || s != "abc" || rest != nil {
+		t.Fatalf("got %q, %q, %v", s, rest, ok)
+	}
+}
+
+func TestOptNeg(t *testing.T) {
+	tests := []struct {
+		name string
+		neg  milterwire.OptNeg
+	}{
+		{"version 2", milterwire.OptNeg{Version: 2, Actions: 0x1f, Protocol: 0x7f}},
+		{"version 6", milterwire.OptNeg{Version: 6, Actions: 0x1ff, Protocol: 0x1fffff}},
+		{"requested macros", milterwire.OptNeg{Version: 6, Actions: 1, Protocol: 2,
+			Macros: map[uint32]string{0: "j _", 2: "i {auth_authen}", 4: ""}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := milterwire.DecodeOptNeg(test.neg.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*decoded, test.neg) {
+				t.Fatalf("decoded %+v, want %+v", *decoded, test.neg)
+			}
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		connect milterwire.Connect
+	}{
+		{"inet", milterwire.Connect{Hostname: "mx.example.com", Family: '4', Port: 25, Address: "192.0.2.1"}},
+		{"inet6", milterwire.Connect{Hostname: "[2001:db8::1]", Family: '6', Port: 587, Address: "2001:db8::1"}},
+		{"unix", milterwire.Connect{Hostname: "localhost", Family: 'L', Address: "/var/run/smtp"}},
+		{"unknown", milterwire.Connect{Hostname: "localhost", Family: 'U'}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := milterwire.DecodeConnect(test.connect.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *decoded != test.connect {
+				t.Fatalf("decoded %+v, want %+v", *decoded, test.connect)
+			}
+		})
+	}
+}
+
+func TestMacros(t *testing.T) {
+	tests := []struct {
+		name   string
+		stage  byte
+		macros []milterwire.Macro
+	}{
+		{"none", 'C', nil},
+		{"single", 'M', []milterwire.Macro{{"i", "Q123"}}},
+		{"several", 'H', []milterwire.Macro{{"{tls_version}", "TLSv1.3"}, {"empty", ""}, {"j", "mx"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stage, macros, err := milterwire.DecodeMacros(milterwire.EncodeMacros(test.stage, test.macros))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stage != test.stage || !reflect.DeepEqual(macros, test.macros) {
+				t.Fatalf("decoded %q %v, want %q %v", stage, macros, test.stage, test.macros)
+			}
+		})
+	}
+}
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		index uint32
+		field string
+		value string
+	}{
+		{"simple", 0, "Subject", "Hello"},
+		{"empty value", 1, "X-Empty", ""},
+		{"folded", 7, "Received", "from a\r\n\tby b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, value, err := milterwire.DecodeHeader(milterwire.EncodeHeader(test.field, test.value))
+			if err != nil || name != test.field || value != test.value {
+				t.Fatalf("DecodeHeader got %q %q %v", name, value, err)
+			}
+			rawName, rawValue, err := milterwire.DecodeHeaderBytes(milterwire.EncodeHeader(test.field, test.value))
+			if err != nil || string(rawName) != test.field || string(rawValue) != test.value {
+				t.Fatalf("DecodeHeaderBytes got %q %q %v", rawName, rawValue, err)
+			}
+			index, name, value, err := milterwire.DecodeIndexedHeader(milterwire.EncodeIndexedHeader(test.index, test.field, test.value))
+			if err != nil || index != test.index || name != test.field || value != test.value {
+				t.Fatalf("DecodeIndexedHeader got %d %q %q %v", index, name, value, err)
+			}
+		})
+	}
+}
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		args []string
+	}{
+		{"plain", "<a@example.com>", []string{}},
+		{"null sender", "<>", []string{}},
+		{"esmtp arguments", "<a@example.com>", []string{"SIZE=1024", "BODY=8BITMIME"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, args, err := milterwire.DecodeAddress(milterwire.EncodeAddress(test.addr, test.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr != test.addr || !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("decoded %q %q, want %q %q", addr, args, test.addr, test.args)
+			}
+		})
+	}
+}
+
+func TestPayloadMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func([]byte) error
+		data   []byte
+	}{
+		{"optneg truncated uint32", optNeg, []byte{0, 0, 0, 6, 0, 0, 1, 0xff, 0, 0, 0}},
+		{"optneg truncated stage", optNeg, append(make([]byte, 12), 0, 0)},
+		{"optneg macros missing NUL", optNeg, append(make([]byte, 16), 'i')},
+		{"connect empty", connect, nil},
+		{"connect missing NUL", connect, []byte("mx.example.com")},
+		{"connect missing family", connect, []byte("mx.example.com\x00")},
+		{"connect truncated port", connect, []byte("mx.example.com\x004\x00")},
+		{"macros empty", macros, nil},
+		{"macros missing value", macros, []byte("Mi\x00")},
+		{"header missing NUL", header, []byte("Subject")},
+		{"header missing value", header, []byte("Subject\x00")},
+		{"header extra field", header, []byte("Subject\x00Hello\x00x\x00")},
+		{"indexed header truncated uint32", indexedHeader, []byte{0, 0, 1}},
+		{"indexed header missing NUL", indexedHeader, []byte("\x00\x00\x00\x01Subject")},
+		{"address empty", address, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.decode(test.data); !errors.Is(err, milterwire.EMalformed) {
+				t.Fatalf("error %v, want %v", err, milterwire.EMalformed)
+			}
+		})
+	}
+}
+
+// decoders reduced to their error for TestPayloadMalformed
+func optNeg(data []byte) error {
+	_, err := milterwire.DecodeOptNeg(data)
+	return err
+}
+
+func connect(data []byte) error {
+	_, err := milterwire.DecodeConnect(data)
+	return err
+}
+
+func macros(data []byte) error {
+	_, _, err := milterwire.DecodeMacros(data)
+	return err
+}
+
+func header(data []byte) error {
+	_, _, err := milterwire.DecodeHeader(data)
+	return err
+}
+
+func indexedHeader(data []byte) error {
+	_, _, _, err := milterwire.DecodeIndexedHeader(data)
+	return err
+}
+
+func address(data []byte) error {
+	_, _, err := milterwire.DecodeAddress(data)
+	return err
+}
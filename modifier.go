@@ -4,68 +4,359 @@ package milter
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"net/textproto"
+	"sync"
+
+	"github.com/phalaaxx/milter/milterwire"
 )
 
 // Modifier provides access to Macros, Headers and Body data to callback handlers. It also defines a
 // number of functions that can be used by callback handlers to modify processing of the email message
+//
+// Modification functions are safe to call from goroutines started by the handler. Packets are
+// written one at a time in the order the calls acquire the modifier, and all of them are sent
+// before the response returned by the handler. Once the handler has returned the modifier is
+// closed and further modifications fail with EModifierClosed, so handlers must wait for their
+// workers to finish before returning. Macros and Headers must be treated as read-only.
+//
+// Headers holds canonical header names, HeaderFields the headers in received order with
+// their original capitalization, as needed by signature verification.
 type Modifier struct {
-	Macros      map[string]string
-	Headers     textproto.MIMEHeader
-	WritePacket func(*Message) error
+	Macros       map[string]string
+	Headers      textproto.MIMEHeader
+	HeaderFields HeaderFields
+	WritePacket  func(*Message) error
+	// NonSMTP reports mail submitted locally instead of over SMTP
+	NonSMTP bool
+
+	mutex        sync.Mutex
+	closed       bool
+	ctx          context.Context
+	writeContext func(context.Context, *Message) error
+	receivedBody func() ([]byte, int64)
+	flushContext func(context.Context) error
+	tx           *Transaction
+	codec        Codec
+	actions      uint32
+	protocol     uint32
+	macros       *MacroRequests
+	sendmail     bool
+	afterVerdict func(pendingTask)
+	direction    *Direction
+	spawn        func(func(context.Context)) error
+	logger       Logger
+	clock        Clock
+	sessionID    string
+	messageID    string
+}
+
+// Macro returns the value of macro name, long names are looked up both with and
+// without braces as MTAs differ in how they send them
+func (m *Modifier) Macro(name string) string {
+	if value, ok := m.Macros[name]; ok {
+		return value
+	}
+	if len(name) > 2 && name[0] == '{' && name[len(name)-1] == '}' {
+		return m.Macros[name[1:len(name)-1]]
+	}
+	return m.Macros["{"+name+"}"]
+}
+
+// Context returns the context of the handler, it is cancelled when the session
+// ends or its server is closed, and for commands of a message once the message
+// is complete or aborted. End of message handlers get a context which is also
+// cancelled with cause EPeerClosed when the MTA closes the connection before
+// the handler returns.
+func (m *Modifier) Context() context.Context {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// SetContext makes subsequent modifications abort as soon as ctx is done, so a
+// handler does not block on a stalled MTA connection after giving up
+func (m *Modifier) SetContext(ctx context.Context) {
+	m.mutex.Lock()
+	m.ctx = ctx
+	m.mutex.Unlock()
+}
+
+// write sends a modification packet unless the modifier has been closed; packets
+// are queued and flushed together with the response returned by the handler
+func (m *Modifier) write(msg *Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return EModifierClosed
+	}
+	if err := m.available(msg.Code); err != nil {
+		return err
+	}
+	if m.sendmail {
+		msg = sendmailHeader(msg)
+	}
+	// open transactions hold modifications back until committed
+	if m.tx != nil {
+		m.tx.msgs = append(m.tx.msgs, msg)
+		return nil
+	}
+	return m.send(msg)
+}
+
+// actionFlags maps modification responses to the action flag they require
+var actionFlags = map[Code]uint32{
+	ActAddHeader:  OptAddHeader,
+	ActInsHeader:  OptAddHeader,
+	ActChgHeader:  OptChangeHeader,
+	ActReplBody:   OptChangeBody,
+	ActAddRcpt:    OptAddRcpt,
+	ActAddRcptPar: OptAddRcptPar,
+	ActDelRcpt:    OptRemoveRcpt,
+	ActQuarantine: OptQuarantine,
+	ActChgFrom:    OptChangeFrom,
+}
+
+// available checks that a modification was negotiated, modifiers of sessions
+// which did not negotiate are not restricted
+func (m *Modifier) available(code Code) error {
+	if m.codec == nil {
+		return nil
+	}
+	flag, ok := actionFlags[code]
+	if !m.codec.Supports(code) || ok && m.actions&flag == 0 {
+		return fmt.Errorf("%w: %v in protocol version %d", EActionUnavailable, code, m.codec.Version())
+	}
+	return nil
+}
+
+// send writes a modification packet, the caller holds the mutex
+func (m *Modifier) send(msg *Message) error {
+	if m.writeContext != nil {
+		ctx := m.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		return m.writeContext(ctx, msg)
+	}
+	// custom packet writers can only be checked before writing
+	if m.ctx != nil {
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return m.WritePacket(msg)
+}
+
+// close waits for in-flight modifications and rejects all further ones, it
+// returns the number of modifications discarded with open transactions
+func (m *Modifier) close() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	n := 0
+	for tx := m.tx; tx != nil; tx = tx.parent {
+		n += len(tx.msgs)
+	}
+	m.tx = nil
+	return n
 }
 
 // AddRecipient appends a new envelope recipient for current message
 func (m *Modifier) AddRecipient(r string) error {
-	data := []byte(fmt.Sprintf("<%s>", r) + NULL)
-	return m.WritePacket(NewResponse('+', data).Response())
+	data := milterwire.EncodeAddress(fmt.Sprintf("<%s>", r))
+	return m.write(NewResponse(ActAddRcpt, data).Response())
+}
+
+// AddRecipientPar appends a new envelope recipient with ESMTP arguments such as
+// "NOTIFY=NEVER ORCPT=rfc822;user@example.com", it needs protocol version 6 and
+// the OptAddRcptPar action
+func (m *Modifier) AddRecipientPar(r string, esmtpArgs string) error {
+	var args []string
+	if esmtpArgs != "" {
+		args = append(args, esmtpArgs)
+	}
+	data := milterwire.EncodeAddress(fmt.Sprintf("<%s>", r), args...)
+	return m.write(NewResponse(ActAddRcptPar, data).Response())
 }
 
 // DeleteRecipient removes an envelope recipient address from message
 func (m *Modifier) DeleteRecipient(r string) error {
-	data := []byte(fmt.Sprintf("<%s>", r) + NULL)
-	return m.WritePacket(NewResponse('-', data).Response())
+	data := milterwire.EncodeAddress(fmt.Sprintf("<%s>", r))
+	return m.write(NewResponse(ActDelRcpt, data).Response())
+}
+
+// ChangeFrom replaces the envelope sender with addr and optional ESMTP arguments
+// such as "SIZE=1000", it needs protocol version 6 and the OptChangeFrom action
+func (m *Modifier) ChangeFrom(addr string, esmtpArgs string) error {
+	var args []string
+	if esmtpArgs != "" {
+		args = append(args, esmtpArgs)
+	}
+	data := milterwire.EncodeAddress(fmt.Sprintf("<%s>", addr), args...)
+	return m.write(NewResponse(ActChgFrom, data).Response())
 }
 
 // ReplaceBody substitutes message body with provided body
 func (m *Modifier) ReplaceBody(body []byte) error {
-	return m.WritePacket(NewResponse('b', body).Response())
+	return m.write(NewResponse(ActReplBody, body).Response())
+}
+
+// ReplaceBodyReader substitutes message body with the content of r, which is
+// streamed to the MTA in packets of DefaultMaxResponseSize bytes so large bodies
+// need not be held in memory. A read error leaves a partial body at the MTA
+// unless the call is made within a Transaction which is rolled back.
+func (m *Modifier) ReplaceBodyReader(r io.Reader) error {
+	for sent := false; ; sent = true {
+		// queued packets reference their data so every chunk gets its own buffer
+		chunk := make([]byte, DefaultMaxResponseSize)
+		n, readErr := io.ReadFull(r, chunk)
+		if readErr == io.EOF && sent {
+			return nil
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		// an empty reader still replaces the body with an empty one
+		if err := m.ReplaceBody(chunk[:n]); err != nil {
+			return err
+		}
+		if readErr != nil {
+			return nil
+		}
+	}
+}
+
+// ReplaceBodyIfChanged substitutes message body only if body differs from the
+// received one, so filters which usually leave the body alone do not send it back
+func (m *Modifier) ReplaceBodyIfChanged(body []byte) (changed bool, err error) {
+	if m.receivedBody != nil {
+		digest, length := m.receivedBody()
+		if int64(len(body)) == length {
+			sum := sha256.Sum256(body)
+			if bytes.Equal(sum[:], digest) {
+				return false, nil
+			}
+		}
+	}
+	return true, m.ReplaceBody(body)
 }
 
 // AddHeader appends a new email message header the message
 func (m *Modifier) AddHeader(name, value string) error {
-	data := []byte(name + NULL + value + NULL)
-	return m.WritePacket(NewResponse('h', data).Response())
+	data := milterwire.EncodeHeader(name, value)
+	return m.write(NewResponse(ActAddHeader, data).Response())
+}
+
+// InsertHeader inserts a new header at index of the message headers, index 0
+// places it on top and indexes past the last header append it; it needs
+// protocol version 6 and the OptAddHeader action
+func (m *Modifier) InsertHeader(index int, name, value string) error {
+	if index < 0 {
+		index = 0
+	}
+	data := milterwire.EncodeIndexedHeader(uint32(index), name, value)
+	return m.write(NewResponse(ActInsHeader, data).Response())
 }
 
-// Quarantine a message by giving a reason to hold it
+// Quarantine a message by giving a reason to hold it, MTAs require a non-empty
+// reason and show it with the held message
 func (m *Modifier) Quarantine(reason string) error {
-	return m.WritePacket(NewResponse('q', []byte(reason+NULL)).Response())
+	if reason == "" {
+		return EQuarantineReason
+	}
+	return m.write(NewResponse(ActQuarantine, milterwire.EncodeStrings(reason)).Response())
 }
 
-// ChangeHeader replaces the header at the specified position with a new one
+// ChangeHeader replaces the value of the index-th occurrence of header name,
+// counting from 1, an empty value deletes the header and an index past the last
+// occurrence adds a new header; it needs the OptChangeHeader action
 func (m *Modifier) ChangeHeader(index int, name, value string) error {
-	buffer := new(bytes.Buffer)
-	// encode header index in the beginning
-	if err := binary.Write(buffer, binary.BigEndian, uint32(index)); err != nil {
-		return err
-	}
-	// add header name and value to buffer
-	data := []byte(name + NULL + value + NULL)
-	if _, err := buffer.Write(data); err != nil {
-		return err
+	if index < 1 {
+		return EHeaderIndex
 	}
+	// encode header index followed by header name and value
+	data := milterwire.EncodeIndexedHeader(uint32(index), name, value)
 	// prepare and send response packet
-	return m.WritePacket(NewResponse('m', buffer.Bytes()).Response())
+	return m.write(NewResponse(ActChgHeader, data).Response())
+}
+
+// DeleteHeader removes the index-th occurrence of header name, counting from 1
+func (m *Modifier) DeleteHeader(index int, name string) error {
+	return m.ChangeHeader(index, name, "")
+}
+
+// Negotiation holds the options agreed with the MTA during option negotiation
+type Negotiation struct {
+	// Version is the selected protocol version
+	Version uint32
+	// Actions and Protocol hold the granted Opt* action and protocol flags
+	Actions  uint32
+	Protocol uint32
+	// Macros holds the macro lists requested from the MTA, nil if the MTA
+	// defaults are used
+	Macros *MacroRequests
+}
+
+// Negotiated returns the options granted by the MTA, ok is false if the session
+// has not negotiated options
+func (m *Modifier) Negotiated() (n Negotiation, ok bool) {
+	if m.codec == nil {
+		return Negotiation{}, false
+	}
+	return Negotiation{m.codec.Version(), m.actions, m.protocol, m.macros}, true
+}
+
+// Direction returns the direction of the current message as classified by
+// DirectionClassifier, DirectionUnknown without classifier
+func (m *Modifier) Direction() Direction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.direction == nil {
+		return DirectionUnknown
+	}
+	return *m.direction
+}
+
+// setDirection records the direction of the current message
+func (m *Modifier) setDirection(d Direction) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.direction == nil {
+		m.direction = new(Direction)
+	}
+	*m.direction = d
 }
 
 // NewModifier creates a new Modifier instance from MilterSession
 func NewModifier(s *MilterSession) *Modifier {
-	return &Modifier{
-		Macros:      s.Macros,
-		Headers:     s.Headers,
-		WritePacket: s.WritePacket,
+	m := &Modifier{
+		Macros:       s.Macros,
+		Headers:      s.Headers,
+		HeaderFields: s.HeaderFields,
+		WritePacket:  s.WritePacket,
+		writeContext: s.QueuePacket,
+		receivedBody: s.receivedBody,
+		flushContext: s.Flush,
+		NonSMTP:      s.nonSMTP,
+		sendmail:     s.Sendmail,
+		afterVerdict: s.addTask,
+		direction:    &s.direction,
+		spawn:        s.spawn,
+		logger:       s.Logger,
+		clock:        s.Clock,
+		sessionID:    s.SessionID,
+		messageID:    s.messageID,
+	}
+	// modifications are only restricted once options are negotiated
+	if s.negotiated {
+		m.codec, m.actions, m.protocol, m.macros = s.codec, s.actions, s.protocol, s.macros
 	}
+	return m
 }
@@ -0,0 +1,83 @@
+package milter_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+)
+
+// workerMilter adds one header from each of workers goroutines at the end of
+// the message, it waits for them unless leak is set
+type workerMilter struct {
+	milter.NoOpMilter
+	workers int
+	leak    bool
+	errs    chan error
+}
+
+func (w workerMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < w.workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			w.errs <- m.AddHeader(fmt.Sprintf("X-Worker-%d", i), "done")
+		}(i)
+	}
+	if w.leak {
+		// workers run once the handler has returned
+		defer close(start)
+		return milter.RespAccept, nil
+	}
+	close(start)
+	wg.Wait()
+	return milter.RespAccept, nil
+}
+
+func TestModifierConcurrent(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		leak    bool
+		headers int
+		err     error
+	}{
+		{"no workers", 0, false, 0, nil},
+		{"single worker", 1, false, 1, nil},
+		{"many workers", 50, false, 50, nil},
+		{"workers after return", 5, true, 0, milter.EModifierClosed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := workerMilter{workers: test.workers, leak: test.leak, errs: make(chan error, test.workers)}
+			c := pipeSession(t, milter.WithMilter(inner, milter.OptAddHeader, 0))
+			send(t, c, milter.CmdMail, mailFrom("a@example.com"))
+			send(t, c, milter.CmdRcpt, rcptTo("b@example.org"))
+			send(t, c, milter.CmdEOH, nil)
+			reply := send(t, c, milter.CmdEOB, nil)
+			if reply.Code != milter.ActAccept {
+				t.Fatalf("end of message got %v", reply.Code)
+			}
+			// every header arrives before the verdict, none after it
+			headers := 0
+			for _, msg := range reply.Modifications {
+				if msg.Code == milter.ActAddHeader {
+					headers++
+				}
+			}
+			if headers != test.headers {
+				t.Fatalf("%d headers, want %d", headers, test.headers)
+			}
+			for i := 0; i < test.workers; i++ {
+				if err := <-inner.errs; !errors.Is(err, test.err) {
+					t.Fatalf("worker error %v, want %v", err, test.err)
+				}
+			}
+		})
+	}
+}
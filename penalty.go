@@ -0,0 +1,303 @@
+package milter
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// PenaltyBox escalates responses to clients which keep getting rejected
+//
+// Every rejected or temporarily failed message adds to the score of the client
+// address and scores decay over time. Connect turns the score into a response:
+// growing tarpit delays first, rejection at connect time once RejectScore is
+// reached and a temporary ban after BanScore. Zero fields use defaults and a
+// single PenaltyBox is meant to be shared by all sessions.
+type PenaltyBox struct {
+	// HalfLife is the time it takes a score to halve, default one hour
+	HalfLife time.Duration
+	// TarpitStep is the tarpit delay per score point, default one second
+	TarpitStep time.Duration
+	// RejectScore rejects clients at connect, default 10
+	RejectScore float64
+	// BanScore bans clients for BanDuration regardless of decay, defaults 20 and
+	// one hour
+	BanScore    float64
+	BanDuration time.Duration
+	// MaxClients limits the number of tracked addresses, default 100000
+	MaxClients int
+	// Clock decays scores and times bans, nil means SystemClock
+	Clock Clock
+
+	mutex   sync.Mutex
+	clients map[netip.Addr]*penalty
+}
+
+// penalty is the state of a single client address
+type penalty struct {
+	score   float64
+	updated time.Time
+	banned  time.Time
+}
+
+// Connect returns the response for a new connection from addr, it is meant to be
+// returned from Milter.Connect
+func (p *PenaltyBox) Connect(addr net.IP) Response {
+	key, ok := penaltyKey(addr)
+	if !ok {
+		return RespContinue
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, ok := p.clients[key]
+	if !ok {
+		return RespContinue
+	}
+	now := p.now()
+	score := p.decay(entry, now)
+	switch {
+	case now.Before(entry.banned), score >= p.rejectScore():
+		return RespReject
+	case score >= 1:
+		return Tarpit(RespContinue, time.Duration(score*float64(p.tarpitStep())))
+	}
+	return RespContinue
+}
+
+// Record adds the penalty for resp sent to addr, rejections count one point and
+// temporary failures half a point
+func (p *PenaltyBox) Record(addr net.IP, resp Response) {
+	if points := penaltyPoints(resp); points != 0 {
+		p.Penalize(addr, points)
+	}
+}
+
+// penaltyPoints returns the points a client gets for resp
+func penaltyPoints(resp Response) float64 {
+	if resp == nil {
+		return 0
+	}
+	msg := resp.Response()
+	switch {
+	case msg.Code == ActReject, msg.Code == ActReplyCode && len(msg.Data) != 0 && msg.Data[0] == '5':
+		return 1
+	case msg.Code == ActTempFail, msg.Code == ActReplyCode && len(msg.Data) != 0 && msg.Data[0] == '4':
+		return 0.5
+	}
+	return 0
+}
+
+// Penalize adds points to the score of addr
+func (p *PenaltyBox) Penalize(addr net.IP, points float64) {
+	key, ok := penaltyKey(addr)
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.now()
+	entry, ok := p.clients[key]
+	if !ok {
+		if p.clients == nil {
+			p.clients = make(map[netip.Addr]*penalty)
+		}
+		// make room by dropping forgotten clients, stop tracking if that fails
+		if len(p.clients) >= p.maxClients() && p.sweep(now) >= p.maxClients() {
+			return
+		}
+		entry = &penalty{updated: now}
+		p.clients[key] = entry
+	}
+	entry.score = p.decay(entry, now) + points
+	if entry.score >= p.banScore() {
+		entry.banned = now.Add(p.banDuration())
+	}
+}
+
+// Forgive removes all penalties of addr
+func (p *PenaltyBox) Forgive(addr net.IP) {
+	if key, ok := penaltyKey(addr); ok {
+		p.mutex.Lock()
+		delete(p.clients, key)
+		p.mutex.Unlock()
+	}
+}
+
+// decay updates entry score to now and returns it
+func (p *PenaltyBox) decay(entry *penalty, now time.Time) float64 {
+	elapsed := now.Sub(entry.updated)
+	if elapsed > 0 {
+		entry.score *= math.Exp2(-float64(elapsed) / float64(p.halfLife()))
+		entry.updated = now
+	}
+	return entry.score
+}
+
+// sweep drops clients with negligible score and returns the number left
+func (p *PenaltyBox) sweep(now time.Time) int {
+	for key, entry := range p.clients {
+		if p.decay(entry, now) < 0.1 && !now.Before(entry.banned) {
+			delete(p.clients, key)
+		}
+	}
+	return len(p.clients)
+}
+
+// Trim drops clients with negligible score which were not seen for idle,
+// it implements Trimmer and returns the estimated number of bytes reclaimed
+func (p *PenaltyBox) Trim(idle time.Duration) int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.now()
+	kept := make(map[netip.Addr]*penalty)
+	var dropped int64
+	for key, entry := range p.clients {
+		if now.Sub(entry.updated) < idle || p.decay(entry, now) >= 0.1 || now.Before(entry.banned) {
+			kept[key] = entry
+		} else {
+			dropped++
+		}
+	}
+	// a new map releases the buckets of dropped clients
+	if dropped != 0 {
+		p.clients = kept
+	}
+	return dropped * 96
+}
+
+// penaltyKey converts addr to a map key
+func penaltyKey(addr net.IP) (netip.Addr, bool) {
+	key, ok := netip.AddrFromSlice(addr)
+	return key.Unmap(), ok
+}
+
+// defaults for unset fields
+func (p *PenaltyBox) now() time.Time {
+	return ClockOrSystem(p.Clock).Now()
+}
+
+func (p *PenaltyBox) halfLife() time.Duration {
+	if p.HalfLife <= 0 {
+		return time.Hour
+	}
+	return p.HalfLife
+}
+
+func (p *PenaltyBox) tarpitStep() time.Duration {
+	if p.TarpitStep <= 0 {
+		return time.Second
+	}
+	return p.TarpitStep
+}
+
+func (p *PenaltyBox) rejectScore() float64 {
+	if p.RejectScore <= 0 {
+		return 10
+	}
+	return p.RejectScore
+}
+
+func (p *PenaltyBox) banScore() float64 {
+	if p.BanScore <= 0 {
+		return 20
+	}
+	return p.BanScore
+}
+
+func (p *PenaltyBox) banDuration() time.Duration {
+	if p.BanDuration <= 0 {
+		return time.Hour
+	}
+	return p.BanDuration
+}
+
+func (p *PenaltyBox) maxClients() int {
+	if p.MaxClients <= 0 {
+		return 100000
+	}
+	return p.MaxClients
+}
+
+// Wrap returns milter which applies Connect in front of next and records the
+// verdicts sent to the client, so a single PenaltyBox handles both ends
+func (p *PenaltyBox) Wrap(next Milter) Milter {
+	return &penaltyMilter{Milter: ConnectFilter(p.check)(next), box: p}
+}
+
+// check adapts Connect to ConnectCheck
+func (p *PenaltyBox) check(host string, family string, port uint16, addr net.IP) Response {
+	return p.Connect(addr)
+}
+
+// penaltyMilter records verdicts of a single session, a message is penalized
+// once for the first refusal at any stage
+type penaltyMilter struct {
+	Milter
+	box      *PenaltyBox
+	addr     net.IP
+	recorded bool
+}
+
+// record penalizes the client for resp unless the message already was
+func (p *penaltyMilter) record(resp Response, err error) (Response, error) {
+	if points := penaltyPoints(resp); err == nil && points != 0 && !p.recorded {
+		p.box.Penalize(p.addr, points)
+		p.recorded = true
+	}
+	return resp, err
+}
+
+// Connect remembers client address
+func (p *penaltyMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	p.addr = addr
+	return p.Milter.Connect(host, family, port, addr, m)
+}
+
+// Helo, MailFrom, RcptTo, Data, Header, Headers, BodyChunk and Body record the
+// verdict of the wrapped milter
+func (p *penaltyMilter) Helo(name string, m *Modifier) (Response, error) {
+	return p.record(p.Milter.Helo(name, m))
+}
+
+func (p *penaltyMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	return p.record(p.Milter.MailFrom(from, m))
+}
+
+func (p *penaltyMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	return p.record(p.Milter.RcptTo(rcptTo, m))
+}
+
+func (p *penaltyMilter) Data(m *Modifier) (Response, error) {
+	return p.record(p.Milter.Data(m))
+}
+
+func (p *penaltyMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	return p.record(p.Milter.Header(name, value, m))
+}
+
+func (p *penaltyMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return p.record(p.Milter.Headers(h, m))
+}
+
+func (p *penaltyMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	return p.record(p.Milter.BodyChunk(chunk, m))
+}
+
+func (p *penaltyMilter) Body(m *Modifier) (Response, error) {
+	return p.record(p.Milter.Body(m))
+}
+
+// MessageReset starts recording the next message
+func (p *penaltyMilter) MessageReset() {
+	p.recorded = false
+	ResetMessage(p.Milter)
+}
+
+// ConnectionReset forgets the client address of the finished connection
+func (p *penaltyMilter) ConnectionReset() {
+	p.addr, p.recorded = nil, false
+	ResetConnection(p.Milter)
+}
@@ -0,0 +1,160 @@
+package milter_test
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+func TestPenaltyBox(t *testing.T) {
+	client := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name    string
+		points  float64
+		advance time.Duration
+		code    milter.Code
+		delay   time.Duration
+	}{
+		{"unknown client", 0, 0, milter.ActContinue, 0},
+		{"below tarpit", 0.5, 0, milter.ActContinue, 0},
+		{"tarpit", 4, 0, milter.ActContinue, 4 * time.Second},
+		{"tarpit decayed", 4, time.Hour, milter.ActContinue, 2 * time.Second},
+		{"rejected", 10, 0, milter.ActReject, 0},
+		{"rejection decayed", 10, time.Hour, milter.ActContinue, 5 * time.Second},
+		{"banned", 20, 59 * time.Minute, milter.ActReject, 0},
+		{"ban expired", 20, 3 * time.Hour, milter.ActContinue, 2500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := miltertest.NewFakeClock(time.Unix(1000, 0))
+			box := &milter.PenaltyBox{Clock: clock}
+			if test.points != 0 {
+				box.Penalize(client, test.points)
+			}
+			clock.Advance(test.advance)
+			resp := box.Connect(client)
+			if code := resp.Response().Code; code != test.code {
+				t.Fatalf("code %v, want %v", code, test.code)
+			}
+			var delay time.Duration
+			if delayed, ok := resp.(*milter.DelayedResponse); ok {
+				delay = delayed.Delay
+			}
+			if diff := delay - test.delay; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Fatalf("delay %v, want %v", delay, test.delay)
+			}
+		})
+	}
+}
+
+func TestPenaltyBoxRecord(t *testing.T) {
+	client := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name  string
+		resp  milter.Response
+		delay time.Duration
+	}{
+		{"accepted", milter.RespAccept, 0},
+		{"rejected", milter.RespReject, 2 * time.Second},
+		{"temporary failure", milter.RespTempFail, time.Second},
+		{"permanent reply", milter.NewResponseStr(milter.ActReplyCode, "550 5.7.1 No"), 2 * time.Second},
+		{"temporary reply", milter.NewResponseStr(milter.ActReplyCode, "450 4.7.1 Later"), time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			box := &milter.PenaltyBox{Clock: miltertest.NewFakeClock(time.Unix(1000, 0))}
+			// two verdicts reach the tarpit threshold of one point
+			box.Record(client, test.resp)
+			box.Record(client, test.resp)
+			var delay time.Duration
+			if delayed, ok := box.Connect(client).(*milter.DelayedResponse); ok {
+				delay = delayed.Delay
+			}
+			if delay != test.delay {
+				t.Fatalf("delay %v, want %v", delay, test.delay)
+			}
+		})
+	}
+}
+
+// refuseMilter answers commands of stage with resp
+type refuseMilter struct {
+	milter.NoOpMilter
+	stage milter.Code
+	resp  milter.Response
+}
+
+func (r refuseMilter) verdict(stage milter.Code) (milter.Response, error) {
+	if stage == r.stage {
+		return r.resp, nil
+	}
+	return milter.RespContinue, nil
+}
+
+func (r refuseMilter) MailFrom(string, *milter.Modifier) (milter.Response, error) {
+	return r.verdict(milter.CmdMail)
+}
+
+func (r refuseMilter) RcptTo(string, *milter.Modifier) (milter.Response, error) {
+	return r.verdict(milter.CmdRcpt)
+}
+
+func (r refuseMilter) Data(*milter.Modifier) (milter.Response, error) {
+	return r.verdict(milter.CmdData)
+}
+
+func (r refuseMilter) Headers(textproto.MIMEHeader, *milter.Modifier) (milter.Response, error) {
+	return r.verdict(milter.CmdEOH)
+}
+
+func (r refuseMilter) BodyChunk([]byte, *milter.Modifier) (milter.Response, error) {
+	return r.verdict(milter.CmdBody)
+}
+
+func (r refuseMilter) Body(*milter.Modifier) (milter.Response, error) {
+	return r.verdict(milter.CmdEOB)
+}
+
+func TestPenaltyBoxWrap(t *testing.T) {
+	client := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name  string
+		stage milter.Code
+		resp  milter.Response
+		// delay follows an extra penalty of one point
+		delay time.Duration
+	}{
+		{"accepted", 0, nil, time.Second},
+		{"rejected at mail", milter.CmdMail, milter.RespReject, 2 * time.Second},
+		{"rejected recipients", milter.CmdRcpt, milter.RespReject, 2 * time.Second},
+		{"temporary failure at data", milter.CmdData, milter.RespTempFail, 1500 * time.Millisecond},
+		{"rejected at end of headers", milter.CmdEOH, milter.RespReject, 2 * time.Second},
+		{"rejected body chunk", milter.CmdBody, milter.RespReject, 2 * time.Second},
+		{"rejected at end of message", milter.CmdEOB, milter.RespReject, 2 * time.Second},
+		{"reply code at mail", milter.CmdMail, milter.NewResponseStr(milter.ActReplyCode, "450 4.7.1 Later"), 1500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			box := &milter.PenaltyBox{Clock: miltertest.NewFakeClock(time.Unix(1000, 0))}
+			// refused recipients are counted once for the message
+			miltertest.NewScenario().Connect("client.example.com", client.String()).
+				MailFrom("a@example.com").RcptTo("b@example.org").RcptTo("c@example.org").
+				Data().Header("Subject", "x").Body("x").
+				Check(func() (milter.Milter, uint32, uint32) {
+					return box.Wrap(refuseMilter{stage: test.stage, resp: test.resp}), 0, 0
+				})
+			box.Penalize(client, 1)
+			var delay time.Duration
+			if delayed, ok := box.Connect(client).(*milter.DelayedResponse); ok {
+				delay = delayed.Delay
+			}
+			if delay != test.delay {
+				t.Fatalf("delay %v, want %v", delay, test.delay)
+			}
+		})
+	}
+}
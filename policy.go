@@ -0,0 +1,237 @@
+package milter
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// DomainPolicies applies a separate milter chain per recipient domain, so a
+// host serving several domains can filter, sign and archive each differently
+// within one filter process
+//
+// The policy of a message is resolved at its first accepted recipient, the
+// chain of that policy then gets the connection and MAIL FROM callbacks
+// replayed and handles the rest of the message. Recipients of other policies
+// are refused with Mixed, which makes the MTA deliver them in a separate
+// transaction. Callbacks before the first recipient are answered with continue.
+type DomainPolicies struct {
+	// Policies maps policy names to constructors of their chains, a new chain
+	// is built for every session using the policy
+	Policies map[string]func() Milter
+	// Domains maps recipient domains to policy names, several domains can share
+	// a policy; a key with leading dot like ".example.com" matches subdomains
+	Domains map[string]string
+	// Default is the policy of domains not in Domains, recipients of domains
+	// without policy are passed to NoOpMilter
+	Default string
+	// Mixed answers recipients with a different policy than the message, default
+	// 452 4.5.3 reply asking the MTA to retry them separately
+	Mixed Response
+}
+
+// mixedPolicy refuses recipients of a different policy for now
+var mixedPolicy = NewResponseStr(ActReplyCode, "452 4.5.3 Recipient must be sent in a separate transaction")
+
+// Policy returns the policy name of recipient address rcpt
+func (p *DomainPolicies) Policy(rcpt string) string {
+	domain := rcpt
+	if at := strings.LastIndexByte(rcpt, '@'); at != -1 {
+		domain = rcpt[at+1:]
+	}
+	domain = strings.ToLower(strings.Trim(domain, "<> "))
+	if name, ok := p.Domains[domain]; ok {
+		return name
+	}
+	// look up parent domains
+	for dot := strings.IndexByte(domain, '.'); dot != -1; {
+		if name, ok := p.Domains[domain[dot:]]; ok {
+			return name
+		}
+		next := strings.IndexByte(domain[dot+1:], '.')
+		if next == -1 {
+			break
+		}
+		dot += next + 1
+	}
+	return p.Default
+}
+
+// Milter returns a session milter dispatching messages to policy chains, it is
+// meant to be returned by MilterInit for every new session
+func (p *DomainPolicies) Milter() Milter {
+	return &policyMilter{policies: p, chains: make(map[string]*policyChain)}
+}
+
+// policyChain is the chain of a policy within one session
+type policyChain struct {
+	milter Milter
+	// refused holds the response which refused the replayed callbacks
+	refused Response
+}
+
+// policyMilter dispatches messages of a single session
+type policyMilter struct {
+	policies *DomainPolicies
+	chains   map[string]*policyChain
+	// connection stage callbacks replayed to new chains
+	connect func(Milter, *Modifier) (Response, error)
+	helo    string
+	from    string
+	// active is the chain of the current message
+	name   string
+	active *policyChain
+}
+
+// chain returns the chain of policy name prepared for the current message
+func (p *policyMilter) chain(name string, m *Modifier) (*policyChain, error) {
+	if chain, ok := p.chains[name]; ok {
+		return chain, nil
+	}
+	chain := &policyChain{milter: NoOpMilter{}}
+	if build, ok := p.policies.Policies[name]; ok {
+		chain.milter = build()
+	}
+	p.chains[name] = chain
+	replay := []func() (Response, error){
+		func() (Response, error) {
+			if p.connect == nil {
+				return RespContinue, nil
+			}
+			return p.connect(chain.milter, m)
+		},
+		func() (Response, error) {
+			if p.helo == "" {
+				return RespContinue, nil
+			}
+			return chain.milter.Helo(p.helo, m)
+		},
+	}
+	for _, callback := range replay {
+		resp, err := callback()
+		if err != nil {
+			return nil, err
+		}
+		if resp != nil && !resp.Continue() {
+			chain.refused = resp
+			break
+		}
+	}
+	return chain, nil
+}
+
+func (p *policyMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	p.connect = func(next Milter, m *Modifier) (Response, error) {
+		return next.Connect(host, family, port, addr, m)
+	}
+	return RespContinue, nil
+}
+
+func (p *policyMilter) Helo(name string, m *Modifier) (Response, error) {
+	p.helo = name
+	return RespContinue, nil
+}
+
+func (p *policyMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	p.from = from
+	return RespContinue, nil
+}
+
+func (p *policyMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	name := p.policies.Policy(rcptTo)
+	if p.active != nil {
+		if name != p.name {
+			if p.policies.Mixed != nil {
+				return p.policies.Mixed, nil
+			}
+			return mixedPolicy, nil
+		}
+		return p.active.milter.RcptTo(rcptTo, m)
+	}
+
+	chain, err := p.chain(name, m)
+	if err != nil {
+		return nil, err
+	}
+	if chain.refused != nil {
+		return chain.refused, nil
+	}
+	// replay MAIL FROM to the chain chosen for this message
+	resp, err := chain.milter.MailFrom(p.from, m)
+	if err != nil || resp != nil && !resp.Continue() {
+		ResetMessage(chain.milter)
+		return resp, err
+	}
+	resp, err = chain.milter.RcptTo(rcptTo, m)
+	if err != nil || resp != nil && !resp.Continue() {
+		// the next recipient may choose another policy
+		ResetMessage(chain.milter)
+		return resp, err
+	}
+	p.name, p.active = name, chain
+	return resp, nil
+}
+
+func (p *policyMilter) Data(m *Modifier) (Response, error) {
+	if p.active == nil {
+		return RespContinue, nil
+	}
+	return p.active.milter.Data(m)
+}
+
+func (p *policyMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	if p.active == nil {
+		return RespContinue, nil
+	}
+	return p.active.milter.Header(name, value, m)
+}
+
+func (p *policyMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	if p.active == nil {
+		return RespContinue, nil
+	}
+	return p.active.milter.Headers(h, m)
+}
+
+func (p *policyMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	if p.active == nil {
+		return RespContinue, nil
+	}
+	return p.active.milter.BodyChunk(chunk, m)
+}
+
+func (p *policyMilter) Body(m *Modifier) (Response, error) {
+	if p.active == nil {
+		return RespAccept, nil
+	}
+	return p.active.milter.Body(m)
+}
+
+func (p *policyMilter) Abort(m *Modifier) error {
+	if p.active == nil {
+		return nil
+	}
+	return p.active.milter.Abort(m)
+}
+
+func (p *policyMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	if p.active == nil {
+		return RespContinue, nil
+	}
+	return p.active.milter.Unknown(cmd, m)
+}
+
+func (p *policyMilter) MessageReset() {
+	if p.active != nil {
+		ResetMessage(p.active.milter)
+	}
+	p.from, p.name, p.active = "", "", nil
+}
+
+func (p *policyMilter) ConnectionReset() {
+	for _, chain := range p.chains {
+		ResetConnection(chain.milter)
+	}
+	clear(p.chains)
+	p.connect, p.helo = nil, ""
+}
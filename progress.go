@@ -0,0 +1,60 @@
+package milter
+
+import (
+	"context"
+)
+
+// Progress tells the MTA that the end of message handler is still working so
+// that it restarts its reply timeout, handlers running long scans call it
+// periodically. Progress is sent immediately, also within open transactions.
+func (m *Modifier) Progress() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return EModifierClosed
+	}
+	if err := m.available(ActProgress); err != nil {
+		return err
+	}
+	if err := m.send(&Message{ActProgress, nil}); err != nil {
+		return err
+	}
+	if m.flushContext == nil {
+		return nil
+	}
+	ctx := m.ctx
+	if ctx == nil {
+		return m.flushContext(context.Background())
+	}
+	return m.flushContext(ctx)
+}
+
+// keepalive sends progress every ProgressInterval until stop is called, MTAs
+// which did not negotiate progress get none
+func (m *MilterSession) keepalive(modifier *Modifier) (stop func()) {
+	if m.ProgressInterval <= 0 || modifier.available(ActProgress) != nil {
+		return func() {}
+	}
+	clock := ClockOrSystem(m.Clock)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			timer := clock.NewTimer(m.ProgressInterval)
+			select {
+			case <-timer.C():
+				if err := modifier.Progress(); err != nil {
+					m.logf("Error sending progress: %v", err)
+					return
+				}
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
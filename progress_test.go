@@ -0,0 +1,137 @@
+package milter_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// blockingMilter holds end of message until release is closed
+type blockingMilter struct {
+	milter.NoOpMilter
+	release chan struct{}
+}
+
+func (b blockingMilter) Body(*milter.Modifier) (milter.Response, error) {
+	<-b.release
+	return milter.RespAccept, nil
+}
+
+// waitTimers waits until clock has n pending timers
+func waitTimers(t *testing.T, clock *miltertest.FakeClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Timers() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, want %d", clock.Timers(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProgressKeepalive(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		ticks    int
+		progress int
+	}{
+		{"disabled", 0, 0, 0},
+		{"not yet due", time.Second, 0, 0},
+		{"every interval", time.Second, 3, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := miltertest.NewFakeClock(time.Unix(1000, 0))
+			inner := blockingMilter{release: make(chan struct{})}
+			c := pipeSession(t, milter.WithMilter(inner, 0, 0), milter.WithConfig(func(s *milter.MilterSession) {
+				s.Clock, s.ProgressInterval = clock, test.interval
+			}))
+			send(t, c, milter.CmdMail, mailFrom("a@example.com"))
+			send(t, c, milter.CmdRcpt, rcptTo("b@example.org"))
+			send(t, c, milter.CmdEOH, nil)
+
+			replies := make(chan error, 1)
+			progress := 0
+			go func() {
+				reply, err := c.Send(milter.CmdEOB, nil)
+				if err == nil {
+					for _, msg := range reply.Modifications {
+						if msg.Code == milter.ActProgress {
+							progress++
+						}
+					}
+				}
+				replies <- err
+			}()
+			for i := 0; i < test.ticks; i++ {
+				waitTimers(t, clock, 1)
+				clock.Advance(test.interval)
+			}
+			if test.interval != 0 {
+				waitTimers(t, clock, 1)
+			}
+			close(inner.release)
+			if err := <-replies; err != nil {
+				t.Fatal(err)
+			}
+			if progress != test.progress {
+				t.Fatalf("%d progress packets, want %d", progress, test.progress)
+			}
+			// keepalives stop with the handler
+			waitTimers(t, clock, 0)
+		})
+	}
+}
+
+// progressMilter sends progress from the end of message handler
+type progressMilter struct {
+	milter.NoOpMilter
+	errs chan error
+}
+
+func (p progressMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	p.errs <- m.Progress()
+	return milter.RespAccept, nil
+}
+
+func TestProgressVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  uint32
+		progress int
+		err      error
+	}{
+		{"version 2", 2, 0, milter.EActionUnavailable},
+		{"version 6", 6, 1, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := progressMilter{errs: make(chan error, 1)}
+			neg := milterwire.OptNeg{Version: test.version, Actions: 0x3f}
+			c := pipeSessionOffer(t, neg, milter.WithMilter(inner, 0, 0), milter.WithConfig(func(s *milter.MilterSession) {
+				s.ProgressInterval = time.Hour
+			}))
+			send(t, c, milter.CmdMail, mailFrom("a@example.com"))
+			send(t, c, milter.CmdRcpt, rcptTo("b@example.org"))
+			send(t, c, milter.CmdEOH, nil)
+			reply := send(t, c, milter.CmdEOB, nil)
+			if err := <-inner.errs; !errors.Is(err, test.err) {
+				t.Fatalf("progress error %v, want %v", err, test.err)
+			}
+			progress := 0
+			for _, msg := range reply.Modifications {
+				if msg.Code == milter.ActProgress {
+					progress++
+				}
+			}
+			if progress != test.progress {
+				t.Fatalf("%d progress packets, want %d", progress, test.progress)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package milter
+
+import (
+	"context"
+)
+
+// ResponseWriter sends arbitrary response packets, for protocol extensions or MTA
+// specific codes the library does not know about
+//
+// Packets are framed, ordered and flushed like the ones sent by the library:
+// Write queues a packet behind all previously written ones and Flush sends the
+// queue immediately. The caller is responsible for sending packets the MTA
+// expects at the current protocol stage.
+type ResponseWriter interface {
+	Write(ctx context.Context, msg *Message) error
+	Flush(ctx context.Context) error
+}
+
+// ResponseWriter returns a writer sending packets directly to the session stream
+func (m *MilterSession) ResponseWriter() ResponseWriter {
+	return sessionWriter{m}
+}
+
+// sessionWriter writes to the session queue
+type sessionWriter struct {
+	session *MilterSession
+}
+
+// Write implements ResponseWriter
+func (w sessionWriter) Write(ctx context.Context, msg *Message) error {
+	return w.session.QueuePacket(ctx, msg)
+}
+
+// Flush implements ResponseWriter
+func (w sessionWriter) Flush(ctx context.Context) error {
+	return w.session.Flush(ctx)
+}
+
+// ResponseWriter returns a writer sending packets like modifications do, they are
+// ordered with other modifications, recorded by open transactions and refused
+// once the handler has returned
+func (m *Modifier) ResponseWriter() ResponseWriter {
+	return modifierWriter{m}
+}
+
+// modifierWriter writes through a modifier
+type modifierWriter struct {
+	modifier *Modifier
+}
+
+// Write implements ResponseWriter, ctx is checked before the packet is queued
+// while the modifier context set by SetContext bounds the write itself
+func (w modifierWriter) Write(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return w.modifier.write(msg)
+}
+
+// Flush implements ResponseWriter, packets recorded by transactions are not flushed
+func (w modifierWriter) Flush(ctx context.Context) error {
+	m := w.modifier
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return EModifierClosed
+	}
+	if m.flushContext == nil {
+		return nil
+	}
+	return m.flushContext(ctx)
+}
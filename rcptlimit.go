@@ -0,0 +1,120 @@
+package milter
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecipientLimit limits the number of recipients per message and per sender
+// within a time window, recipients over the limit are refused with Response
+// while the message continues for the others. A single RecipientLimit holds
+// sender windows shared by all sessions, Wrap adds it to a session milter.
+type RecipientLimit struct {
+	// PerMessage limits recipients of a single message, zero means no limit
+	PerMessage int
+	// PerSender limits recipients of a sender within Window, zero means no limit
+	PerSender int
+	// Window is the period of sender limits, default one hour
+	Window time.Duration
+	// Response is sent for recipients over the limit, default RespTempFail
+	Response Response
+	// Clock measures windows, nil means SystemClock
+	Clock Clock
+
+	mutex   sync.Mutex
+	senders Windows[string]
+}
+
+// Wrap returns milter enforcing limits in front of next
+func (l *RecipientLimit) Wrap(next Milter) Milter {
+	return &recipientLimiter{Milter: next, limit: l}
+}
+
+// reserve counts a recipient of sender and returns false if it is over the limit
+func (l *RecipientLimit) reserve(sender string, now time.Time) bool {
+	if l.PerSender <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	window := l.senders.Get(sender, now, l.window())
+	if window.Count >= l.PerSender {
+		return false
+	}
+	window.Count++
+	return true
+}
+
+// release returns a recipient reserved for sender at now which was not accepted
+func (l *RecipientLimit) release(sender string, now time.Time) {
+	if l.PerSender <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if window := l.senders.Get(sender, now, l.window()); window.Count > 0 {
+		window.Count--
+	}
+}
+
+// window returns the period of sender limits
+func (l *RecipientLimit) window() time.Duration {
+	if l.Window <= 0 {
+		return time.Hour
+	}
+	return l.Window
+}
+
+// response returns the response for refused recipients
+func (l *RecipientLimit) response() Response {
+	if l.Response == nil {
+		return RespTempFail
+	}
+	return l.Response
+}
+
+// recipientLimiter applies RecipientLimit to a single session
+type recipientLimiter struct {
+	Milter
+	limit  *RecipientLimit
+	sender string
+	count  int
+}
+
+// MailFrom starts counting recipients of a new message
+func (r *recipientLimiter) MailFrom(from string, m *Modifier) (Response, error) {
+	r.sender, r.count = strings.ToLower(from), 0
+	return r.Milter.MailFrom(from, m)
+}
+
+// RcptTo refuses recipients over the limit and passes others to the wrapped milter
+func (r *recipientLimiter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	if r.limit.PerMessage > 0 && r.count >= r.limit.PerMessage {
+		return r.limit.response(), nil
+	}
+	now := ClockOrSystem(r.limit.Clock).Now()
+	if !r.limit.reserve(r.sender, now) {
+		return r.limit.response(), nil
+	}
+	resp, err := r.Milter.RcptTo(rcptTo, m)
+	// empty responses continue, recipients refused by the wrapped milter do
+	// not count
+	if err != nil || resp != nil && !resp.Continue() {
+		r.limit.release(r.sender, now)
+		return resp, err
+	}
+	r.count++
+	return resp, nil
+}
+
+// MessageReset stops counting recipients of the finished message
+func (r *recipientLimiter) MessageReset() {
+	r.sender, r.count = "", 0
+	ResetMessage(r.Milter)
+}
+
+// ConnectionReset passes the call on to the wrapped milter
+func (r *recipientLimiter) ConnectionReset() {
+	ResetConnection(r.Milter)
+}
@@ -0,0 +1,79 @@
+package milter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+// silentMilter sends no response for recipients
+type silentMilter struct {
+	milter.NoOpMilter
+}
+
+func (silentMilter) RcptTo(string, *milter.Modifier) (milter.Response, error) {
+	return nil, nil
+}
+
+// refusedRecipients counts recipients refused with a temporary failure
+func refusedRecipients(exchanges []miltertest.Exchange) int {
+	refused := 0
+	for _, exchange := range exchanges {
+		if exchange.Command.Code != milter.CmdRcpt {
+			continue
+		}
+		for _, resp := range exchange.Responses {
+			if resp.Code == milter.ActTempFail {
+				refused++
+			}
+		}
+	}
+	return refused
+}
+
+func TestRecipientLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    *milter.RecipientLimit
+		inner    milter.Milter
+		advance  time.Duration
+		messages []int
+		refused  int
+	}{
+		{"per message", &milter.RecipientLimit{PerMessage: 2}, milter.NoOpMilter{}, 0, []int{3, 3}, 2},
+		{"per sender", &milter.RecipientLimit{PerSender: 3, Window: time.Minute}, milter.NoOpMilter{}, 0, []int{2, 2}, 1},
+		{"per sender default window", &milter.RecipientLimit{PerSender: 3}, milter.NoOpMilter{}, 0, []int{2, 2}, 1},
+		{"sender window expired", &milter.RecipientLimit{PerSender: 3, Window: time.Minute}, milter.NoOpMilter{}, time.Minute, []int{2, 2}, 0},
+		{"default window expired", &milter.RecipientLimit{PerSender: 3}, milter.NoOpMilter{}, time.Hour, []int{2, 2}, 0},
+		{"empty responses", &milter.RecipientLimit{PerMessage: 2, PerSender: 3}, silentMilter{}, 0, []int{3, 2}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := miltertest.NewFakeClock(time.Unix(1000, 0))
+			limit := test.limit
+			limit.Clock = clock
+			refused := 0
+			for i, recipients := range test.messages {
+				if i != 0 {
+					clock.Advance(test.advance)
+				}
+				scenario := miltertest.NewScenario().MailFrom("a@example.com")
+				for j := 0; j < recipients; j++ {
+					scenario.RcptTo("b@example.org")
+				}
+				exchanges, failures := scenario.Abort().Check(func() (milter.Milter, uint32, uint32) {
+					return limit.Wrap(test.inner), 0, 0
+				})
+				if len(failures) != 0 {
+					t.Fatal(failures)
+				}
+				refused += refusedRecipients(exchanges)
+			}
+			if refused != test.refused {
+				t.Fatalf("%d recipients refused, want %d", refused, test.refused)
+			}
+		})
+	}
+}
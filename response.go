@@ -1,5 +1,10 @@
 package milter
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Response represents a response structure returned by callback
 // handlers to indicate how the milter server should proceed
 type Response interface {
@@ -12,12 +17,12 @@ type SimpleResponse byte
 
 // Response returns a Message object reference
 func (r SimpleResponse) Response() *Message {
-	return &Message{byte(r), nil}
+	return &Message{Code(r), nil}
 }
 
-// Continue to process milter messages only if current code is Continue
+// Continue to process milter messages only if current code is Continue or Skip
 func (r SimpleResponse) Continue() bool {
-	return byte(r) == Continue
+	return Code(r) == Continue || Code(r) == Skip
 }
 
 // Define standard responses with no data
@@ -27,12 +32,17 @@ const (
 	RespDiscard  = SimpleResponse(Discard)
 	RespReject   = SimpleResponse(Reject)
 	RespTempFail = SimpleResponse(TempFail)
+	// RespSkip is returned from BodyChunk to receive no further body chunks of
+	// the message, end of body follows. Without protocol version 6 the MTA keeps
+	// sending the body and the remaining chunks are not passed to the milter.
+	// Modifier.ReplaceBodyIfChanged always replaces a skipped body.
+	RespSkip = SimpleResponse(Skip)
 )
 
 // CustomResponse is a response instance used by callback handlers to indicate
 // how the milter should continue processing of current message
 type CustomResponse struct {
-	Code byte
+	Code Code
 	Data []byte
 }
 
@@ -43,7 +53,7 @@ func (c *CustomResponse) Response() *Message {
 
 // Continue returns false if milter chain should be stopped, true otherwise
 func (c *CustomResponse) Continue() bool {
-	for _, q := range []byte{Accept, Discard, Reject, TempFail} {
+	for _, q := range []Code{Accept, Discard, Reject, TempFail, ActReplyCode} {
 		if c.Code == q {
 			return false
 		}
@@ -52,11 +62,80 @@ func (c *CustomResponse) Continue() bool {
 }
 
 // NewResponse generates a new CustomRespanse suitable for WritePacket
-func NewResponse(code byte, data []byte) *CustomResponse {
+func NewResponse(code Code, data []byte) *CustomResponse {
 	return &CustomResponse{code, data}
 }
 
 // NewResponseStr generates a new CustomResponse with string payload
-func NewResponseStr(code byte, data string) *CustomResponse {
+func NewResponseStr(code Code, data string) *CustomResponse {
 	return NewResponse(code, []byte(data+NULL))
 }
+
+// maxReplyLines is the number of reply lines accepted by MTAs
+const maxReplyLines = 32
+
+// NewReply returns an SMFIR_REPLYCODE response with SMTP reply code, optional
+// enhanced status code xcode and one or more text lines as smfi_setmlreply
+// does, for example NewReply("550", "5.7.1", "Rejected by policy"). The code
+// must be a 4xx or 5xx reply, percent signs are escaped for the MTA and lines
+// must not contain line breaks; EReply reports invalid input.
+func NewReply(code, xcode string, lines ...string) (*CustomResponse, error) {
+	if len(code) != 3 || code[0] != '4' && code[0] != '5' || !isDigits(code) {
+		return nil, fmt.Errorf("%w: code %q", EReply, code)
+	}
+	if xcode != "" && !validXCode(code, xcode) {
+		return nil, fmt.Errorf("%w: enhanced status code %q for %s", EReply, xcode, code)
+	}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	if len(lines) > maxReplyLines {
+		return nil, fmt.Errorf("%w: %d lines", EReply, len(lines))
+	}
+	var b strings.Builder
+	for i, line := range lines {
+		if strings.ContainsAny(line, "\r\n") {
+			return nil, fmt.Errorf("%w: line break in line %d", EReply, i+1)
+		}
+		if i != 0 {
+			b.WriteString("\r\n")
+		}
+		// continuation lines are marked with a dash
+		b.WriteString(code)
+		if i == len(lines)-1 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte('-')
+		}
+		if xcode != "" {
+			b.WriteString(xcode + " ")
+		}
+		b.WriteString(strings.ReplaceAll(line, "%", "%%"))
+	}
+	return NewResponseStr(ActReplyCode, strings.TrimRight(b.String(), " ")), nil
+}
+
+// validXCode returns true if xcode is an enhanced status code of the same class
+// as code
+func validXCode(code, xcode string) bool {
+	parts := strings.Split(xcode, ".")
+	if len(parts) != 3 || parts[0] != code[:1] {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if len(part) == 0 || len(part) > 3 || !isDigits(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDigits returns true if s consists of ASCII digits only
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
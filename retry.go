@@ -0,0 +1,182 @@
+package milter
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// transientError marks errors worth retrying
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// Transient marks err as a transient failure which Retry retries
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transientError{err}
+}
+
+// IsTransient returns true if err was marked with Transient or is a network
+// timeout
+func IsTransient(err error) bool {
+	var transient *transientError
+	if errors.As(err, &transient) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// RetryPolicy configures Retry, zero fields use defaults
+type RetryPolicy struct {
+	// Attempts is the maximum number of calls per callback, default 3
+	Attempts int
+	// Budget limits the time spent on a callback including waits between
+	// attempts, it must stay below the MTA command timeout; default 5 seconds
+	Budget time.Duration
+	// Backoff is the wait before the second attempt, doubled for every further
+	// one; default 100 milliseconds
+	Backoff time.Duration
+	// Retryable decides which errors are retried, default IsTransient
+	Retryable func(error) bool
+	// Fallback is returned once attempts or budget are exhausted, default
+	// RespTempFail
+	Fallback Response
+	// Clock times waits and budget, nil means SystemClock
+	Clock Clock
+}
+
+// Retry returns middleware which calls callbacks failing with retryable errors
+// again within the policy budget and answers with the fallback response when
+// they keep failing; other errors are returned unchanged
+//
+// Modifications of failed attempts are rolled back, so a retried end of body
+// callback does not send them twice. Other effects of a failed attempt, such as
+// state kept by the wrapped milter, are up to the callback to undo.
+func Retry(policy RetryPolicy) Middleware {
+	return func(next Milter) Milter {
+		return &retryMilter{next: next, policy: &policy}
+	}
+}
+
+// retryMilter retries callbacks of a single session
+type retryMilter struct {
+	next   Milter
+	policy *RetryPolicy
+}
+
+// do runs callback under the retry policy
+func (r *retryMilter) do(name string, m *Modifier, callback func() (Response, error)) (Response, error) {
+	p := r.policy
+	attempts, budget, backoff := p.Attempts, p.Budget, p.Backoff
+	if attempts <= 0 {
+		attempts = 3
+	}
+	if budget <= 0 {
+		budget = 5 * time.Second
+	}
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+	clock := ClockOrSystem(p.Clock)
+	deadline := clock.Now().Add(budget)
+
+	for attempt := 1; ; attempt++ {
+		tx := m.Begin()
+		resp, err := callback()
+		if err == nil || !retryable(err) {
+			if err := tx.Commit(); err != nil {
+				return nil, err
+			}
+			return resp, err
+		}
+		if err := tx.Rollback(); err != nil {
+			return nil, err
+		}
+		// give up if the next attempt would not start within budget
+		if attempt >= attempts || !clock.Now().Add(backoff).Before(deadline) {
+			m.Logf("Error in %s callback after %d attempts: %v", name, attempt, err)
+			if p.Fallback == nil {
+				return RespTempFail, nil
+			}
+			return p.Fallback, nil
+		}
+		// the message or session may end while waiting
+		timer := clock.NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-m.Context().Done():
+			timer.Stop()
+			return nil, m.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (r *retryMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	return r.do("Connect", m, func() (Response, error) { return r.next.Connect(host, family, port, addr, m) })
+}
+
+func (r *retryMilter) Helo(name string, m *Modifier) (Response, error) {
+	return r.do("Helo", m, func() (Response, error) { return r.next.Helo(name, m) })
+}
+
+func (r *retryMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	return r.do("MailFrom", m, func() (Response, error) { return r.next.MailFrom(from, m) })
+}
+
+func (r *retryMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	return r.do("RcptTo", m, func() (Response, error) { return r.next.RcptTo(rcptTo, m) })
+}
+
+func (r *retryMilter) Data(m *Modifier) (Response, error) {
+	return r.do("Data", m, func() (Response, error) { return r.next.Data(m) })
+}
+
+func (r *retryMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	return r.do("Header", m, func() (Response, error) { return r.next.Header(name, value, m) })
+}
+
+func (r *retryMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return r.do("Headers", m, func() (Response, error) { return r.next.Headers(h, m) })
+}
+
+func (r *retryMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	return r.do("BodyChunk", m, func() (Response, error) { return r.next.BodyChunk(chunk, m) })
+}
+
+func (r *retryMilter) Body(m *Modifier) (Response, error) {
+	return r.do("Body", m, func() (Response, error) { return r.next.Body(m) })
+}
+
+func (r *retryMilter) Abort(m *Modifier) error {
+	return r.next.Abort(m)
+}
+
+func (r *retryMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	return r.do("Unknown", m, func() (Response, error) { return r.next.Unknown(cmd, m) })
+}
+
+func (r *retryMilter) MessageReset() {
+	ResetMessage(r.next)
+}
+
+func (r *retryMilter) ConnectionReset() {
+	ResetConnection(r.next)
+}
@@ -0,0 +1,185 @@
+package milter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Finding is a match reported by a ScanFunc
+type Finding struct {
+	// Offset is the position of the match, relative to the data passed to the
+	// ScanFunc and relative to the whole body in results of ParallelScan
+	Offset int64
+	// Length is the number of matched bytes
+	Length int
+	// Rule names what was found
+	Rule string
+}
+
+// ScanFunc scans a segment of message body, data must not be retained
+type ScanFunc func(ctx context.Context, data []byte) ([]Finding, error)
+
+// ParallelScan splits a body into segments and scans them concurrently so that
+// large messages can be scanned within the end of message deadline. Zero fields
+// use defaults and a single ParallelScan may be shared by all sessions.
+//
+// Every segment extends MaxMatch-1 bytes into the next one, so a match of up to
+// MaxMatch bytes crossing a segment boundary is seen whole by one scanner.
+// Findings are reported by the segment they start in, matches found twice in
+// overlapping data are dropped.
+type ParallelScan struct {
+	// Scanners are run on every segment
+	Scanners []ScanFunc
+	// Workers is the number of segments scanned at the same time, default
+	// GOMAXPROCS
+	Workers int
+	// SegmentSize is the number of bytes per segment, default 1MiB
+	SegmentSize int
+	// MaxMatch is the longest match scanners report, default 4KiB
+	MaxMatch int
+}
+
+// scanJob is a single scanner run over a single segment
+type scanJob struct {
+	scanner int
+	start   int64
+}
+
+// Bytes scans body and returns findings ordered by offset
+func (p *ParallelScan) Bytes(ctx context.Context, body []byte) ([]Finding, error) {
+	return p.scan(ctx, int64(len(body)), func(start, end int64, _ []byte) ([]byte, error) {
+		return body[start:end], nil
+	})
+}
+
+// ReaderAt scans size bytes of r, for example a body spooled to a file, and
+// returns findings ordered by offset
+func (p *ParallelScan) ReaderAt(ctx context.Context, r io.ReaderAt, size int64) ([]Finding, error) {
+	return p.scan(ctx, size, func(start, end int64, buffer []byte) ([]byte, error) {
+		data := buffer[:end-start]
+		n, err := r.ReadAt(data, start)
+		if n == len(data) {
+			return data, nil
+		}
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	})
+}
+
+// scan fans segments of a body of size bytes out to workers, read returns
+// segment data and may use buffer which is reused by the same worker
+func (p *ParallelScan) scan(ctx context.Context, size int64, read func(start, end int64, buffer []byte) ([]byte, error)) ([]Finding, error) {
+	if size == 0 || len(p.Scanners) == 0 {
+		return nil, nil
+	}
+	segment, overlap := int64(p.segmentSize()), int64(p.maxMatch()-1)
+	jobs := make(chan scanJob)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		mutex    sync.Mutex
+		findings []Finding
+		workers  sync.WaitGroup
+	)
+	work := func() {
+		defer workers.Done()
+		var buffer []byte
+		for job := range jobs {
+			if ctx.Err() != nil {
+				continue
+			}
+			end := min(job.start+segment+overlap, size)
+			if buffer == nil {
+				buffer = make([]byte, segment+overlap)
+			}
+			data, err := read(job.start, end, buffer)
+			var found []Finding
+			if err == nil {
+				found, err = p.Scanners[job.scanner](ctx, data)
+			}
+			if err != nil {
+				cancel(fmt.Errorf("scan segment at %d: %w", job.start, err))
+				continue
+			}
+			mutex.Lock()
+			for _, f := range found {
+				// matches starting in the overlap belong to the next segment
+				if f.Offset < segment || job.start+segment >= size {
+					f.Offset += job.start
+					findings = append(findings, f)
+				}
+			}
+			mutex.Unlock()
+		}
+	}
+	for i := min(p.workers(), int((size+segment-1)/segment)*len(p.Scanners)); i > 0; i-- {
+		workers.Add(1)
+		go work()
+	}
+queue:
+	for start := int64(0); start < size; start += segment {
+		for scanner := range p.Scanners {
+			select {
+			case jobs <- scanJob{scanner, start}:
+			case <-ctx.Done():
+				break queue
+			}
+		}
+	}
+	close(jobs)
+	workers.Wait()
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	return mergeFindings(findings), nil
+}
+
+// mergeFindings orders findings by offset and drops duplicates
+func mergeFindings(findings []Finding) []Finding {
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Offset != b.Offset {
+			return a.Offset < b.Offset
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Length < b.Length
+	})
+	merged := findings[:0]
+	for i, f := range findings {
+		if i == 0 || f != findings[i-1] {
+			merged = append(merged, f)
+		}
+	}
+	return merged
+}
+
+// defaults for unset fields
+func (p *ParallelScan) workers() int {
+	if p.Workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return p.Workers
+}
+
+func (p *ParallelScan) segmentSize() int {
+	if p.SegmentSize <= 0 {
+		return 1 << 20
+	}
+	return p.SegmentSize
+}
+
+func (p *ParallelScan) maxMatch() int {
+	if p.MaxMatch <= 0 {
+		return 4 << 10
+	}
+	return p.MaxMatch
+}
@@ -0,0 +1,57 @@
+package milter
+
+import (
+	"strings"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// macroAliases adds the alternative spelling of every macro name, Sendmail sends
+// long names in braces and single letter names bare, but filters written for
+// other MTAs often look up either form
+func macroAliases(macros map[string]string) {
+	for name, value := range macros {
+		var alias string
+		switch {
+		case len(name) > 2 && name[0] == '{' && name[len(name)-1] == '}':
+			alias = name[1 : len(name)-1]
+		case len(name) == 1:
+			alias = "{" + name + "}"
+		default:
+			continue
+		}
+		if _, ok := macros[alias]; !ok {
+			macros[alias] = value
+		}
+	}
+}
+
+// sendmailHeader removes the leading space of header values in header
+// modifications, Sendmail inserts its own separator after the colon which
+// would otherwise be doubled
+func sendmailHeader(msg *Message) *Message {
+	switch msg.Code {
+	case ActAddHeader:
+		name, value, err := milterwire.DecodeHeader(msg.Data)
+		if err == nil && strings.HasPrefix(value, " ") {
+			return &Message{msg.Code, milterwire.EncodeHeader(name, value[1:])}
+		}
+	case ActInsHeader, ActChgHeader:
+		index, name, value, err := milterwire.DecodeIndexedHeader(msg.Data)
+		if err == nil && strings.HasPrefix(value, " ") {
+			return &Message{msg.Code, milterwire.EncodeIndexedHeader(index, name, value[1:])}
+		}
+	}
+	return msg
+}
+
+// keepsSession returns true if Sendmail continues the session after a final
+// response to code; message verdicts only end the message and Sendmail treats
+// a closed connection as filter failure for the next message
+func keepsSession(code Code) bool {
+	switch code {
+	case CmdMail, CmdRcpt, CmdData, CmdHeader, CmdEOH, CmdBody, CmdEOB:
+		return true
+	}
+	return false
+}
@@ -2,29 +2,311 @@
 package milter
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
+	"net/netip"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // MilterInit initializes milter options
 type MilterInit func() (Milter, uint32, uint32)
 
-// RunServer provides a convenient way to start a milter server
-func RunServer(server net.Listener, init MilterInit) error {
+// TCPOptions tunes accepted TCP connections, zero values keep system defaults
+type TCPOptions struct {
+	// Nagle enables Nagle's algorithm, Go disables it with TCP_NODELAY by default
+	// which suits small latency sensitive milter responses
+	Nagle bool
+	// KeepAlive sets the keep-alive probe interval, negative disables keep-alives
+	KeepAlive time.Duration
+	// ReadBuffer and WriteBuffer set socket receive and send buffer sizes
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// apply applies options to conn, connections other than TCP are left unchanged
+func (o *TCPOptions) apply(conn net.Conn) error {
+	// TLS connections are tuned on the underlying connection
+	if wrapped, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = wrapped.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.Nagle {
+		if err := tcp.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	switch {
+	case o.KeepAlive < 0:
+		if err := tcp.SetKeepAlive(false); err != nil {
+			return err
+		}
+	case o.KeepAlive > 0:
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcp.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Server accepts milter connections and processes each in a new session
+type Server struct {
+	// Init creates milter callback handler and options for every connection
+	Init MilterInit
+
+	// TCP tunes accepted TCP connections
+	TCP TCPOptions
+
+	// Logger receives the log messages of the server and its sessions, nil
+	// means the standard logger
+	Logger Logger
+
+	// Hooks receives instrumentation events of all sessions
+	Hooks Hooks
+
+	// TLSConfig is used by ServeTLS, certificates given to ServeTLS are added
+	// to a copy of it
+	TLSConfig *tls.Config
+
+	// ReadTimeout and WriteTimeout set the packet timeouts of every session, see
+	// MilterSession; Configure may override them
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Configure is called with every new session before it starts, for example
+	// to set RawHeaders or limits
+	Configure func(*MilterSession)
+
+	// MaxSessions stops accepting connections while that many sessions are active
+	// and MaxMemory while the heap holds more bytes, leaving bursts to the kernel
+	// backlog; zero means no limit
+	MaxSessions int
+	MaxMemory   uint64
+
+	// RejectOverload closes connections accepted while MaxSessions sessions are
+	// active instead of pausing accepting, so the MTA applies its milter failure
+	// policy right away rather than after its connect timeout
+	RejectOverload bool
+
+	// MaxSessionsPerPeer limits concurrent sessions of a single MTA address,
+	// connections over the limit are closed right away; zero means no limit
+	MaxSessionsPerPeer int
+
+	once     sync.Once
+	active   atomic.Int64
+	released chan struct{}
+
+	sessionMutex sync.Mutex
+	sessions     map[uint64]*trackedSession
+	lastID       uint64
+	peers        map[netip.Addr]int
+	leaks        atomic.Uint64
+	listeners    map[net.Listener]struct{}
+	closing      atomic.Bool
+	ctxOnce      sync.Once
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+// memoryPoll is the interval at which memory use is checked while accepting is paused
+const memoryPoll = 100 * time.Millisecond
+
+// heapMetric reports memory occupied by live and not yet collected heap objects
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// Active returns the number of sessions currently served
+func (s *Server) Active() int {
+	return int(s.active.Load())
+}
+
+// wait blocks while the server is overloaded
+func (s *Server) wait() {
+	s.once.Do(func() { s.released = make(chan struct{}, 1) })
+	for {
+		sessions := s.MaxSessions <= 0 || s.RejectOverload || s.Active() < s.MaxSessions
+		memory := s.MaxMemory == 0 || heapBytes() <= s.MaxMemory
+		if sessions && memory {
+			return
+		}
+		// finished sessions wake up waiting immediately, memory is polled
+		timer := time.NewTimer(memoryPoll)
+		select {
+		case <-s.released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// heapBytes returns current heap memory use
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// peerKey returns the MTA address of conn, connections other than IP have none
+func peerKey(conn net.Conn) (netip.Addr, bool) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	key, ok := netip.AddrFromSlice(addr.IP)
+	return key.Unmap(), ok
+}
+
+// admit reserves a session slot of the MTA address of conn, it returns false if
+// the address is at MaxSessionsPerPeer
+func (s *Server) admit(conn net.Conn) bool {
+	key, ok := peerKey(conn)
+	if s.MaxSessionsPerPeer <= 0 || !ok {
+		return true
+	}
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	if s.peers[key] >= s.MaxSessionsPerPeer {
+		return false
+	}
+	if s.peers == nil {
+		s.peers = make(map[netip.Addr]int)
+	}
+	s.peers[key]++
+	return true
+}
+
+// leave releases the session slot reserved by admit
+func (s *Server) leave(conn net.Conn) {
+	key, ok := peerKey(conn)
+	if s.MaxSessionsPerPeer <= 0 || !ok {
+		return
+	}
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	if s.peers[key]--; s.peers[key] <= 0 {
+		delete(s.peers, key)
+	}
+}
+
+// run serves session and releases its slot afterwards
+func (s *Server) run(session *MilterSession, conn net.Conn, id uint64) {
+	defer func() {
+		s.leave(conn)
+		s.untrack(id)
+		s.active.Add(-1)
+		select {
+		case s.released <- struct{}{}:
+		default:
+		}
+	}()
+	session.handle(s.context())
+}
+
+// context returns the context of all sessions, it is cancelled by Close
+func (s *Server) context() context.Context {
+	s.ctxOnce.Do(func() {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	})
+	return s.ctx
+}
+
+// Serve accepts connections from listener until it fails or the server is shut
+// down, accepting pauses while the server is over MaxSessions or MaxMemory and
+// connections over MaxSessions are closed with RejectOverload.
+// After Shutdown or Close it returns EServerClosed.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.addListener(listener) {
+		return EServerClosed
+	}
+	defer s.removeListener(listener)
 	for {
+		s.wait()
 		// accept connection from client
-		client, err := server.Accept()
+		client, err := listener.Accept()
+		if s.closing.Load() {
+			if err == nil {
+				client.Close()
+			}
+			return EServerClosed
+		}
 		if err != nil {
 			return err
 		}
+		if s.RejectOverload && s.MaxSessions > 0 && s.Active() >= s.MaxSessions {
+			LoggerOrDefault(s.Logger).Printf("Error accepting milter connection: %v over session limit", client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		if !s.admit(client) {
+			LoggerOrDefault(s.Logger).Printf("Error accepting milter connection: %v over session limit per peer", client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		// tuning failures are not fatal for the connection
+		if err := s.TCP.apply(client); err != nil {
+			LoggerOrDefault(s.Logger).Printf("Error tuning milter connection: %v", err)
+		}
 		// create milter object
-		milter, actions, protocol := init()
-		session := MilterSession{
-			Actions:  actions,
-			Protocol: protocol,
-			Sock:     client,
-			Milter:   milter,
+		session := NewSession(client, WithInit(s.Init))
+		session.leaked = func(int64) { s.leaks.Add(1) }
+		session.ReadTimeout, session.WriteTimeout = s.ReadTimeout, s.WriteTimeout
+		session.Logger, session.Hooks = s.Logger, s.Hooks
+		if s.Configure != nil {
+			s.Configure(session)
 		}
-		// handle connection commands
-		go session.HandleMilterCommands()
+		// handle connection commands, the session is tracked before it starts
+		// so that Shutdown reaches it
+		s.active.Add(1)
+		id := s.track(session)
+		go s.run(session, client, id)
 	}
 }
+
+// ServeTLS accepts connections from listener like Serve and serves TLS on them
+// with TLSConfig, certFile and keyFile name a PEM encoded certificate and key
+// and may be empty if TLSConfig has certificates. Client certificates are
+// verified as configured in TLSConfig, see MutualTLSConfig.
+func (s *Server) ServeTLS(listener net.Listener, certFile, keyFile string) error {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return fmt.Errorf("%w: no server certificate", ETLSConfig)
+	}
+	return s.Serve(tls.NewListener(listener, config))
+}
+
+// RunServer provides a convenient way to start a milter server
+func RunServer(server net.Listener, init MilterInit) error {
+	return (&Server{Init: init}).Serve(server)
+}
@@ -1,14 +1,20 @@
 package milter
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
 	"io"
-	"log"
 	"net"
 	"net/textproto"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/phalaaxx/milter/milterwire"
 )
 
 const (
@@ -19,6 +25,9 @@ const (
 	OptRemoveRcpt   = 0x08
 	OptChangeHeader = 0x10
 	OptQuarantine   = 0x20
+	OptChangeFrom   = 0x40
+	OptAddRcptPar   = 0x80
+	OptSetSymList   = 0x100
 
 	// undesired protocol content
 	OptNoConnect  = 0x01
@@ -28,8 +37,44 @@ const (
 	OptNoBody     = 0x10
 	OptNoHeaders  = 0x20
 	OptNoEOH      = 0x40
+
+	// protocol version 6 content and behaviour, OptNoReply flags tell the MTA
+	// not to wait for the response to a command
+	OptNoReplyHeader      = 0x80
+	OptNoUnknown          = 0x100
+	OptNoData             = 0x200
+	OptSkip               = 0x400
+	OptRcptRejected       = 0x800
+	OptNoReplyConnect     = 0x1000
+	OptNoReplyHelo        = 0x2000
+	OptNoReplyMailFrom    = 0x4000
+	OptNoReplyRcptTo      = 0x8000
+	OptNoReplyData        = 0x10000
+	OptNoReplyUnknown     = 0x20000
+	OptNoReplyEOH         = 0x40000
+	OptNoReplyBody        = 0x80000
+	OptHeaderLeadingSpace = 0x100000
+	OptMaxDataSize256K    = 0x10000000
+	OptMaxDataSize1M      = 0x20000000
 )
 
+// noReplyFlags maps commands to the protocol flags dropping their response
+var noReplyFlags = map[Code]uint32{
+	CmdConnect: OptNoReplyConnect,
+	CmdHelo:    OptNoReplyHelo,
+	CmdMail:    OptNoReplyMailFrom,
+	CmdRcpt:    OptNoReplyRcptTo,
+	CmdData:    OptNoReplyData,
+	CmdUnknown: OptNoReplyUnknown,
+	CmdHeader:  OptNoReplyHeader,
+	CmdEOH:     OptNoReplyEOH,
+	CmdBody:    OptNoReplyBody,
+}
+
+// DefaultMaxFrameSize is the packet size limit used when MaxFrameSize is not set,
+// it fits the largest body chunk an MTA may negotiate
+const DefaultMaxFrameSize = 2 << 20
+
 // MilterSession keeps session state during MTA communication
 type MilterSession struct {
 	Actions  uint32
@@ -38,91 +83,277 @@ type MilterSession struct {
 	Headers  textproto.MIMEHeader
 	Macros   map[string]string
 	Milter   Milter
+
+	// HeaderFields keeps headers in received order with original name case
+	HeaderFields HeaderFields
+
+	// RawHeaders passes headers to the milter without collecting them in Headers
+	// and HeaderFields, milters implementing RawHeaderHandler receive them as
+	// byte slices valid only during the call
+	RawHeaders bool
+
+	// Sendmail adapts the session to Sendmail behavior: macros are available
+	// both with and without braces, a leading space is removed from values of
+	// header modifications and message verdicts do not end the session
+	Sendmail bool
+
+	// Interceptors are applied to every packet read and written, see Interceptor
+	Interceptors []Interceptor
+
+	// ReadTimeout limits the time spent waiting for the next packet from the MTA,
+	// if Sock supports read deadlines; zero means no limit. It must exceed the
+	// time the MTA may spend waiting on the SMTP client between commands.
+	ReadTimeout time.Duration
+
+	// WriteTimeout limits the time spent writing a single packet, if Sock supports
+	// write deadlines; zero means no limit
+	WriteTimeout time.Duration
+
+	// MaxFrameSize limits the size of packets accepted from the MTA, larger packets
+	// end the session with ProtocolError; zero means DefaultMaxFrameSize
+	MaxFrameSize uint32
+
+	// MaxResponseSize limits the payload of packets sent to the MTA, larger body
+	// replacements are split and other packets fail with ETooLarge; zero means
+	// DefaultMaxResponseSize
+	MaxResponseSize uint32
+
+	// MaxDelay caps the delay of DelayedResponse replies, zero means DefaultMaxDelay
+	MaxDelay time.Duration
+
+	// ProgressInterval sends progress to the MTA while end of message handlers
+	// run, so slow scans do not hit its reply timeout; zero disables keepalives,
+	// they are not sent in protocol version 2 which lacks progress
+	ProgressInterval time.Duration
+
+	// Clock times DelayedResponse replies and progress keepalives and stamps
+	// journal and audit records, nil means SystemClock
+	Clock Clock
+
+	// RequestMacros asks the MTA for specific macros at each stage instead of
+	// its configured defaults
+	RequestMacros *MacroRequests
+
+	// Logger receives the log messages of the session, nil means the standard
+	// logger
+	Logger Logger
+
+	// Hooks receives instrumentation events of the session, nil ignores them
+	Hooks Hooks
+
+	// SessionID identifies the session in callbacks and log messages,
+	// NewSession sets a random one
+	SessionID string
+
+	// OnPanic is called with panics recovered from handlers, the session sends
+	// a temporary failure and ends afterwards; nil logs the panic and its stack
+	OnPanic func(err *PanicError)
+
+	// MaxGoroutines limits goroutines started with Modifier.Go which run at the
+	// same time, zero means no limit
+	MaxGoroutines int
+
+	stats      sessionStats
+	readBuf    []byte
+	bodyHash   hash.Hash
+	bodyLength int64
+	skipBody   bool
+	writeMutex sync.Mutex
+	writeErr   error
+	queue      net.Buffers
+	queued     int
+	codec      Codec
+	actions    uint32
+	protocol   uint32
+	negotiated bool
+	macros     *MacroRequests
+	connected  bool
+	nonSMTP    bool
+	pending    []pendingTask
+	direction  Direction
+	early      bytes.Buffer
+	ctxOnce    sync.Once
+	ctx        context.Context
+	cancel     context.CancelFunc
+	msgCtx     context.Context
+	messageID  string
+	messages   int
+	msgCancel  context.CancelFunc
+	leaked     func(n int64)
+	drain      drainState
 }
 
-// ReadPacket reads incoming milter packet
+// ReadPacket reads incoming milter packet, the returned message owns its data
 func (c *MilterSession) ReadPacket() (*Message, error) {
-	// read packet length
-	var length uint32
-	if err := binary.Read(c.Sock, binary.BigEndian, &length); err != nil {
+	msg, err := c.readPacket()
+	if err != nil {
 		return nil, err
 	}
+	msg.Data = append([]byte(nil), msg.Data...)
+	return msg, nil
+}
 
-	// read packet data
-	data := make([]byte, length)
-	if _, err := io.ReadFull(c.Sock, data); err != nil {
+// readPacket reads incoming milter packet into the session read buffer,
+// message data is only valid until the next packet is read
+func (c *MilterSession) readPacket() (*Message, error) {
+	max := c.MaxFrameSize
+	if max == 0 {
+		max = DefaultMaxFrameSize
+	}
+	if c.readBuf == nil {
+		c.readBuf = readBuffers.get()
+	}
+	// stalled or half-open connections fail once the read timeout expires
+	if conn, ok := c.Sock.(readDeadliner); ok && c.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	code, data, buf, err := milterwire.ReadFrameBuffer(c.reader(), c.readBuf, max)
+	c.readBuf = buf
+	if err != nil {
+		if err == milterwire.EMalformed || err == milterwire.ETooLarge {
+			return nil, &ProtocolError{Err: err}
+		}
 		return nil, err
 	}
+	c.stats.read.Add(int64(milterwire.HeaderSize + 1 + len(data)))
 
 	// prepare response data
 	message := Message{
-		Code: data[0],
-		Data: data[1:],
+		Code: Code(code),
+		Data: data,
 	}
 
 	return &message, nil
 }
 
-// WritePacket sends a milter response packet to socket stream
-func (m *MilterSession) WritePacket(msg *Message) error {
-	buffer := bufio.NewWriter(m.Sock)
-
-	// calculate and write response length
-	length := uint32(len(msg.Data) + 1)
-	if err := binary.Write(buffer, binary.BigEndian, length); err != nil {
-		return err
+// Process processes incoming milter commands
+//
+// Modifications made by the handler are flushed to the MTA before Process
+// returns, so they always precede the response even if it is delayed or
+// written by the caller.
+func (m *MilterSession) Process(msg *Message) (Response, error) {
+	m.beginMessage(msg.Code)
+	// modifier is valid only while the callback handler runs
+	modifier := NewModifier(m)
+	modifier.ctx = m.commandContext(msg.Code)
+	// end of message handlers are cancelled when the MTA gives up waiting and
+	// kept alive with progress while they run
+	stop := func() {}
+	if msg.Code == CmdEOB {
+		ctx, cancel := context.WithCancelCause(modifier.ctx)
+		modifier.ctx = ctx
+		defer m.watch(cancel)()
+		defer cancel(nil)
+		stop = m.keepalive(modifier)
 	}
-
-	// write response code
-	if err := buffer.WriteByte(msg.Code); err != nil {
-		return err
+	resp, err := m.recoverProcess(msg, modifier)
+	stop()
+	if n := modifier.close(); n != 0 {
+		m.logf("Error in %v handler: %d modifications of open transaction discarded", msg.Code, n)
 	}
-
-	// write response data
-	if _, err := buffer.Write(msg.Data); err != nil {
-		return err
+	if err == nil && resp != nil {
+		if err := m.Flush(context.Background()); err != nil {
+			return nil, &SessionClosedError{err}
+		}
+		resp = m.noReply(msg.Code, m.supported(msg.Code, resp))
 	}
+	return resp, err
+}
 
-	// flush data to network socket stream
-	if err := buffer.Flush(); err != nil {
-		return err
+// recoverProcess runs process and turns a panic of the handler into
+// PanicError, together with a temporary failure if the MTA waits for a reply
+func (m *MilterSession) recoverProcess(msg *Message, modifier *Modifier) (resp Response, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		panicErr := &PanicError{msg.Code, r, debug.Stack()}
+		if m.OnPanic != nil {
+			m.OnPanic(panicErr)
+		} else {
+			m.logf("Error in %v handler: panic: %v\n%s", msg.Code, r, panicErr.Stack)
+		}
+		resp, err = nil, panicErr
+		if _, ok := noReplyFlags[msg.Code]; (ok || msg.Code == CmdEOB) && m.protocol&noReplyFlags[msg.Code] == 0 {
+			resp = RespTempFail
+		}
+	}()
+	return m.process(msg, modifier)
+}
+
+// supported replaces responses the negotiated version does not define with
+// continue; skip also needs to be negotiated and falls back to continue
+// silently as the MTA keeps sending body chunks either way, it is only valid
+// for body chunks
+func (m *MilterSession) supported(code Code, resp Response) Response {
+	reply := resp.Response().Code
+	switch {
+	case reply == ActSkip && (code != CmdBody || !m.codec.Supports(reply) || m.protocol&OptSkip == 0):
+		return RespContinue
+	case !m.codec.Supports(reply):
+		m.logf("Error in %v handler: response %v unavailable in protocol version %d", code, reply, m.codec.Version())
+		return RespContinue
 	}
+	return resp
+}
 
+// noReply drops responses to commands the MTA does not wait for, only
+// continue is assumed for them
+func (m *MilterSession) noReply(code Code, resp Response) Response {
+	if m.protocol&noReplyFlags[code] == 0 {
+		return resp
+	}
+	if !resp.Continue() || resp.Response().Code != ActContinue {
+		m.logf("Error in %v handler: response %v dropped as no reply was negotiated", code, resp.Response().Code)
+	}
 	return nil
 }
 
-// Process processes incoming milter commands
-func (m *MilterSession) Process(msg *Message) (Response, error) {
+// process runs the handler of a single command
+func (m *MilterSession) process(msg *Message, modifier *Modifier) (Response, error) {
+	// protocol version 2 is assumed until negotiated otherwise
+	if m.codec == nil {
+		m.codec = codecV2{}
+	}
+	if !m.codec.Allowed(msg.Code) {
+		return nil, &ProtocolError{msg.Code, EUnknownCommand}
+	}
+
 	switch msg.Code {
-	case 'A':
-		// abort current message and start over
-		m.Headers = nil
-		m.Macros = nil
+	case CmdAbort:
+		// abort current message and start over, modifications are refused
+		modifier.close()
+		err := m.Milter.Abort(modifier)
+		m.ResetMessage()
+		if err != nil {
+			return nil, &HandlerError{"Abort", err}
+		}
 		// do not send response
 		return nil, nil
 
-	case 'B':
-		// body chunk
-		return m.Milter.BodyChunk(msg.Data, NewModifier(m))
-
-	case 'C':
-		// new connection, get hostname
-		Hostname := ReadCString(msg.Data)
-		msg.Data = msg.Data[len(Hostname)+1:]
-		// get protocol family
-		ProtocolFamily := msg.Data[0]
-		msg.Data = msg.Data[1:]
-		// get port
-		var Port uint16
-		if ProtocolFamily == '4' || ProtocolFamily == '6' {
-			if len(msg.Data) < 2 {
-				return RespTempFail, nil
-			}
-			Port = binary.BigEndian.Uint16(msg.Data)
-			msg.Data = msg.Data[2:]
+	case CmdBody:
+		// body chunk, digest is kept to detect unchanged replacement bodies
+		if m.bodyHash == nil {
+			m.bodyHash = sha256.New()
+		}
+		m.bodyHash.Write(msg.Data)
+		m.bodyLength += int64(len(msg.Data))
+		// chunks after skip arrive when the MTA does not support skipping
+		if m.skipBody {
+			return RespContinue, nil
+		}
+		resp, err := handlerResult("BodyChunk")(m.Milter.BodyChunk(msg.Data, modifier))
+		m.skipBody = err == nil && resp != nil && resp.Response().Code == ActSkip
+		return resp, err
+
+	case CmdConnect:
+		// new connection, get hostname, family, port and address
+		connect, err := m.codec.Connect(msg.Data)
+		if err != nil {
+			return nil, &ProtocolError{msg.Code, err}
 		}
-		// get address
-		Address := ReadCString(msg.Data)
 		// convert address and port to human readable string
 		family := map[byte]string{
 			'U': "unknown",
@@ -130,130 +361,329 @@ func (m *MilterSession) Process(msg *Message) (Response, error) {
 			'4': "tcp4",
 			'6': "tcp6",
 		}
+		m.connected = true
+		m.stats.setClient(connect.Hostname + " [" + connect.Address + "]")
 		// run handler and return
-		return m.Milter.Connect(
-			Hostname,
-			family[ProtocolFamily],
-			Port,
-			net.ParseIP(Address),
-			NewModifier(m))
-
-	case 'D':
+		return handlerResult("Connect")(m.Milter.Connect(
+			connect.Hostname,
+			family[connect.Family],
+			connect.Port,
+			net.ParseIP(connect.Address),
+			modifier))
+
+	case CmdMacro:
 		// define macros
 		m.Macros = make(map[string]string)
-		// convert data to Go strings
-		data := DecodeCStrings(msg.Data[1:])
-		if len(data) != 0 {
-			// store data in a map
-			for i := 0; i < len(data); i += 2 {
-				m.Macros[data[i]] = data[i+1]
-			}
+		if len(msg.Data) == 0 {
+			return nil, &ProtocolError{msg.Code, EMacroNoData}
+		}
+		_, macros, err := m.codec.Macros(msg.Data)
+		if err != nil {
+			return nil, &ProtocolError{msg.Code, err}
+		}
+		// store data in a map
+		for _, macro := range macros {
+			m.Macros[macro.Name] = macro.Value
+		}
+		if m.Sendmail {
+			macroAliases(m.Macros)
+		}
+		if id, ok := m.Macros["i"]; ok {
+			m.stats.setQueueID(id)
 		}
 		// do not send response
 		return nil, nil
 
-	case 'E':
-		// call and return milter handler
-		return m.Milter.Body(NewModifier(m))
+	case CmdEOB:
+		// call milter handler, the message is complete afterwards
+		resp, err := handlerResult("Body")(m.Milter.Body(modifier))
+		m.ResetMessage()
+		return resp, err
 
-	case 'H':
+	case CmdHelo:
 		// helo command
-		name := strings.TrimSuffix(string(msg.Data), NULL)
-		return m.Milter.Helo(name, NewModifier(m))
+		name, err := m.codec.Helo(msg.Data)
+		if err != nil {
+			return nil, &ProtocolError{msg.Code, err}
+		}
+		return handlerResult("Helo")(m.Milter.Helo(name, modifier))
 
-	case 'L':
+	case CmdHeader:
+		if m.RawHeaders {
+			return m.rawHeader(msg, modifier)
+		}
 		// make sure Headers is initialized
 		if m.Headers == nil {
 			m.Headers = make(textproto.MIMEHeader)
+			modifier.Headers = m.Headers
 		}
 		// add new header to headers map
-		HeaderData := DecodeCStrings(msg.Data)
-		if len(HeaderData) == 2 {
-			m.Headers.Add(HeaderData[0], HeaderData[1])
+		name, value, err := m.codec.Header(msg.Data)
+		if err == nil {
+			m.Headers.Add(name, value)
+			m.HeaderFields = append(m.HeaderFields, HeaderField{name, value})
+			modifier.HeaderFields = m.HeaderFields
 			// call and return milter handler
-			return m.Milter.Header(HeaderData[0], HeaderData[1], NewModifier(m))
+			return handlerResult("Header")(m.Milter.Header(name, value, modifier))
 		}
 
-	case 'M':
+	case CmdMail:
 		// envelope from address
-		envfrom := ReadCString(msg.Data)
-		return m.Milter.MailFrom(strings.Trim(envfrom, "<>"), NewModifier(m))
+		envfrom, _, err := m.codec.Envelope(msg.Data)
+		if err != nil {
+			return nil, &ProtocolError{msg.Code, err}
+		}
+		// locally submitted mail arrives without connection information
+		if !m.connected && m.protocol&OptNoConnect == 0 {
+			m.connected, m.nonSMTP = true, true
+			modifier.NonSMTP = true
+			resp, err := handlerResult("Connect")(m.Milter.Connect("localhost", "unknown", 0, net.IPv4(127, 0, 0, 1), modifier))
+			if err != nil || !resp.Continue() {
+				return resp, err
+			}
+		}
+		return handlerResult("MailFrom")(m.Milter.MailFrom(strings.Trim(envfrom, "<>"), modifier))
 
-	case 'N':
+	case CmdEOH:
 		// end of headers
-		return m.Milter.Headers(m.Headers, NewModifier(m))
-
-	case 'O':
-		// ignore request and prepare response buffer
-		buffer := new(bytes.Buffer)
-		// prepare response data
-		for _, value := range []uint32{2, m.Actions, m.Protocol} {
-			if err := binary.Write(buffer, binary.BigEndian, value); err != nil {
-				return nil, err
-			}
+		return handlerResult("Headers")(m.Milter.Headers(m.Headers, modifier))
+
+	case CmdOptNeg:
+		// check offered protocol version
+		offer, err := milterwire.DecodeOptNeg(msg.Data)
+		if err != nil {
+			return nil, &NegotiationError{Err: err}
+		}
+		// select codec for the highest mutually supported version
+		codec := selectCodec(offer.Version)
+		if codec == nil {
+			return nil, &NegotiationError{offer.Version, offer.Actions, offer.Protocol, EVersion}
+		}
+		m.codec = codec
+		// the milter may choose flags for this connection
+		actions, protocol := m.Actions, m.Protocol
+		if negotiator, ok := m.Milter.(Negotiator); ok {
+			actions, protocol = negotiator.Negotiate(offer.Actions&codec.Actions(), offer.Protocol&codec.Protocol())
 		}
+		// request only what the MTA offers and the selected version defines
+		m.actions = actions & offer.Actions & codec.Actions()
+		m.protocol = protocol & offer.Protocol & codec.Protocol()
+		// skipping is always requested when offered, RespSkip falls back to continue
+		m.protocol |= offer.Protocol & codec.Protocol() & OptSkip
+		m.negotiated = true
 		// build and send packet
-		return NewResponse('O', buffer.Bytes()), nil
+		reply := milterwire.OptNeg{Version: codec.Version(), Actions: m.actions, Protocol: m.protocol}
+		// macro lists are sent if the MTA lets the milter choose them
+		m.macros = nil
+		if !m.RequestMacros.empty() && offer.Actions&codec.Actions()&OptSetSymList != 0 {
+			m.macros = m.RequestMacros
+			m.actions |= OptSetSymList
+			reply.Actions, reply.Macros = m.actions, m.macros.stages()
+		}
+		return NewResponse(ActOptNeg, reply.Encode()), nil
 
-	case 'Q':
+	case CmdQuit:
 		// client requested session close
-		return nil, ECloseSession
+		return nil, &SessionClosedError{ECloseSession}
+
+	case CmdQuitNC:
+		// connection context ends, the MTA reuses the session for a new one
+		m.ResetConnection()
+		// do not send response
+		return nil, nil
 
-	case 'R':
+	case CmdRcpt:
 		// envelope to address
-		envto := ReadCString(msg.Data)
-		return m.Milter.RcptTo(strings.Trim(envto, "<>"), NewModifier(m))
+		envto, _, err := m.codec.Envelope(msg.Data)
+		if err != nil {
+			return nil, &ProtocolError{msg.Code, err}
+		}
+		return handlerResult("RcptTo")(m.Milter.RcptTo(strings.Trim(envto, "<>"), modifier))
+
+	case CmdData:
+		// start of message data
+		return handlerResult("Data")(m.Milter.Data(modifier))
 
-	case 'T':
-		// data, ignore
+	case CmdUnknown:
+		// SMTP command not recognized by the MTA
+		cmd, _, _ := milterwire.ReadString(msg.Data)
+		return handlerResult("Unknown")(m.Milter.Unknown(cmd, modifier))
 
 	default:
-		// print error and close session
-		log.Printf("Unrecognized command code: %c", msg.Code)
-		return nil, ECloseSession
+		// report error and close session
+		return nil, &ProtocolError{msg.Code, EUnknownCommand}
 	}
 
 	// by default continue with next milter message
 	return RespContinue, nil
 }
 
-// HandleMilterComands processes all milter commands in the same connection
-func (m *MilterSession) HandleMilterCommands() {
+// rawHeader passes header to milter without bookkeeping
+func (m *MilterSession) rawHeader(msg *Message, modifier *Modifier) (Response, error) {
+	name, value, err := milterwire.DecodeHeaderBytes(msg.Data)
+	if err != nil {
+		// malformed headers are ignored as in collecting mode
+		return RespContinue, nil
+	}
+	if handler, ok := m.Milter.(RawHeaderHandler); ok {
+		return handlerResult("RawHeader")(handler.RawHeader(name, value, modifier))
+	}
+	return handlerResult("Header")(m.Milter.Header(string(name), string(value), modifier))
+}
+
+// NonSMTP returns true if the session carries locally submitted mail, as sent by
+// Postfix non_smtpd_milters without connect and helo; the milter Connect callback
+// is then called before MailFrom with localhost and the loopback address
+func (m *MilterSession) NonSMTP() bool {
+	return m.nonSMTP
+}
+
+// ResetMessage clears per-message state and notifies milter if it implements
+// MessageResetter; it is called after the end of body callback and when the MTA
+// aborts a message
+func (m *MilterSession) ResetMessage() {
+	m.Headers = nil
+	m.HeaderFields = nil
+	m.Macros = nil
+	m.bodyHash = nil
+	m.bodyLength = 0
+	m.skipBody = false
+	m.direction = DirectionUnknown
+	m.stats.setQueueID("")
+	m.messageID = ""
+	m.stats.setMessageID("")
+	m.finishMessage()
+	if m.msgCancel != nil {
+		m.msgCancel()
+		m.msgCtx, m.msgCancel = nil, nil
+	}
+	ResetMessage(m.Milter)
+}
+
+// ResetConnection clears per-connection state and notifies milter if it
+// implements ConnectionResetter; negotiated options are kept
+func (m *MilterSession) ResetConnection() {
+	m.ResetMessage()
+	m.connected = false
+	m.nonSMTP = false
+	ResetConnection(m.Milter)
+}
+
+// receivedBody returns digest and length of body chunks received so far, the
+// digest is nil once the milter skipped the rest of the body
+func (m *MilterSession) receivedBody() ([]byte, int64) {
+	if m.skipBody {
+		return nil, m.bodyLength
+	}
+	if m.bodyHash == nil {
+		return sha256.New().Sum(nil), 0
+	}
+	return m.bodyHash.Sum(nil), m.bodyLength
+}
+
+// handlerResult wraps errors returned by a callback handler in HandlerError
+func handlerResult(callback string) func(Response, error) (Response, error) {
+	return func(resp Response, err error) (Response, error) {
+		if err != nil {
+			return nil, &HandlerError{callback, err}
+		}
+		return resp, nil
+	}
+}
+
+// Serve processes all milter commands in the same connection and returns the error
+// which ended the session; nil is returned when a final response ends processing.
+// SessionClosedError reports closed connection, ProtocolError and NegotiationError
+// misbehaving MTA and HandlerError failed callback handler.
+func (m *MilterSession) Serve() error {
 	// close session socket on exit
 	defer m.Sock.Close()
+	defer m.end()
 
 	for {
-		// ReadPacket
-		msg, err := m.ReadPacket()
+		// read packet, data is reused for the next packet
+		msg, err := m.readPacket()
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading milter command: %v", err)
+			// a drained session is closed while waiting for the next message
+			if m.drained() {
+				return nil
 			}
-			return
+			var protocolErr *ProtocolError
+			if errors.As(err, &protocolErr) {
+				return err
+			}
+			return &SessionClosedError{err}
+		}
+		if !m.receiveCommand() {
+			return nil
+		}
+
+		// pass command through interceptors
+		if msg, err = m.intercept(msg); err != nil {
+			return err
+		}
+		if msg == nil {
+			if m.finishCommand() {
+				return nil
+			}
+			continue
 		}
 
 		// process command
+		m.stats.setStage(msg.Code)
+		m.startCommand(msg.Code)
+		started := time.Now()
 		resp, err := m.Process(msg)
+		m.hooks().OnCommand(msg.Code, time.Since(started))
 		if err != nil {
-			if err != ECloseSession {
-				// log error condition
-				log.Printf("Error performing milter command: %v", err)
+			// a panicking handler temporarily fails the message
+			var panicErr *PanicError
+			if errors.As(err, &panicErr) && resp != nil && m.WritePacket(resp.Response()) == nil {
+				m.hooks().OnResponse(msg.Code, resp.Response().Code)
 			}
-			return
+			return err
 		}
 
 		// ignore empty responses
 		if resp != nil {
+			// tarpit responses are held back first
+			m.delay(resp)
 			// send back response message
 			if err = m.WritePacket(resp.Response()); err != nil {
-				log.Printf("Error writing packet: %v", err)
-				return
-			}
-
-			if !resp.Continue() {
-				return
+				return &SessionClosedError{err}
 			}
+			m.hooks().OnResponse(msg.Code, resp.Response().Code)
+		}
+		// background tasks start once the MTA has the response
+		m.releaseTasks()
+		if m.finishCommand() {
+			return nil
+		}
 
+		// a rejected recipient or unknown command does not end the message, in
+		// Sendmail mode no message verdict ends the session
+		if resp != nil && !resp.Continue() && msg.Code != CmdRcpt && msg.Code != CmdUnknown && !(m.Sendmail && keepsSession(msg.Code)) {
+			return nil
 		}
 	}
 }
+
+// HandleMilterComands processes all milter commands in the same connection
+// and logs the error which ended the session
+func (m *MilterSession) HandleMilterCommands() {
+	m.handle(context.Background())
+}
+
+// handle runs the session under ctx and logs the error which ended it, ends
+// caused by ctx are not logged
+func (m *MilterSession) handle(ctx context.Context) {
+	err := m.Run(ctx)
+	var closedErr *SessionClosedError
+	switch {
+	case err == nil, ctx.Err() != nil:
+	case errors.As(err, &closedErr):
+		m.logf("Error in milter connection: %v", err)
+	default:
+		m.logf("Error performing milter command: %v", err)
+	}
+}
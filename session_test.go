@@ -0,0 +1,78 @@
+package milter_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterclient"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// offer negotiates protocol version 6 with all actions
+var offer = milterwire.OptNeg{Version: 6, Actions: 0x1ff, Protocol: 0}
+
+// pipeSession runs a session over an in-memory pipe and returns a negotiated
+// client, the session ends with the test
+func pipeSession(t *testing.T, opts ...milter.SessionOption) *milterclient.Client {
+	t.Helper()
+	return pipeSessionOffer(t, offer, opts...)
+}
+
+// pipeSessionOffer is pipeSession negotiating neg
+func pipeSessionOffer(t *testing.T, neg milterwire.OptNeg, opts ...milter.SessionOption) *milterclient.Client {
+	t.Helper()
+	client, server := net.Pipe()
+	session := milter.NewSession(server, opts...)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		session.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	c := milterclient.New(client)
+	c.Timeout = 5 * time.Second
+	if _, err := c.Negotiate(neg); err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	return c
+}
+
+// send sends a command and fails the test if the milter does not reply
+func send(t *testing.T, c *milterclient.Client, code milter.Code, data []byte) *milterclient.Reply {
+	t.Helper()
+	reply, err := c.Send(code, data)
+	if err != nil {
+		t.Fatalf("%v: %v", code, err)
+	}
+	return reply
+}
+
+// expectClosed fails the test unless the milter closes the connection
+func expectClosed(t *testing.T, c *milterclient.Client) {
+	t.Helper()
+	code, _, err := c.Read()
+	switch {
+	case err == nil:
+		t.Fatalf("connection open, got %v", code)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		t.Fatal("connection still open")
+	}
+}
+
+// mailFrom and rcptTo encode envelope addresses
+func mailFrom(sender string) []byte {
+	return milterwire.EncodeAddress("<" + sender + ">")
+}
+
+func rcptTo(rcpt string) []byte {
+	return milterwire.EncodeAddress("<" + rcpt + ">")
+}
@@ -0,0 +1,230 @@
+package milter
+
+import (
+	"net"
+	"net/textproto"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// LoadSignal returns true while the server is saturated
+type LoadSignal func() bool
+
+// LoadShedder refuses new work with a temporary failure while any signal reports
+// saturation, so MTAs retry later instead of all in-flight messages slowing down
+//
+// New connections are refused at connect and new messages of existing ones at
+// MAIL FROM, messages already past that stage are always completed.
+type LoadShedder struct {
+	// Signals are checked in order, the first one reporting saturation sheds load
+	Signals []LoadSignal
+	// Response answers shed connections and messages, default RespTempFail
+	Response Response
+}
+
+// Overloaded returns true if any signal reports saturation
+func (l *LoadShedder) Overloaded() bool {
+	for _, signal := range l.Signals {
+		if signal() {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns milter which sheds load in front of next
+func (l *LoadShedder) Wrap(next Milter) Milter {
+	return &loadShedder{Milter: ConnectFilter(l.check)(next), shedder: l}
+}
+
+// check adapts Overloaded to ConnectCheck
+func (l *LoadShedder) check(host string, family string, port uint16, addr net.IP) Response {
+	if l.Overloaded() {
+		return l.response()
+	}
+	return RespContinue
+}
+
+func (l *LoadShedder) response() Response {
+	if l.Response == nil {
+		return RespTempFail
+	}
+	return l.Response
+}
+
+// loadShedder sheds new messages of a single session
+type loadShedder struct {
+	Milter
+	shedder *LoadShedder
+}
+
+// MailFrom refuses new messages while overloaded
+func (l *loadShedder) MailFrom(from string, m *Modifier) (Response, error) {
+	if l.shedder.Overloaded() {
+		return l.shedder.response(), nil
+	}
+	return l.Milter.MailFrom(from, m)
+}
+
+// MessageReset passes the call on to the wrapped milter
+func (l *loadShedder) MessageReset() {
+	ResetMessage(l.Milter)
+}
+
+// ConnectionReset passes the call on to the wrapped milter
+func (l *loadShedder) ConnectionReset() {
+	ResetConnection(l.Milter)
+}
+
+// SessionSignal reports saturation while server serves max or more sessions
+func SessionSignal(server *Server, max int) LoadSignal {
+	return func() bool {
+		return server.Active() >= max
+	}
+}
+
+// CPUSignal reports saturation while the process uses more than max of the
+// available CPU time, 0.9 meaning 90%; usage is the user and system time of the
+// process sampled at most once a second, it never reports saturation on systems
+// without process CPU accounting
+func CPUSignal(max float64) LoadSignal {
+	var mutex sync.Mutex
+	var sampled time.Time
+	var used float64
+	overloaded := false
+	return func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now := time.Now()
+		if elapsed := now.Sub(sampled); elapsed >= time.Second {
+			total, ok := processCPU()
+			if !ok {
+				return false
+			}
+			if !sampled.IsZero() {
+				usage := (total - used) / (elapsed.Seconds() * float64(runtime.GOMAXPROCS(0)))
+				overloaded = usage > max
+			}
+			sampled, used = now, total
+		}
+		return overloaded
+	}
+}
+
+// LatencyMonitor measures how long the wrapped milter spends in its callbacks
+// from MAIL FROM to the end of body, a moving average over recent messages is
+// kept; time waiting for the SMTP client between commands is not counted
+type LatencyMonitor struct {
+	// Clock measures latency, nil means SystemClock
+	Clock Clock
+
+	mutex   sync.Mutex
+	average time.Duration
+}
+
+// Average returns the moving average of message latency
+func (l *LatencyMonitor) Average() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.average
+}
+
+// record adds a message latency, every message weighs a tenth
+func (l *LatencyMonitor) record(latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.average == 0 {
+		l.average = latency
+		return
+	}
+	l.average += (latency - l.average) / 10
+}
+
+// Signal reports saturation while average latency exceeds max
+func (l *LatencyMonitor) Signal(max time.Duration) LoadSignal {
+	return func() bool {
+		return l.Average() > max
+	}
+}
+
+// Wrap returns milter which measures the callbacks of next from MAIL FROM to
+// the end of body callback
+func (l *LatencyMonitor) Wrap(next Milter) Milter {
+	return &latencyMilter{Milter: next, monitor: l}
+}
+
+// latencyMilter measures messages of a single session
+type latencyMilter struct {
+	Milter
+	monitor   *LatencyMonitor
+	measuring bool
+	busy      time.Duration
+}
+
+func (l *latencyMilter) now() time.Time {
+	return ClockOrSystem(l.monitor.Clock).Now()
+}
+
+// measure adds the time since start to the message, it is deferred by callbacks
+func (l *latencyMilter) measure(start time.Time) {
+	if l.measuring {
+		l.busy += l.now().Sub(start)
+	}
+}
+
+// MailFrom starts measuring
+func (l *latencyMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	l.measuring, l.busy = true, 0
+	defer l.measure(l.now())
+	return l.Milter.MailFrom(from, m)
+}
+
+// RcptTo, Data, Header, Headers and BodyChunk add to message latency
+func (l *latencyMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	defer l.measure(l.now())
+	return l.Milter.RcptTo(rcptTo, m)
+}
+
+func (l *latencyMilter) Data(m *Modifier) (Response, error) {
+	defer l.measure(l.now())
+	return l.Milter.Data(m)
+}
+
+func (l *latencyMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	defer l.measure(l.now())
+	return l.Milter.Header(name, value, m)
+}
+
+func (l *latencyMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	defer l.measure(l.now())
+	return l.Milter.Headers(h, m)
+}
+
+func (l *latencyMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	defer l.measure(l.now())
+	return l.Milter.BodyChunk(chunk, m)
+}
+
+// Body records message latency
+func (l *latencyMilter) Body(m *Modifier) (Response, error) {
+	start := l.now()
+	resp, err := l.Milter.Body(m)
+	if l.measuring {
+		l.measure(start)
+		l.monitor.record(l.busy)
+		l.measuring = false
+	}
+	return resp, err
+}
+
+// MessageReset stops measuring the finished message
+func (l *latencyMilter) MessageReset() {
+	l.measuring, l.busy = false, 0
+	ResetMessage(l.Milter)
+}
+
+// ConnectionReset passes the call on to the wrapped milter
+func (l *latencyMilter) ConnectionReset() {
+	ResetConnection(l.Milter)
+}
@@ -0,0 +1,145 @@
+package milter_test
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+// overloadMilter reports overload from stage from on, it continues at the end
+// of messages so the session carries on
+type overloadMilter struct {
+	milter.NoOpMilter
+	overloaded *bool
+	from       milter.Code
+}
+
+func (o overloadMilter) Connect(string, string, uint16, net.IP, *milter.Modifier) (milter.Response, error) {
+	*o.overloaded = *o.overloaded || o.from == milter.CmdConnect
+	return milter.RespContinue, nil
+}
+
+func (o overloadMilter) RcptTo(string, *milter.Modifier) (milter.Response, error) {
+	*o.overloaded = *o.overloaded || o.from == milter.CmdRcpt
+	return milter.RespContinue, nil
+}
+
+func (o overloadMilter) Body(*milter.Modifier) (milter.Response, error) {
+	return milter.RespContinue, nil
+}
+
+func TestLoadShedder(t *testing.T) {
+	tests := []struct {
+		name       string
+		overloaded bool
+		from       milter.Code
+		// refused lists the commands answered with a temporary failure
+		refused []milter.Code
+	}{
+		{"idle", false, 0, nil},
+		{"overloaded before connect", true, 0, []milter.Code{milter.CmdConnect}},
+		{"overloaded after connect", false, milter.CmdConnect, []milter.Code{milter.CmdMail}},
+		{"overloaded during message", false, milter.CmdRcpt, []milter.Code{milter.CmdMail}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			overloaded := test.overloaded
+			shedder := &milter.LoadShedder{Signals: []milter.LoadSignal{func() bool { return overloaded }}}
+			// messages past MAIL FROM complete, later ones are shed
+			exchanges, _ := miltertest.NewScenario().Connect("client.example.com", "192.0.2.1").
+				MailFrom("a@example.com").RcptTo("b@example.org").Header("Subject", "x").Body("x").
+				MailFrom("a@example.com").Abort().
+				Check(func() (milter.Milter, uint32, uint32) {
+					return shedder.Wrap(overloadMilter{overloaded: &overloaded, from: test.from}), 0, 0
+				})
+			var refused []milter.Code
+			for _, exchange := range exchanges {
+				for _, resp := range exchange.Responses {
+					if resp.Code == milter.ActTempFail {
+						refused = append(refused, exchange.Command.Code)
+					}
+				}
+			}
+			if len(refused) != len(test.refused) {
+				t.Fatalf("refused %v, want %v", refused, test.refused)
+			}
+			for i := range refused {
+				if refused[i] != test.refused[i] {
+					t.Fatalf("refused %v, want %v", refused, test.refused)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyMonitor(t *testing.T) {
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		// transfer passes between MAIL FROM and end of message outside of callbacks
+		transfer  time.Duration
+		average   time.Duration
+		saturated bool
+	}{
+		{"none", nil, 0, 0, false},
+		{"first message", []time.Duration{2 * time.Second}, 0, 2 * time.Second, true},
+		{"moving average", []time.Duration{time.Second, 11 * time.Second}, 0, 2 * time.Second, true},
+		{"fast", []time.Duration{100 * time.Millisecond}, 0, 100 * time.Millisecond, false},
+		{"slow client", []time.Duration{100 * time.Millisecond}, time.Minute, 100 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := miltertest.NewFakeClock(time.Unix(1000, 0))
+			monitor := &milter.LatencyMonitor{Clock: clock}
+			for _, latency := range test.latencies {
+				slow := monitor.Wrap(slowBody{clock: clock, latency: latency})
+				m := &milter.Modifier{}
+				slow.MailFrom("a@example.com", m)
+				clock.Advance(test.transfer)
+				slow.Body(m)
+				slow.(milter.MessageResetter).MessageReset()
+			}
+			if average := monitor.Average(); average != test.average {
+				t.Fatalf("average %v, want %v", average, test.average)
+			}
+			if saturated := monitor.Signal(time.Second)(); saturated != test.saturated {
+				t.Fatalf("saturated %v, want %v", saturated, test.saturated)
+			}
+		})
+	}
+}
+
+// slowBody advances clock by latency at the end of the message
+type slowBody struct {
+	milter.NoOpMilter
+	clock   *miltertest.FakeClock
+	latency time.Duration
+}
+
+func (s slowBody) Body(*milter.Modifier) (milter.Response, error) {
+	s.clock.Advance(s.latency)
+	return milter.RespAccept, nil
+}
+
+func TestCPUSignal(t *testing.T) {
+	switch {
+	case testing.Short():
+		t.Skip("samples CPU usage for a second")
+	case runtime.GOOS == "windows", runtime.GOOS == "plan9", runtime.GOOS == "js", runtime.GOOS == "wasip1":
+		t.Skip("no process CPU accounting")
+	}
+	signal := milter.CPUSignal(0)
+	if signal() {
+		t.Fatal("saturated before the first sample")
+	}
+	// spinning without allocations accounts CPU time without garbage collection
+	for start := time.Now(); time.Since(start) < 1100*time.Millisecond; {
+	}
+	if !signal() {
+		t.Fatal("busy process not saturated")
+	}
+}
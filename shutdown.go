@@ -0,0 +1,176 @@
+package milter
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// shutdownPoll is the interval at which Shutdown checks for finished sessions
+const shutdownPoll = 50 * time.Millisecond
+
+// drainState tracks whether a session may be closed without losing a message
+type drainState struct {
+	mutex    sync.Mutex
+	busy     bool
+	message  bool
+	draining bool
+	// stop is closed once draining starts
+	stop chan struct{}
+}
+
+// receiveCommand records that a command has been read, it returns false if an
+// idle session was drained meanwhile and its connection closed; the check
+// shares the lock of stopAfterMessage so that no command is in flight when an
+// idle session is closed
+func (m *MilterSession) receiveCommand() bool {
+	m.drain.mutex.Lock()
+	defer m.drain.mutex.Unlock()
+	if m.drain.draining && !m.drain.busy && !m.drain.message {
+		return false
+	}
+	m.drain.busy = true
+	return true
+}
+
+// startCommand records that code is being processed
+func (m *MilterSession) startCommand(code Code) {
+	m.drain.mutex.Lock()
+	m.drain.busy = true
+	if code == CmdMail {
+		m.drain.message = true
+	}
+	m.drain.mutex.Unlock()
+}
+
+// finishCommand records that the response has been sent, it returns true if
+// the session is drained and should end
+func (m *MilterSession) finishCommand() bool {
+	m.drain.mutex.Lock()
+	defer m.drain.mutex.Unlock()
+	m.drain.busy = false
+	return m.drain.draining && !m.drain.message
+}
+
+// finishMessage records that the current message is complete
+func (m *MilterSession) finishMessage() {
+	m.drain.mutex.Lock()
+	m.drain.message = false
+	m.drain.mutex.Unlock()
+}
+
+// stopAfterMessage ends the session once the current message is complete, an
+// idle session is closed right away
+func (m *MilterSession) stopAfterMessage() {
+	m.drain.mutex.Lock()
+	if !m.drain.draining {
+		m.drain.draining = true
+		if m.drain.stop != nil {
+			close(m.drain.stop)
+		}
+	}
+	idle := !m.drain.busy && !m.drain.message
+	m.drain.mutex.Unlock()
+	if idle {
+		m.Sock.Close()
+	}
+}
+
+// draining returns a channel which is closed once the session was told to stop
+// after its message
+func (m *MilterSession) draining() <-chan struct{} {
+	m.drain.mutex.Lock()
+	defer m.drain.mutex.Unlock()
+	if m.drain.stop == nil {
+		m.drain.stop = make(chan struct{})
+		if m.drain.draining {
+			close(m.drain.stop)
+		}
+	}
+	return m.drain.stop
+}
+
+// drained returns true if the session was told to stop after its message
+func (m *MilterSession) drained() bool {
+	m.drain.mutex.Lock()
+	defer m.drain.mutex.Unlock()
+	return m.drain.draining
+}
+
+// Shutdown stops the server gracefully: listeners are closed, idle sessions
+// end right away and busy ones once their current message is complete. When
+// ctx is done first the context error is returned and remaining sessions are
+// left running, Close terminates them. Serve returns EServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+	err := s.closeListeners()
+	s.sessionMutex.Lock()
+	for _, tracked := range s.sessions {
+		tracked.session.stopAfterMessage()
+	}
+	s.sessionMutex.Unlock()
+
+	ticker := time.NewTicker(shutdownPoll)
+	defer ticker.Stop()
+	for s.Active() != 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// Close stops the server immediately: session contexts are cancelled and
+// listeners and the connections of all sessions are closed, the MTA applies its
+// milter failure policy to messages in progress. Serve returns EServerClosed.
+func (s *Server) Close() error {
+	s.closing.Store(true)
+	s.context()
+	s.cancel()
+	err := s.closeListeners()
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	for _, tracked := range s.sessions {
+		tracked.session.Sock.Close()
+	}
+	return err
+}
+
+// addListener registers a listener served by Serve, it returns false if the
+// server is closed
+func (s *Server) addListener(listener net.Listener) bool {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+// removeListener unregisters a listener once Serve returns
+func (s *Server) removeListener(listener net.Listener) {
+	s.sessionMutex.Lock()
+	delete(s.listeners, listener)
+	s.sessionMutex.Unlock()
+}
+
+// closeListeners closes all listeners and returns the first error
+func (s *Server) closeListeners() error {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	var err error
+	for listener := range s.listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.listeners, listener)
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package milter_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterclient"
+)
+
+// serve starts server on a local listener and returns a connected, negotiated
+// client together with the result of Serve
+func serve(t *testing.T, server *milter.Server) (*milterclient.Client, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+	})
+	c, err := milterclient.Dial(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	c.Timeout = 5 * time.Second
+	if _, err := c.Negotiate(offer); err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	return c, served
+}
+
+func TestServerShutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		// message starts a message before shutdown, finish completes it
+		message bool
+		finish  bool
+		timeout time.Duration
+		err     error
+	}{
+		{"idle session", false, false, 5 * time.Second, nil},
+		{"message completed", true, true, 5 * time.Second, nil},
+		{"message pending past deadline", true, false, 200 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &milter.Server{
+				Init: func() (milter.Milter, uint32, uint32) {
+					return milter.NoOpMilter{}, 0, 0
+				},
+				Logger: milter.DiscardLogger,
+			}
+			c, served := serve(t, server)
+			if test.message {
+				send(t, c, milter.CmdMail, mailFrom("a@example.com"))
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- server.Shutdown(ctx)
+			}()
+			if test.message {
+				// the session waits for the end of its message
+				select {
+				case err := <-shutdown:
+					if test.finish {
+						t.Fatalf("shutdown returned %v during message", err)
+					}
+					shutdown <- err
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			if test.finish {
+				send(t, c, milter.CmdRcpt, rcptTo("b@example.org"))
+				send(t, c, milter.CmdEOH, nil)
+				if reply := send(t, c, milter.CmdEOB, nil); reply.Code != milter.ActAccept && reply.Code != milter.ActContinue {
+					t.Fatalf("message got %v", reply.Code)
+				}
+			}
+			if err := <-shutdown; !errors.Is(err, test.err) {
+				t.Fatalf("shutdown error %v, want %v", err, test.err)
+			}
+			if test.err == nil {
+				expectClosed(t, c)
+			}
+			server.Close()
+			if err := <-served; !errors.Is(err, milter.EServerClosed) {
+				t.Fatalf("serve error %v, want %v", err, milter.EServerClosed)
+			}
+			expectClosed(t, c)
+		})
+	}
+}
+
+func TestServerShutdownCommandInFlight(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	server := &milter.Server{
+		Init: func() (milter.Milter, uint32, uint32) {
+			return milter.NoOpMilter{}, 0, 0
+		},
+		// MAIL FROM is held after it was read, before the session starts it
+		Configure: func(s *milter.MilterSession) {
+			s.Use(milter.InterceptorFuncs{In: func(msg *milter.Message) (*milter.Message, error) {
+				if msg.Code == milter.CmdMail {
+					close(received)
+					<-release
+				}
+				return msg, nil
+			}})
+		},
+		Logger: milter.DiscardLogger,
+	}
+	c, _ := serve(t, server)
+	replies := make(chan error, 1)
+	go func() {
+		_, err := c.Send(milter.CmdMail, mailFrom("a@example.com"))
+		replies <- err
+	}()
+	<-received
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	// the session is not idle, its connection stays open for the message
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := <-replies; err != nil {
+		t.Fatalf("MAIL FROM: %v", err)
+	}
+	send(t, c, milter.CmdRcpt, rcptTo("b@example.org"))
+	send(t, c, milter.CmdEOH, nil)
+	send(t, c, milter.CmdEOB, nil)
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown error %v", err)
+	}
+	expectClosed(t, c)
+}
@@ -0,0 +1,179 @@
+package milter
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// SenderMap returns the sender addresses an authenticated login may use, entries
+// starting with "@" allow all addresses of a domain
+type SenderMap interface {
+	Senders(login string) ([]string, error)
+}
+
+// SenderMapFunc adapts a function to SenderMap
+type SenderMapFunc func(login string) ([]string, error)
+
+// Senders implements SenderMap
+func (f SenderMapFunc) Senders(login string) ([]string, error) {
+	return f(login)
+}
+
+// StaticSenderMap maps logins to their sender addresses
+type StaticSenderMap map[string][]string
+
+// Senders implements SenderMap
+func (s StaticSenderMap) Senders(login string) ([]string, error) {
+	return s[login], nil
+}
+
+// Submission enforces that mail relayed by a submission listener is sent by an
+// authenticated user from one of its own addresses
+//
+// Unauthenticated messages are refused at MAIL FROM. The envelope sender, and
+// with HeaderFrom the addresses of the From header, must be allowed by Map for
+// the login reported in the auth_authen macro. Violations are refused with
+// Response, or with Rewrite replaced by the login when it is an address.
+type Submission struct {
+	// Map lists the senders of a login, nil only allows the login itself
+	Map SenderMap
+	// HeaderFrom checks the From header as well as the envelope sender
+	HeaderFrom bool
+	// Rewrite replaces foreign senders with the login address instead of
+	// refusing the message, it requires the change from and change header actions
+	Rewrite bool
+	// Unauthenticated refuses messages without authentication, default a 530
+	// 5.7.0 reply
+	Unauthenticated Response
+	// Response refuses foreign senders, default a 550 5.7.1 reply
+	Response Response
+}
+
+// default responses of Submission
+var (
+	submissionUnauthenticated = NewResponseStr(ActReplyCode, "530 5.7.0 Authentication required")
+	submissionForeignSender   = NewResponseStr(ActReplyCode, "550 5.7.1 Sender address not owned by authenticated user")
+)
+
+// Allowed returns true if login may send from address
+func (s *Submission) Allowed(login, address string) (bool, error) {
+	address = strings.ToLower(strings.Trim(address, "<> "))
+	senders := []string{login}
+	if s.Map != nil {
+		var err error
+		if senders, err = s.Map.Senders(login); err != nil {
+			return false, err
+		}
+	}
+	for _, sender := range senders {
+		sender = strings.ToLower(sender)
+		if sender == address || strings.HasPrefix(sender, "@") && strings.HasSuffix(address, sender) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Wrap returns milter enforcing submission rules in front of next
+func (s *Submission) Wrap(next Milter) Milter {
+	return &submissionMilter{Milter: next, submission: s}
+}
+
+// submissionMilter enforces submission rules on a single session
+type submissionMilter struct {
+	Milter
+	submission *Submission
+	login      string
+	// from counts From headers, rewrite holds the indexes of foreign ones
+	from    int
+	rewrite map[int]string
+	foreign bool
+}
+
+// refused returns the response to a foreign sender
+func (s *submissionMilter) refused() Response {
+	if s.submission.Response != nil {
+		return s.submission.Response
+	}
+	return submissionForeignSender
+}
+
+// rewritable returns true if foreign senders are replaced by the login
+func (s *submissionMilter) rewritable() bool {
+	return s.submission.Rewrite && strings.Contains(s.login, "@")
+}
+
+func (s *submissionMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	s.login = m.Macro("auth_authen")
+	if s.login == "" {
+		if s.submission.Unauthenticated != nil {
+			return s.submission.Unauthenticated, nil
+		}
+		return submissionUnauthenticated, nil
+	}
+	ok, err := s.submission.Allowed(s.login, from)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if !s.rewritable() {
+			m.Logf("Refused sender %s of user %s", from, s.login)
+			return s.refused(), nil
+		}
+		s.foreign = true
+	}
+	return s.Milter.MailFrom(from, m)
+}
+
+func (s *submissionMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	if s.submission.HeaderFrom && textproto.CanonicalMIMEHeaderKey(name) == "From" {
+		s.from++
+		addresses, err := mail.ParseAddressList(value)
+		if err != nil || len(addresses) == 0 {
+			addresses = []*mail.Address{{Address: value}}
+		}
+		for _, address := range addresses {
+			ok, err := s.submission.Allowed(s.login, address.Address)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				continue
+			}
+			if !s.rewritable() {
+				m.Logf("Refused From header %q of user %s", value, s.login)
+				return s.refused(), nil
+			}
+			if s.rewrite == nil {
+				s.rewrite = make(map[int]string)
+			}
+			s.rewrite[s.from] = (&mail.Address{Name: addresses[0].Name, Address: s.login}).String()
+			break
+		}
+	}
+	return s.Milter.Header(name, value, m)
+}
+
+func (s *submissionMilter) Body(m *Modifier) (Response, error) {
+	if s.foreign {
+		if err := m.ChangeFrom(s.login, ""); err != nil {
+			return nil, err
+		}
+	}
+	for index, value := range s.rewrite {
+		if err := m.ChangeHeader(index, "From", value); err != nil {
+			return nil, err
+		}
+	}
+	return s.Milter.Body(m)
+}
+
+func (s *submissionMilter) MessageReset() {
+	s.login, s.from, s.rewrite, s.foreign = "", 0, nil, false
+	ResetMessage(s.Milter)
+}
+
+func (s *submissionMilter) ConnectionReset() {
+	ResetConnection(s.Milter)
+}
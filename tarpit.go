@@ -0,0 +1,76 @@
+package milter
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultMaxDelay limits tarpit delays when MaxDelay is not set, it stays below
+// the shortest default MTA command timeout (10 seconds in Sendmail)
+const DefaultMaxDelay = 8 * time.Second
+
+// DelayedResponse sends the wrapped response after a delay, slowing down the SMTP
+// client without holding up other sessions
+type DelayedResponse struct {
+	// Reply is the response sent after the delay
+	Reply Response
+	// Delay is capped by session MaxDelay so that the MTA does not time out
+	Delay time.Duration
+	// Context ends the delay early when it is done, the response is still sent
+	Context context.Context
+}
+
+// Tarpit returns resp delayed by delay
+func Tarpit(resp Response, delay time.Duration) *DelayedResponse {
+	return &DelayedResponse{Reply: resp, Delay: delay}
+}
+
+// TarpitContext returns resp delayed by delay or until ctx is done
+func TarpitContext(ctx context.Context, resp Response, delay time.Duration) *DelayedResponse {
+	return &DelayedResponse{Reply: resp, Delay: delay, Context: ctx}
+}
+
+// Response returns the delayed response message
+func (r *DelayedResponse) Response() *Message {
+	return r.Reply.Response()
+}
+
+// Continue returns true if the delayed response continues processing
+func (r *DelayedResponse) Continue() bool {
+	return r.Reply.Continue()
+}
+
+// wait blocks until the delay expires, the response or session context is
+// done or stop is closed
+func (r *DelayedResponse) wait(ctx context.Context, clock Clock, limit time.Duration, stop <-chan struct{}) {
+	delay := min(r.Delay, limit)
+	if delay <= 0 {
+		return
+	}
+	timer := clock.NewTimer(delay)
+	defer timer.Stop()
+	var done <-chan struct{}
+	if r.Context != nil {
+		done = r.Context.Done()
+	}
+	select {
+	case <-timer.C():
+	case <-done:
+	case <-ctx.Done():
+	case <-stop:
+	}
+}
+
+// delay waits before sending resp if it is a delayed response, the delay ends
+// early when the session ends or its server shuts down
+func (m *MilterSession) delay(resp Response) {
+	delayed, ok := resp.(*DelayedResponse)
+	if !ok {
+		return
+	}
+	limit := m.MaxDelay
+	if limit == 0 {
+		limit = DefaultMaxDelay
+	}
+	delayed.wait(m.context(), ClockOrSystem(m.Clock), limit, m.draining())
+}
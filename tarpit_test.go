@@ -0,0 +1,71 @@
+package milter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+// tarpitMilter delays MAIL FROM replies
+type tarpitMilter struct {
+	milter.NoOpMilter
+}
+
+func (tarpitMilter) MailFrom(string, *milter.Modifier) (milter.Response, error) {
+	return milter.Tarpit(milter.RespContinue, time.Second), nil
+}
+
+func TestTarpitStop(t *testing.T) {
+	tests := []struct {
+		name string
+		// stop ends the delay of the MAIL FROM reply
+		stop func(server *milter.Server, clock *miltertest.FakeClock)
+		// replied requires the reply to arrive, after Close it may be lost
+		// with the connection
+		replied bool
+	}{
+		{"delay expired", func(_ *milter.Server, clock *miltertest.FakeClock) {
+			clock.Advance(time.Second)
+		}, true},
+		{"server shutdown", func(server *milter.Server, _ *miltertest.FakeClock) {
+			go server.Shutdown(context.Background())
+		}, true},
+		{"server closed", func(server *milter.Server, _ *miltertest.FakeClock) {
+			server.Close()
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := miltertest.NewFakeClock(time.Unix(1000, 0))
+			server := &milter.Server{
+				Init: func() (milter.Milter, uint32, uint32) {
+					return tarpitMilter{}, 0, 0
+				},
+				Configure: func(s *milter.MilterSession) {
+					s.Clock = clock
+				},
+				Logger: milter.DiscardLogger,
+			}
+			c, _ := serve(t, server)
+			replies := make(chan error, 1)
+			go func() {
+				_, err := c.Send(milter.CmdMail, mailFrom("a@example.com"))
+				replies <- err
+			}()
+			waitTimers(t, clock, 1)
+			test.stop(server, clock)
+			// the delay ends well before the client times out
+			select {
+			case err := <-replies:
+				if test.replied && err != nil {
+					t.Fatalf("no reply: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("tarpit delay did not end")
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package milter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Task is work run in the background, ctx is cancelled when a shutdown deadline
+// passes before the task has finished
+type Task func(ctx context.Context)
+
+// TaskQueue runs tasks on a bounded pool of background workers so that slow
+// side effects like notifications, archiving or reputation updates do not add
+// to SMTP latency. A single TaskQueue is meant to be shared by all sessions.
+//
+// Handlers schedule tasks with Modifier.AfterVerdict, they are queued once the
+// response of the handler has been written to the MTA. Enqueue adds tasks
+// directly. Workers are started with the first task.
+type TaskQueue struct {
+	// Workers is the number of tasks run at the same time, default 4
+	Workers int
+	// Size limits the number of waiting tasks, default 1000
+	Size int
+	// Logger receives panics of tasks, nil means the standard logger
+	Logger Logger
+
+	once   sync.Once
+	mutex  sync.RWMutex
+	closed bool
+	tasks  chan Task
+	// dequeue is held by workers taking a task and by Shutdown dropping them
+	dequeue sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// start launches workers
+func (q *TaskQueue) start() {
+	q.once.Do(func() {
+		size, workers := q.Size, q.Workers
+		if size <= 0 {
+			size = 1000
+		}
+		if workers <= 0 {
+			workers = 4
+		}
+		q.tasks = make(chan Task, size)
+		q.ctx, q.cancel = context.WithCancel(context.Background())
+		for i := 0; i < workers; i++ {
+			q.workers.Add(1)
+			go q.work()
+		}
+	})
+}
+
+// work runs queued tasks until the queue is shut down and drained
+func (q *TaskQueue) work() {
+	defer q.workers.Done()
+	for {
+		q.dequeue.Lock()
+		task, ok := <-q.tasks
+		q.dequeue.Unlock()
+		if !ok {
+			return
+		}
+		q.run(task)
+	}
+}
+
+// run runs a single task, a panicking task does not stop the worker
+func (q *TaskQueue) run(task Task) {
+	defer func() {
+		if r := recover(); r != nil {
+			LoggerOrDefault(q.Logger).Printf("Error in background task: panic: %v", r)
+		}
+	}()
+	task(q.ctx)
+}
+
+// Enqueue adds task to the queue, it fails with EQueueFull when the queue has
+// no room and with EQueueClosed after Shutdown
+func (q *TaskQueue) Enqueue(task Task) error {
+	q.start()
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.closed {
+		return EQueueClosed
+	}
+	select {
+	case q.tasks <- task:
+		return nil
+	default:
+		return EQueueFull
+	}
+}
+
+// Len returns the number of tasks waiting to run
+func (q *TaskQueue) Len() int {
+	q.start()
+	return len(q.tasks)
+}
+
+// Shutdown stops accepting tasks and waits for queued tasks to finish. When ctx
+// is done first, running tasks are cancelled, waiting ones are dropped without
+// running and the context error is returned with the number dropped.
+func (q *TaskQueue) Shutdown(ctx context.Context) error {
+	q.start()
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		// drop waiting tasks so the workers exit, none is taken meanwhile
+		q.dequeue.Lock()
+		dropped := 0
+		for range q.tasks {
+			dropped++
+		}
+		q.dequeue.Unlock()
+		return fmt.Errorf("%w: %d waiting tasks dropped", ctx.Err(), dropped)
+	}
+}
+
+// pendingTask is a task scheduled for after the current verdict
+type pendingTask struct {
+	queue *TaskQueue
+	task  Task
+}
+
+// AfterVerdict schedules task to be added to queue once the response to the
+// current callback has been sent to the MTA; tasks of a session which ends
+// before the response is sent are dropped
+func (m *Modifier) AfterVerdict(queue *TaskQueue, task Task) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return EModifierClosed
+	}
+	if m.afterVerdict == nil {
+		// modifiers not created by a session queue tasks right away
+		return queue.Enqueue(task)
+	}
+	m.afterVerdict(pendingTask{queue, task})
+	return nil
+}
+
+// releaseTasks queues tasks scheduled for after the last response
+func (m *MilterSession) releaseTasks() {
+	for i, pending := range m.pending {
+		if err := pending.queue.Enqueue(pending.task); err != nil {
+			m.logf("Error queueing background task: %v", err)
+		}
+		m.pending[i] = pendingTask{}
+	}
+	m.pending = m.pending[:0]
+}
+
+// addTask records a task scheduled by a handler
+func (m *MilterSession) addTask(pending pendingTask) {
+	m.pending = append(m.pending, pending)
+}
@@ -0,0 +1,70 @@
+package milter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+)
+
+func TestTaskQueueShutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		// blocked tasks run until cancelled, quick ones return right away
+		blocked int
+		quick   int
+		timeout time.Duration
+		ran     int32
+		err     error
+		dropped int
+	}{
+		{"empty", 0, 0, time.Second, 0, nil, 0},
+		{"drained", 0, 5, time.Second, 5, nil, 0},
+		{"deadline with waiting tasks", 2, 5, 50 * time.Millisecond, 2, context.DeadlineExceeded, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := &milter.TaskQueue{Workers: 2}
+			var ran atomic.Int32
+			started := make(chan struct{}, test.blocked)
+			for i := 0; i < test.blocked; i++ {
+				queue.Enqueue(func(ctx context.Context) {
+					ran.Add(1)
+					started <- struct{}{}
+					<-ctx.Done()
+				})
+			}
+			// quick tasks wait behind the blocked ones
+			for i := 0; i < test.blocked; i++ {
+				<-started
+			}
+			for i := 0; i < test.quick; i++ {
+				queue.Enqueue(func(context.Context) {
+					ran.Add(1)
+				})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			err := queue.Shutdown(ctx)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("shutdown error %v, want %v", err, test.err)
+			}
+			if test.dropped != 0 && !strings.Contains(err.Error(), fmt.Sprintf(" %d waiting tasks dropped", test.dropped)) {
+				t.Fatalf("shutdown error %q does not report %d dropped tasks", err, test.dropped)
+			}
+			// cancelled workers do not pick up dropped tasks
+			time.Sleep(50 * time.Millisecond)
+			if n := ran.Load(); n != test.ran {
+				t.Fatalf("%d tasks ran, want %d", n, test.ran)
+			}
+			if err := queue.Enqueue(func(context.Context) {}); !errors.Is(err, milter.EQueueClosed) {
+				t.Fatalf("enqueue after shutdown: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package milter
+
+import (
+	"strings"
+)
+
+// ReplyTemplate is an SMTP reply such as "550 5.7.1 Rejected by ${rule}" with
+// placeholders expanded from variables and macros, letting operators customize
+// reject and tempfail texts in configuration
+//
+// ${name} is looked up in variables first, then as macro name and finally as
+// long macro name {name}, so ${i} and ${client_addr} refer to the queue id and
+// client address macros. Unknown placeholders expand to an empty string and $$
+// produces a literal dollar sign.
+type ReplyTemplate string
+
+// Expand returns template text with placeholders replaced, control characters
+// are removed from expanded values so that clients can not inject reply lines
+func (t ReplyTemplate) Expand(vars map[string]string, macros map[string]string) string {
+	var b strings.Builder
+	s := string(t)
+	for {
+		pos := strings.IndexByte(s, '$')
+		if pos == -1 || pos == len(s)-1 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:pos])
+		s = s[pos+1:]
+		switch {
+		case s[0] == '$':
+			b.WriteByte('$')
+			s = s[1:]
+		case s[0] == '{' && strings.IndexByte(s, '}') != -1:
+			end := strings.IndexByte(s, '}')
+			b.WriteString(sanitizeReply(lookupVar(s[1:end], vars, macros)))
+			s = s[end+1:]
+		default:
+			b.WriteByte('$')
+		}
+	}
+}
+
+// Response returns expanded template as SMFIR_REPLYCODE response, the reply code
+// decides whether it rejects or temporarily fails the command
+func (t ReplyTemplate) Response(m *Modifier, vars map[string]string) Response {
+	return NewResponseStr(ActReplyCode, t.Expand(vars, m.Macros))
+}
+
+// lookupVar returns the value of a placeholder
+func lookupVar(name string, vars, macros map[string]string) string {
+	if value, ok := vars[name]; ok {
+		return value
+	}
+	if value, ok := macros[name]; ok {
+		return value
+	}
+	return macros["{"+name+"}"]
+}
+
+// sanitizeReply drops control characters from a value inserted into a reply
+func sanitizeReply(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
@@ -0,0 +1,213 @@
+package milter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TLSPolicy checks the TLS parameters of the SMTP session which the MTA reports
+// in the tls_version, cipher, cipher_bits, verify and cert_subject macros
+//
+// MTAs send these macros with HELO, the milter of Wrap keeps them for the
+// messages of the session; macros sent again at MAIL FROM take precedence.
+//
+// Required sessions must use TLS, sessions using TLS must meet MinVersion,
+// Ciphers and MinCipherBits. Recipients of RequireTLS domains are refused on
+// sessions which do not use TLS or do not meet these requirements, senders in
+// ClientCert must present a verified client certificate. Violating messages are
+// refused with Response, or tagged with header Tag if it is set.
+type TLSPolicy struct {
+	// Required requires TLS for all messages
+	Required bool
+	// MinVersion is the lowest accepted protocol version like tls.VersionTLS12
+	MinVersion uint16
+	// Ciphers lists accepted cipher names as reported by the MTA, empty accepts
+	// any cipher
+	Ciphers []string
+	// MinCipherBits is the lowest accepted symmetric key size
+	MinCipherBits int
+	// ClientCert lists sender addresses and domains which must authenticate with
+	// a verified client certificate
+	ClientCert []string
+	// RequireTLS lists recipient domains which may only be reached over TLS
+	RequireTLS []string
+	// Tag names the header added to violating messages instead of refusing them,
+	// its value lists the violations
+	Tag string
+	// Response refuses violations, default a 530 5.7.0 reply
+	Response Response
+}
+
+// tlsVersions maps version macro values to protocol versions
+var tlsVersions = map[string]uint16{
+	"SSLv3":   tls.VersionSSL30,
+	"TLSv1":   tls.VersionTLS10,
+	"TLSv1.0": tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+	"TLSv1.3": tls.VersionTLS13,
+}
+
+// tlsViolation refuses messages violating the policy
+var tlsViolation = NewResponseStr(ActReplyCode, "530 5.7.0 Message does not meet TLS policy")
+
+// Check returns the violations of session parameters in m, no violations means
+// the session complies; TLS requirements are checked even without Required
+func (p *TLSPolicy) Check(m *Modifier) []string {
+	return p.check(m.Macro)
+}
+
+// check returns the violations of session parameters looked up with macro
+func (p *TLSPolicy) check(macro func(name string) string) []string {
+	version := macro("tls_version")
+	if version == "" {
+		return []string{"no TLS"}
+	}
+	var violations []string
+	if p.MinVersion != 0 && tlsVersions[version] < p.MinVersion {
+		violations = append(violations, fmt.Sprintf("version %s below %s", version, tls.VersionName(p.MinVersion)))
+	}
+	if cipher := macro("cipher"); len(p.Ciphers) != 0 && !slices.Contains(p.Ciphers, cipher) {
+		violations = append(violations, fmt.Sprintf("cipher %s not allowed", cipher))
+	}
+	if p.MinCipherBits != 0 {
+		if bits, _ := strconv.Atoi(macro("cipher_bits")); bits < p.MinCipherBits {
+			violations = append(violations, fmt.Sprintf("%d cipher bits below %d", bits, p.MinCipherBits))
+		}
+	}
+	return violations
+}
+
+// ClientCertified returns true if the session presented a verified client certificate
+func (p *TLSPolicy) ClientCertified(m *Modifier) bool {
+	return certified(m.Macro)
+}
+
+// certified returns true if macros report a verified client certificate;
+// Postfix only sends cert_subject for verified certificates and no verify macro
+func certified(macro func(name string) string) bool {
+	verify := macro("verify")
+	return macro("cert_subject") != "" && (verify == "OK" || verify == "")
+}
+
+// tlsMacros are the macros checked by TLSPolicy
+var tlsMacros = []string{"tls_version", "cipher", "cipher_bits", "verify", "cert_subject"}
+
+// matches returns true if address or its domain is listed
+func matches(list []string, address string) bool {
+	address = strings.ToLower(strings.Trim(address, "<> "))
+	domain := address
+	if at := strings.LastIndexByte(address, '@'); at != -1 {
+		domain = address[at+1:]
+	}
+	for _, entry := range list {
+		if entry = strings.ToLower(entry); entry == address || entry == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns milter enforcing the policy in front of next
+func (p *TLSPolicy) Wrap(next Milter) Milter {
+	return &tlsMilter{Milter: next, policy: p}
+}
+
+// tlsMilter enforces the policy on a single session
+type tlsMilter struct {
+	Milter
+	policy     *TLSPolicy
+	violations []string
+	tagged     []string
+	// helo holds the TLS macros sent with the last HELO
+	helo map[string]string
+}
+
+// macro looks up a TLS macro of the current stage or the last HELO
+func (t *tlsMilter) macro(m *Modifier) func(name string) string {
+	return func(name string) string {
+		if value := m.Macro(name); value != "" {
+			return value
+		}
+		return t.helo[name]
+	}
+}
+
+// Helo keeps the TLS macros, a HELO after STARTTLS replaces those of the plain
+// session
+func (t *tlsMilter) Helo(name string, m *Modifier) (Response, error) {
+	t.helo = make(map[string]string)
+	for _, macro := range tlsMacros {
+		if value := m.Macro(macro); value != "" {
+			t.helo[macro] = value
+		}
+	}
+	return t.Milter.Helo(name, m)
+}
+
+// refuse refuses violations or records them for tagging
+func (t *tlsMilter) refuse(violations []string) Response {
+	if t.policy.Tag != "" {
+		for _, violation := range violations {
+			if !slices.Contains(t.tagged, violation) {
+				t.tagged = append(t.tagged, violation)
+			}
+		}
+		return nil
+	}
+	if t.policy.Response != nil {
+		return t.policy.Response
+	}
+	return tlsViolation
+}
+
+func (t *tlsMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	// plain sessions are only refused where TLS is required, violations are
+	// kept for recipients of RequireTLS domains
+	macro := t.macro(m)
+	t.violations = t.policy.check(macro)
+	var refused []string
+	if t.policy.Required || macro("tls_version") != "" {
+		refused = append(refused, t.violations...)
+	}
+	if matches(t.policy.ClientCert, from) && !certified(macro) {
+		refused = append(refused, "client certificate required for sender")
+	}
+	if len(refused) != 0 {
+		if resp := t.refuse(refused); resp != nil {
+			return resp, nil
+		}
+	}
+	return t.Milter.MailFrom(from, m)
+}
+
+func (t *tlsMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	if len(t.violations) != 0 && matches(t.policy.RequireTLS, rcptTo) {
+		if resp := t.refuse(t.violations); resp != nil {
+			return resp, nil
+		}
+	}
+	return t.Milter.RcptTo(rcptTo, m)
+}
+
+func (t *tlsMilter) Body(m *Modifier) (Response, error) {
+	if len(t.tagged) != 0 {
+		if err := m.AddHeader(t.policy.Tag, strings.Join(t.tagged, "; ")); err != nil {
+			return nil, err
+		}
+	}
+	return t.Milter.Body(m)
+}
+
+func (t *tlsMilter) MessageReset() {
+	t.violations, t.tagged = nil, nil
+	ResetMessage(t.Milter)
+}
+
+func (t *tlsMilter) ConnectionReset() {
+	t.helo = nil
+	ResetConnection(t.Milter)
+}
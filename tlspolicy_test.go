@@ -0,0 +1,63 @@
+package milter_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+func TestTLSPolicyHeloMacros(t *testing.T) {
+	tls13 := []string{"{tls_version}", "TLSv1.3", "{cipher}", "TLS_AES_256_GCM_SHA384", "{cipher_bits}", "256"}
+	tests := []struct {
+		name    string
+		policy  milter.TLSPolicy
+		helo    []string
+		mail    []string
+		refused bool
+	}{
+		{"required with TLS", milter.TLSPolicy{Required: true}, tls13, nil, false},
+		{"required without TLS", milter.TLSPolicy{Required: true}, nil, nil, true},
+		{"minimum version", milter.TLSPolicy{MinVersion: tls.VersionTLS12}, tls13, nil, false},
+		{"version too low", milter.TLSPolicy{MinVersion: tls.VersionTLS13},
+			[]string{"{tls_version}", "TLSv1.2"}, nil, true},
+		{"mail macros override helo", milter.TLSPolicy{MinVersion: tls.VersionTLS13},
+			[]string{"{tls_version}", "TLSv1.2"}, []string{"{tls_version}", "TLSv1.3"}, false},
+		{"require TLS domain with TLS", milter.TLSPolicy{RequireTLS: []string{"example.org"}}, tls13, nil, false},
+		{"require TLS domain without TLS", milter.TLSPolicy{RequireTLS: []string{"example.org"}}, nil, nil, true},
+		{"postfix client certificate", milter.TLSPolicy{ClientCert: []string{"example.com"}},
+			append([]string{"{cert_subject}", "CN=client"}, tls13...), nil, false},
+		{"unverified client certificate", milter.TLSPolicy{ClientCert: []string{"example.com"}},
+			append([]string{"{cert_subject}", "CN=client", "{verify}", "FAIL"}, tls13...), nil, true},
+		{"missing client certificate", milter.TLSPolicy{ClientCert: []string{"example.com"}}, tls13, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scenario := miltertest.NewScenario().Connect("client.example.com", "192.0.2.1")
+			if test.helo != nil {
+				scenario.Macros(milter.CmdHelo, test.helo...)
+			}
+			scenario.Helo("client.example.com").Macros(milter.CmdMail, append([]string{"i", "Q123"}, test.mail...)...)
+			policy := test.policy
+			scenario.MailFrom("a@example.com").RcptTo("b@example.org").Body("x").
+				Expect(func(exchanges []miltertest.Exchange) string {
+					refused := false
+					for _, exchange := range exchanges {
+						for _, resp := range exchange.Responses {
+							refused = refused || resp.Code == milter.ActReplyCode && bytes.HasPrefix(resp.Data, []byte("530 "))
+						}
+					}
+					if refused != test.refused {
+						return fmt.Sprintf("refused %v, want %v", refused, test.refused)
+					}
+					return ""
+				}).
+				Run(t, func() (milter.Milter, uint32, uint32) {
+					return policy.Wrap(milter.NoOpMilter{}), milter.OptAddHeader, 0
+				})
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package milter
+
+// Transaction holds modifications back so that they can be inspected, amended
+// or discarded before they are sent to the MTA
+//
+// While a transaction is open all modifications made through the modifier are
+// recorded in it instead of being sent. Transactions nest: committing an inner
+// transaction moves its modifications to the enclosing one, so a middleware can
+// wrap the callbacks of the milters it chains and veto their changes. Only the
+// innermost transaction may be committed or rolled back, and modifications
+// of a transaction still open when the handler returns are discarded and
+// logged.
+type Transaction struct {
+	modifier *Modifier
+	parent   *Transaction
+	msgs     []*Message
+	done     bool
+}
+
+// Begin opens a new transaction on modifier
+func (m *Modifier) Begin() *Transaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.tx = &Transaction{modifier: m, parent: m.tx}
+	return m.tx
+}
+
+// Messages returns a copy of the modifications recorded so far
+func (t *Transaction) Messages() []*Message {
+	t.modifier.mutex.Lock()
+	defer t.modifier.mutex.Unlock()
+	return append([]*Message(nil), t.msgs...)
+}
+
+// Replace replaces recorded modifications with msgs
+func (t *Transaction) Replace(msgs []*Message) {
+	t.modifier.mutex.Lock()
+	defer t.modifier.mutex.Unlock()
+	t.msgs = append([]*Message(nil), msgs...)
+}
+
+// Filter keeps only the recorded modifications for which keep returns true
+func (t *Transaction) Filter(keep func(*Message) bool) {
+	t.modifier.mutex.Lock()
+	defer t.modifier.mutex.Unlock()
+	msgs := t.msgs[:0]
+	for _, msg := range t.msgs {
+		if keep(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+	t.msgs = msgs
+}
+
+// Commit closes transaction and passes its modifications to the enclosing
+// transaction, or sends them if there is none
+func (t *Transaction) Commit() error {
+	m := t.modifier
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := t.end(); err != nil {
+		return err
+	}
+	if t.parent != nil {
+		t.parent.msgs = append(t.parent.msgs, t.msgs...)
+		return nil
+	}
+	for _, msg := range t.msgs {
+		if err := m.send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback closes transaction and discards its modifications
+func (t *Transaction) Rollback() error {
+	t.modifier.mutex.Lock()
+	defer t.modifier.mutex.Unlock()
+	if err := t.end(); err != nil {
+		return err
+	}
+	t.msgs = nil
+	return nil
+}
+
+// end closes the innermost transaction, the caller holds the modifier mutex
+func (t *Transaction) end() error {
+	m := t.modifier
+	switch {
+	case m.closed:
+		return EModifierClosed
+	case t.done || m.tx != t:
+		return ETransaction
+	}
+	t.done = true
+	m.tx = t.parent
+	return nil
+}
@@ -0,0 +1,98 @@
+package milter_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+)
+
+func TestTransaction(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(m *milter.Modifier) error
+		// sent lists the header names sent to the MTA
+		sent []string
+		err  error
+	}{
+		{"commit", func(m *milter.Modifier) error {
+			tx := m.Begin()
+			m.AddHeader("A", "1")
+			return tx.Commit()
+		}, []string{"A"}, nil},
+		{"rollback", func(m *milter.Modifier) error {
+			tx := m.Begin()
+			m.AddHeader("A", "1")
+			return tx.Rollback()
+		}, nil, nil},
+		{"inner commit outer rollback", func(m *milter.Modifier) error {
+			outer := m.Begin()
+			m.AddHeader("A", "1")
+			inner := m.Begin()
+			m.AddHeader("B", "2")
+			if err := inner.Commit(); err != nil {
+				return err
+			}
+			return outer.Rollback()
+		}, nil, nil},
+		{"inner rollback outer commit", func(m *milter.Modifier) error {
+			outer := m.Begin()
+			m.AddHeader("A", "1")
+			inner := m.Begin()
+			m.AddHeader("B", "2")
+			if err := inner.Rollback(); err != nil {
+				return err
+			}
+			m.AddHeader("C", "3")
+			return outer.Commit()
+		}, []string{"A", "C"}, nil},
+		{"filter", func(m *milter.Modifier) error {
+			tx := m.Begin()
+			m.AddHeader("A", "1")
+			m.AddHeader("B", "2")
+			tx.Filter(func(msg *milter.Message) bool { return msg.Data[0] == 'B' })
+			return tx.Commit()
+		}, []string{"B"}, nil},
+		{"replace", func(m *milter.Modifier) error {
+			tx := m.Begin()
+			m.AddHeader("A", "1")
+			other := tx.Messages()
+			m.AddHeader("B", "2")
+			tx.Replace(other)
+			return tx.Commit()
+		}, []string{"A"}, nil},
+		{"outer commit with inner open", func(m *milter.Modifier) error {
+			outer := m.Begin()
+			m.Begin()
+			return outer.Commit()
+		}, nil, milter.ETransaction},
+		{"commit twice", func(m *milter.Modifier) error {
+			tx := m.Begin()
+			m.AddHeader("A", "1")
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}, []string{"A"}, milter.ETransaction},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sent []string
+			m := &milter.Modifier{WritePacket: func(msg *milter.Message) error {
+				sent = append(sent, string(msg.Data[:1]))
+				return nil
+			}}
+			if err := test.run(m); !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if len(sent) != len(test.sent) {
+				t.Fatalf("sent %q, want %q", sent, test.sent)
+			}
+			for i := range sent {
+				if sent[i] != test.sent[i] {
+					t.Fatalf("sent %q, want %q", sent, test.sent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package milter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Trimmer is a resource which keeps memory or disk space for reuse, Trim
+// releases what has not been used for idle and returns the estimated number of
+// bytes reclaimed
+type Trimmer interface {
+	Trim(idle time.Duration) int64
+}
+
+// TrimFunc adapts a function to Trimmer
+type TrimFunc func(idle time.Duration) int64
+
+// Trim calls f
+func (f TrimFunc) Trim(idle time.Duration) int64 {
+	return f(idle)
+}
+
+// Janitor periodically trims pooled buffers, caches and spool files so that a
+// process which survived a traffic spike returns to its baseline footprint
+// instead of holding peak sized pools forever. Session read buffers are always
+// trimmed, other resources are added with Register.
+type Janitor struct {
+	// Interval is the time between trimming runs, default one minute
+	Interval time.Duration
+	// Idle is the time a resource must stay unused to be released, default
+	// five minutes
+	Idle time.Duration
+	// Clock times trimming runs, nil means SystemClock
+	Clock Clock
+
+	mutex     sync.Mutex
+	names     []string
+	resources map[string]Trimmer
+	stats     TrimStats
+}
+
+// TrimStats reports trimming counters
+type TrimStats struct {
+	Runs uint64
+	Last time.Time
+	// Reclaimed is the total of estimated bytes released, by resource in
+	// Resources
+	Reclaimed int64
+	Resources map[string]int64
+}
+
+// Register adds resource trimmed under name, registering a name again
+// replaces its resource
+func (j *Janitor) Register(name string, resource Trimmer) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.resources == nil {
+		j.resources = make(map[string]Trimmer)
+	}
+	if _, ok := j.resources[name]; !ok {
+		j.names = append(j.names, name)
+	}
+	j.resources[name] = resource
+}
+
+// Run trims resources every Interval until ctx is done
+func (j *Janitor) Run(ctx context.Context) error {
+	clock := ClockOrSystem(j.Clock)
+	for {
+		timer := clock.NewTimer(j.interval())
+		select {
+		case <-timer.C():
+			j.Trim()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Trim trims all resources now and returns the estimated number of bytes
+// reclaimed
+func (j *Janitor) Trim() int64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.stats.Resources == nil {
+		j.stats.Resources = make(map[string]int64)
+	}
+	idle := j.idle()
+	now := ClockOrSystem(j.Clock).Now()
+	total := j.record("read buffers", readBuffers.trim(idle, now))
+	for _, name := range j.names {
+		total += j.record(name, j.resources[name].Trim(idle))
+	}
+	j.stats.Runs++
+	j.stats.Last = now
+	return total
+}
+
+// record adds reclaimed bytes of resource name to stats
+func (j *Janitor) record(name string, reclaimed int64) int64 {
+	j.stats.Resources[name] += reclaimed
+	j.stats.Reclaimed += reclaimed
+	return reclaimed
+}
+
+// Stats returns trimming counters
+func (j *Janitor) Stats() TrimStats {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	stats := j.stats
+	stats.Resources = make(map[string]int64, len(j.stats.Resources))
+	for name, n := range j.stats.Resources {
+		stats.Resources[name] = n
+	}
+	return stats
+}
+
+// defaults for unset fields
+func (j *Janitor) interval() time.Duration {
+	if j.Interval <= 0 {
+		return time.Minute
+	}
+	return j.Interval
+}
+
+func (j *Janitor) idle() time.Duration {
+	if j.Idle <= 0 {
+		return 5 * time.Minute
+	}
+	return j.Idle
+}
+
+// bufferPool keeps released buffers for reuse, most recently released first.
+// Buffers are stamped by the first trimming run which finds them pooled, so
+// idle is measured with the clock of the Janitor and buffers stay up to one
+// Interval longer. The pool keeps at most maxPooledBytes and no buffers over
+// maxPooledBuffer, so it stays bounded after a spike of sessions or large
+// packets even without a running Janitor.
+type bufferPool struct {
+	mutex   sync.Mutex
+	buffers []pooledBuffer
+	// size is the capacity of all pooled buffers
+	size int
+}
+
+// pooledBuffer is a buffer waiting for reuse, released is zero until the buffer
+// is first seen by trim
+type pooledBuffer struct {
+	buf      []byte
+	released time.Time
+}
+
+// maxPooledBytes limits the total capacity of buffers kept by a pool, buffers
+// released over the limit are left to the garbage collector, as are buffers
+// larger than maxPooledBuffer which only very large packets need
+const (
+	maxPooledBytes  = 16 << 20
+	maxPooledBuffer = 256 << 10
+)
+
+// readBuffers holds session read buffers between sessions
+var readBuffers = &bufferPool{}
+
+// get returns a pooled buffer or nil
+func (p *bufferPool) get() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	n := len(p.buffers)
+	if n == 0 {
+		return nil
+	}
+	buf := p.buffers[n-1].buf
+	p.buffers[n-1] = pooledBuffer{}
+	p.buffers = p.buffers[:n-1]
+	p.size -= cap(buf)
+	return buf
+}
+
+// put releases buf for reuse
+func (p *bufferPool) put(buf []byte) {
+	if cap(buf) == 0 || cap(buf) > maxPooledBuffer {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.size+cap(buf) <= maxPooledBytes {
+		p.buffers = append(p.buffers, pooledBuffer{buf: buf})
+		p.size += cap(buf)
+	}
+}
+
+// trim drops buffers which were not reused for idle at now and stamps those
+// released since the last run
+func (p *bufferPool) trim(idle time.Duration, now time.Time) int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := len(p.buffers) - 1; i >= 0 && p.buffers[i].released.IsZero(); i-- {
+		p.buffers[i].released = now
+	}
+	limit := now.Add(-idle)
+	// buffers are released in order so the oldest come first
+	var n int
+	var reclaimed int64
+	for n < len(p.buffers) && !p.buffers[n].released.After(limit) {
+		reclaimed += int64(cap(p.buffers[n].buf))
+		n++
+	}
+	if n != 0 {
+		p.buffers = append([]pooledBuffer(nil), p.buffers[n:]...)
+		p.size -= int(reclaimed)
+	}
+	return reclaimed
+}
@@ -0,0 +1,269 @@
+package milter
+
+import (
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VerdictAttributes holds the message attributes verdict cache keys are built from
+type VerdictAttributes struct {
+	Client     net.IP
+	From       string
+	Recipients []string
+	// BodyDigest is the SHA-256 digest of the message body, it is nil until the
+	// whole body has been received
+	BodyDigest []byte
+}
+
+// VerdictKey builds the verdict cache key of a message, an empty key means the
+// attributes do not identify the message yet or it must not be cached
+type VerdictKey func(a *VerdictAttributes) string
+
+// ClientSenderKey identifies messages by client address and envelope sender
+func ClientSenderKey(a *VerdictAttributes) string {
+	if a.Client == nil || a.From == "" {
+		return ""
+	}
+	return a.Client.String() + " " + strings.ToLower(a.From)
+}
+
+// BodyDigestKey identifies messages by body contents
+func BodyDigestKey(a *VerdictAttributes) string {
+	if a.BodyDigest == nil {
+		return ""
+	}
+	return hex.EncodeToString(a.BodyDigest)
+}
+
+// VerdictCache remembers the final response of messages and replays it for
+// identical messages instead of calling the wrapped milter, a single
+// VerdictCache is meant to be shared by all sessions
+//
+// The key is looked up once headers are complete, so keys which do not need the
+// body skip body callbacks of the wrapped milter, and again after the body has
+// been received. Failed callbacks, messages the wrapped milter rejects before
+// end of body and messages it modifies are not cached: body replacements,
+// recipient changes and index based header changes only apply to the message
+// they were made for.
+type VerdictCache struct {
+	// Key builds cache keys, default BodyDigestKey
+	Key VerdictKey
+	// TTL is the time verdicts are kept, default 10 minutes
+	TTL time.Duration
+	// MaxEntries limits cache size, default 10000
+	MaxEntries int
+	// Clock times entries, nil means SystemClock
+	Clock Clock
+
+	mutex   sync.Mutex
+	entries map[string]*verdictEntry
+	hits    uint64
+	misses  uint64
+}
+
+// verdictEntry is a cached verdict
+type verdictEntry struct {
+	resp    Response
+	expires time.Time
+	used    time.Time
+}
+
+// VerdictCacheStats reports verdict cache counters
+type VerdictCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// Stats returns cache counters
+func (c *VerdictCache) Stats() VerdictCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return VerdictCacheStats{len(c.entries), c.hits, c.misses}
+}
+
+// Invalidate removes the cached verdict of key
+func (c *VerdictCache) Invalidate(key string) {
+	c.mutex.Lock()
+	delete(c.entries, key)
+	c.mutex.Unlock()
+}
+
+// Flush removes all cached verdicts
+func (c *VerdictCache) Flush() {
+	c.mutex.Lock()
+	c.entries = nil
+	c.mutex.Unlock()
+}
+
+// get returns the cached verdict of key
+func (c *VerdictCache) get(key string) *verdictEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[key]
+	if now := ClockOrSystem(c.Clock).Now(); ok && now.Before(e.expires) {
+		e.used = now
+		c.hits++
+		return e
+	}
+	if ok {
+		delete(c.entries, key)
+	}
+	c.misses++
+	return nil
+}
+
+// put caches a verdict of key
+func (c *VerdictCache) put(key string, resp Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := ClockOrSystem(c.Clock).Now()
+	if c.entries == nil {
+		c.entries = make(map[string]*verdictEntry)
+	}
+	// make room by dropping expired entries
+	if len(c.entries) >= c.maxEntries() {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries() {
+			return
+		}
+	}
+	c.entries[key] = &verdictEntry{resp, now.Add(c.ttl()), now}
+}
+
+// Trim drops expired verdicts and verdicts not used for idle, it implements
+// Trimmer and returns the estimated number of bytes reclaimed
+func (c *VerdictCache) Trim(idle time.Duration) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := ClockOrSystem(c.Clock).Now()
+	var reclaimed int64
+	kept := make(map[string]*verdictEntry)
+	for key, e := range c.entries {
+		if now.Before(e.expires) && now.Sub(e.used) < idle {
+			kept[key] = e
+			continue
+		}
+		reclaimed += int64(96 + len(key))
+	}
+	// a new map releases the buckets of dropped entries
+	if reclaimed != 0 {
+		c.entries = kept
+	}
+	return reclaimed
+}
+
+// defaults for unset fields
+func (c *VerdictCache) key() VerdictKey {
+	if c.Key == nil {
+		return BodyDigestKey
+	}
+	return c.Key
+}
+
+func (c *VerdictCache) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return 10 * time.Minute
+	}
+	return c.TTL
+}
+
+func (c *VerdictCache) maxEntries() int {
+	if c.MaxEntries <= 0 {
+		return 10000
+	}
+	return c.MaxEntries
+}
+
+// Wrap returns milter which answers messages of next from the cache
+func (c *VerdictCache) Wrap(next Milter) Milter {
+	return &verdictMilter{Milter: next, cache: c}
+}
+
+// verdictMilter caches verdicts of a single session
+type verdictMilter struct {
+	Milter
+	cache *VerdictCache
+	attrs VerdictAttributes
+	// key is the message key looked up at end of headers, hit its cached verdict
+	key string
+	hit *verdictEntry
+}
+
+func (v *verdictMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	v.attrs.Client = addr
+	return v.Milter.Connect(host, family, port, addr, m)
+}
+
+func (v *verdictMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	v.attrs.From = from
+	return v.Milter.MailFrom(from, m)
+}
+
+func (v *verdictMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	v.attrs.Recipients = append(v.attrs.Recipients, rcptTo)
+	return v.Milter.RcptTo(rcptTo, m)
+}
+
+func (v *verdictMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	if v.key = v.cache.key()(&v.attrs); v.key != "" {
+		if v.hit = v.cache.get(v.key); v.hit != nil {
+			return RespContinue, nil
+		}
+	}
+	return v.Milter.Headers(h, m)
+}
+
+func (v *verdictMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	if v.hit != nil {
+		return RespContinue, nil
+	}
+	return v.Milter.BodyChunk(chunk, m)
+}
+
+func (v *verdictMilter) Body(m *Modifier) (Response, error) {
+	if v.hit == nil && v.key == "" && m.receivedBody != nil {
+		v.attrs.BodyDigest, _ = m.receivedBody()
+		if v.key = v.cache.key()(&v.attrs); v.key != "" {
+			v.hit = v.cache.get(v.key)
+		}
+	}
+	if v.hit != nil {
+		return v.hit.resp, nil
+	}
+
+	// watch for modifications of the wrapped milter
+	tx := m.Begin()
+	resp, err := v.Milter.Body(m)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	modified := len(tx.Messages()) != 0
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if v.key != "" && resp != nil && !modified {
+		v.cache.put(v.key, resp)
+	}
+	return resp, nil
+}
+
+func (v *verdictMilter) MessageReset() {
+	client := v.attrs.Client
+	v.attrs, v.key, v.hit = VerdictAttributes{Client: client}, "", nil
+	ResetMessage(v.Milter)
+}
+
+func (v *verdictMilter) ConnectionReset() {
+	v.attrs.Client = nil
+	ResetConnection(v.Milter)
+}
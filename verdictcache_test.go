@@ -0,0 +1,89 @@
+package milter_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/miltertest"
+)
+
+// bodyMilter counts messages and optionally replaces their body with an upper
+// case copy
+type bodyMilter struct {
+	milter.NoOpMilter
+	modify bool
+	calls  *int
+	body   *bytes.Buffer
+}
+
+func (b bodyMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
+	b.body.Write(chunk)
+	return milter.RespContinue, nil
+}
+
+func (b bodyMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	*b.calls++
+	defer b.body.Reset()
+	if b.modify {
+		if err := m.ReplaceBody(bytes.ToUpper(b.body.Bytes())); err != nil {
+			return nil, err
+		}
+	}
+	return milter.RespContinue, nil
+}
+
+func TestVerdictCacheSharedKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify bool
+		// calls is the number of messages the wrapped milter saw
+		calls int
+		// bodies lists the replaced bodies sent with each verdict
+		bodies []string
+	}{
+		{"verdict reused", false, 1, []string{"", ""}},
+		{"modified message not cached", true, 2, []string{"ONE", "TWO"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := &milter.VerdictCache{Key: milter.ClientSenderKey}
+			calls := 0
+			inner := bodyMilter{modify: test.modify, calls: &calls, body: &bytes.Buffer{}}
+			// both messages share client and sender, and so the key
+			exchanges, failures := miltertest.NewScenario().Connect("client.example.com", "192.0.2.1").
+				MailFrom("a@example.com").RcptTo("b@example.org").Header("Subject", "one").Body("one").
+				MailFrom("a@example.com").RcptTo("c@example.org").Header("Subject", "two").Body("two").
+				Check(func() (milter.Milter, uint32, uint32) {
+					return cache.Wrap(inner), milter.OptChangeBody, 0
+				})
+			if len(failures) != 0 {
+				t.Fatal(failures)
+			}
+			if calls != test.calls {
+				t.Fatalf("wrapped milter called %d times, want %d", calls, test.calls)
+			}
+			var bodies []string
+			for _, exchange := range exchanges {
+				if exchange.Command.Code != milter.CmdEOB {
+					continue
+				}
+				var body []byte
+				for _, resp := range exchange.Responses {
+					if resp.Code == milter.ActReplBody {
+						body = append(body, resp.Data...)
+					}
+				}
+				bodies = append(bodies, string(body))
+			}
+			if len(bodies) != len(test.bodies) {
+				t.Fatalf("bodies %q, want %q", bodies, test.bodies)
+			}
+			for i := range bodies {
+				if bodies[i] != test.bodies[i] {
+					t.Fatalf("bodies %q, want %q", bodies, test.bodies)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package milter
+
+import (
+	"time"
+)
+
+// Window counts events of a key within one fixed time window
+type Window struct {
+	Start time.Time
+	Count int
+}
+
+// Windows holds a Window per key for rate limits, windows which expired are
+// dropped whenever the number of keys doubles. The zero value is ready to use,
+// callers serialize access.
+type Windows[K comparable] struct {
+	windows map[K]*Window
+	sweepAt int
+}
+
+// Get returns the window of key at now, a new window is started if key has none
+// or its window is older than period
+func (w *Windows[K]) Get(key K, now time.Time, period time.Duration) *Window {
+	if w.windows == nil {
+		w.windows = make(map[K]*Window)
+	}
+	window, ok := w.windows[key]
+	if ok && now.Sub(window.Start) < period {
+		return window
+	}
+	if !ok && len(w.windows) >= w.sweepAt {
+		for k, old := range w.windows {
+			if now.Sub(old.Start) >= period {
+				delete(w.windows, k)
+			}
+		}
+		w.sweepAt = max(2*len(w.windows), 1024)
+	}
+	window = &Window{Start: now}
+	w.windows[key] = window
+	return window
+}
@@ -0,0 +1,33 @@
+package milter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+)
+
+func TestWindows(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name  string
+		key   string
+		at    time.Duration
+		count int
+	}{
+		{"first", "a", 0, 1},
+		{"same window", "a", 30 * time.Second, 2},
+		{"other key", "b", 30 * time.Second, 1},
+		{"expired", "a", time.Minute, 1},
+		{"after expiry", "a", 90 * time.Second, 2},
+		{"other key expired", "b", 2 * time.Minute, 1},
+	}
+	var windows milter.Windows[string]
+	for _, test := range tests {
+		window := windows.Get(test.key, start.Add(test.at), time.Minute)
+		window.Count++
+		if window.Count != test.count {
+			t.Fatalf("%s: count %d, want %d", test.name, window.Count, test.count)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package milter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// queueLimit is the amount of queued data which triggers an automatic flush
+const queueLimit = 256 * 1024
+
+// DefaultMaxResponseSize is the payload limit used when MaxResponseSize is not
+// set, it matches the default frame limit of libmilter based MTAs
+const DefaultMaxResponseSize = 65535
+
+// writeDeadliner is implemented by sockets supporting write deadlines, like net.Conn
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// WritePacket sends a milter response packet to socket stream
+func (m *MilterSession) WritePacket(msg *Message) error {
+	return m.WritePacketContext(context.Background(), msg)
+}
+
+// WritePacketContext sends a milter response packet to socket stream together with
+// all previously queued packets. The write is aborted when ctx is done or WriteTimeout
+// expires. A failed write leaves the stream in unknown state, so the error is returned
+// by all subsequent writes as well.
+func (m *MilterSession) WritePacketContext(ctx context.Context, msg *Message) error {
+	return m.send(ctx, msg, true)
+}
+
+// QueuePacket adds a packet to the session write queue without flushing it, so bursts
+// of modifications are sent with a single vectored write. Queued packets are sent by the
+// next WritePacket or Flush call, or once queued data exceeds an internal limit. Packet
+// data is referenced, not copied, and must not be modified until it has been sent.
+func (m *MilterSession) QueuePacket(ctx context.Context, msg *Message) error {
+	return m.send(ctx, msg, false)
+}
+
+// Flush sends all queued packets to socket stream
+func (m *MilterSession) Flush(ctx context.Context) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	if len(m.queue) == 0 {
+		return nil
+	}
+	return m.withDeadline(ctx, m.flush)
+}
+
+// send writes a packet to session buffer and optionally flushes it
+func (m *MilterSession) send(ctx context.Context, msg *Message, flush bool) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+
+	// fail fast on broken stream or finished context
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// pass packet through interceptors
+	msg, err := m.interceptOutgoing(msg)
+	if err != nil {
+		return err
+	}
+	// oversize payloads are refused before touching the stream
+	msgs, err := m.split(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		m.writePacket(msg)
+	}
+	// only writes reaching the socket are put under deadlines
+	if flush || m.queued >= queueLimit {
+		return m.withDeadline(ctx, m.flush)
+	}
+	return nil
+}
+
+// split divides replacement bodies larger than the payload limit into several
+// packets, other packets cannot be split and fail with ETooLarge
+func (m *MilterSession) split(msg *Message) ([]*Message, error) {
+	if msg == nil {
+		return nil, nil
+	}
+	limit := int(m.MaxResponseSize)
+	if limit == 0 {
+		limit = DefaultMaxResponseSize
+	}
+	if len(msg.Data) <= limit {
+		return []*Message{msg}, nil
+	}
+	if msg.Code != ActReplBody {
+		return nil, fmt.Errorf("%w: %v payload of %d bytes", ETooLarge, msg.Code, len(msg.Data))
+	}
+	msgs := make([]*Message, 0, (len(msg.Data)+limit-1)/limit)
+	for data := msg.Data; len(data) != 0; {
+		n := min(len(data), limit)
+		msgs = append(msgs, &Message{ActReplBody, data[:n]})
+		data = data[n:]
+	}
+	return msgs, nil
+}
+
+// withDeadline runs socket write operation under context and WriteTimeout deadlines,
+// write errors are recorded so that all subsequent writes fail as well
+func (m *MilterSession) withDeadline(ctx context.Context, write func() error) error {
+	conn, ok := m.Sock.(writeDeadliner)
+	if !ok {
+		if err := write(); err != nil {
+			m.writeErr = err
+			return err
+		}
+		return nil
+	}
+
+	// use the earliest of context deadline and write timeout
+	deadline, limited := ctx.Deadline()
+	if m.WriteTimeout > 0 {
+		if timeout := time.Now().Add(m.WriteTimeout); !limited || timeout.Before(deadline) {
+			deadline, limited = timeout, true
+		}
+	}
+	if limited {
+		conn.SetWriteDeadline(deadline)
+	}
+
+	// interrupt blocked write on context cancellation
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	if ctx.Done() != nil {
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetWriteDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+	} else {
+		close(stopped)
+	}
+
+	err := write()
+	close(stop)
+	<-stopped
+	conn.SetWriteDeadline(time.Time{})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		m.writeErr = err
+	}
+	return err
+}
+
+// writePacket frames and appends a packet to the write queue
+func (m *MilterSession) writePacket(msg *Message) {
+	header := make([]byte, milterwire.HeaderSize+1)
+	binary.BigEndian.PutUint32(header, uint32(len(msg.Data)+1))
+	header[milterwire.HeaderSize] = byte(msg.Code)
+	m.queue = append(m.queue, header)
+	if len(msg.Data) != 0 {
+		m.queue = append(m.queue, msg.Data)
+	}
+	m.queued += len(header) + len(msg.Data)
+	m.stats.written.Add(int64(len(header) + len(msg.Data)))
+}
+
+// flush writes all queued packets with a single vectored write where supported
+func (m *MilterSession) flush() error {
+	if len(m.queue) == 0 {
+		return nil
+	}
+	buffers := m.queue
+	_, err := buffers.WriteTo(m.Sock)
+	// release references to sent data and reuse queue
+	clear(m.queue)
+	m.queue, m.queued = m.queue[:0], 0
+	return err
+}
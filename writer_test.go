@@ -0,0 +1,192 @@
+package milter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phalaaxx/milter"
+	"github.com/phalaaxx/milter/milterwire"
+)
+
+// recordingStream records writes and fails them once failAfter writes were made,
+// negative failAfter never fails
+type recordingStream struct {
+	bytes.Buffer
+	writes    int
+	failAfter int
+}
+
+func (s *recordingStream) Write(p []byte) (int, error) {
+	if s.failAfter >= 0 && s.writes >= s.failAfter {
+		return 0, io.ErrClosedPipe
+	}
+	s.writes++
+	return s.Buffer.Write(p)
+}
+
+func (s *recordingStream) Close() error {
+	return nil
+}
+
+// packets decodes all packets written to s
+func (s *recordingStream) packets(t *testing.T) []*milter.Message {
+	t.Helper()
+	var msgs []*milter.Message
+	for s.Len() != 0 {
+		code, data, err := milterwire.ReadFrame(&s.Buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, &milter.Message{Code: milter.Code(code), Data: data})
+	}
+	return msgs
+}
+
+func TestWriteSplit(t *testing.T) {
+	body := []byte(strings.Repeat("x", 25))
+	tests := []struct {
+		name    string
+		msg     *milter.Message
+		packets int
+		err     error
+	}{
+		{"small", &milter.Message{Code: milter.ActAddHeader, Data: []byte("X\x00y\x00")}, 1, nil},
+		{"body at limit", &milter.Message{Code: milter.ActReplBody, Data: body[:10]}, 1, nil},
+		{"body split", &milter.Message{Code: milter.ActReplBody, Data: body}, 3, nil},
+		{"header too large", &milter.Message{Code: milter.ActAddHeader, Data: body}, 0, milter.ETooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := &recordingStream{failAfter: -1}
+			session := milter.NewSession(stream, milter.WithConfig(func(s *milter.MilterSession) {
+				s.MaxResponseSize = 10
+			}))
+			if err := session.WritePacket(test.msg); !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			packets := stream.packets(t)
+			if len(packets) != test.packets {
+				t.Fatalf("%d packets, want %d", len(packets), test.packets)
+			}
+			var data []byte
+			for _, packet := range packets {
+				if packet.Code != test.msg.Code || len(packet.Data) > 10 {
+					t.Fatalf("packet %v of %d bytes", packet.Code, len(packet.Data))
+				}
+				data = append(data, packet.Data...)
+			}
+			if test.err == nil && !bytes.Equal(data, test.msg.Data) {
+				t.Fatalf("data %q, want %q", data, test.msg.Data)
+			}
+		})
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	header := &milter.Message{Code: milter.ActAddHeader, Data: []byte("X\x00y\x00")}
+	tests := []struct {
+		name string
+		// queued packets are followed by write unless it is nil
+		queued    int
+		write     *milter.Message
+		flush     bool
+		failAfter int
+		packets   int
+		err       error
+	}{
+		{"queued only", 2, nil, false, -1, 0, nil},
+		{"flushed", 2, nil, true, -1, 2, nil},
+		{"written with response", 2, milter.RespAccept.Response(), false, -1, 3, nil},
+		{"broken stream", 1, milter.RespAccept.Response(), false, 0, 0, io.ErrClosedPipe},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := &recordingStream{failAfter: test.failAfter}
+			session := milter.NewSession(stream)
+			ctx := context.Background()
+			for i := 0; i < test.queued; i++ {
+				if err := session.QueuePacket(ctx, header); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var err error
+			if test.write != nil {
+				err = session.WritePacket(test.write)
+			}
+			if test.flush {
+				err = session.Flush(ctx)
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if packets := stream.packets(t); len(packets) != test.packets {
+				t.Fatalf("%d packets, want %d", len(packets), test.packets)
+			}
+			if test.err != nil {
+				// a failed write leaves the stream unusable
+				stream.failAfter = -1
+				if err := session.WritePacket(test.write); !errors.Is(err, test.err) {
+					t.Fatalf("write after failure: %v, want %v", err, test.err)
+				}
+				if err := session.Flush(ctx); !errors.Is(err, test.err) {
+					t.Fatalf("flush after failure: %v, want %v", err, test.err)
+				}
+			}
+		})
+	}
+}
+
+// deadlineStream counts the write deadlines armed on it
+type deadlineStream struct {
+	recordingStream
+	deadlines int
+}
+
+func (s *deadlineStream) SetWriteDeadline(deadline time.Time) error {
+	if !deadline.IsZero() {
+		s.deadlines++
+	}
+	return nil
+}
+
+func TestWriteDeadline(t *testing.T) {
+	header := &milter.Message{Code: milter.ActAddHeader, Data: []byte("X\x00y\x00")}
+	tests := []struct {
+		name      string
+		queued    int
+		flush     bool
+		deadlines int
+	}{
+		{"nothing queued", 0, true, 0},
+		{"queued only", 3, false, 0},
+		{"flushed", 3, true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := &deadlineStream{recordingStream: recordingStream{failAfter: -1}}
+			session := milter.NewSession(stream, milter.WithConfig(func(s *milter.MilterSession) {
+				s.WriteTimeout = time.Second
+			}))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for i := 0; i < test.queued; i++ {
+				if err := session.QueuePacket(ctx, header); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.flush {
+				if err := session.Flush(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if stream.deadlines != test.deadlines {
+				t.Fatalf("%d deadlines armed, want %d", stream.deadlines, test.deadlines)
+			}
+		})
+	}
+}